@@ -1 +1,12 @@
-go build -o ./AtlasTerritoryMap.exe
\ No newline at end of file
+@echo off
+rem main.go imports github.com/GrapeshotGames/AtlasTerritoryMap/pkg/territory, so the build runs in
+rem a GOPATH where that import path is a junction to this checkout, wherever it was cloned
+set GO111MODULE=off
+if "%GOPATH%"=="" set GOPATH=%USERPROFILE%\go
+set BUILDPATH=%TEMP%\AtlasTerritoryMap-gopath
+set CHECKOUT=%BUILDPATH%\src\github.com\GrapeshotGames\AtlasTerritoryMap
+if exist "%CHECKOUT%" rmdir "%CHECKOUT%"
+mkdir "%BUILDPATH%\src\github.com\GrapeshotGames" 2>nul
+mklink /J "%CHECKOUT%" "%~dp0." >nul
+set GOPATH=%BUILDPATH%;%GOPATH%
+go build -o ./AtlasTerritoryMap.exe github.com/GrapeshotGames/AtlasTerritoryMap
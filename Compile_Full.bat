@@ -1,5 +1,6 @@
+set GO111MODULE=off
 go get github.com/go-redis/redis
 go get github.com/llgcode/draw2d
 go get github.com/GrapeshotGames/goquadtree/quadtree
 go get github.com/aws/aws-sdk-go
-go build -o ./AtlasTerritoryMap.exe
\ No newline at end of file
+call "%~dp0Compile.bat"
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/GrapeshotGames/AtlasTerritoryMap/pkg/territory"
+)
+
+func main() {
+	os.Exit(territory.RunCLI(os.Args[1:]))
+}
@@ -0,0 +1,110 @@
+package territory
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// GridID is a server's position in the world
+type GridID struct {
+	X, Y int
+}
+
+// configuredGrids is the parsed ActiveGrids, or the full ServersX by ServersY rectangle
+var configuredGrids []GridID
+
+// discoveryWarned remembers keys already warned about so discovery doesn't repeat itself each cycle
+var discoveryWarned = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// loadActiveGrids parses ActiveGrids once the config is loaded, invalid entries are skipped
+func loadActiveGrids() []GridID {
+	var grids []GridID
+	if len(config.ActiveGrids) == 0 {
+		for x := 0; x < config.ServersX; x++ {
+			for y := 0; y < config.ServersY; y++ {
+				grids = append(grids, GridID{X: x, Y: y})
+			}
+		}
+		return grids
+	}
+
+	seen := make(map[GridID]bool)
+	for _, packed := range config.ActiveGrids {
+		split, err := parseServerID(packed)
+		if err != nil {
+			log.Printf("Warning! Ignoring ActiveGrids entry: %v", err)
+			continue
+		}
+		grid := GridID{X: int(split[0]), Y: int(split[1])}
+		if !seen[grid] {
+			seen[grid] = true
+			grids = append(grids, grid)
+		}
+	}
+	return grids
+}
+
+// discoverGrids SCANs for territorymapdata keys, warning once about keys outside the world or
+// missing from ActiveGrids and returning the in-world ones not in grids
+func discoverGrids(client *redis.Client, grids []GridID) []GridID {
+	known := make(map[GridID]bool, len(grids))
+	for _, grid := range grids {
+		known[grid] = true
+	}
+
+	var found []GridID
+	iter := client.Scan(0, "territorymapdata:*", 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		split, err := parseServerID(strings.TrimPrefix(key, "territorymapdata:"))
+		if err != nil {
+			warnDiscoveredKey(key, err.Error())
+			continue
+		}
+		grid := GridID{X: int(split[0]), Y: int(split[1])}
+		if known[grid] {
+			continue
+		}
+		known[grid] = true
+		warnDiscoveredKey(key, "grid isn't in ActiveGrids")
+		found = append(found, grid)
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Warning! %v", err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].X != found[j].X {
+			return found[i].X < found[j].X
+		}
+		return found[i].Y < found[j].Y
+	})
+	return found
+}
+
+func warnDiscoveredKey(key, reason string) {
+	discoveryWarned.Lock()
+	defer discoveryWarned.Unlock()
+	if !discoveryWarned.keys[key] {
+		discoveryWarned.keys[key] = true
+		log.Printf("Warning! Discovered %s: %s", key, reason)
+	}
+}
+
+// fetchGrids returns the grids to fetch markers for this cycle
+func fetchGrids(client *redis.Client) []GridID {
+	if !config.GridDiscovery {
+		return configuredGrids
+	}
+	discovered := discoverGrids(client, configuredGrids)
+	if !config.GridDiscoveryAutoInclude || len(discovered) == 0 {
+		return configuredGrids
+	}
+	return append(append([]GridID(nil), configuredGrids...), discovered...)
+}
@@ -0,0 +1,104 @@
+package territory
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseServerID(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 3, 2 })
+	for _, test := range []struct {
+		packed string
+		split  [2]uint16
+		err    string
+	}{
+		{"0", [2]uint16{0, 0}, ""},
+		{"65537", [2]uint16{1, 1}, ""},
+		{"131073", [2]uint16{2, 1}, ""},
+		{"196608", [2]uint16{}, "(3, 0) which is outside the 3x2 world"},
+		{"2", [2]uint16{}, "(0, 2) which is outside the 3x2 world"},
+		{"-1", [2]uint16{}, "invalid syntax"},
+		{"4294967296", [2]uint16{}, "out of range"},
+		{"grid", [2]uint16{}, "invalid syntax"},
+	} {
+		split, err := parseServerID(test.packed)
+		if test.err == "" {
+			if err != nil || split != test.split {
+				t.Errorf("parseServerID(%q) = %v, %v, want %v", test.packed, split, err, test.split)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseServerID(%q) error %v, want one containing %q", test.packed, err, test.err)
+		}
+	}
+}
+
+func TestActiveGridsSkipsInvalidEntries(t *testing.T) {
+	logs := useLogBuffer(t)
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 3, 3
+		// a removed column and a stray entry from a bigger world
+		cfg.ActiveGrids = []string{"0", "1", "131072", "131074", "1", "327680", "north"}
+	})
+	want := []GridID{{X: 0, Y: 0}, {X: 0, Y: 1}, {X: 2, Y: 0}, {X: 2, Y: 2}}
+	if !reflect.DeepEqual(configuredGrids, want) {
+		t.Errorf("active grids %v, want %v", configuredGrids, want)
+	}
+	if warnings := strings.Count(logs.String(), "Warning! Ignoring ActiveGrids entry"); warnings != 2 {
+		t.Errorf("%d warnings, want one for each invalid entry:\n%s", warnings, logs.String())
+	}
+
+	config.ActiveGrids = nil
+	if grids := loadActiveGrids(); len(grids) != 9 {
+		t.Errorf("%d grids without ActiveGrids, want the full 3x3 rectangle", len(grids))
+	}
+}
+
+func TestGridDiscoveryOverSparseKeys(t *testing.T) {
+	for _, autoInclude := range []bool{false, true} {
+		discoveryWarned.Lock()
+		discoveryWarned.keys = make(map[string]bool)
+		discoveryWarned.Unlock()
+		logs := useLogBuffer(t)
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.ServersX, cfg.ServersY = 2, 2
+			cfg.ActiveGrids = []string{"0"}
+			cfg.GridDiscovery = true
+			cfg.GridDiscoveryAutoInclude = autoInclude
+		})
+		_, client := newTestRedis(t)
+		addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+		// in the world but not active, outside the world, and not a packed ID
+		addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, 0.5, 0.5, MarkerLand)
+		addClaim(t, client, GridID{X: 5, Y: 0}, 1000050003, 0.5, 0.5, MarkerLand)
+		if err := client.SAdd("territorymapdata:north", "x").Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []GridID{{X: 0, Y: 0}}
+		if autoInclude {
+			want = append(want, GridID{X: 1, Y: 1})
+		}
+		for cycle := 0; cycle < 2; cycle++ {
+			if grids := fetchGrids(client); !reflect.DeepEqual(grids, want) {
+				t.Errorf("auto include %v: fetching %v, want %v", autoInclude, grids, want)
+			}
+		}
+		markers, _, _ := fetchClaimMarkers(client, false, nil)
+		if len(markers) != len(want) {
+			t.Errorf("auto include %v: fetched %d markers, want %d", autoInclude, len(markers), len(want))
+		}
+
+		// each stray key is warned about once, not every cycle
+		for _, key := range []string{"territorymapdata:65537", "territorymapdata:327680", "territorymapdata:north"} {
+			if count := strings.Count(logs.String(), "Warning! Discovered "+key+":"); count != 1 {
+				t.Errorf("auto include %v: %d warnings about %s, want 1:\n%s", autoInclude, count, key, logs.String())
+			}
+		}
+		if strings.Contains(logs.String(), "territorymapdata:0:") {
+			t.Errorf("warned about an active grid:\n%s", logs.String())
+		}
+	}
+}
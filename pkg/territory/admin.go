@@ -0,0 +1,198 @@
+package territory
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one admin API call as written to the audit log. Each authenticated call
+// is written twice, as "started" before the action runs and "finished" with its status
+type AuditEntry struct {
+	Timestamp string `json:"timestamp"`
+	RequestID string `json:"requestID"`
+	RemoteIP  string `json:"remoteIP"`
+	Principal string `json:"principal"`
+	Endpoint  string `json:"endpoint"`
+	Summary   string `json:"summary"`
+	Phase     string `json:"phase"`
+	Status    int    `json:"status,omitempty"`
+}
+
+const (
+	auditStarted  = "started"
+	auditFinished = "finished"
+)
+
+const auditRecentEntries = 1000
+
+// auditLog is the append only JSON lines file of admin actions plus an in-memory tail
+var auditLog auditTail
+
+type auditTail struct {
+	sync.Mutex
+	recent []AuditEntry
+}
+
+// append adds the entry to the tail, dropping the oldest beyond auditRecentEntries. Callers hold the lock
+func (a *auditTail) append(entry AuditEntry) {
+	a.recent = append(a.recent, entry)
+	if len(a.recent) > auditRecentEntries {
+		a.recent = a.recent[len(a.recent)-auditRecentEntries:]
+	}
+}
+
+// adminTokens merges the legacy single AdminToken into the named AdminTokens
+func adminTokens() map[string]string {
+	tokens := make(map[string]string)
+	for name, token := range config.AdminTokens {
+		tokens[name] = token
+	}
+	if len(config.AdminToken) > 0 {
+		tokens["admin"] = config.AdminToken
+	}
+	return tokens
+}
+
+// adminPrincipal returns the name of the token used by the request, if any
+func adminPrincipal(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(token) == 0 {
+		return "", false
+	}
+	for name, expected := range adminTokens() {
+		if len(expected) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requireAdmin authenticates an admin token and records the call in the audit log
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		principal, ok := adminPrincipal(r)
+
+		entry := AuditEntry{
+			Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+			RequestID: requestIDFromContext(r.Context()),
+			RemoteIP:  remoteIP(r),
+			Principal: principal,
+			Endpoint:  r.Method + " " + r.URL.Path,
+			Summary:   r.URL.RawQuery,
+		}
+
+		// rejected calls are kept in memory only, so unauthenticated clients can't fill the disk
+		if !ok {
+			writeError(rec, r, http.StatusUnauthorized, "unauthorized")
+			entry.Phase, entry.Status = auditFinished, rec.status
+			recordAuditEntry(entry)
+			return
+		}
+
+		// the started entry is on disk before the action runs, so a crash it causes is still
+		// recorded. An action that panics is left with only its started entry
+		entry.Phase = auditStarted
+		writeAuditEntry(entry)
+		next(rec, r)
+		entry.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+		entry.Phase, entry.Status = auditFinished, rec.status
+		writeAuditEntry(entry)
+	}
+}
+
+// recordAuditEntry adds the entry to the in-memory tail served by /admin/audit
+func recordAuditEntry(entry AuditEntry) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.append(entry)
+}
+
+// writeAuditEntry appends and flushes the entry so it survives a crash caused by the action itself
+func writeAuditEntry(entry AuditEntry) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	auditLog.append(entry)
+
+	if len(config.AuditLogPath) == 0 {
+		return
+	}
+	rotateAuditLog()
+	f, err := os.OpenFile(config.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+	defer f.Close()
+	js, _ := json.Marshal(entry)
+	f.Write(append(js, '\n'))
+	f.Sync()
+}
+
+// rotateAuditLog shifts the audit log to .1, .2 ... once it reaches AuditLogMaxBytes, keeping
+// AuditLogMaxFiles rotated files
+func rotateAuditLog() {
+	if config.AuditLogMaxBytes <= 0 {
+		return
+	}
+	info, err := os.Stat(config.AuditLogPath)
+	if err != nil || info.Size() < config.AuditLogMaxBytes {
+		return
+	}
+	if config.AuditLogMaxFiles <= 0 {
+		if err := os.Remove(config.AuditLogPath); err != nil {
+			log.Printf("Warning! %v", err)
+		}
+		return
+	}
+	rotated := func(i int) string { return fmt.Sprintf("%s.%d", config.AuditLogPath, i) }
+	os.Remove(rotated(config.AuditLogMaxFiles))
+	for i := config.AuditLogMaxFiles - 1; i > 0; i-- {
+		os.Rename(rotated(i), rotated(i+1))
+	}
+	if err := os.Rename(config.AuditLogPath, rotated(1)); err != nil {
+		log.Printf("Warning! %v", err)
+	}
+}
+
+// auditHandler serves GET /admin/audit?n=<count> with the most recent entries, newest last
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	n := 100
+	if v := r.URL.Query().Get("n"); len(v) > 0 {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid n")
+			return
+		}
+	}
+
+	auditLog.Lock()
+	n = Min(n, len(auditLog.recent))
+	entries := append([]AuditEntry(nil), auditLog.recent[len(auditLog.recent)-n:]...)
+	auditLog.Unlock()
+
+	js, _ := json.Marshal(entries)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
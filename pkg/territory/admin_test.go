@@ -0,0 +1,183 @@
+package territory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useAuditLog configures admin tokens and an audit log in the test's directory, with edit applied to the config first
+func useAuditLog(t *testing.T, edit func(cfg *Configuration)) {
+	t.Helper()
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.AdminToken = "legacy-token"
+		cfg.AdminTokens = map[string]string{"ops": "ops-token"}
+		cfg.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+		if edit != nil {
+			edit(cfg)
+		}
+	})
+	t.Cleanup(func() {
+		auditLog.Lock()
+		auditLog.recent = nil
+		auditLog.Unlock()
+	})
+}
+
+// adminRequest calls handler through requireAdmin with the token, empty sends no Authorization header
+func adminRequest(handler http.HandlerFunc, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if len(token) > 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	requireAdmin(handler)(w, r)
+	return w
+}
+
+// readAuditFile returns the entries written to the file, missing files have none
+func readAuditFile(t *testing.T, filename string) []AuditEntry {
+	t.Helper()
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%s has a bad line %q: %v", filename, scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// noAction is an admin action that does nothing
+func noAction(w http.ResponseWriter, r *http.Request) {}
+
+func TestAdminTokensResolvePrincipals(t *testing.T) {
+	useAuditLog(t, nil)
+
+	for token, want := range map[string]string{"ops-token": "ops", "legacy-token": "admin"} {
+		if w := adminRequest(noAction, "/admin/caches", token); w.Code != http.StatusOK {
+			t.Fatalf("%s answered %d, want 200", token, w.Code)
+		}
+		entries := readAuditFile(t, config.AuditLogPath)
+		last := entries[len(entries)-1]
+		if last.Principal != want || last.Phase != auditFinished || last.Status != http.StatusOK {
+			t.Errorf("%s audited as %+v, want principal %s finished with 200", token, last, want)
+		}
+	}
+}
+
+func TestAdminAuditStartsBeforeTheAction(t *testing.T) {
+	useAuditLog(t, nil)
+
+	var during []AuditEntry
+	w := adminRequest(func(w http.ResponseWriter, r *http.Request) {
+		during = readAuditFile(t, config.AuditLogPath)
+		w.WriteHeader(http.StatusAccepted)
+	}, "/admin/poster?width=100", "ops-token")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("answered %d, want 202", w.Code)
+	}
+
+	if len(during) != 1 || during[0].Phase != auditStarted || during[0].Summary != "width=100" {
+		t.Fatalf("audit log while the action ran %+v, want one started entry", during)
+	}
+	after := readAuditFile(t, config.AuditLogPath)
+	if len(after) != 2 || after[1].Phase != auditFinished || after[1].Status != http.StatusAccepted {
+		t.Errorf("audit log after the action %+v, want started then finished with 202", after)
+	}
+}
+
+func TestAdminRejectsBadTokens(t *testing.T) {
+	useAuditLog(t, nil)
+
+	for _, token := range []string{"", "wrong-token"} {
+		called := false
+		w := adminRequest(func(w http.ResponseWriter, r *http.Request) { called = true }, "/admin/caches", token)
+		if w.Code != http.StatusUnauthorized || called {
+			t.Errorf("token %q answered %d (action ran %v), want 401", token, w.Code, called)
+		}
+	}
+
+	// rejected calls are audited in memory, never on disk
+	auditLog.Lock()
+	recent := append([]AuditEntry(nil), auditLog.recent...)
+	auditLog.Unlock()
+	if len(recent) != 2 {
+		t.Fatalf("audited %d rejected calls, want 2", len(recent))
+	}
+	for _, entry := range recent {
+		if entry.Status != http.StatusUnauthorized || len(entry.Principal) != 0 {
+			t.Errorf("rejected call audited as %+v", entry)
+		}
+	}
+	if entries := readAuditFile(t, config.AuditLogPath); len(entries) != 0 {
+		t.Errorf("rejected calls written to the audit log: %+v", entries)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	useAuditLog(t, func(cfg *Configuration) {
+		cfg.AuditLogMaxBytes = 1
+		cfg.AuditLogMaxFiles = 2
+	})
+
+	// every write after the first rotates, as the log is already over 1 byte
+	for i := 0; i < 4; i++ {
+		writeAuditEntry(AuditEntry{Summary: fmt.Sprint(i), Phase: auditStarted})
+	}
+
+	for filename, want := range map[string]string{"": "3", ".1": "2", ".2": "1"} {
+		entries := readAuditFile(t, config.AuditLogPath+filename)
+		if len(entries) != 1 || entries[0].Summary != want {
+			t.Errorf("audit.log%s holds %+v, want entry %s", filename, entries, want)
+		}
+	}
+	if _, err := os.Stat(config.AuditLogPath + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than AuditLogMaxFiles rotated logs: %v", err)
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	useAuditLog(t, nil)
+	for i := 0; i < 5; i++ {
+		recordAuditEntry(AuditEntry{Summary: fmt.Sprint(i)})
+	}
+
+	w := httptest.NewRecorder()
+	auditHandler(w, httptest.NewRequest(http.MethodGet, "/admin/audit?n=2", nil))
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Summary)
+	}
+	if want := []string{"3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("?n=2 returned %q, want the newest two oldest first", got)
+	}
+
+	for _, n := range []string{"-1", "ten"} {
+		w := httptest.NewRecorder()
+		auditHandler(w, httptest.NewRequest(http.MethodGet, "/admin/audit?n="+n, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?n=%s answered %d, want 400", n, w.Code)
+		}
+	}
+}
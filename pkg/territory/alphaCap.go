@@ -0,0 +1,36 @@
+package territory
+
+import "image"
+
+// capAlpha limits the accumulated alpha of every pixel so heavily overlapped claims keep some
+// translucency, the premultiplied channels are scaled down with it to keep the color
+func capAlpha(img *image.RGBA, max uint8) {
+	if max == 255 {
+		return
+	}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		a := img.Pix[i+3]
+		if a <= max {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(uint32(img.Pix[i+c]) * uint32(max) / uint32(a))
+		}
+		img.Pix[i+3] = max
+	}
+}
+
+// solidifyAlpha makes every pixel a claim touched fully opaque, including the anti-aliased edges,
+// un-premultiplying their color
+func solidifyAlpha(img *image.RGBA) {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		a := img.Pix[i+3]
+		if a == 0 || a == 255 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8(Min(int(uint32(img.Pix[i+c])*255/uint32(a)), 255))
+		}
+		img.Pix[i+3] = 255
+	}
+}
@@ -0,0 +1,96 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// URLMirror is one of the AlternativeURLs the outputs are mirrored to
+type URLMirror struct {
+	URL     string   // host[:port] or a URL with its own scheme, like AlternativeURL
+	Weight  float64  // share of generations handed this mirror, 0 only lists it for clients that pick
+	Regions []string // regions the mirror serves, passed on to clients that pick
+}
+
+// PublishedMirror is one entry of the <file>_urls JSON arrays in territory_urls
+type PublishedMirror struct {
+	URL     string   `json:"url"`
+	Weight  float64  `json:"weight"`
+	Regions []string `json:"regions,omitempty"`
+}
+
+// expandAlternativeURL turns the AlternativeURL shorthand into a single mirror when there are no
+// AlternativeURLs, New runs it too for a Config that wasn't loaded from a file
+func (cfg *Configuration) expandAlternativeURL() {
+	if len(cfg.AlternativeURL) > 0 && len(cfg.AlternativeURLs) == 0 {
+		cfg.AlternativeURLs = []URLMirror{{URL: cfg.AlternativeURL, Weight: 1}}
+	}
+}
+
+// baseURLFor is the URL outputs are served under at endpoint, which may carry its own scheme
+// otherwise URLScheme is used
+func baseURLFor(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/") + config.BasePath
+	}
+	return fmt.Sprintf("%s://%s%s", config.URLScheme, endpoint, config.BasePath)
+}
+
+// primaryMirror is the mirror the web viewer and published artifact links use, ok is false
+// without AlternativeURLs
+func primaryMirror() (URLMirror, bool) {
+	if len(config.AlternativeURLs) == 0 {
+		return URLMirror{}, false
+	}
+	return config.AlternativeURLs[config.PrimaryURL], true
+}
+
+// selectMirror picks a mirror by weight for the game servers, seeded by the generation CRC so
+// every publish of the same generation hands out the same mirror. Falls back to the primary when
+// no mirror has a weight
+func selectMirror(seed uint32) (URLMirror, bool) {
+	total := 0.0
+	for _, mirror := range config.AlternativeURLs {
+		total += mirror.Weight
+	}
+	if total <= 0 {
+		return primaryMirror()
+	}
+	pick := rand.New(rand.NewSource(int64(seed))).Float64() * total
+	for _, mirror := range config.AlternativeURLs {
+		if mirror.Weight <= 0 {
+			continue
+		}
+		if pick < mirror.Weight {
+			return mirror, true
+		}
+		pick -= mirror.Weight
+	}
+	// rounding left pick past the last weight
+	for i := len(config.AlternativeURLs) - 1; ; i-- {
+		if config.AlternativeURLs[i].Weight > 0 {
+			return config.AlternativeURLs[i], true
+		}
+	}
+}
+
+// publishedMirrors lists every mirror with the URL of file for game servers that pick their own,
+// query is appended to each URL. Without AlternativeURLs the list is just this service
+func publishedMirrors(file gameMapFile, query string) string {
+	configured := config.AlternativeURLs
+	if len(configured) == 0 {
+		configured = []URLMirror{{URL: publicEndpoint(), Weight: 1}}
+	}
+	mirrors := make([]PublishedMirror, len(configured))
+	for i, mirror := range configured {
+		mirrors[i] = PublishedMirror{
+			URL:     fmt.Sprintf("%s/gameTiles/%s?%s", baseURLFor(mirror.URL), file.name, query),
+			Weight:  mirror.Weight,
+			Regions: mirror.Regions,
+		}
+	}
+	js, _ := json.Marshal(mirrors)
+	return string(js)
+}
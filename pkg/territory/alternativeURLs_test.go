@@ -0,0 +1,122 @@
+package territory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAlternativeURLShorthand(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		json string
+		want []URLMirror
+	}{
+		{"shorthand", `{"AlternativeURL": "cdn.example.com"}`, []URLMirror{{URL: "cdn.example.com", Weight: 1}}},
+		{"list", `{"AlternativeURLs": [{"URL": "eu.example.com", "Weight": 2, "Regions": ["eu"]}]}`, []URLMirror{{URL: "eu.example.com", Weight: 2, Regions: []string{"eu"}}}},
+		{"both", `{"AlternativeURL": "cdn.example.com", "AlternativeURLs": [{"URL": "eu.example.com", "Weight": 1}]}`, []URLMirror{{URL: "eu.example.com", Weight: 1}}},
+		{"neither", `{}`, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.json")
+			if err := ioutil.WriteFile(filename, []byte(test.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.AlternativeURLs, test.want) {
+				t.Errorf("AlternativeURLs %+v, want %+v", cfg.AlternativeURLs, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectMirrorWeighting(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.AlternativeURLs = []URLMirror{
+			{URL: "na.example.com", Weight: 3},
+			{URL: "listed.example.com", Weight: 0},
+			{URL: "eu.example.com", Weight: 1},
+		}
+	})
+	const generations = 10000
+	picked := make(map[string]int)
+	for crc := uint32(0); crc < generations; crc++ {
+		mirror, ok := selectMirror(crc * 2654435761)
+		if !ok {
+			t.Fatal("no mirror selected")
+		}
+		picked[mirror.URL]++
+	}
+	if picked["listed.example.com"] != 0 {
+		t.Errorf("a mirror without weight was handed out %d times", picked["listed.example.com"])
+	}
+	if share := float64(picked["na.example.com"]) / generations; math.Abs(share-0.75) > 0.02 {
+		t.Errorf("na.example.com got %.3f of generations, want 0.75", share)
+	}
+
+	for crc := uint32(0); crc < 100; crc++ {
+		first, _ := selectMirror(crc)
+		again, _ := selectMirror(crc)
+		if first.URL != again.URL {
+			t.Fatalf("generation %d picked %s then %s", crc, first.URL, again.URL)
+		}
+	}
+}
+
+// TestMirrorStableAcrossPublishes checks republishing a generation doesn't flap between mirrors
+func TestMirrorStableAcrossPublishes(t *testing.T) {
+	useURLPublisher(t, "primary", "takeover")
+	config.AlternativeURLs = []URLMirror{{URL: "na.example.com", Weight: 1}, {URL: "eu.example.com", Weight: 1}}
+	_, client := newTestRedis(t)
+
+	hosts := make(map[string]bool)
+	for tag := int32(1); tag <= 20; tag++ {
+		if written, _ := writeUrlsToRedis(client, ArtifactMeta{CRC: 42}, tag); !written {
+			t.Fatal("URLs weren't written")
+		}
+		world, _ := client.HGet("territory_urls", "world").Result()
+		hosts[strings.SplitN(world, "/gameTiles/", 2)[0]] = true
+	}
+	if len(hosts) != 1 {
+		t.Errorf("one generation was published on %d mirrors: %v", len(hosts), hosts)
+	}
+}
+
+func TestMirrorListNeedsHandshake(t *testing.T) {
+	useURLPublisher(t, "primary", "takeover")
+	config.AlternativeURLs = []URLMirror{
+		{URL: "na.example.com", Weight: 3, Regions: []string{"na"}},
+		{URL: "https://eu.example.com", Weight: 1, Regions: []string{"eu"}},
+	}
+	_, client := newTestRedis(t)
+
+	writeUrlsToRedis(client, ArtifactMeta{CRC: 1}, 7)
+	if exists, _ := client.HExists("territory_urls", "world_urls").Result(); exists {
+		t.Errorf("world_urls published to game servers that didn't advertise urlLists")
+	}
+
+	client.HSet("territory_capabilities", "urlLists", "true")
+	writeUrlsToRedis(client, ArtifactMeta{CRC: 1}, 7)
+	js, err := client.HGet("territory_urls", "world_urls").Result()
+	if err != nil {
+		t.Fatalf("world_urls wasn't published: %v", err)
+	}
+	var mirrors []PublishedMirror
+	if err := json.Unmarshal([]byte(js), &mirrors); err != nil {
+		t.Fatal(err)
+	}
+	want := []PublishedMirror{
+		{URL: "http://na.example.com/gameTiles/world.map?t=7", Weight: 3, Regions: []string{"na"}},
+		{URL: "https://eu.example.com/gameTiles/world.map?t=7", Weight: 1, Regions: []string{"eu"}},
+	}
+	if !reflect.DeepEqual(mirrors, want) {
+		t.Errorf("world_urls %+v, want %+v", mirrors, want)
+	}
+}
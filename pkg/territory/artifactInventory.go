@@ -0,0 +1,155 @@
+package territory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ArtifactInventoryEntry is one generated file, or one zoom of the tile tree
+type ArtifactInventoryEntry struct {
+	Key         string         `json:"key"`
+	Path        string         `json:"path"`
+	URL         string         `json:"url"`
+	S3Key       string         `json:"s3Key,omitempty"`
+	Size        int64          `json:"size,omitempty"`
+	SHA256      string         `json:"sha256,omitempty"`
+	CRC         uint32         `json:"crc"`
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Tiles       *ZoomTileCount `json:"tiles,omitempty"`
+}
+
+// artifactHashes caches file hashes by path so polling the inventory doesn't re-read unchanged files
+var artifactHashes = struct {
+	sync.Mutex
+	byPath map[string]artifactHash
+}{byPath: make(map[string]artifactHash)}
+
+type artifactHash struct {
+	modTime time.Time
+	size    int64
+	sha256  string
+}
+
+// artifactInventoryWrite serializes writes of artifacts.json from the workers
+var artifactInventoryWrite sync.Mutex
+
+func fileSHA256(filename string, info os.FileInfo) (string, error) {
+	artifactHashes.Lock()
+	cached, ok := artifactHashes.byPath[filename]
+	artifactHashes.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.sha256, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	artifactHashes.Lock()
+	artifactHashes.byPath[filename] = artifactHash{modTime: info.ModTime(), size: info.Size(), sha256: sum}
+	artifactHashes.Unlock()
+	return sum, nil
+}
+
+// buildArtifactInventory lists every artifact with metadata, files are checked on disk and tile
+// zooms are summarised by their tile counts
+func buildArtifactInventory() []ArtifactInventoryEntry {
+	zooms := make(map[string]ZoomTileCount)
+	for _, count := range getZoomTileCounts() {
+		zooms[fmt.Sprintf("territoryTiles/%d", count.Zoom)] = count
+	}
+
+	inventory := []ArtifactInventoryEntry{}
+	for key, meta := range artifactMetaSnapshot() {
+		entry := ArtifactInventoryEntry{
+			Key:         key,
+			Path:        path.Join(config.WWWDir, key),
+			URL:         fmt.Sprintf("%s/%s", publicBaseURL(), key),
+			CRC:         meta.CRC,
+			GeneratedAt: meta.GeneratedAt,
+		}
+		if len(config.AtlasS3AccessID) > 0 {
+			entry.S3Key = config.AtlasS3KeyPrefix + key
+		}
+
+		if count, ok := zooms[key]; ok {
+			entry.URL += "/{x}/{y}.png"
+			entry.Tiles = &count
+		} else {
+			info, err := os.Stat(filepath.FromSlash(entry.Path))
+			if err != nil {
+				continue // recorded before a restart but since removed
+			}
+			entry.Size = info.Size()
+			if entry.SHA256, err = fileSHA256(entry.Path, info); err != nil {
+				log.Printf("Warning! Failed to hash %s: %v", entry.Path, err)
+			}
+		}
+		inventory = append(inventory, entry)
+	}
+	sort.Slice(inventory, func(i, j int) bool { return inventory[i].Key < inventory[j].Key })
+	return inventory
+}
+
+// writeArtifactInventory saves the inventory as artifacts.json, called last in each cycle so it
+// only lists artifacts that are already in place
+func writeArtifactInventory(ctx context.Context) {
+	artifactInventoryWrite.Lock()
+	defer artifactInventoryWrite.Unlock()
+
+	js, err := json.MarshalIndent(buildArtifactInventory(), "", "  ")
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+
+	// save the a tmp file
+	filename := path.Join(config.WWWDir, "artifacts.json")
+	if err := os.MkdirAll(config.WWWDir, os.ModePerm); err != nil {
+		log.Printf("Warning! Failed to create directory %s: %v", config.WWWDir, err)
+		return
+	}
+	tmpFilename := path.Join(config.WWWDir, tempFileName("tmp_", ".json"))
+	if err := ioutil.WriteFile(tmpFilename, js, 0600); err != nil {
+		log.Printf("Warning! Failed to write %s: %v", tmpFilename, err)
+		return
+	}
+
+	// delete old file and rename tmp
+	os.Remove(filename)
+	os.Rename(tmpFilename, filename)
+
+	uploadToS3(ctx, filename)
+}
+
+// artifactsHandler serves GET /api/artifacts
+func artifactsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	js, _ := json.Marshal(buildArtifactInventory())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(js)
+}
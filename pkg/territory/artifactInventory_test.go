@@ -0,0 +1,108 @@
+package territory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestArtifactInventoryMatchesFilesOnDisk(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MaxZoom = 2
+		cfg.Host, cfg.Port = "maps.example.com", 8880
+	})
+	useArtifactMeta(t)
+	useTestStateStore(t)
+	resetTileCounts()
+	useTileGeneration(t, loadTileProgress(filepath.Join(config.WWWDir, "territoryTiles")), nil)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, 0.25, 0.75, MarkerWater)
+
+	startGameWorker(t, client)
+	ctx, cancel := context.WithCancel(context.Background())
+	var firstCycle sync.WaitGroup
+	firstCycle.Add(1)
+	stopped := make(chan struct{})
+	go func() {
+		tileBackgroundWorker(ctx, client, &firstCycle)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	firstCycle.Wait()
+
+	data, err := ioutil.ReadFile(filepath.Join(config.WWWDir, "artifacts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []ArtifactInventoryEntry
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	var served []ArtifactInventoryEntry
+	if err := json.Unmarshal(getGenerated(t, newHTTPHandler(client), "/api/artifacts").Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != len(written) {
+		t.Fatalf("/api/artifacts lists %d artifacts, artifacts.json %d", len(served), len(written))
+	}
+
+	keys := make(map[string]bool)
+	for i, entry := range written {
+		keys[entry.Key] = true
+		if served[i].Key != entry.Key || served[i].SHA256 != entry.SHA256 {
+			t.Errorf("/api/artifacts has %s (%s), artifacts.json %s (%s)", served[i].Key, served[i].SHA256, entry.Key, entry.SHA256)
+		}
+		if !strings.HasPrefix(entry.URL, "http://maps.example.com:8880/"+entry.Key) {
+			t.Errorf("%s is published at %s", entry.Key, entry.URL)
+		}
+		if entry.CRC == 0 || entry.GeneratedAt.IsZero() {
+			t.Errorf("%s has no generation: %+v", entry.Key, entry)
+		}
+		if entry.Tiles != nil {
+			if info, err := os.Stat(entry.Path); err != nil || !info.IsDir() {
+				t.Errorf("zoom %s isn't a directory on disk: %v", entry.Key, err)
+			}
+			if entry.Tiles.NonEmpty == 0 {
+				t.Errorf("zoom %s has no tiles: %+v", entry.Key, entry.Tiles)
+			}
+			continue
+		}
+		content, err := ioutil.ReadFile(entry.Path)
+		if err != nil {
+			t.Errorf("%s isn't on disk: %v", entry.Key, err)
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if entry.Size != int64(len(content)) || entry.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s listed as %d bytes %s, on disk %d bytes %x", entry.Key, entry.Size, entry.SHA256, len(content), sum)
+		}
+	}
+	for _, key := range []string{"gameTiles/world.map", "territoryTiles/0", "territoryTiles/1"} {
+		if !keys[key] {
+			t.Errorf("inventory is missing %s: %v", key, keys)
+		}
+	}
+
+	// every game file on disk is listed
+	files, err := ioutil.ReadDir(filepath.Join(config.WWWDir, "gameTiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !keys["gameTiles/"+file.Name()] {
+			t.Errorf("gameTiles/%s is on disk but not in the inventory", file.Name())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArtifactMeta records the cycle that produced a generated file, or every tile of a zoom, and the
+// last cycle that found it still current so an unchanged file isn't mistaken for a dead generator
+type ArtifactMeta struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	CheckedAt   time.Time `json:"checkedAt"`
+	CRC         uint32    `json:"crc"`
+}
+
+// artifacts is keyed by path under WWWDir, tiles are keyed by zoom as "territoryTiles/<z>"
+var artifacts = struct {
+	sync.Mutex
+	byKey map[string]ArtifactMeta
+}{byKey: make(map[string]ArtifactMeta)}
+
+func setArtifactMeta(key string, crc uint32) {
+	now := time.Now().UTC()
+	artifacts.Lock()
+	artifacts.byKey[key] = ArtifactMeta{GeneratedAt: now, CheckedAt: now, CRC: crc}
+	artifacts.Unlock()
+}
+
+// touchArtifacts marks the artifacts under prefix generated from crc as still current
+func touchArtifacts(prefix string, crc uint32) {
+	now := time.Now().UTC()
+	artifacts.Lock()
+	for key, meta := range artifacts.byKey {
+		if strings.HasPrefix(key, prefix) && meta.CRC == crc {
+			meta.CheckedAt = now
+			artifacts.byKey[key] = meta
+		}
+	}
+	artifacts.Unlock()
+}
+
+func artifactMetaSnapshot() map[string]ArtifactMeta {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+	snapshot := make(map[string]ArtifactMeta, len(artifacts.byKey))
+	for k, v := range artifacts.byKey {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+func restoreArtifactMeta(restored map[string]ArtifactMeta) {
+	artifacts.Lock()
+	for k, v := range restored {
+		artifacts.byKey[k] = v
+	}
+	artifacts.Unlock()
+}
+
+// artifactMetaFor looks up the metadata of a file under WWWDir, ok is false for files that
+// aren't generated or were generated before metadata was kept
+func artifactMetaFor(relPath string) (ArtifactMeta, bool) {
+	artifacts.Lock()
+	defer artifacts.Unlock()
+	if meta, ok := artifacts.byKey[relPath]; ok {
+		return meta, true
+	}
+	if parts := strings.SplitN(relPath, "/", 3); len(parts) == 3 && parts[0] == "territoryTiles" {
+		meta, ok := artifacts.byKey[parts[0]+"/"+parts[1]]
+		return meta, ok
+	}
+	return ArtifactMeta{}, false
+}
+
+// isGeneratedPath checks if a path under WWWDir is written by the generators
+func isGeneratedPath(relPath string) bool {
+	return strings.HasPrefix(relPath, "territoryTiles/") || strings.HasPrefix(relPath, "gameTiles/") || strings.HasPrefix(relPath, "exports/")
+}
+
+// isStale checks if the artifact hasn't been confirmed current within StaleAfterSeconds
+func isStale(meta ArtifactMeta) bool {
+	return config.StaleAfterSeconds > 0 && time.Since(meta.CheckedAt) > time.Duration(config.StaleAfterSeconds)*time.Second
+}
+
+// setFreshnessHeaders adds the X-Atlas-* headers for generated artifacts, falling back to the
+// file's mtime when there's no metadata
+func setFreshnessHeaders(w http.ResponseWriter, relPath string) {
+	if !isGeneratedPath(relPath) {
+		return
+	}
+	meta, ok := artifactMetaFor(relPath)
+	if ok {
+		w.Header().Set("X-Atlas-Generation-CRC", fmt.Sprintf("%08x", meta.CRC))
+	} else {
+		info, err := os.Stat(filepath.Join(config.WWWDir, filepath.FromSlash(relPath)))
+		if err != nil {
+			return
+		}
+		meta.GeneratedAt = info.ModTime().UTC()
+		meta.CheckedAt = meta.GeneratedAt
+	}
+
+	age := time.Since(meta.GeneratedAt)
+	w.Header().Set("X-Atlas-Generated-At", meta.GeneratedAt.Format(time.RFC3339))
+	w.Header().Set("X-Atlas-Age-Seconds", strconv.Itoa(int(age.Seconds())))
+	if isStale(meta) {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
+
+// HealthStatus is the /health response
+type HealthStatus struct {
+	Status            string              `json:"status"` // "ok", "degraded" or "stale"
+	OldestAgeSeconds  int                 `json:"oldestAgeSeconds"`
+	StaleArtifacts    int                 `json:"staleArtifacts"`
+	Role              string              `json:"role,omitempty"`              // "leader" or "follower" with LeaderLockKey set
+	URLConflict       *URLConflict        `json:"urlConflict,omitempty"`       // another tool is publishing territory_urls too
+	FailingGrids      []FailingGrid       `json:"failingGrids,omitempty"`      // grids whose fetch is failing every cycle
+	ZeroPositionDrops []ZeroPositionDrops `json:"zeroPositionDrops,omitempty"` // markers dropped with DropZeroPositionMarkers
+}
+
+// evaluateHealth reports stale when any known artifact hasn't been confirmed current within
+// StaleAfterSeconds, otherwise degraded when a failing grid has escalated. Shared by /health and
+// the healthcheck subcommand
+func evaluateHealth(known map[string]ArtifactMeta, failing []FailingGrid) HealthStatus {
+	health := HealthStatus{Status: "ok", FailingGrids: failing}
+	for _, grid := range failing {
+		if grid.Escalated {
+			health.Status = "degraded"
+		}
+	}
+	for _, meta := range known {
+		health.OldestAgeSeconds = Max(health.OldestAgeSeconds, int(time.Since(meta.GeneratedAt).Seconds()))
+		if isStale(meta) {
+			health.StaleArtifacts++
+		}
+	}
+	if health.StaleArtifacts > 0 {
+		health.Status = "stale"
+	}
+	return health
+}
+
+// healthHandler serves GET /health
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	health := evaluateHealth(artifactMetaSnapshot(), currentFailingGrids())
+	health.Role = leadershipRole()
+	health.URLConflict = urlConflict()
+	health.ZeroPositionDrops = currentZeroPositionDrops()
+	js, _ := json.Marshal(health)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(js)
+}
@@ -0,0 +1,157 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useArtifactMeta starts the test without artifact metadata, restoring the previous afterwards
+func useArtifactMeta(t *testing.T) {
+	artifacts.Lock()
+	previous := artifacts.byKey
+	artifacts.byKey = make(map[string]ArtifactMeta)
+	artifacts.Unlock()
+	t.Cleanup(func() {
+		artifacts.Lock()
+		artifacts.byKey = previous
+		artifacts.Unlock()
+	})
+}
+
+func getGenerated(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s is %d", path, w.Code)
+	}
+	return w
+}
+
+func getHealth(t *testing.T, handler http.Handler) HealthStatus {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	return health
+}
+
+func TestFreshArtifactHeaders(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.StaleAfterSeconds = 60 })
+	useArtifactMeta(t)
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	writeOutput(t, "territoryTiles/2/1/3.png", []byte("tile"))
+	setArtifactMeta("gameTiles/world.map", 0xabcd)
+	setArtifactMeta("territoryTiles/2", 0x1234)
+	handler := newHTTPHandler(nil)
+
+	w := getGenerated(t, handler, "/gameTiles/world.map")
+	if crc := w.Header().Get("X-Atlas-Generation-CRC"); crc != "0000abcd" {
+		t.Errorf("X-Atlas-Generation-CRC %q, want 0000abcd", crc)
+	}
+	if age := w.Header().Get("X-Atlas-Age-Seconds"); age != "0" {
+		t.Errorf("X-Atlas-Age-Seconds %q, want 0", age)
+	}
+	if _, err := time.Parse(time.RFC3339, w.Header().Get("X-Atlas-Generated-At")); err != nil {
+		t.Errorf("X-Atlas-Generated-At: %v", err)
+	}
+	if warning := w.Header().Get("Warning"); len(warning) > 0 {
+		t.Errorf("fresh file warned %q", warning)
+	}
+
+	// tiles use their zoom's metadata
+	w = getGenerated(t, handler, "/territoryTiles/2/1/3.png")
+	if crc := w.Header().Get("X-Atlas-Generation-CRC"); crc != "00001234" {
+		t.Errorf("tile X-Atlas-Generation-CRC %q, want 00001234", crc)
+	}
+	if health := getHealth(t, handler); health.Status != "ok" || health.StaleArtifacts != 0 {
+		t.Errorf("health %+v, want ok", health)
+	}
+}
+
+func TestStaleArtifactWarns(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.StaleAfterSeconds = 60 })
+	useArtifactMeta(t)
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	generated := time.Now().UTC().Add(-2 * time.Hour)
+	restoreArtifactMeta(map[string]ArtifactMeta{"gameTiles/world.map": {GeneratedAt: generated, CheckedAt: generated, CRC: 1}})
+	handler := newHTTPHandler(nil)
+
+	w := getGenerated(t, handler, "/gameTiles/world.map")
+	if warning := w.Header().Get("Warning"); warning != `110 - "Response is Stale"` {
+		t.Errorf("Warning %q, want 110", warning)
+	}
+	if age := w.Header().Get("X-Atlas-Age-Seconds"); age != "7200" {
+		t.Errorf("X-Atlas-Age-Seconds %q, want 7200", age)
+	}
+	if health := getHealth(t, handler); health.Status != "stale" || health.StaleArtifacts != 1 {
+		t.Errorf("health %+v, want 1 stale artifact", health)
+	}
+
+	// a cycle that finds the map unchanged makes it current again without a new GeneratedAt
+	touchArtifacts("gameTiles/", 1)
+	w = getGenerated(t, handler, "/gameTiles/world.map")
+	if warning := w.Header().Get("Warning"); len(warning) > 0 {
+		t.Errorf("checked file still warned %q", warning)
+	}
+	if age := w.Header().Get("X-Atlas-Age-Seconds"); age != "7200" {
+		t.Errorf("X-Atlas-Age-Seconds %q after the check, want 7200", age)
+	}
+	if health := getHealth(t, handler); health.Status != "ok" {
+		t.Errorf("health %+v after the check, want ok", health)
+	}
+}
+
+func TestArtifactMetaRestoredFromStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	useTestConfig(t, func(cfg *Configuration) { cfg.StateFile = stateFile })
+	useArtifactMeta(t)
+	previous := stateStore
+	t.Cleanup(func() { stateStore = previous })
+	stateStore = openStateStore(stateFile)
+	setArtifactMeta("gameTiles/world.map", 0xbeef)
+	saved, _ := artifactMetaFor("gameTiles/world.map")
+	saveGenerationState(nil)
+
+	// a restart starts without metadata and restores it before serving
+	artifacts.Lock()
+	artifacts.byKey = make(map[string]ArtifactMeta)
+	artifacts.Unlock()
+	stateStore = openStateStore(stateFile)
+	restoreGenerationState()
+
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	w := getGenerated(t, newHTTPHandler(nil), "/gameTiles/world.map")
+	if crc := w.Header().Get("X-Atlas-Generation-CRC"); crc != "0000beef" {
+		t.Errorf("X-Atlas-Generation-CRC %q after restart, want 0000beef", crc)
+	}
+	if generatedAt := w.Header().Get("X-Atlas-Generated-At"); generatedAt != saved.GeneratedAt.Format(time.RFC3339) {
+		t.Errorf("X-Atlas-Generated-At %q after restart, want %q", generatedAt, saved.GeneratedAt.Format(time.RFC3339))
+	}
+}
+
+func TestArtifactWithoutMetaFallsBackToMtime(t *testing.T) {
+	useTestConfig(t, nil)
+	useArtifactMeta(t)
+	filename := writeOutput(t, "gameTiles/world.map", []byte("map"))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	w := getGenerated(t, newHTTPHandler(nil), "/gameTiles/world.map")
+	if crc := w.Header().Get("X-Atlas-Generation-CRC"); len(crc) > 0 {
+		t.Errorf("X-Atlas-Generation-CRC %q without metadata", crc)
+	}
+	if generatedAt := w.Header().Get("X-Atlas-Generated-At"); generatedAt != mtime.UTC().Format(time.RFC3339) {
+		t.Errorf("X-Atlas-Generated-At %q, want the mtime %q", generatedAt, mtime.UTC().Format(time.RFC3339))
+	}
+}
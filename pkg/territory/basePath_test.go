@@ -0,0 +1,81 @@
+package territory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoutesAreMountedUnderBasePath(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.BasePath = "/atlasmap" })
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	handler := newHTTPHandler(nil)
+
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/atlasmap/gameTiles/world.map", http.StatusOK},
+		{"/atlasmap/api/tiles/counts", http.StatusOK},
+		{"/gameTiles/world.map", http.StatusNotFound},
+		{"/api/tiles/counts", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("GET %s is %d, want %d", test.path, w.Code, test.code)
+		}
+	}
+}
+
+func TestPublishedURLsIncludeBasePath(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.BasePath = "/atlasmap"
+		cfg.Host = "maps.example.com"
+		cfg.Port = 8880
+	})
+	_, client := newTestRedis(t)
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 7); !written {
+		t.Fatalf("URLs weren't written")
+	}
+	url, err := client.HGet("territory_urls", "world").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "://maps.example.com:8880/atlasmap/gameTiles/world.map?t=7"; !strings.HasSuffix(url, want) {
+		t.Errorf("published %q, want it to end with %q", url, want)
+	}
+
+	var mirrors []PublishedMirror
+	if err := json.Unmarshal([]byte(publishedMirrors(gameMapFile{name: "world.map", key: "world"}, "t=7")), &mirrors); err != nil {
+		t.Fatal(err)
+	}
+	if len(mirrors) != 1 || !strings.Contains(mirrors[0].URL, "/atlasmap/gameTiles/world.map") {
+		t.Errorf("mirror list %+v doesn't include the prefix", mirrors)
+	}
+
+	// a mirror with its own scheme gets the prefix too
+	if got, want := baseURLFor("https://cdn.example.com/"), "https://cdn.example.com/atlasmap"; got != want {
+		t.Errorf("baseURLFor = %q, want %q", got, want)
+	}
+}
+
+func TestBasePathIsNormalized(t *testing.T) {
+	for _, basePath := range []string{"atlasmap", "/atlasmap/", "atlasmap//"} {
+		filename := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(filename, []byte(`{"BasePath": "`+basePath+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.BasePath != "/atlasmap" {
+			t.Errorf("BasePath %q loaded as %q, want /atlasmap", basePath, cfg.BasePath)
+		}
+	}
+}
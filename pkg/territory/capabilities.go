@@ -0,0 +1,77 @@
+package territory
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// supportedMapVersions lists the .map file versions this generator can write, oldest first. v4 is
+// the v3 layout with a zlib compressed body
+var supportedMapVersions = []uint16{2, 3, 4}
+
+// MapFlagColorTable marks a v3 .map with a trailing RGBA per owner
+const MapFlagColorTable uint32 = 0x1
+
+// MapFlagCoverage marks a v3 .map with a run length encoded ownership raster after the color table
+const MapFlagCoverage uint32 = 0x2
+
+// GameCapabilities is what the game servers advertise in the territory_capabilities hash
+type GameCapabilities struct {
+	MapVersions []uint16 // supported .map file versions
+	Deltas      bool     // supports delta .map files
+	PerGrid     bool     // supports per grid .map files
+	URLLists    bool     // picks its own mirror from the <file>_urls lists in territory_urls
+}
+
+// fetchGameCapabilities reads the territory_capabilities hash, found is false when the game hasn't written it
+func fetchGameCapabilities(client *redis.Client) (caps GameCapabilities, found bool) {
+	fields, err := client.HGetAll("territory_capabilities").Result()
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	found = true
+
+	for _, v := range strings.Split(fields["mapVersions"], ",") {
+		version, err := strconv.ParseUint(strings.TrimSpace(v), 10, 16)
+		if err == nil {
+			caps.MapVersions = append(caps.MapVersions, uint16(version))
+		}
+	}
+	caps.Deltas, _ = strconv.ParseBool(fields["deltas"])
+	caps.PerGrid, _ = strconv.ParseBool(fields["perGrid"])
+	caps.URLLists, _ = strconv.ParseBool(fields["urlLists"])
+	return
+}
+
+// negotiateMapVersion picks the highest .map version both sides support, explicit config wins
+func negotiateMapVersion(caps GameCapabilities, found bool) uint16 {
+	defaultVersion := supportedMapVersions[0]
+	if config.MapFileVersion != 0 {
+		for _, v := range supportedMapVersions {
+			if v == config.MapFileVersion {
+				return v
+			}
+		}
+		log.Printf("Warning! MapFileVersion %d not supported, using %d", config.MapFileVersion, defaultVersion)
+		return defaultVersion
+	}
+	if !found {
+		return defaultVersion
+	}
+	for i := len(supportedMapVersions) - 1; i >= 0; i-- {
+		for _, v := range caps.MapVersions {
+			if v == supportedMapVersions[i] {
+				return v
+			}
+		}
+	}
+	log.Printf("Warning! game advertised map versions %v, none supported, using %d", caps.MapVersions, defaultVersion)
+	return defaultVersion
+}
@@ -0,0 +1,81 @@
+package territory
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateMapVersion(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		configured uint16
+		caps       GameCapabilities
+		found      bool
+		want       uint16
+	}{
+		{"no handshake", 0, GameCapabilities{}, false, 2},
+		{"both versions", 0, GameCapabilities{MapVersions: []uint16{2, 3}}, true, 3},
+		{"old game", 0, GameCapabilities{MapVersions: []uint16{2}}, true, 2},
+		{"zlib game", 0, GameCapabilities{MapVersions: []uint16{2, 3, 4}}, true, 4},
+		{"newer game", 0, GameCapabilities{MapVersions: []uint16{3, 5}}, true, 3},
+		{"nothing in common", 0, GameCapabilities{MapVersions: []uint16{5}}, true, 2},
+		{"empty hash", 0, GameCapabilities{}, true, 2},
+		{"config wins", 3, GameCapabilities{MapVersions: []uint16{2}}, true, 3},
+		{"config without handshake", 3, GameCapabilities{}, false, 3},
+		{"unsupported config", 9, GameCapabilities{MapVersions: []uint16{3}}, true, 2},
+	} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.MapFileVersion = test.configured })
+		if got := negotiateMapVersion(test.caps, test.found); got != test.want {
+			t.Errorf("%s: negotiated %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFetchGameCapabilities(t *testing.T) {
+	useTestConfig(t, nil)
+	_, client := newTestRedis(t)
+	if _, found := fetchGameCapabilities(client); found {
+		t.Fatalf("found capabilities before the game wrote them")
+	}
+
+	client.HSet("territory_capabilities", "mapVersions", "2, 3,x")
+	client.HSet("territory_capabilities", "deltas", "true")
+	client.HSet("territory_capabilities", "urlLists", "1")
+	caps, found := fetchGameCapabilities(client)
+	want := GameCapabilities{MapVersions: []uint16{2, 3}, Deltas: true, URLLists: true}
+	if !found || !reflect.DeepEqual(caps, want) {
+		t.Fatalf("got %+v (found %v), want %+v", caps, found, want)
+	}
+}
+
+func TestCapabilityChangeSwitchesMapVersionNextCycle(t *testing.T) {
+	useTestConfig(t, nil)
+	_, client := newTestRedis(t)
+	filename := filepath.Join(config.WWWDir, "gameTiles", "world.map")
+	cycle := func() uint16 {
+		t.Helper()
+		if err := generateGame(context.Background(), filepath.Dir(filename), testMarkers(), negotiateMapVersion(fetchGameCapabilities(client))); err != nil {
+			t.Fatal(err)
+		}
+		header, _, _, err := readMapFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header.Version
+	}
+
+	if version := cycle(); version != 2 {
+		t.Fatalf("wrote version %d before the handshake, want 2", version)
+	}
+	// a game build supporting v3 rolls out between cycles
+	client.HSet("territory_capabilities", "mapVersions", "2,3")
+	if version := cycle(); version != 3 {
+		t.Fatalf("wrote version %d after the game advertised v3, want 3", version)
+	}
+	client.HSet("territory_capabilities", "mapVersions", "2")
+	if version := cycle(); version != 2 {
+		t.Fatalf("wrote version %d after the game rolled back, want 2", version)
+	}
+}
@@ -0,0 +1,33 @@
+package territory
+
+import "sort"
+
+// mortonCode interleaves the bits of x and y so sorting by it keeps nearby claims together
+func mortonCode(c ClaimFlagOutputEntry) uint32 {
+	spread := func(v uint16) uint32 {
+		x := uint32(v)
+		x = (x | (x << 8)) & 0x00FF00FF
+		x = (x | (x << 4)) & 0x0F0F0F0F
+		x = (x | (x << 2)) & 0x33333333
+		x = (x | (x << 1)) & 0x55555555
+		return x
+	}
+	return spread(c.X) | (spread(c.Y) << 1)
+}
+
+// sampleClaims keeps max claims spread evenly along a Z-order curve so the subset still covers
+// the same area as the full set, the result reuses the claims backing array
+func sampleClaims(claims []ClaimFlagOutputEntry, max int) []ClaimFlagOutputEntry {
+	if len(claims) <= max {
+		return claims
+	}
+	if max <= 0 {
+		return claims[:0]
+	}
+	sort.Slice(claims, func(i, j int) bool { return mortonCode(claims[i]) < mortonCode(claims[j]) })
+	step := float64(len(claims)) / float64(max)
+	for i := 0; i < max; i++ {
+		claims[i] = claims[int(float64(i)*step)]
+	}
+	return claims[:max]
+}
@@ -0,0 +1,65 @@
+package territory
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMapClaimCapLimitsOverCapOwners(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MapMaxClaimsPerOwner = 40
+	})
+	const mega, small = 1000050001, 1000050002
+	var markers []Marker
+	// 300 land and 100 water claims spread over the whole world
+	for i := 0; i < 400; i++ {
+		markerType := MarkerLand
+		if i%4 == 3 {
+			markerType = MarkerWater
+		}
+		markers = append(markers, Marker{serverX: i % 2, serverY: (i / 2) % 2, tribeOrOwnerID: mega, relX: float64(i%20) / 20, relY: float64(i/20) / 20, markerType: markerType})
+	}
+	for i := 0; i < 10; i++ {
+		markers = append(markers, Marker{tribeOrOwnerID: small, relX: float64(i) / 10, relY: 0.5, markerType: MarkerLand})
+	}
+
+	owners, _, capped := buildMapOwners(markers)
+	if capped != 1 || len(owners) != 2 {
+		t.Fatalf("%d owners capped of %d, want the one over the cap", capped, len(owners))
+	}
+	megaOwner, smallOwner := owners[0], owners[1]
+	if land, water := len(megaOwner.LandClaims), len(megaOwner.WaterClaims); land != 30 || water != 10 {
+		t.Errorf("capped owner exports %d land and %d water claims, want 30 and 10 keeping the mix", land, water)
+	}
+	if len(smallOwner.LandClaims) != 10 {
+		t.Errorf("owner under the cap exports %d claims, want all 10", len(smallOwner.LandClaims))
+	}
+
+	// the kept claims are a spatial subset reaching every quarter of the world
+	half := uint16(mapSrcPixels(config.GameSize) / 2)
+	quarters := make(map[[2]bool]bool)
+	for _, claim := range append(megaOwner.LandClaims, megaOwner.WaterClaims...) {
+		quarters[[2]bool{claim.X >= half, claim.Y >= half}] = true
+	}
+	if len(quarters) != 4 {
+		t.Errorf("capped claims cover %d quarters of the world, want all 4", len(quarters))
+	}
+
+	logs := useLogBuffer(t)
+	if err := generateGame(context.Background(), filepath.Join(config.WWWDir, "gameTiles"), markers, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Capped 1 owners to 40 claims") {
+		t.Errorf("capping wasn't logged: %s", logs.String())
+	}
+	_, published, _, err := readMapFile(filepath.Join(config.WWWDir, "gameTiles", "world.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := len(published[0].LandClaims) + len(published[0].WaterClaims); claims != 40 {
+		t.Errorf("world.map has %d claims of the capped owner, want 40", claims)
+	}
+}
@@ -0,0 +1,65 @@
+package territory
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	ClaimFalloffNone   = "none"   // hard edged circles
+	ClaimFalloffLinear = "linear" // alpha falls evenly from the center to the radius
+	ClaimFalloffSmooth = "smooth" // smoothstep, flatter near the center and the edge
+)
+
+// falloffAlpha is the fraction of a claim's alpha at distance d from its center, 1 at the center
+// and 0 at the radius
+func falloffAlpha(d, radius float64) float64 {
+	t := 1 - d/radius
+	if t <= 0 {
+		return 0
+	}
+	if config.ClaimFalloff == ClaimFalloffSmooth {
+		return t * t * (3 - 2*t)
+	}
+	return t
+}
+
+// drawFalloffClaim composites a claim fading from c at its center to transparent at radius over
+// img, pixel centers are sampled. With sweep < 2π only the sector starting at angle start is drawn
+func drawFalloffClaim(img *image.RGBA, x, y, radius, start, sweep float64, c color.NRGBA) {
+	bounds := image.Rect(
+		int(math.Floor(x-radius)), int(math.Floor(y-radius)),
+		int(math.Ceil(x+radius))+1, int(math.Ceil(y+radius))+1,
+	).Intersect(img.Bounds())
+	sector := sweep < 2*math.Pi
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		dy := float64(py) + 0.5 - y
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			dx := float64(px) + 0.5 - x
+			d := math.Hypot(dx, dy)
+			if d >= radius {
+				continue
+			}
+			if sector {
+				angle := math.Mod(math.Atan2(dy, dx)-start+4*math.Pi, 2*math.Pi)
+				if angle >= sweep {
+					continue
+				}
+			}
+			a := uint32(float64(c.A)*falloffAlpha(d, radius) + 0.5)
+			if a == 0 {
+				continue
+			}
+
+			// source over destination, img is premultiplied
+			i := img.PixOffset(px, py)
+			pix := img.Pix[i : i+4 : i+4]
+			inverse := 255 - a
+			pix[0] = uint8((uint32(c.R)*a + uint32(pix[0])*inverse + 127) / 255)
+			pix[1] = uint8((uint32(c.G)*a + uint32(pix[1])*inverse + 127) / 255)
+			pix[2] = uint8((uint32(c.B)*a + uint32(pix[2])*inverse + 127) / 255)
+			pix[3] = uint8((255*a + uint32(pix[3])*inverse + 127) / 255)
+		}
+	}
+}
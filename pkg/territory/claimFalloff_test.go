@@ -0,0 +1,50 @@
+package territory
+
+import (
+	"math"
+	"testing"
+)
+
+func TestClaimFalloffFadesTowardsTheRadius(t *testing.T) {
+	const size = 1024
+	marker := Marker{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	for _, falloff := range []string{ClaimFalloffNone, ClaimFalloffLinear, ClaimFalloffSmooth} {
+		t.Run(falloff, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 1, 1
+				cfg.LandRadiusUE = 0.1 * cfg.GridSize
+				cfg.OpaqueClaims = true
+				cfg.ClaimFalloff = falloff
+			})
+			img := renderWorld([]Marker{marker}, MapOptions{}, size)
+			radius := 0.1 * size
+			// alpha at fractions of the radius right of the center
+			alpha := func(fraction float64) uint8 {
+				return img.RGBAAt(size/2+int(math.Round(fraction*radius)), size/2).A
+			}
+			center, middle, edge, outside := alpha(0), alpha(0.5), alpha(0.9), alpha(1.1)
+			if outside != 0 {
+				t.Errorf("alpha %d outside the radius", outside)
+			}
+			if falloff == ClaimFalloffNone {
+				if center != 0xff || edge != 0xff {
+					t.Errorf("solid claim alpha %d at the center and %d at the edge, want 255", center, edge)
+				}
+				return
+			}
+			if !(center > middle && middle > edge) {
+				t.Errorf("alpha %d at the center, %d half way and %d at the edge, want it falling", center, middle, edge)
+			}
+			if center < 0xf0 || edge > 0x40 {
+				t.Errorf("alpha %d at the center and %d at the edge, want nearly solid and nearly transparent", center, edge)
+			}
+			// linear halves by the middle, smoothstep is still at half there but flatter near the center
+			if want := 0x80; falloff == ClaimFalloffLinear && math.Abs(float64(int(middle)-want)) > 12 {
+				t.Errorf("linear alpha %d half way, want about %d", middle, want)
+			}
+			if falloff == ClaimFalloffSmooth && alpha(0.2) <= uint8(0.8*0xff) {
+				t.Errorf("smooth alpha %d at a fifth of the radius, want above 80%%", alpha(0.2))
+			}
+		})
+	}
+}
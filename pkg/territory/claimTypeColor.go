@@ -0,0 +1,16 @@
+package territory
+
+import "image/color"
+
+const (
+	ClaimColorByOwner      = "owner"
+	ClaimColorByMarkerType = "markerType"
+)
+
+// markerTypeColor is the claim color with ClaimColorBy "markerType", the owner doesn't matter
+func markerTypeColor(markerType uint8) color.NRGBA {
+	if markerType == MarkerWater {
+		return colorValues[config.WaterClaimColor]
+	}
+	return colorValues[config.LandClaimColor]
+}
@@ -0,0 +1,55 @@
+package territory
+
+import "testing"
+
+func TestMarkerTypeColorsIgnoreOwners(t *testing.T) {
+	markers := []Marker{
+		{tribeOrOwnerID: 1000050001, relX: 0.25, relY: 0.25, markerType: MarkerLand},
+		{tribeOrOwnerID: 1000050002, relX: 0.75, relY: 0.25, markerType: MarkerLand},
+		{tribeOrOwnerID: 42, relX: 0.25, relY: 0.75, markerType: MarkerWater},
+		{tribeOrOwnerID: 1000050001, relX: 0.75, relY: 0.75, markerType: MarkerWater},
+	}
+	const size = 256
+	for _, test := range []struct {
+		colorBy string
+		want    func(marker Marker) string
+	}{
+		{ClaimColorByMarkerType, func(marker Marker) string {
+			if marker.markerType == MarkerWater {
+				return "teal"
+			}
+			return "maroon"
+		}},
+		{ClaimColorByOwner, nil},
+	} {
+		t.Run(test.colorBy, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 1, 1
+				cfg.OpaqueClaims = true
+				cfg.ClaimColorBy = test.colorBy
+				cfg.LandClaimColor, cfg.WaterClaimColor = "maroon", "teal"
+			})
+			img := renderWorld(markers, MapOptions{}, size)
+			for _, marker := range markers {
+				want := getTribeColor(marker.tribeOrOwnerID)
+				if test.want != nil {
+					want = colorValues[test.want(marker)]
+				}
+				if got := worldPixel(img, marker, size); colorDistance(got, want) != 0 {
+					t.Errorf("claim %+v is %v, want %v", marker, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimColorSettingsChangeTheRenderHash(t *testing.T) {
+	useTestConfig(t, nil)
+	byOwner := renderSettingsHash()
+	config.ClaimColorBy = ClaimColorByMarkerType
+	byType := renderSettingsHash()
+	config.WaterClaimColor = "teal"
+	if byOwner == byType || byType == renderSettingsHash() {
+		t.Errorf("changing the claim colors kept the render settings hash, so tiles wouldn't be redrawn")
+	}
+}
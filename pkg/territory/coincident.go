@@ -0,0 +1,58 @@
+package territory
+
+import "math"
+
+const (
+	CoincidentNone   = "none"
+	CoincidentOffset = "offset"
+	CoincidentSplit  = "split"
+)
+
+// coincidentKey is a marker's exact virtual position
+type coincidentKey struct {
+	x, y float64
+}
+
+// coincidentGroups maps positions claimed by more than one owner to those owners in render
+// order, vbs must already be sorted by sortForRendering
+func coincidentGroups(vbs []VirtualBounds) map[coincidentKey][]uint64 {
+	if config.CoincidentPolicy == CoincidentNone {
+		return nil
+	}
+	owners := make(map[coincidentKey][]uint64)
+	for _, vb := range vbs {
+		key := coincidentKey{vb.x, vb.y}
+		group := owners[key]
+		if len(group) > 0 && group[len(group)-1] == vb.marker.tribeOrOwnerID {
+			continue
+		}
+		owners[key] = append(group, vb.marker.tribeOrOwnerID)
+	}
+	for key, group := range owners {
+		if len(group) < 2 {
+			delete(owners, key)
+		}
+	}
+	return owners
+}
+
+// coincidentSlot returns the marker's position k among the n owners at its position, n is 1 for
+// markers that aren't coincident with another owner's
+func coincidentSlot(groups map[coincidentKey][]uint64, vb VirtualBounds) (k, n int) {
+	group, ok := groups[coincidentKey{vb.x, vb.y}]
+	if !ok {
+		return 0, 1
+	}
+	for i, owner := range group {
+		if owner == vb.marker.tribeOrOwnerID {
+			return i, len(group)
+		}
+	}
+	return 0, 1
+}
+
+// coincidentOffset spreads the n owners evenly on a circle of CoincidentOffsetPixels
+func coincidentOffset(k, n int) (float64, float64) {
+	angle := 2 * math.Pi * float64(k) / float64(n)
+	return math.Cos(angle) * config.CoincidentOffsetPixels, math.Sin(angle) * config.CoincidentOffsetPixels
+}
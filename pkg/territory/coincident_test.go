@@ -0,0 +1,54 @@
+package territory
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCoincidentClaimsShowBothOwners(t *testing.T) {
+	const first, second = 1000050001, 1000050002
+	const size = 256
+	markers := []Marker{
+		{tribeOrOwnerID: first, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: second, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+	}
+	// owner at a pixel offset from the shared center, 0 when it's neither
+	ownerAt := func(img *image.RGBA, dx, dy int) uint64 {
+		got := img.RGBAAt(size/2+dx, size/2+dy)
+		for _, owner := range []uint64{first, second} {
+			if colorDistance(got, getTribeColor(owner)) <= 8 {
+				return owner
+			}
+		}
+		return 0
+	}
+
+	for _, test := range []struct {
+		policy string
+		// pixels on either side of the shared center
+		a, b [2]int
+		want [2]uint64
+	}{
+		// the later owner covers the earlier one completely
+		{CoincidentNone, [2]int{0, 12}, [2]int{0, -12}, [2]uint64{second, second}},
+		// each owner gets half of the circle
+		{CoincidentSplit, [2]int{0, 12}, [2]int{0, -12}, [2]uint64{first, second}},
+		// each owner is moved 8 pixels, the first to the right and the second to the left
+		{CoincidentOffset, [2]int{30, 0}, [2]int{-30, 0}, [2]uint64{first, second}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 1, 1
+				cfg.LandRadiusUE = 140000
+				cfg.OpaqueClaims = true
+				cfg.CoincidentPolicy = test.policy
+				cfg.CoincidentOffsetPixels = 8
+			})
+			img := renderWorld(markers, MapOptions{}, size)
+			got := [2]uint64{ownerAt(img, test.a[0], test.a[1]), ownerAt(img, test.b[0], test.b[1])}
+			if got != test.want {
+				t.Errorf("owners at %v and %v are %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CompareTile is one tile's difference between the two renders
+type CompareTile struct {
+	Tile           string  `json:"tile"`
+	ChangedPercent float64 `json:"changedPercent"`
+}
+
+// CompareReport is written to report.json by the compare subcommand
+type CompareReport struct {
+	ConfigA        string        `json:"configA"`
+	ConfigB        string        `json:"configB"`
+	Tiles          int           `json:"tiles"`
+	ChangedTiles   int           `json:"changedTiles"`
+	MaxPercent     float64       `json:"maxPercent"`
+	MeanPercent    float64       `json:"meanPercent"`
+	Threshold      float64       `json:"threshold"`
+	Pass           bool          `json:"pass"`
+	MostChanged    []CompareTile `json:"mostChanged"`
+	MarkerSnapshot int           `json:"markerSnapshot"`
+}
+
+// runCompare renders one marker snapshot under two configs and reports the per tile pixel
+// differences, returning the process exit code
+func runCompare(args []string) int {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	outDir := flags.String("out", "./compare", "directory for both renders and the report")
+	threshold := flags.Float64("threshold", 0, "fail if any tile has more than this percent of pixels changed")
+	topK := flags.Int("top", 10, "number of most changed tiles to report and composite")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: compare [-out dir] [-threshold percent] [-top k] <configA.json> <configB.json>")
+		return 2
+	}
+
+	configs := make([]Configuration, 2)
+	for i := range configs {
+		cfg, err := loadConfig(flags.Arg(i))
+		if err != nil {
+			log.Printf("Failed to read configuration file %s: %v", flags.Arg(i), err)
+			return 2
+		}
+		// renders stay local
+		cfg.AtlasS3AccessID = ""
+		configs[i] = cfg
+	}
+
+	// one snapshot from the first config's redis is rendered under both
+	config = configs[0]
+	configuredGrids = loadActiveGrids()
+	dbCfg, err := config.getDatabaseByName("TerritoryDB")
+	if err != nil {
+		log.Printf("Compare failed: %v", err)
+		return 2
+	}
+	client := newRedisClient(dbCfg, dbCfg.credentialProvider())
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	optOut, _ := fetchOptOutOwners(client)
+	markers = withoutOptedOut(markers, optOut)
+
+	dirs := []string{path.Join(*outDir, "a"), path.Join(*outDir, "b")}
+	for i, cfg := range configs {
+		config = cfg
+		os.RemoveAll(dirs[i])
+		// each config has its own scale and radii so gets its own snapshot
+		snapshot := newTileSnapshot(markers, 0, 0)
+		for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+			generateTiles(context.Background(), dirs[i], zoom, snapshot, nil)
+		}
+	}
+
+	report := CompareReport{
+		ConfigA:        flags.Arg(0),
+		ConfigB:        flags.Arg(1),
+		Threshold:      *threshold,
+		MarkerSnapshot: len(markers),
+	}
+	tiles, err := compareTileDirs(dirs[0], dirs[1])
+	if err != nil {
+		log.Printf("Compare failed: %v", err)
+		return 2
+	}
+	total := 0.0
+	for _, tile := range tiles {
+		total += tile.ChangedPercent
+		if tile.ChangedPercent > 0 {
+			report.ChangedTiles++
+		}
+	}
+	report.Tiles = len(tiles)
+	if len(tiles) > 0 {
+		report.MaxPercent = tiles[0].ChangedPercent
+		report.MeanPercent = total / float64(len(tiles))
+	}
+	report.Pass = report.MaxPercent <= *threshold
+	for _, tile := range tiles[:Min(*topK, len(tiles))] {
+		if tile.ChangedPercent == 0 {
+			break
+		}
+		report.MostChanged = append(report.MostChanged, tile)
+		writeSideBySide(path.Join(*outDir, "sideBySide", strings.Replace(tile.Tile, "/", "_", -1)), dirs[0], dirs[1], tile.Tile)
+	}
+
+	js, _ := json.MarshalIndent(report, "", "  ")
+	ioutil.WriteFile(path.Join(*outDir, "report.json"), js, 0644)
+	summary := compareSummary(report)
+	ioutil.WriteFile(path.Join(*outDir, "summary.md"), []byte(summary), 0644)
+	fmt.Print(summary)
+
+	if !report.Pass {
+		return 1
+	}
+	return 0
+}
+
+// compareTileDirs diffs every tile in either directory, most changed first. A tile missing on
+// one side counts as fully changed
+func compareTileDirs(dirA, dirB string) ([]CompareTile, error) {
+	names := make(map[string]bool)
+	for _, dir := range []string{dirA, dirB} {
+		err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(file, ".png") {
+				return err
+			}
+			rel, err := filepath.Rel(dir, file)
+			names[filepath.ToSlash(rel)] = true
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var tiles []CompareTile
+	for name := range names {
+		a, errA := readPNG(path.Join(dirA, name))
+		b, errB := readPNG(path.Join(dirB, name))
+		changed := 100.0
+		if errA == nil && errB == nil {
+			changed = pixelDifference(a, b)
+		}
+		tiles = append(tiles, CompareTile{Tile: name, ChangedPercent: changed})
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].ChangedPercent != tiles[j].ChangedPercent {
+			return tiles[i].ChangedPercent > tiles[j].ChangedPercent
+		}
+		return tiles[i].Tile < tiles[j].Tile
+	})
+	return tiles, nil
+}
+
+func readPNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// pixelDifference returns the percent of pixels that differ, images of different sizes are fully changed
+func pixelDifference(a, b image.Image) float64 {
+	if a.Bounds() != b.Bounds() {
+		return 100
+	}
+	bounds := a.Bounds()
+	changed := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				changed++
+			}
+		}
+	}
+	return 100 * float64(changed) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// writeSideBySide composites a tile from both renders next to each other, missing sides are left blank
+func writeSideBySide(filename, dirA, dirB, tile string) {
+	a, _ := readPNG(path.Join(dirA, tile))
+	b, _ := readPNG(path.Join(dirB, tile))
+	size := config.TileSize
+	img := image.NewNRGBA(image.Rect(0, 0, size*2, size))
+	if a != nil {
+		draw.Draw(img, image.Rect(0, 0, size, size), a, a.Bounds().Min, draw.Src)
+	}
+	if b != nil {
+		draw.Draw(img, image.Rect(size, 0, size*2, size), b, b.Bounds().Min, draw.Src)
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), os.ModePerm); err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+	defer f.Close()
+	png.Encode(f, img)
+}
+
+// compareSummary formats the report as markdown for pasting into a PR
+func compareSummary(report CompareReport) string {
+	var sb strings.Builder
+	result := "PASS"
+	if !report.Pass {
+		result = "FAIL"
+	}
+	fmt.Fprintf(&sb, "## Render comparison: %s\n\n", result)
+	fmt.Fprintf(&sb, "`%s` vs `%s`, %d markers\n\n", report.ConfigA, report.ConfigB, report.MarkerSnapshot)
+	fmt.Fprintf(&sb, "- Tiles compared: %d\n", report.Tiles)
+	fmt.Fprintf(&sb, "- Tiles changed: %d\n", report.ChangedTiles)
+	fmt.Fprintf(&sb, "- Max changed: %.3f%% (threshold %.3f%%)\n", report.MaxPercent, report.Threshold)
+	fmt.Fprintf(&sb, "- Mean changed: %.3f%%\n", report.MeanPercent)
+	if len(report.MostChanged) > 0 {
+		sb.WriteString("\n| Tile | Changed |\n|---|---|\n")
+		for _, tile := range report.MostChanged {
+			fmt.Fprintf(&sb, "| %s | %.3f%% |\n", tile.Tile, tile.ChangedPercent)
+		}
+	}
+	return sb.String()
+}
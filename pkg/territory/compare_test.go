@@ -0,0 +1,94 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeCompareConfig writes a config.json of a 2x2 world on the miniredis with extra settings
+func writeCompareConfig(t *testing.T, dir, name, host string, port int, extra string) string {
+	t.Helper()
+	js := fmt.Sprintf(`{
+		"ServersX": 2, "ServersY": 2, "MaxZoom": 2, "StateFile": "",
+		"DatabaseConnections": [
+			{"Name": "Default", "URL": %q, "Port": %d, "Password": ""},
+			{"Name": "TerritoryDB", "URL": %q, "Port": %d, "Password": ""}
+		]%s
+	}`, host, port, host, port, extra)
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func readCompareReport(t *testing.T, outDir string) CompareReport {
+	t.Helper()
+	js, err := ioutil.ReadFile(filepath.Join(outDir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report CompareReport
+	if err := json.Unmarshal(js, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCompareDetectsPaletteChange(t *testing.T) {
+	// runCompare installs each config, the test's is put back afterwards
+	useTestConfig(t, nil)
+	server, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, 0.25, 0.75, MarkerLand)
+	port, _ := strconv.Atoi(server.Port())
+	dir := t.TempDir()
+	configA := writeCompareConfig(t, dir, "a.json", server.Host(), port, "")
+	configB := writeCompareConfig(t, dir, "b.json", server.Host(), port, `, "TribeColorMode": "hash"`)
+
+	// the same config twice is identical
+	sameDir := filepath.Join(dir, "same")
+	if code := runCompare([]string{"-out", sameDir, configA, configA}); code != 0 {
+		t.Fatalf("comparing a config with itself exited %d", code)
+	}
+	if report := readCompareReport(t, sameDir); report.ChangedTiles != 0 || report.Tiles == 0 || !report.Pass {
+		t.Errorf("identical renders reported %+v", report)
+	}
+
+	changedDir := filepath.Join(dir, "changed")
+	if code := runCompare([]string{"-out", changedDir, "-top", "2", configA, configB}); code != 1 {
+		t.Fatalf("palette change exited %d, want 1 at threshold 0", code)
+	}
+	report := readCompareReport(t, changedDir)
+	if report.ChangedTiles == 0 || report.MaxPercent <= 0 || report.Pass {
+		t.Fatalf("palette change not detected: %+v", report)
+	}
+	if report.MarkerSnapshot != 2 {
+		t.Errorf("rendered %d markers, want 2", report.MarkerSnapshot)
+	}
+	if len(report.MostChanged) == 0 || len(report.MostChanged) > 2 {
+		t.Fatalf("%d most changed tiles, want 1-2 with -top 2", len(report.MostChanged))
+	}
+	for i := 1; i < len(report.MostChanged); i++ {
+		if report.MostChanged[i].ChangedPercent > report.MostChanged[i-1].ChangedPercent {
+			t.Errorf("most changed tiles aren't sorted: %+v", report.MostChanged)
+		}
+	}
+	composites, _ := ioutil.ReadDir(filepath.Join(changedDir, "sideBySide"))
+	if len(composites) != len(report.MostChanged) {
+		t.Errorf("%d side-by-side composites, want one per most changed tile", len(composites))
+	}
+	if _, err := os.Stat(filepath.Join(changedDir, "summary.md")); err != nil {
+		t.Errorf("no summary: %v", err)
+	}
+
+	// a threshold above the change lets it pass
+	if code := runCompare([]string{"-out", changedDir, "-threshold", "100", configA, configB}); code != 0 {
+		t.Errorf("threshold 100 exited %d, want 0", code)
+	}
+}
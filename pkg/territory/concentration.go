@@ -0,0 +1,58 @@
+package territory
+
+import (
+	"sort"
+)
+
+// ownerScores is every public owner's ClaimWeights score, largest first
+func ownerScores(markers []Marker, optOut map[uint64]bool) []float64 {
+	byOwner := make(map[uint64]float64)
+	for _, marker := range markers {
+		if !optOut[marker.tribeOrOwnerID] {
+			byOwner[marker.tribeOrOwnerID] += claimWeight(marker.markerType)
+		}
+	}
+	scores := make([]float64, 0, len(byOwner))
+	for _, score := range byOwner {
+		scores = append(scores, score)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+	return scores
+}
+
+// giniCoefficient of scores sorted largest first: 0 when every owner holds the same, approaching
+// 1 as one owner holds everything. No owners, one owner or no score at all is 0
+func giniCoefficient(scores []float64) float64 {
+	n := float64(len(scores))
+	total, weighted := 0.0, 0.0
+	for i, score := range scores {
+		total += score
+		// rank from smallest, 1 based
+		weighted += (n - float64(i)) * score
+	}
+	if len(scores) < 2 || total <= 0 {
+		return 0
+	}
+	return 2*weighted/(n*total) - (n+1)/n
+}
+
+// topShare is the fraction of the total score held by the largest n owners of scores sorted
+// largest first, 0 without any score
+func topShare(scores []float64, n int) float64 {
+	total, top := 0.0, 0.0
+	for i, score := range scores {
+		total += score
+		if i < n {
+			top += score
+		}
+	}
+	if total <= 0 {
+		return 0
+	}
+	return top / total
+}
+
+// ownersAbove counts the owners of scores sorted largest first whose score exceeds threshold
+func ownersAbove(scores []float64, threshold float64) int {
+	return sort.Search(len(scores), func(i int) bool { return scores[i] <= threshold })
+}
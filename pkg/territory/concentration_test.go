@@ -0,0 +1,108 @@
+package territory
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestConcentrationMetrics(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		scores []float64
+		gini   float64
+		top1   float64
+		top5   float64
+	}{
+		{"no owners", nil, 0, 0, 0},
+		{"one owner", []float64{5}, 0, 1, 1},
+		{"no score", []float64{0, 0}, 0, 0, 0},
+		{"equal", []float64{1, 1, 1, 1}, 0, 0.25, 1},
+		{"two owners", []float64{3, 1}, 0.25, 0.75, 1},
+		{"one holds everything", []float64{4, 0, 0, 0}, 0.75, 1, 1},
+		{"steps", []float64{4, 3, 2, 1}, 0.25, 0.4, 1},
+		{"long tail", []float64{10, 1, 1, 1, 1, 1, 1}, 27.0 / 56, 10.0 / 16, 14.0 / 16},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := giniCoefficient(test.scores); math.Abs(got-test.gini) > 1e-12 {
+				t.Errorf("gini %v, want %v", got, test.gini)
+			}
+			if got := topShare(test.scores, 1); math.Abs(got-test.top1) > 1e-12 {
+				t.Errorf("top1Share %v, want %v", got, test.top1)
+			}
+			if got := topShare(test.scores, 5); math.Abs(got-test.top5) > 1e-12 {
+				t.Errorf("top5Share %v, want %v", got, test.top5)
+			}
+		})
+	}
+
+	steps := []float64{4, 3, 2, 1}
+	for threshold, want := range map[float64]int{0: 4, 2: 2, 3.5: 1, 4: 0} {
+		if got := ownersAbove(steps, threshold); got != want {
+			t.Errorf("ownersAbove %v is %d, want %d", threshold, got, want)
+		}
+	}
+}
+
+// TestGiniUnderEqualClaims checks the Gini is unchanged when every owner's claims grow in the same
+// proportion, and lowered, never raised, when every owner gains the same number of claims
+func TestGiniUnderEqualClaims(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 200; trial++ {
+		scores := make([]float64, 2+random.Intn(30))
+		for i := range scores {
+			scores[i] = float64(random.Intn(500))
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+		gini := giniCoefficient(scores)
+
+		factor := float64(2 + random.Intn(5))
+		scaled := make([]float64, len(scores))
+		added := make([]float64, len(scores))
+		extra := float64(1 + random.Intn(50))
+		for i, score := range scores {
+			scaled[i] = score * factor
+			added[i] = score + extra
+		}
+		if got := giniCoefficient(scaled); math.Abs(got-gini) > 1e-9 {
+			t.Fatalf("%v: scaling every owner by %v moved the Gini from %v to %v", scores, factor, gini, got)
+		}
+		if got := giniCoefficient(added); got > gini+1e-9 {
+			t.Fatalf("%v: adding %v claims to every owner raised the Gini from %v to %v", scores, extra, gini, got)
+		}
+	}
+}
+
+func TestConcentrationStatsHonorWeightsAndOptOut(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ClaimWeights.Land, cfg.ClaimWeights.Water = 1, 2
+		cfg.StatsFields = []string{"gini", "top1Share", "ownersAbove"}
+		cfg.ConcentrationBuckets = []int{1, 5}
+	})
+	const big, small, hidden = 1000050001, 1000050002, 1000050003
+	var markers []Marker
+	// big scores 1+2 = 3, small 1, hidden would dominate
+	markers = append(markers,
+		Marker{tribeOrOwnerID: big, markerType: MarkerLand},
+		Marker{tribeOrOwnerID: big, markerType: MarkerWater},
+		Marker{tribeOrOwnerID: small, markerType: MarkerLand},
+	)
+	for i := 0; i < 20; i++ {
+		markers = append(markers, Marker{tribeOrOwnerID: hidden, markerType: MarkerLand})
+	}
+
+	stats := make(map[string]publicStat)
+	for _, stat := range computePublicStats(markers, map[uint64]bool{hidden: true}) {
+		stats[stat.name] = stat
+	}
+	if got := stats["gini"].ratio; math.Abs(got-0.25) > 1e-12 {
+		t.Errorf("gini %v, want 0.25 from the weighted scores 3 and 1", got)
+	}
+	if got := stats["top1Share"].ratio; math.Abs(got-0.75) > 1e-12 {
+		t.Errorf("top1Share %v, want 0.75", got)
+	}
+	if stats["ownersAbove1"].value != 1 || stats["ownersAbove5"].value != 0 {
+		t.Errorf("ownersAbove1 %d and ownersAbove5 %d, want 1 and 0", stats["ownersAbove1"].value, stats["ownersAbove5"].value)
+	}
+}
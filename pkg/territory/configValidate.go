@@ -0,0 +1,123 @@
+package territory
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// maxVirtualPixels bounds TileSize << (MaxZoom-1) so virtual coordinates stay exact in a float64
+// and image sizes fit in an int32
+const maxVirtualPixels = 1 << 30
+
+// maxClaimPixels bounds the radius of a claim in the deepest zoom's tiles
+const maxClaimPixels = 1 << 16
+
+// Validate rejects configurations that load but can't be rendered, e.g. a zero GridSize turns
+// every radius into NaN and a MaxZoom of 0 underflows the virtual size
+func (cfg *Configuration) Validate() error {
+	if cfg.ServersX <= 0 || cfg.ServersY <= 0 {
+		return fmt.Errorf("ServersX and ServersY must be positive, got %dx%d", cfg.ServersX, cfg.ServersY)
+	}
+	if cfg.ServersX > math.MaxUint16 || cfg.ServersY > math.MaxUint16 {
+		return fmt.Errorf("ServersX and ServersY must fit a packed server ID, got %dx%d", cfg.ServersX, cfg.ServersY)
+	}
+	if !isFinite(cfg.GridSize) || cfg.GridSize <= 0 {
+		return fmt.Errorf("GridSize must be positive, got %v", cfg.GridSize)
+	}
+	if !isFinite(cfg.LandRadiusUE) || cfg.LandRadiusUE < 0 {
+		return fmt.Errorf("LandRadiusUE must not be negative, got %v", cfg.LandRadiusUE)
+	}
+	if !isFinite(cfg.WaterRadiusUE) || cfg.WaterRadiusUE < 0 {
+		return fmt.Errorf("WaterRadiusUE must not be negative, got %v", cfg.WaterRadiusUE)
+	}
+	if cfg.TileSize <= 0 {
+		return fmt.Errorf("TileSize must be positive, got %d", cfg.TileSize)
+	}
+	if cfg.MaxZoom < 1 || cfg.MaxZoom > 30 {
+		return fmt.Errorf("MaxZoom must be between 1 and 30, got %d", cfg.MaxZoom)
+	}
+	virtualPixels := int64(cfg.TileSize) << (cfg.MaxZoom - 1)
+	if virtualPixels > maxVirtualPixels {
+		return fmt.Errorf("TileSize %d at MaxZoom %d is %d virtual pixels, more than %d", cfg.TileSize, cfg.MaxZoom, virtualPixels, maxVirtualPixels)
+	}
+	if virtualPixels < int64(Max(cfg.ServersX, cfg.ServersY)) {
+		return fmt.Errorf("TileSize %d at MaxZoom %d leaves less than a virtual pixel per server", cfg.TileSize, cfg.MaxZoom)
+	}
+	// rasterizing a circle takes time in proportion to its radius in pixels, even when most of it
+	// is outside the tile
+	pixelsPerServer := float64(virtualPixels / int64(Max(cfg.ServersX, cfg.ServersY)))
+	if radius := math.Max(cfg.LandRadiusUE, cfg.WaterRadiusUE) / cfg.GridSize * pixelsPerServer; radius > maxClaimPixels {
+		return fmt.Errorf("claims are %.0f pixels in radius at MaxZoom %d, more than %d", radius, cfg.MaxZoom, maxClaimPixels)
+	}
+	if cfg.GameSize <= 0 || mapSrcPixels(cfg.GameSize) > math.MaxUint16 {
+		return fmt.Errorf("GameSize must be positive and fit the .map's uint16 source width, got %d", cfg.GameSize)
+	}
+	if cfg.GameSize < Max(cfg.ServersX, cfg.ServersY) {
+		return fmt.Errorf("GameSize %d leaves less than a pixel per server", cfg.GameSize)
+	}
+	if err := cfg.GameArtifactAccess.validate(); err != nil {
+		return err
+	}
+	if cfg.Port == 0 {
+		return fmt.Errorf("Port must be set")
+	}
+	if cfg.URLScheme != "http" && cfg.URLScheme != "https" {
+		return fmt.Errorf("URLScheme must be http or https, got %q", cfg.URLScheme)
+	}
+	if len(cfg.LeaderLockKey) > 0 && cfg.LeaderLockTTLSeconds < 3 {
+		return fmt.Errorf("LeaderLockTTLSeconds must be at least 3, got %d", cfg.LeaderLockTTLSeconds)
+	}
+	if cfg.PosterStripPixels <= 0 || cfg.PosterQueueSize <= 0 {
+		return fmt.Errorf("PosterStripPixels and PosterQueueSize must be positive, got %d and %d", cfg.PosterStripPixels, cfg.PosterQueueSize)
+	}
+	weights := []float64{cfg.ClaimWeights.Land, cfg.ClaimWeights.Water}
+	for _, weight := range cfg.ClaimWeights.Types {
+		weights = append(weights, weight)
+	}
+	for _, weight := range weights {
+		if !isFinite(weight) || weight < 0 {
+			return fmt.Errorf("ClaimWeights must not be negative, got %v", weight)
+		}
+	}
+	for _, mirror := range cfg.AlternativeURLs {
+		if len(mirror.URL) == 0 {
+			return fmt.Errorf("AlternativeURLs entries need a URL")
+		}
+		if !isFinite(mirror.Weight) || mirror.Weight < 0 {
+			return fmt.Errorf("AlternativeURLs weight of %s must not be negative, got %v", mirror.URL, mirror.Weight)
+		}
+	}
+	if cfg.PrimaryURL < 0 || (cfg.PrimaryURL > 0 && cfg.PrimaryURL >= len(cfg.AlternativeURLs)) {
+		return fmt.Errorf("PrimaryURL must index AlternativeURLs, got %d with %d entries", cfg.PrimaryURL, len(cfg.AlternativeURLs))
+	}
+	if cfg.LogBufferRecords < 0 {
+		return fmt.Errorf("LogBufferRecords must not be negative, got %d", cfg.LogBufferRecords)
+	}
+	if cfg.GridWarningEveryCycles < 0 || cfg.GridErrorAfterCycles < 0 {
+		return fmt.Errorf("GridWarningEveryCycles and GridErrorAfterCycles must not be negative, got %d and %d", cfg.GridWarningEveryCycles, cfg.GridErrorAfterCycles)
+	}
+	for _, threshold := range cfg.ConcentrationBuckets {
+		if threshold < 0 {
+			return fmt.Errorf("ConcentrationBuckets must not be negative, got %d", threshold)
+		}
+	}
+	for _, name := range requiredDatabases {
+		if _, err := cfg.getDatabaseByName(name); err != nil {
+			return err
+		}
+	}
+	if cfg.FetchRateInSeconds <= 0 {
+		return fmt.Errorf("FetchRateInSeconds must be positive, got %d", cfg.FetchRateInSeconds)
+	}
+	location, err := time.LoadLocation(cfg.ScheduleTimeZone)
+	if err != nil {
+		return fmt.Errorf("ScheduleTimeZone: %v", err)
+	}
+	if len(cfg.FetchSchedule) > 0 {
+		if _, err := parseCronSchedule(cfg.FetchSchedule, location); err != nil {
+			return fmt.Errorf("FetchSchedule: %v", err)
+		}
+	}
+	return nil
+}
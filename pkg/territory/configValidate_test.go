@@ -0,0 +1,181 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pipelineConfig is the part of a Configuration the pipeline harness varies
+type pipelineConfig struct {
+	serversX, serversY        int
+	gridSize                  float64
+	landRadius, waterRadius   float64
+	tileSize                  int
+	maxZoom                   int
+	gameSize                  int
+	rotation                  int
+	flipHorizontal, smallSkip bool
+}
+
+// checkConfigPipeline runs a miniature generation under every configuration Validate accepts,
+// failing when one panics, drops a valid marker as invalid or writes a file that doesn't decode
+func checkConfigPipeline(t *testing.T, params pipelineConfig) {
+	// the renderer allocates a TileSize square per tile and the .map a GameSize raster, keep both
+	// small enough to run often
+	if params.tileSize > 1024 || params.gameSize > 8192 {
+		return
+	}
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = params.serversX, params.serversY
+		cfg.GridSize = params.gridSize
+		cfg.LandRadiusUE, cfg.WaterRadiusUE = params.landRadius, params.waterRadius
+		cfg.TileSize = params.tileSize
+		cfg.MaxZoom = uint(Max(0, params.maxZoom))
+		cfg.GameSize = params.gameSize
+		cfg.MapRotation = ((params.rotation%4)*90 + 360) % 360
+		cfg.MapFlipHorizontal = params.flipHorizontal
+		if params.smallSkip {
+			cfg.SmallClaimPolicy = SmallClaimSkip
+		}
+	})
+	if config.Validate() != nil {
+		return
+	}
+	logs := useLogBuffer(t)
+
+	// corners and the middle of the world, with positions at both ends of the grid
+	markers := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1000050001, relX: 0, relY: 0, markerType: MarkerLand},
+		{serverX: config.ServersX - 1, serverY: config.ServersY - 1, tribeOrOwnerID: 1000050002, relX: 1, relY: 1, markerType: MarkerWater},
+		{serverX: config.ServersX / 2, serverY: config.ServersY / 2, tribeOrOwnerID: 1000050003, relX: 0.5, relY: 0.25, markerType: MarkerLand},
+	}
+
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	snapshot := newTileSnapshot(markers, 0, 0)
+	count := generateTileRange(context.Background(), tilePath, 0, snapshot, MapOptions{}, image.Rect(0, 0, 1, 1))
+	failed := len(count.FailedTiles)
+	// at the deepest zoom only the tiles holding a marker are rendered
+	deepest := int(config.MaxZoom) - 1
+	tiles := 1 << uint(deepest)
+	for _, marker := range markers {
+		x, y := tileForPoint((float64(marker.serverX)+marker.relX)*config.GridSize, (float64(marker.serverY)+marker.relY)*config.GridSize, deepest)
+		if x < 0 || y < 0 || x >= tiles || y >= tiles {
+			t.Fatalf("%+v: marker %+v in tile %d/%d/%d outside the %d tiles", params, marker, deepest, x, y, tiles)
+		}
+		count = generateTileRange(context.Background(), tilePath, uint(deepest), snapshot, MapOptions{}, image.Rect(x, y, x+1, y+1))
+		failed += len(count.FailedTiles)
+	}
+	if failed > 0 {
+		t.Errorf("%+v: %d tiles failed", params, failed)
+	}
+
+	owners, invalid, _ := buildMapOwners(markers)
+	if invalid > 0 {
+		t.Errorf("%+v: %d valid markers were left out of the .map as invalid", params, invalid)
+	}
+	mapFile := filepath.Join(config.WWWDir, "gameTiles", "world.map")
+	os.MkdirAll(filepath.Dir(mapFile), 0755)
+	if err := generateCompressedFile(context.Background(), &MapOptions{filename: mapFile, mapVersion: 3}, mapOwnerList(owners), config.GameSize); err != nil {
+		t.Fatalf("%+v: %v", params, err)
+	}
+	header, read, _, err := readMapFile(mapFile)
+	if err != nil {
+		t.Fatalf("%+v: %v", params, err)
+	}
+	for _, owner := range read {
+		for _, claim := range append(owner.LandClaims, owner.WaterClaims...) {
+			if claim.X > header.SrcPixels || claim.Y > header.SrcPixels {
+				t.Errorf("%+v: claim %+v outside the %d pixel .map", params, claim, header.SrcPixels)
+			}
+		}
+	}
+
+	if strings.Contains(logs.String(), "invalid coordinates") {
+		t.Errorf("%+v: NaN or Inf coordinates reached the renderer:\n%s", params, logs)
+	}
+	filepath.Walk(tilePath, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(tilePath, filename)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		z, _ := strconv.Atoi(parts[0])
+		x, _ := strconv.Atoi(parts[1])
+		y, _ := strconv.Atoi(strings.TrimSuffix(parts[2], ".png"))
+		if x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+			t.Errorf("%+v: tile %s outside zoom %d", params, rel, z)
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		img, err := png.Decode(f)
+		if err != nil {
+			t.Errorf("%+v: %s doesn't decode: %v", params, rel, err)
+		} else if img.Bounds().Dx() != config.TileSize || img.Bounds().Dy() != config.TileSize {
+			t.Errorf("%+v: %s is %v, want %d pixels", params, rel, img.Bounds(), config.TileSize)
+		}
+		return nil
+	})
+}
+
+// pipelineSeeds are configurations that used to load and then fail deep in generation
+var pipelineSeeds = []pipelineConfig{
+	{3, 3, 1400000, 4000, 7000, 256, 6, 2048, 0, false, false},
+	{3, 3, 0, 4000, 7000, 256, 6, 2048, 0, false, false},
+	{3, 3, 1400000, 4000, 7000, 256, 0, 2048, 0, false, false},
+	{3, 3, 1400000, 4000, 7000, 100, 5, 2048, 1, true, false},
+	{15, 15, 1400000, 4000, 7000, 1000, 30, 2048, 0, false, false},
+	{7, 2, 1400000, 1, 1, 3, 2, 7, 3, false, true},
+	{1, 1, math.Inf(1), 4000, 7000, 256, 3, 2048, 0, false, false},
+	{18, 16, 1, 1.3e6, 25000, 100, 20, 512, 0, false, false},
+	{2, 1, 1400000, math.NaN(), 7000, 256, 3, 2048, 2, false, false},
+}
+
+func TestPipelineAcceptsEveryValidConfig(t *testing.T) {
+	for i, params := range pipelineSeeds {
+		t.Run("seed"+strconv.Itoa(i), func(t *testing.T) { checkConfigPipeline(t, params) })
+	}
+	random := rand.New(rand.NewSource(1))
+	iterations := 300
+	if testing.Short() {
+		iterations = 10
+	}
+	for i := 0; i < iterations; i++ {
+		gridSize := []float64{0, 1, 1000, 1400000, 1e9}[random.Intn(5)]
+		params := pipelineConfig{
+			serversX:       1 + random.Intn(20),
+			serversY:       1 + random.Intn(20),
+			gridSize:       gridSize,
+			landRadius:     random.Float64() * gridSize * 1.2,
+			waterRadius:    random.Float64() * gridSize * 1.2,
+			tileSize:       []int{0, 1, 3, 64, 100, 256, 1024}[random.Intn(7)],
+			maxZoom:        random.Intn(32),
+			gameSize:       []int{0, 1, 7, 512, 2048, 8192}[random.Intn(6)],
+			rotation:       random.Intn(4),
+			flipHorizontal: random.Intn(2) == 0,
+			smallSkip:      random.Intn(2) == 0,
+		}
+		t.Run("random"+strconv.Itoa(i), func(t *testing.T) { checkConfigPipeline(t, params) })
+	}
+}
+
+// FuzzConfigPipeline runs the same checks over configurations from the fuzzer, run it for longer
+// with go test -fuzz FuzzConfigPipeline
+func FuzzConfigPipeline(f *testing.F) {
+	for _, seed := range pipelineSeeds {
+		f.Add(seed.serversX, seed.serversY, seed.gridSize, seed.landRadius, seed.waterRadius, seed.tileSize, seed.maxZoom, seed.gameSize, seed.rotation, seed.flipHorizontal, seed.smallSkip)
+	}
+	f.Fuzz(func(t *testing.T, serversX, serversY int, gridSize, landRadius, waterRadius float64, tileSize, maxZoom, gameSize, rotation int, flipHorizontal, smallSkip bool) {
+		checkConfigPipeline(t, pipelineConfig{serversX, serversY, gridSize, landRadius, waterRadius, tileSize, maxZoom, gameSize, rotation, flipHorizontal, smallSkip})
+	})
+}
@@ -0,0 +1,140 @@
+package territory
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	ContestedPatternSolid = "solid"
+	ContestedPatternHatch = "hatch"
+)
+
+// contestedCircle is a claim as drawn in image coordinates
+type contestedCircle struct {
+	owner   uint64
+	x, y, r float64
+}
+
+// contestedCounts returns how many distinct owners cover each pixel, nil when fewer than
+// ContestedMinOwners owners are in the tile at all
+func contestedCounts(circles []contestedCircle, size int) []uint8 {
+	byOwner := make(map[uint64][]contestedCircle)
+	for _, c := range circles {
+		byOwner[c.owner] = append(byOwner[c.owner], c)
+	}
+	if len(byOwner) < config.ContestedMinOwners {
+		return nil
+	}
+
+	// each owner is rasterized into a scratch layer so overlaps within one owner count once
+	counts := make([]uint8, size*size)
+	layer := make([]bool, size*size)
+	for _, ownerCircles := range byOwner {
+		for i := range layer {
+			layer[i] = false
+		}
+		for _, c := range ownerCircles {
+			minX, maxX := Max(0, int(math.Floor(c.x-c.r))), Min(size-1, int(math.Ceil(c.x+c.r)))
+			minY, maxY := Max(0, int(math.Floor(c.y-c.r))), Min(size-1, int(math.Ceil(c.y+c.r)))
+			for py := minY; py <= maxY; py++ {
+				dy := float64(py) + 0.5 - c.y
+				for px := minX; px <= maxX; px++ {
+					dx := float64(px) + 0.5 - c.x
+					if dx*dx+dy*dy <= c.r*c.r {
+						layer[py*size+px] = true
+					}
+				}
+			}
+		}
+		for i, covered := range layer {
+			if covered && counts[i] < math.MaxUint8 {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
+
+// drawContested paints pixels covered by at least ContestedMinOwners owners with the contested
+// color, returning the number of contested pixels
+func drawContested(img *image.RGBA, circles []contestedCircle) int {
+	size := img.Bounds().Dx()
+	counts := contestedCounts(circles, size)
+	if counts == nil {
+		return 0
+	}
+
+	c := colorValues[config.ContestedColor]
+	alpha := uint32(config.ContestedAlpha)
+	contested := 0
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			if int(counts[py*size+px]) < config.ContestedMinOwners {
+				continue
+			}
+			contested++
+			// diagonal stripes, 2 of every 6 pixels
+			if config.ContestedPattern == ContestedPatternHatch && (px+py)%6 >= 2 {
+				continue
+			}
+			// premultiplied source over the existing pixel
+			i := img.PixOffset(px, py)
+			inv := 255 - alpha
+			img.Pix[i+0] = uint8((uint32(c.R)*alpha + uint32(img.Pix[i+0])*inv) / 255)
+			img.Pix[i+1] = uint8((uint32(c.G)*alpha + uint32(img.Pix[i+1])*inv) / 255)
+			img.Pix[i+2] = uint8((uint32(c.B)*alpha + uint32(img.Pix[i+2])*inv) / 255)
+			img.Pix[i+3] = uint8(alpha + uint32(img.Pix[i+3])*inv/255)
+		}
+	}
+	return contested
+}
+
+// contestedStatPixels is the resolution of each side of a grid for its contested area statistic
+const contestedStatPixels = 64
+
+// gridContestedAreas returns the fraction of each grid covered by ContestedMinOwners or more
+// distinct owners, rasterized at contestedStatPixels per grid with the same per owner layers as
+// the tiles. Grids without contested area are left out
+func gridContestedAreas(markers []Marker) map[GridID]float64 {
+	// claims of neighbouring grids can reach over the border so each grid gets every circle overlapping it
+	byGrid := make(map[GridID][]contestedCircle)
+	for _, marker := range markers {
+		radius := config.LandRadiusUE / config.GridSize
+		if marker.markerType == MarkerWater {
+			radius = config.WaterRadiusUE / config.GridSize
+		}
+		x := float64(marker.serverX) + marker.relX
+		y := float64(marker.serverY) + marker.relY
+		if !isFinite(x) || !isFinite(y) {
+			continue
+		}
+		minX, maxX := Max(0, int(math.Floor(x-radius))), Min(config.ServersX-1, int(math.Floor(x+radius)))
+		minY, maxY := Max(0, int(math.Floor(y-radius))), Min(config.ServersY-1, int(math.Floor(y+radius)))
+		for gx := minX; gx <= maxX; gx++ {
+			for gy := minY; gy <= maxY; gy++ {
+				byGrid[GridID{X: gx, Y: gy}] = append(byGrid[GridID{X: gx, Y: gy}], contestedCircle{
+					owner: marker.tribeOrOwnerID,
+					x:     (x - float64(gx)) * contestedStatPixels,
+					y:     (y - float64(gy)) * contestedStatPixels,
+					r:     radius * contestedStatPixels,
+				})
+			}
+		}
+	}
+
+	areas := make(map[GridID]float64)
+	for grid, circles := range byGrid {
+		counts := contestedCounts(circles, contestedStatPixels)
+		contested := 0
+		for _, count := range counts {
+			if int(count) >= config.ContestedMinOwners {
+				contested++
+			}
+		}
+		if contested > 0 {
+			areas[grid] = float64(contested) / (contestedStatPixels * contestedStatPixels)
+		}
+	}
+	return areas
+}
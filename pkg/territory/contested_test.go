@@ -0,0 +1,148 @@
+package territory
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestContestedMinOwnersMarksOnlyThreeWayOverlaps(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.EnableContested = true
+		cfg.ContestedMinOwners = 3
+		cfg.ContestedPattern = ContestedPatternSolid
+		cfg.ContestedColor = "blue"
+		cfg.ContestedAlpha = 255
+	})
+	circles := []contestedCircle{
+		// a 3-way overlap around (30, 30)
+		{owner: 1, x: 28, y: 30, r: 10},
+		{owner: 2, x: 32, y: 30, r: 10},
+		{owner: 3, x: 30, y: 33, r: 10},
+		// a 2-way overlap around (90, 90), one owner's claims piled up count once
+		{owner: 4, x: 88, y: 90, r: 10},
+		{owner: 4, x: 90, y: 92, r: 10},
+		{owner: 5, x: 92, y: 90, r: 10},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	if drawContested(img, circles) == 0 {
+		t.Fatalf("nothing marked contested")
+	}
+	blue := colorValues["blue"]
+	if got := img.RGBAAt(30, 30); got.R != blue.R || got.G != blue.G || got.B != blue.B || got.A != 255 {
+		t.Errorf("3-way overlap is %v, want the contested %v", got, blue)
+	}
+	if got := img.RGBAAt(90, 90); got.A != 0 {
+		t.Errorf("2-way overlap is %v, want it unmarked with ContestedMinOwners 3", got)
+	}
+
+	// the default threshold of 2 marks both
+	config.ContestedMinOwners = 2
+	img = image.NewRGBA(image.Rect(0, 0, 128, 128))
+	drawContested(img, circles)
+	if got := img.RGBAAt(90, 90); got.A != 255 {
+		t.Errorf("2-way overlap is %v, want it marked with ContestedMinOwners 2", got)
+	}
+}
+
+func TestContestedHatchLeavesStripesUnmarked(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.EnableContested = true
+		cfg.ContestedPattern = ContestedPatternHatch
+		cfg.ContestedAlpha = 255
+	})
+	circles := []contestedCircle{{owner: 1, x: 32, y: 32, r: 20}, {owner: 2, x: 32, y: 32, r: 20}}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	contested := drawContested(img, circles)
+	painted := 0
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			painted++
+		}
+	}
+	// 2 of every 6 diagonals
+	if painted == 0 || painted*2 > contested {
+		t.Errorf("hatch painted %d of %d contested pixels, want about a third", painted, contested)
+	}
+}
+
+// warMarkers are two foreign claims overlapping around the middle of the grid
+func warMarkers() []Marker {
+	return []Marker{
+		{tribeOrOwnerID: 1000050001, relX: 0.4, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: 1000050002, relX: 0.6, relY: 0.5, markerType: MarkerLand},
+	}
+}
+
+func TestContestedRegionRendersDistinctly(t *testing.T) {
+	markers := warMarkers()
+	const size = 128
+	for _, pattern := range []string{ContestedPatternSolid, ContestedPatternHatch} {
+		t.Run(pattern, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 1, 1
+				cfg.LandRadiusUE = 0.2 * cfg.GridSize
+				cfg.OpaqueClaims = true
+				cfg.EnableContested = true
+				cfg.ContestedPattern = pattern
+				cfg.ContestedColor = "red"
+				cfg.ContestedAlpha = 255
+			})
+			img := renderWorld(markers, MapOptions{}, size)
+			// each owner's own side keeps its color
+			for _, marker := range markers {
+				side := marker
+				side.relX += (marker.relX - 0.5) * 2
+				if got := worldPixel(img, side, size); colorDistance(got, getTribeColor(marker.tribeOrOwnerID)) != 0 {
+					t.Errorf("uncontested side of %d is %v, want its color", marker.tribeOrOwnerID, got)
+				}
+			}
+			// the overlap differs from both owners, every pixel of it with a solid fill
+			distinct, overlap := 0, 0
+			for y := size * 9 / 20; y < size*11/20; y++ {
+				for x := size * 9 / 20; x < size*11/20; x++ {
+					overlap++
+					got := img.RGBAAt(x, y)
+					if colorDistance(got, getTribeColor(markers[0].tribeOrOwnerID)) != 0 && colorDistance(got, getTribeColor(markers[1].tribeOrOwnerID)) != 0 {
+						distinct++
+					}
+				}
+			}
+			if pattern == ContestedPatternSolid && distinct != overlap {
+				t.Errorf("%d of %d overlap pixels distinct from both owners, want all", distinct, overlap)
+			}
+			if pattern == ContestedPatternHatch && (distinct == 0 || distinct == overlap) {
+				t.Errorf("%d of %d overlap pixels hatched, want stripes", distinct, overlap)
+			}
+			checkGolden(t, "contested_"+pattern, img)
+		})
+	}
+}
+
+func TestGridContestedArea(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 1
+		cfg.LandRadiusUE = 0.2 * cfg.GridSize
+		cfg.EnableContested = true
+	})
+	markers := append(warMarkers(),
+		// one owner's claims overlapping each other aren't contested
+		Marker{serverX: 1, tribeOrOwnerID: 1000050003, relX: 0.4, relY: 0.5, markerType: MarkerLand},
+		Marker{serverX: 1, tribeOrOwnerID: 1000050003, relX: 0.6, relY: 0.5, markerType: MarkerLand},
+	)
+	// the lens of two circles of radius r with centers d apart
+	r, d := 0.2, 0.2
+	want := 2*r*r*math.Acos(d/(2*r)) - d/2*math.Sqrt(4*r*r-d*d)
+
+	areas := gridContestedAreas(markers)
+	if got := areas[GridID{X: 0, Y: 0}]; math.Abs(got-want) > 0.05*want {
+		t.Errorf("contested area %.4f, want about %.4f", got, want)
+	}
+	if got, ok := areas[GridID{X: 1, Y: 0}]; ok {
+		t.Errorf("one owner's grid has contested area %v", got)
+	}
+	summaries := summarizeServers(markers, nil)
+	if summaries[0].ContestedArea != areas[GridID{X: 0, Y: 0}] || summaries[1].ContestedArea != 0 {
+		t.Errorf("/api/servers contested areas %v and %v", summaries[0].ContestedArea, summaries[1].ContestedArea)
+	}
+}
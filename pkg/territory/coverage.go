@@ -0,0 +1,164 @@
+package territory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// coverageUnclaimed marks a coverage cell no owner claims
+const coverageUnclaimed uint16 = 0xFFFF
+
+// coverageScale is how many game image pixels a coverage cell covers in each dimension
+const coverageScale = 4
+
+// MapCoverage is a low resolution ownership raster, each cell is an index into the .map owner
+// table or coverageUnclaimed
+type MapCoverage struct {
+	Width  int
+	Height int
+	Cells  []uint16 // row major
+}
+
+// coverageRenderOrder returns owner indices in the order the visual map paints them, later ones on top
+func coverageRenderOrder(owners mapOwners) []int {
+	order := make([]int, owners.Len())
+	for i := range order {
+		order[i] = i
+	}
+	size := owners.ClaimCount
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		switch {
+		case config.RenderOrder == RenderOrderSizeDescending && size(a) != size(b):
+			return size(a) > size(b)
+		case config.RenderOrder == RenderOrderSizeAscending && size(a) != size(b):
+			return size(a) < size(b)
+		}
+		return a < b // owners are sorted by ID
+	})
+	return order
+}
+
+// rasterizeCoverage stamps each owner's claims into a GameSize/coverageScale grid. A cell belongs
+// to a claim when its center is inside the claim's circle, and the cell under the claim's center
+// is always stamped so claims smaller than a cell still show up. ok is false when there are too
+// many owners to index with a uint16, err is from loading the claims
+func rasterizeCoverage(owners mapOwners, gameSize int) (coverage MapCoverage, ok bool, err error) {
+	if owners.Len() >= int(coverageUnclaimed) {
+		return coverage, false, nil
+	}
+	width := Max(1, gameSize/coverageScale)
+	coverage = MapCoverage{Width: width, Height: width, Cells: make([]uint16, width*width)}
+	for i := range coverage.Cells {
+		coverage.Cells[i] = coverageUnclaimed
+	}
+
+	// claims are in .map source pixels, cells are square in the same space
+	srcPixels := float64(mapSrcPixels(gameSize))
+	cellSize := srcPixels / float64(width)
+	srcPixelsPerServer := srcPixels / float64(Max(config.ServersX, config.ServersY))
+	landRadius := srcPixelsPerServer * config.LandRadiusUE / config.GridSize / cellSize
+	waterRadius := srcPixelsPerServer * config.WaterRadiusUE / config.GridSize / cellSize
+
+	stamp := func(claim ClaimFlagOutputEntry, radius float64, index uint16) {
+		cx, cy := float64(claim.X)/cellSize, float64(claim.Y)/cellSize
+		minX, maxX := Max(0, int(math.Floor(cx-radius))), Min(width-1, int(math.Ceil(cx+radius)))
+		minY, maxY := Max(0, int(math.Floor(cy-radius))), Min(width-1, int(math.Ceil(cy+radius)))
+		for y := minY; y <= maxY; y++ {
+			for x := minX; x <= maxX; x++ {
+				dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+				if dx*dx+dy*dy <= radius*radius {
+					coverage.Cells[y*width+x] = index
+				}
+			}
+		}
+		if x, y := int(cx), int(cy); x < width && y < width {
+			coverage.Cells[y*width+x] = index
+		}
+	}
+	for _, i := range coverageRenderOrder(owners) {
+		owner, err := owners.Owner(i)
+		if err != nil {
+			return coverage, false, err
+		}
+		for _, claim := range owner.WaterClaims {
+			stamp(claim, waterRadius, uint16(i))
+		}
+		for _, claim := range owner.LandClaims {
+			stamp(claim, landRadius, uint16(i))
+		}
+	}
+	return coverage, true, nil
+}
+
+// writeCoverage writes the section as width, height and then per row a run count followed by
+// (length, value) pairs, every field a little endian uint16
+func writeCoverage(w io.Writer, coverage MapCoverage) {
+	buf := make([]byte, 2)
+	put := func(v int) {
+		binary.LittleEndian.PutUint16(buf, uint16(v))
+		w.Write(buf)
+	}
+	put(coverage.Width)
+	put(coverage.Height)
+
+	var runs []int
+	for y := 0; y < coverage.Height; y++ {
+		row := coverage.Cells[y*coverage.Width : (y+1)*coverage.Width]
+		runs = runs[:0]
+		for x := 0; x < len(row); {
+			end := x + 1
+			for end < len(row) && row[end] == row[x] {
+				end++
+			}
+			runs = append(runs, end-x, int(row[x]))
+			x = end
+		}
+		put(len(runs) / 2)
+		for _, v := range runs {
+			put(v)
+		}
+	}
+}
+
+// readCoverage decodes a section written by writeCoverage, checking every row adds up to the width
+func readCoverage(r *bufio.Reader, ownerCount int) (MapCoverage, error) {
+	var size struct{ Width, Height uint16 }
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return MapCoverage{}, fmt.Errorf("failed to read coverage size: %v", err)
+	}
+	coverage := MapCoverage{Width: int(size.Width), Height: int(size.Height)}
+	coverage.Cells = make([]uint16, 0, coverage.Width*coverage.Height)
+	for y := 0; y < coverage.Height; y++ {
+		var runCount uint16
+		if err := binary.Read(r, binary.LittleEndian, &runCount); err != nil {
+			return coverage, fmt.Errorf("failed to read coverage row %d: %v", y, err)
+		}
+		runs := make([]uint16, 2*int(runCount))
+		if err := binary.Read(r, binary.LittleEndian, runs); err != nil {
+			return coverage, fmt.Errorf("failed to read coverage row %d: %v", y, err)
+		}
+		rowWidth := 0
+		for i := 0; i < len(runs); i += 2 {
+			length, value := int(runs[i]), runs[i+1]
+			if value != coverageUnclaimed && int(value) >= ownerCount {
+				return coverage, fmt.Errorf("coverage row %d references owner %d of %d", y, value, ownerCount)
+			}
+			rowWidth += length
+			if rowWidth > coverage.Width {
+				break
+			}
+			for j := 0; j < length; j++ {
+				coverage.Cells = append(coverage.Cells, value)
+			}
+		}
+		if rowWidth != coverage.Width {
+			return coverage, fmt.Errorf("coverage row %d is %d cells wide, expected %d", y, rowWidth, coverage.Width)
+		}
+	}
+	return coverage, nil
+}
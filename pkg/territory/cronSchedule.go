@@ -0,0 +1,188 @@
+package territory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule runs a loop at the times a cron expression ("minute hour day month weekday")
+// matches on the wall clock of its location. Times are matched by wall clock, so a time skipped
+// by a daylight saving change fires once at the same offset after the change (02:30 on
+// spring-forward day in New York fires at 03:30 EDT) and a time that happens twice when the
+// clocks go back fires only at the first
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64 // bit n set when n matches
+	anyDay, anyWeekday                     bool   // day or weekday is *, cron matches either when both are restricted
+	location                               *time.Location
+	last                                   time.Time // the previous cycle's time, the next is after it
+}
+
+// cronFields are the bounds of the expression's fields in order
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day", 1, 31},
+	{"month", 1, 12},
+	{"weekday", 0, 7},
+}
+
+func parseCronSchedule(expr string, location *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%q has %d fields, want minute hour day month weekday", expr, len(fields))
+	}
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, fmt.Errorf("%s field: %v", cronFields[i].name, err)
+		}
+	}
+	// 7 is Sunday as well as 0
+	weekdays := bits[4]
+	if weekdays&(1<<7) != 0 {
+		weekdays |= 1
+	}
+	return &cronSchedule{
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   weekdays,
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+		location:   location,
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, n, n-m, each optionally with a /step
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if slash := strings.IndexByte(part, '/'); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rangePart = part[:slash]
+		}
+		low, high := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay checks the day, month and weekday fields against a date in the location
+func (s *cronSchedule) matchesDay(date time.Time) bool {
+	if s.months&(1<<uint(date.Month())) == 0 {
+		return false
+	}
+	day := s.days&(1<<uint(date.Day())) != 0
+	weekday := s.weekdays&(1<<uint(date.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// next is the first time after after the schedule matches, zero when it never does, like on February 30th
+func (s *cronSchedule) next(after time.Time) time.Time {
+	local := after.In(s.location)
+	year, month, day := local.Date()
+	// every date repeats within 8 years, leap days included
+	for offset := 0; offset <= 8*366; offset++ {
+		// noon is on the date in every zone, midnight isn't where the clocks change at midnight
+		date := time.Date(year, month, day+offset, 12, 0, 0, 0, s.location)
+		if !s.matchesDay(date) {
+			continue
+		}
+		// a skipped wall time moves past later ones on the same day, so take the earliest
+		var earliest time.Time
+		for hour := 0; hour < 24; hour++ {
+			if s.hours&(1<<uint(hour)) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if s.minutes&(1<<uint(minute)) == 0 {
+					continue
+				}
+				t := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, s.location)
+				if t.Hour() != hour || t.Minute() != minute {
+					// time.Date moves a skipped wall time back by the gap, move it past the gap
+					wanted := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, time.UTC)
+					got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+					t = t.Add(wanted.Sub(got))
+				}
+				if t.After(after) && (earliest.IsZero() || t.Before(earliest)) {
+					earliest = t
+				}
+			}
+		}
+		if !earliest.IsZero() {
+			return earliest
+		}
+	}
+	return time.Time{}
+}
+
+// wait blocks until the next matching time, it returns false once ctx is cancelled and the loop
+// should stop. A cycle that overruns a matching time is followed by the next one, not by the
+// times it missed
+func (s *cronSchedule) wait(ctx context.Context) bool {
+	for {
+		if ctx.Err() != nil {
+			return false
+		}
+		now := clock.Now()
+		after := now
+		if s.last.After(after) {
+			after = s.last
+		}
+		due := s.next(after)
+		if due.IsZero() {
+			<-ctx.Done()
+			return false
+		}
+		timer := clock.NewTimer(due.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C():
+		}
+		// the timer runs on the monotonic clock, if the wall clock was stepped back it's early
+		if !clock.Now().Before(due) {
+			s.last = due
+			return true
+		}
+	}
+}
+
+func (s *cronSchedule) stop() {}
@@ -0,0 +1,210 @@
+package territory
+
+import (
+	"context"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustCronSchedule(t *testing.T, expr, zone string) *cronSchedule {
+	t.Helper()
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", zone, err)
+	}
+	schedule, err := parseCronSchedule(expr, location)
+	if err != nil {
+		t.Fatalf("parseCronSchedule(%q): %v", expr, err)
+	}
+	return schedule
+}
+
+// firesOn lists the times the schedule fires on the local date of day
+func firesOn(schedule *cronSchedule, day time.Time) []time.Time {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, schedule.location)
+	end := start.AddDate(0, 0, 1)
+	var fires []time.Time
+	for at := schedule.next(start.Add(-time.Nanosecond)); at.Before(end); at = schedule.next(at) {
+		fires = append(fires, at)
+	}
+	return fires
+}
+
+func TestCronScheduleAcrossDaylightSavingChanges(t *testing.T) {
+	newYork, _ := time.LoadLocation("America/New_York")
+	tests := []struct {
+		name  string
+		expr  string
+		day   time.Time
+		fires []time.Time
+	}{
+		{
+			name:  "02:30 on spring-forward day fires once after the gap",
+			expr:  "30 2 * * *",
+			day:   time.Date(2024, 3, 10, 12, 0, 0, 0, newYork),
+			fires: []time.Time{time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC)},
+		},
+		{
+			name:  "02:30 and 03:00 on spring-forward day keep their order",
+			expr:  "0,30 2-3 * * *",
+			day:   time.Date(2024, 3, 10, 12, 0, 0, 0, newYork),
+			fires: []time.Time{time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC)},
+		},
+		{
+			name:  "01:30 on fall-back day fires once",
+			expr:  "30 1 * * *",
+			day:   time.Date(2024, 11, 3, 12, 0, 0, 0, newYork),
+			fires: []time.Time{time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC)},
+		},
+		{
+			name:  "02:30 on an ordinary day",
+			expr:  "30 2 * * *",
+			day:   time.Date(2024, 3, 11, 12, 0, 0, 0, newYork),
+			fires: []time.Time{time.Date(2024, 3, 11, 6, 30, 0, 0, time.UTC)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := mustCronSchedule(t, test.expr, "America/New_York")
+			fires := firesOn(schedule, test.day)
+			if len(fires) != len(test.fires) {
+				t.Fatalf("fired %d times (%v), want %d", len(fires), fires, len(test.fires))
+			}
+			for i := range fires {
+				if !fires[i].Equal(test.fires[i]) {
+					t.Errorf("fire %d at %v, want %v", i, fires[i].UTC(), test.fires[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCronScheduleMatchesFields(t *testing.T) {
+	schedule := mustCronSchedule(t, "*/15 9-17 * * 1-5", "UTC")
+	// Saturday 2024-03-09 17:50
+	at := time.Date(2024, 3, 9, 17, 50, 0, 0, time.UTC)
+	want := []time.Time{
+		time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 11, 9, 15, 0, 0, time.UTC),
+		time.Date(2024, 3, 11, 9, 30, 0, 0, time.UTC),
+	}
+	for _, w := range want {
+		at = schedule.next(at)
+		if !at.Equal(w) {
+			t.Fatalf("next = %v, want %v", at, w)
+		}
+	}
+
+	// a restricted day and weekday match either, like cron
+	schedule = mustCronSchedule(t, "0 0 1 * 0", "UTC")
+	if got, want := schedule.next(time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC)), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next after the 1st = %v, want Sunday %v", got, want)
+	}
+
+	if got := mustCronSchedule(t, "0 0 30 2 *", "UTC").next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("February 30th fired at %v", got)
+	}
+}
+
+func TestCronScheduleRejectsBadExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCronSchedule(expr, time.UTC); err == nil {
+			t.Errorf("parseCronSchedule(%q) accepted it", expr)
+		}
+	}
+}
+
+func TestCronScheduleWaitsForTheMatchingTime(t *testing.T) {
+	fake := useFakeClock(t)
+	newYork, _ := time.LoadLocation("America/New_York")
+	fake.now = time.Date(2024, 3, 10, 0, 0, 0, 0, newYork)
+	schedule := mustCronSchedule(t, "30 2 * * *", "America/New_York")
+
+	waited := make(chan bool)
+	go func() { waited <- schedule.wait(context.Background()) }()
+	waitForTimer(t, fake)
+	// 02:30 doesn't exist that night, 02:00 EST is 03:00 EDT
+	fake.advance(2 * time.Hour)
+	select {
+	case <-waited:
+		t.Fatalf("wait returned at 03:00 EDT")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.advance(30 * time.Minute)
+	if !<-waited {
+		t.Fatalf("wait returned false at 03:30 EDT")
+	}
+
+	// the next cycle is the following night, not another one in the same one
+	go func() { waited <- schedule.wait(context.Background()) }()
+	waitForTimer(t, fake)
+	fake.advance(22 * time.Hour)
+	select {
+	case <-waited:
+		t.Fatalf("wait returned twice on spring-forward day")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.advance(time.Hour)
+	if !<-waited {
+		t.Fatalf("wait returned false the next night")
+	}
+}
+
+func TestCronScheduleStopsOnCancel(t *testing.T) {
+	useFakeClock(t)
+	schedule := mustCronSchedule(t, "* * * * *", "UTC")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if schedule.wait(ctx) {
+		t.Fatalf("wait returned true after cancellation")
+	}
+}
+
+func TestFetchScheduleFollowsConfig(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.FetchSchedule = "30 2 * * *"
+		cfg.ScheduleTimeZone = "Europe/Berlin"
+	})
+	cron, ok := newFetchSchedule().(*cronSchedule)
+	if !ok {
+		t.Fatalf("FetchSchedule didn't give a cron schedule")
+	}
+	if cron.location.String() != "Europe/Berlin" {
+		t.Errorf("schedule in %v, want Europe/Berlin", cron.location)
+	}
+
+	config.FetchSchedule = ""
+	schedule := newFetchSchedule()
+	defer schedule.stop()
+	if _, ok := schedule.(*intervalSchedule); !ok {
+		t.Errorf("no FetchSchedule gave %T, want the interval", schedule)
+	}
+
+	cfg := config
+	cfg.FetchSchedule = "30 2 * * *"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	cfg.FetchSchedule = "30 25 * * *"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Validate accepted hour 25")
+	}
+	cfg.FetchSchedule = ""
+	cfg.ScheduleTimeZone = "Mars/Olympus_Mons"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Validate accepted an unknown time zone")
+	}
+}
+
+// waitForTimer waits until a goroutine is blocked on a fake timer
+func waitForTimer(t *testing.T, fake *fakeClock) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.timerCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no timer was started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,39 @@
+package territory_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/GrapeshotGames/AtlasTerritoryMap/pkg/territory"
+)
+
+// A server manager embedding the generator renders the claims once and serves the outputs from
+// its own mux
+func Example() {
+	cfg, err := territory.LoadConfig("config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	generator, err := territory.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer generator.Close()
+
+	ctx := context.Background()
+	snapshot, err := generator.FetchOnce(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := generator.GenerateTiles(ctx, snapshot); err != nil {
+		log.Printf("Warning! %v", err)
+	}
+	if err := generator.GenerateGameMap(ctx, snapshot); err != nil {
+		log.Printf("Warning! %v", err)
+	}
+
+	mux := http.NewServeMux()
+	generator.Mount(mux)
+	log.Fatal(http.ListenAndServe(":8881", mux))
+}
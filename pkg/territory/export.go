@@ -0,0 +1,331 @@
+package territory
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// exportSchemaVersion is bumped whenever a field of ExportHeader or ExportClaim changes meaning
+// or is removed, adding fields doesn't bump it
+const exportSchemaVersion = 1
+
+// exportArtifact is where the scheduled export is written, under WWWDir
+const exportArtifact = "exports/claims.jsonl.gz"
+
+// ExportHeader is the first line of an export
+type ExportHeader struct {
+	Type          string    `json:"type"` // "header"
+	SchemaVersion int       `json:"schemaVersion"`
+	GeneratedAt   time.Time `json:"generatedAt"`
+	ServersX      int       `json:"serversX"`
+	ServersY      int       `json:"serversY"`
+	GridSize      float64   `json:"gridSize"` // world units per grid
+	Anonymized    bool      `json:"anonymized"`
+	Since         time.Time `json:"since,omitempty"` // set on incremental exports, generatedAt of the full export they follow
+	RemovedOwners []uint64  `json:"removedOwners,omitempty"`
+}
+
+// ExportClaim is one claim line of an export
+type ExportClaim struct {
+	Type        string    `json:"type"` // "claim"
+	ID          string    `json:"id"`   // CRC of the raw claim, stable across exports while it's unchanged
+	OwnerID     uint64    `json:"ownerId"`
+	OwnerName   string    `json:"ownerName,omitempty"`
+	OwnerClass  string    `json:"ownerClass"` // "tribe" or "player"
+	Grid        string    `json:"grid"`       // grid reference as shown in game, e.g. "B3"
+	ServerID    int       `json:"serverId"`   // packed x<<16|y
+	WorldX      float64   `json:"worldX"`
+	WorldY      float64   `json:"worldY"`
+	MarkerType  string    `json:"markerType"` // "land" or "water"
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+// gridReference names a grid the way the game does, a column letter and a 1-based row number
+func gridReference(x, y int) string {
+	column := ""
+	for n := x + 1; n > 0; n = (n - 1) / 26 {
+		column = string(rune('A'+(n-1)%26)) + column
+	}
+	return column + strconv.Itoa(y+1)
+}
+
+// exportClaimID is the stable ID of a raw claim
+func exportClaimID(raw string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(raw)))
+}
+
+// ownerDigests accumulates an order independent digest of each owner's claims so changed owners
+// can be found without holding the claims themselves
+type ownerDigests map[uint64]uint64
+
+func (d ownerDigests) add(owner uint64, claimID string) {
+	h := fnv.New64a()
+	h.Write([]byte(claimID))
+	d[owner] ^= h.Sum64()
+}
+
+// forEachClaim streams the claims one grid at a time, opted out owners are skipped
+func forEachClaim(client *redis.Client, optOut map[uint64]bool, fn func(grid GridID, owner uint64, raw string)) {
+	for _, grid := range fetchGrids(client) {
+		results, err := client.SMembers(fmt.Sprintf("territorymapdata:%d", grid.X<<16|grid.Y)).Result()
+		if err != nil {
+			log.Printf("Warning! %v", err)
+			continue
+		}
+		if config.DropZeroPositionMarkers {
+			results, _ = dropZeroPositionMarkers(grid.X, grid.Y, results)
+		}
+		for _, raw := range results {
+			if len(raw) < 13 {
+				continue
+			}
+			owner := binary.LittleEndian.Uint64([]byte(raw[0:8]))
+			if optOut[owner] {
+				continue
+			}
+			fn(grid, owner, raw)
+		}
+	}
+}
+
+// readExportDigests reads the owner digests of a previous full export for --since
+func readExportDigests(filename string) (ExportHeader, ownerDigests, error) {
+	var header ExportHeader
+	f, err := os.Open(filename)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return header, nil, err
+	}
+	defer gz.Close()
+
+	digests := make(ownerDigests)
+	scanner := bufio.NewScanner(gz)
+	for line := 0; scanner.Scan(); line++ {
+		if line == 0 {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" {
+				return header, nil, fmt.Errorf("%s doesn't start with an export header", filename)
+			}
+			if !header.Since.IsZero() {
+				return header, nil, fmt.Errorf("%s is incremental, --since needs a full export", filename)
+			}
+			if header.SchemaVersion != exportSchemaVersion {
+				return header, nil, fmt.Errorf("%s is schema version %d, expected %d", filename, header.SchemaVersion, exportSchemaVersion)
+			}
+			continue
+		}
+		var claim ExportClaim
+		if err := json.Unmarshal(scanner.Bytes(), &claim); err != nil {
+			return header, nil, fmt.Errorf("%s line %d: %v", filename, line+1, err)
+		}
+		digests.add(claim.OwnerID, claim.ID)
+	}
+	return header, digests, scanner.Err()
+}
+
+// ExportResult summarises a written export
+type ExportResult struct {
+	Claims int    `json:"claims"`
+	Owners int    `json:"owners"`
+	SHA256 string `json:"sha256"`
+	CRC    uint32 `json:"crc"`
+}
+
+// writeExport streams the claims as gzipped JSON lines to filename, with since only the owners
+// whose claims changed since that full export are written. The redis data is read twice for an
+// incremental export, once to find the changed owners and once to write them
+func writeExport(client *redis.Client, filename, since string) (ExportResult, error) {
+	var result ExportResult
+	optOut, _ := fetchOptOutOwners(client)
+	header := ExportHeader{
+		Type:          "header",
+		SchemaVersion: exportSchemaVersion,
+		GeneratedAt:   time.Now().UTC(),
+		ServersX:      config.ServersX,
+		ServersY:      config.ServersY,
+		GridSize:      config.GridSize,
+		Anonymized:    config.ExportAnonymize,
+	}
+
+	var changed map[uint64]bool
+	if len(since) > 0 {
+		previousHeader, previous, err := readExportDigests(since)
+		if err != nil {
+			return result, err
+		}
+		current := make(ownerDigests)
+		forEachClaim(client, optOut, func(grid GridID, owner uint64, raw string) {
+			current.add(owner, exportClaimID(raw))
+		})
+		changed = make(map[uint64]bool)
+		for owner, digest := range current {
+			if previousDigest, ok := previous[owner]; !ok || previousDigest != digest {
+				changed[owner] = true
+			}
+		}
+		for owner := range previous {
+			if _, ok := current[owner]; !ok {
+				header.RemovedOwners = append(header.RemovedOwners, owner)
+			}
+		}
+		sort.Slice(header.RemovedOwners, func(i, j int) bool { return header.RemovedOwners[i] < header.RemovedOwners[j] })
+		header.Since = previousHeader.GeneratedAt
+	}
+
+	dir := path.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return result, err
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".gz"))
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(tmpFilename)
+
+	sum := sha256.New()
+	crc := crc32.NewIEEE()
+	buffered := bufio.NewWriter(io.MultiWriter(f, sum, crc))
+	gz := gzip.NewWriter(buffered)
+	encoder := json.NewEncoder(gz)
+	if err := encoder.Encode(header); err != nil {
+		f.Close()
+		return result, err
+	}
+
+	names := make(map[uint64]string)
+	owners := make(map[uint64]bool)
+	var encodeErr error
+	forEachClaim(client, optOut, func(grid GridID, owner uint64, raw string) {
+		if encodeErr != nil || (changed != nil && !changed[owner]) {
+			return
+		}
+		bytes := []byte(raw)
+		relX := float64(binary.LittleEndian.Uint16(bytes[8:10])) / float64(math.MaxUint16)
+		relY := float64(binary.LittleEndian.Uint16(bytes[10:12])) / float64(math.MaxUint16)
+		claim := ExportClaim{
+			Type:        "claim",
+			ID:          exportClaimID(raw),
+			OwnerID:     owner,
+			OwnerClass:  "player",
+			Grid:        gridReference(grid.X, grid.Y),
+			ServerID:    grid.X<<16 | grid.Y,
+			WorldX:      (float64(grid.X) + relX) * config.GridSize,
+			WorldY:      (float64(grid.Y) + relY) * config.GridSize,
+			MarkerType:  "land",
+			GeneratedAt: header.GeneratedAt,
+		}
+		if bytes[12] == MarkerWater {
+			claim.MarkerType = "water"
+		}
+		if isTribeID(owner) {
+			claim.OwnerClass = "tribe"
+			if !config.ExportAnonymize {
+				name, ok := names[owner]
+				if !ok {
+					name = lookupTribeName(client, owner)
+					names[owner] = name
+				}
+				claim.OwnerName = name
+			}
+		}
+		encodeErr = encoder.Encode(claim)
+		owners[owner] = true
+		result.Claims++
+	})
+	if encodeErr != nil {
+		f.Close()
+		return result, encodeErr
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return result, err
+	}
+	if err := buffered.Flush(); err != nil {
+		f.Close()
+		return result, err
+	}
+	if err := f.Close(); err != nil {
+		return result, err
+	}
+
+	os.Remove(filename)
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return result, err
+	}
+	result.Owners = len(owners)
+	result.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	result.CRC = crc.Sum32()
+
+	// seed the inventory's hash cache so artifacts.json doesn't re-read the export
+	if info, err := os.Stat(filename); err == nil {
+		artifactHashes.Lock()
+		artifactHashes.byPath[filename] = artifactHash{modTime: info.ModTime(), size: info.Size(), sha256: result.SHA256}
+		artifactHashes.Unlock()
+	}
+	return result, nil
+}
+
+// runExport is the export subcommand, returning the process exit code
+func runExport(client *redis.Client, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "claims.jsonl.gz", "file to write")
+	since := flags.String("since", "", "previous full export, only owners changed since it are written")
+	flags.Parse(args)
+
+	result, err := writeExport(client, *out, *since)
+	if err != nil {
+		log.Printf("Export failed: %v", err)
+		return 1
+	}
+	js, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(js))
+	return 0
+}
+
+// exportWorker writes the scheduled export every ExportIntervalSeconds
+func exportWorker(ctx context.Context, client *redis.Client) {
+	schedule := newIntervalSchedule(time.Duration(config.ExportIntervalSeconds) * time.Second)
+	defer schedule.stop()
+	filename := path.Join(config.WWWDir, exportArtifact)
+	for {
+		if leader, _ := isLeader(); leader {
+			result, err := writeExport(client, filename, "")
+			if err != nil {
+				log.Printf("Warning! Export failed: %v", err)
+			} else {
+				log.Printf("Exported %d claims of %d owners", result.Claims, result.Owners)
+				setArtifactMeta(exportArtifact, result.CRC)
+				if err := uploadToS3(ctx, filename); err != nil {
+					log.Printf("Warning! Failed to upload %s: %v", filename, err)
+				}
+				writeArtifactInventory(ctx)
+			}
+		}
+		if !schedule.wait(ctx) {
+			return
+		}
+	}
+}
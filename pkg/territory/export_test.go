@@ -0,0 +1,197 @@
+package territory
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// readExport parses an export into its header and claims
+func readExport(t *testing.T, filename string) (ExportHeader, []ExportClaim) {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var header ExportHeader
+	var claims []ExportClaim
+	scanner := bufio.NewScanner(gz)
+	for line := 0; scanner.Scan(); line++ {
+		if line == 0 {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var claim ExportClaim
+		if err := json.Unmarshal(scanner.Bytes(), &claim); err != nil {
+			t.Fatalf("line %d: %v", line+1, err)
+		}
+		claims = append(claims, claim)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return header, claims
+}
+
+func writeTestExport(t *testing.T, client *redis.Client, filename, since string) (ExportResult, ExportHeader, []ExportClaim) {
+	t.Helper()
+	result, err := writeExport(client, filename, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, claims := readExport(t, filename)
+	return result, header, claims
+}
+
+func TestExportRoundTripMatchesAggregation(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 2, 2 })
+	useArtifactMeta(t)
+	_, client := newTestRedis(t)
+	const named, abandoned, hidden, player = 1000050001, 1000050002, 1000050003, 42
+	client.HSet("tribedata:1000050001", "TribeName", "Named")
+	addClaim(t, client, GridID{X: 0, Y: 0}, named, 0.25, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, named, 0.5, 0.75, MarkerWater)
+	addClaim(t, client, GridID{X: 1, Y: 0}, abandoned, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 0, Y: 1}, hidden, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 0, Y: 1}, player, 0.1, 0.1, MarkerLand)
+	client.SAdd("territory_optout", hidden)
+
+	filename := filepath.Join(config.WWWDir, exportArtifact)
+	result, header, claims := writeTestExport(t, client, filename, "")
+	if header.Type != "header" || header.SchemaVersion != exportSchemaVersion || header.ServersX != 2 || !header.Since.IsZero() {
+		t.Errorf("header %+v", header)
+	}
+
+	// the claims reconcile with the aggregation the outputs are made from
+	markers, _, counts := fetchClaimMarkers(client, true, nil)
+	optOut, _ := fetchOptOutOwners(client)
+	public := withoutOptedOut(markers, optOut)
+	if len(claims) != len(public) || result.Claims != len(public) || result.Owners != 3 {
+		t.Fatalf("exported %d claims (result %+v), want the %d public ones of 3 owners", len(claims), result, len(public))
+	}
+	perOwner := make(map[uint64][2]uint32)
+	for _, claim := range claims {
+		n := perOwner[claim.OwnerID]
+		if claim.MarkerType == "land" {
+			n[0]++
+		} else {
+			n[1]++
+		}
+		perOwner[claim.OwnerID] = n
+	}
+	for owner, count := range countsWithoutOptedOut(counts, optOut) {
+		if got := perOwner[owner]; got != [2]uint32{count.land, count.water} {
+			t.Errorf("owner %d exported %v land/water, aggregated %d/%d", owner, got, count.land, count.water)
+		}
+	}
+	if _, ok := perOwner[hidden]; ok {
+		t.Errorf("opted out owner was exported")
+	}
+
+	for _, claim := range claims {
+		if claim.OwnerID != named || claim.MarkerType != "water" {
+			continue
+		}
+		want := ExportClaim{Type: "claim", ID: claim.ID, OwnerID: named, OwnerName: "Named", OwnerClass: "tribe", Grid: "B2",
+			ServerID: 1<<16 | 1, WorldX: 1.5 * config.GridSize, WorldY: 1.75 * config.GridSize, MarkerType: "water", GeneratedAt: header.GeneratedAt}
+		claim.WorldX, claim.WorldY = roundTo(claim.WorldX, config.GridSize/1000), roundTo(claim.WorldY, config.GridSize/1000)
+		if !reflect.DeepEqual(claim, want) {
+			t.Errorf("claim %+v, want %+v", claim, want)
+		}
+	}
+	for _, claim := range claims {
+		if claim.OwnerID == player && (claim.OwnerClass != "player" || claim.OwnerName != "") {
+			t.Errorf("player claim %+v", claim)
+		}
+		if claim.OwnerID == abandoned && claim.OwnerName != "<abandoned>" {
+			t.Errorf("tribe without a name exported as %q", claim.OwnerName)
+		}
+	}
+
+	// the recorded hash is the file's, and artifacts.json reports it
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(data); result.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("result sha256 %s, file %x", result.SHA256, sum)
+	}
+	setArtifactMeta(exportArtifact, result.CRC)
+	found := false
+	for _, entry := range buildArtifactInventory() {
+		if entry.Key == exportArtifact {
+			found = true
+			if entry.SHA256 != result.SHA256 || entry.Size != int64(len(data)) {
+				t.Errorf("inventory lists the export as %+v", entry)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("the export isn't in the inventory")
+	}
+
+	config.ExportAnonymize = true
+	_, header, claims = writeTestExport(t, client, filename, "")
+	for _, claim := range claims {
+		if claim.OwnerName != "" {
+			t.Errorf("anonymized export named %d %q", claim.OwnerID, claim.OwnerName)
+		}
+	}
+	if !header.Anonymized {
+		t.Errorf("header doesn't say the export is anonymized")
+	}
+}
+
+// roundTo rounds v to a multiple of step, claims are stored at 16 bit precision
+func roundTo(v, step float64) float64 {
+	return float64(int64(v/step+0.5)) * step
+}
+
+func TestIncrementalExportHasOnlyChangedOwners(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 2, 2 })
+	_, client := newTestRedis(t)
+	const unchanged, grows, leaves = 1000050001, 1000050002, 1000050003
+	addClaim(t, client, GridID{X: 0, Y: 0}, unchanged, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 0}, grows, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, leaves, 0.5, 0.5, MarkerLand)
+	full := filepath.Join(t.TempDir(), "full.jsonl.gz")
+	_, fullHeader, _ := writeTestExport(t, client, full, "")
+
+	client.Del("territorymapdata:" + packedGridID(GridID{X: 1, Y: 1}))
+	addClaim(t, client, GridID{X: 0, Y: 1}, grows, 0.25, 0.25, MarkerWater)
+
+	incremental := filepath.Join(t.TempDir(), "incremental.jsonl.gz")
+	result, header, claims := writeTestExport(t, client, incremental, full)
+	if !header.Since.Equal(fullHeader.GeneratedAt) || !reflect.DeepEqual(header.RemovedOwners, []uint64{leaves}) {
+		t.Errorf("incremental header %+v, want since the full export and %d removed", header, leaves)
+	}
+	if len(claims) != 2 || result.Owners != 1 {
+		t.Fatalf("incremental export has %d claims of %d owners, want the 2 of the grown owner", len(claims), result.Owners)
+	}
+	for _, claim := range claims {
+		if claim.OwnerID != grows {
+			t.Errorf("unchanged owner %d exported", claim.OwnerID)
+		}
+	}
+
+	// incrementals chain from full exports only
+	if _, err := writeExport(client, filepath.Join(t.TempDir(), "next.jsonl.gz"), incremental); err == nil {
+		t.Errorf("export since an incremental export was accepted")
+	}
+}
@@ -0,0 +1,72 @@
+package territory
+
+import (
+	"image"
+	"math"
+
+	"github.com/GrapeshotGames/goquadtree/quadtree"
+)
+
+// fogCircle is an area kept clear of fog, in image coordinates
+type fogCircle struct {
+	x, y, r float64
+}
+
+// fogClearCircles finds the claims within FogRadiusUE of the clip, including ones whose own
+// circle doesn't reach it, as clear circles in image coordinates
+func fogClearCircles(opts *MapOptions, quadTree *quadtree.QuadTree, virtualPixelsPerServer float64, projection Projection) []fogCircle {
+	vFogRadius := virtualPixelsPerServer * config.FogRadiusUE / config.GridSize
+	bb := quadtree.BoundingBox{
+		MinX: float64(opts.virtualClip.Min.X) - vFogRadius,
+		MaxX: float64(opts.virtualClip.Max.X) + vFogRadius,
+		MinY: float64(opts.virtualClip.Min.Y) - vFogRadius,
+		MaxY: float64(opts.virtualClip.Max.Y) + vFogRadius,
+	}
+
+	var circles []fogCircle
+	for _, iVB := range quadTree.Query(bb) {
+		vb := iVB.(VirtualBounds)
+		x, y := projection.center(vb.x, vb.y)
+		circle := fogCircle{x: x, y: y, r: projection.length(vFogRadius)}
+		if isFinite(circle.x) && isFinite(circle.y) && isFinite(circle.r) {
+			circles = append(circles, circle)
+		}
+	}
+	return circles
+}
+
+// drawFog blends FogColor at FogAlpha over every pixel outside the clear circles
+func drawFog(img *image.RGBA, clear []fogCircle) {
+	size := img.Bounds().Dx()
+	clearMask := make([]bool, size*size)
+	for _, c := range clear {
+		minX, maxX := Max(0, int(math.Floor(c.x-c.r))), Min(size-1, int(math.Ceil(c.x+c.r)))
+		minY, maxY := Max(0, int(math.Floor(c.y-c.r))), Min(size-1, int(math.Ceil(c.y+c.r)))
+		for py := minY; py <= maxY; py++ {
+			dy := float64(py) + 0.5 - c.y
+			for px := minX; px <= maxX; px++ {
+				dx := float64(px) + 0.5 - c.x
+				if dx*dx+dy*dy <= c.r*c.r {
+					clearMask[py*size+px] = true
+				}
+			}
+		}
+	}
+
+	c := colorValues[config.FogColor]
+	alpha := uint32(config.FogAlpha)
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			if clearMask[py*size+px] {
+				continue
+			}
+			// premultiplied source over the existing pixel
+			i := img.PixOffset(px, py)
+			inv := 255 - alpha
+			img.Pix[i+0] = uint8((uint32(c.R)*alpha + uint32(img.Pix[i+0])*inv) / 255)
+			img.Pix[i+1] = uint8((uint32(c.G)*alpha + uint32(img.Pix[i+1])*inv) / 255)
+			img.Pix[i+2] = uint8((uint32(c.B)*alpha + uint32(img.Pix[i+2])*inv) / 255)
+			img.Pix[i+3] = uint8(alpha + uint32(img.Pix[i+3])*inv/255)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package territory
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFogCoversOnlyFarFromClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.LandRadiusUE = 70000
+		cfg.OpaqueClaims = true
+		cfg.EnableFog = true
+		cfg.FogColor = "black"
+		cfg.FogAlpha = 160
+		cfg.FogRadiusUE = 280000
+	})
+	const size = 256
+	claim := Marker{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	markers := []Marker{claim}
+	img := renderWorld(markers, MapOptions{}, size)
+
+	if got := worldPixel(img, claim, size); colorDistance(got, getTribeColor(claim.tribeOrOwnerID)) > 8 {
+		t.Errorf("claim is %v, want its unfogged color %v", got, getTribeColor(claim.tribeOrOwnerID))
+	}
+	// outside the claim but within FogRadiusUE stays clear
+	if got := worldPixel(img, Marker{relX: 0.62, relY: 0.5}, size); got.A != 0 {
+		t.Errorf("pixel near the claim is %v, want it clear", got)
+	}
+	for _, far := range []Marker{{relX: 0.9, relY: 0.9}, {relX: 0.05, relY: 0.5}, {relX: 0.5, relY: 0.8}} {
+		if got := worldPixel(img, far, size); got != (color.RGBA{A: 160}) {
+			t.Errorf("pixel at %.2f,%.2f is %v, want the fog", far.relX, far.relY, got)
+		}
+	}
+
+	// a claim just outside a tile still clears the edge of it
+	opts := MapOptions{actualPixels: size / 2, virtualPixels: size}
+	opts.virtualClip = image.Rect(size/2, 0, size, size/2)
+	markers = []Marker{{tribeOrOwnerID: 1000050001, relX: 0.45, relY: 0.25, markerType: MarkerLand}}
+	tile, _ := renderImage(&opts, createQuadTree(&opts, markers))
+	if got := tile.RGBAAt(0, size/4); got.A != 0 {
+		t.Errorf("tile edge next to a claim is %v, want it clear", got)
+	}
+	if got := tile.RGBAAt(size/2-1, size/4); got.A != 160 {
+		t.Errorf("far edge of the tile is %v, want the fog", got)
+	}
+
+	// without EnableFog nothing is fogged
+	config.EnableFog = false
+	if got := worldPixel(renderWorld([]Marker{claim}, MapOptions{}, size), Marker{relX: 0.9, relY: 0.9}, size); got.A != 0 {
+		t.Errorf("fog drawn with EnableFog off: %v", got)
+	}
+}
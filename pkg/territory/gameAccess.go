@@ -0,0 +1,164 @@
+package territory
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// GameAccessConfig restricts /gameTiles/ to the game servers, leaving the web tiles public
+type GameAccessConfig struct {
+	AllowedIPs     []string // IPs or CIDRs (IPv4 or IPv6) allowed to fetch game artifacts, empty allows any address
+	Key            string   // Required X-Atlas-Server-Key header (or key query parameter), empty for none
+	KeyInURL       bool     // Add the key as a query parameter to the URLs published to redis
+	TrustedProxies []string // IPs or CIDRs of proxies whose X-Forwarded-For is used for the client address
+}
+
+const gameKeyHeader = "X-Atlas-Server-Key"
+
+// parseIPNets parses IPs and CIDRs, single IPs become a /32 or /128. Invalid entries are
+// skipped and reported in the error
+func parseIPNets(name string, entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	var invalid []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				invalid = append(invalid, strconv.Quote(entry))
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			invalid = append(invalid, strconv.Quote(entry))
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(invalid) > 0 {
+		return nets, fmt.Errorf("%s has invalid IPs or CIDRs %s", name, strings.Join(invalid, ", "))
+	}
+	return nets, nil
+}
+
+// validate rejects invalid addresses, a typo must not leave the game artifacts open
+func (access GameAccessConfig) validate() error {
+	if _, err := parseIPNets("GameArtifactAccess.AllowedIPs", access.AllowedIPs); err != nil {
+		return err
+	}
+	_, err := parseIPNets("GameArtifactAccess.TrustedProxies", access.TrustedProxies)
+	return err
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// gameAccessHandler enforces GameArtifactAccess in front of the game artifacts
+type gameAccessHandler struct {
+	restricted bool // AllowedIPs is set, even when none of it parsed
+	allowed    []*net.IPNet
+	proxies    []*net.IPNet
+	key        string
+	next       http.Handler
+}
+
+func newGameAccessHandler(next http.Handler) http.Handler {
+	access := config.GameArtifactAccess
+	if len(access.AllowedIPs) == 0 && len(access.Key) == 0 {
+		return next
+	}
+	// Validate rejects invalid entries, this keeps the allowlist closed if it was skipped
+	allowed, err := parseIPNets("GameArtifactAccess.AllowedIPs", access.AllowedIPs)
+	if err != nil {
+		log.Printf("Error! %v, denying those entries", err)
+	}
+	proxies, err := parseIPNets("GameArtifactAccess.TrustedProxies", access.TrustedProxies)
+	if err != nil {
+		log.Printf("Error! %v, not trusting those entries", err)
+	}
+	return &gameAccessHandler{
+		restricted: len(access.AllowedIPs) > 0,
+		allowed:    allowed,
+		proxies:    proxies,
+		key:        access.Key,
+		next:       next,
+	}
+}
+
+// gameTilesAnyCase sends the paths the mux pattern missed whose first segment is gameTiles in
+// another case through the game access check too. http.Dir serves them from the gameTiles
+// directory on case-insensitive filesystems, like the Windows deployments' NTFS
+type gameTilesAnyCase struct {
+	gameTiles http.Handler
+	next      http.Handler
+}
+
+func (g *gameTilesAnyCase) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segment := strings.SplitN(strings.TrimPrefix(path.Clean(r.URL.Path), "/"), "/", 2)[0]
+	if strings.EqualFold(segment, "gameTiles") {
+		g.gameTiles.ServeHTTP(w, r)
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+// clientIP is the connecting address, or when that is a trusted proxy the right-most
+// X-Forwarded-For address that isn't one
+func (g *gameAccessHandler) clientIP(r *http.Request) net.IP {
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil || !ipInNets(ip, g.proxies) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !ipInNets(hop, g.proxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func (g *gameAccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.restricted {
+		ip := g.clientIP(r)
+		if ip == nil || !ipInNets(ip, g.allowed) {
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+	if len(g.key) > 0 {
+		key := r.Header.Get(gameKeyHeader)
+		if len(key) == 0 {
+			key = r.URL.Query().Get("key")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(g.key)) != 1 {
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+	g.next.ServeHTTP(w, r)
+}
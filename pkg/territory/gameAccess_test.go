@@ -0,0 +1,181 @@
+package territory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// getGameMap fetches world.map from addr with the given headers
+func getGameMap(handler http.Handler, target, addr string, headers map[string]string) int {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = addr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGameAccessAllowlistMatchesCIDRs(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GameArtifactAccess.AllowedIPs = []string{"10.1.0.0/16", "192.0.2.7", "2001:db8::/32", "not-an-ip"}
+	})
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	writeOutput(t, "territoryTiles/0/0/0.png", []byte("png"))
+	handler := newHTTPHandler(nil)
+
+	for _, test := range []struct {
+		addr string
+		code int
+	}{
+		{"10.1.200.3:5000", http.StatusOK},
+		{"10.2.0.1:5000", http.StatusForbidden},
+		{"192.0.2.7:5000", http.StatusOK},
+		{"192.0.2.8:5000", http.StatusForbidden},
+		{"[2001:db8:1::5]:5000", http.StatusOK},
+		{"[2001:db9::5]:5000", http.StatusForbidden},
+		{"[::ffff:10.1.0.9]:5000", http.StatusOK},
+	} {
+		if code := getGameMap(handler, "/gameTiles/world.map", test.addr, nil); code != test.code {
+			t.Errorf("world.map from %s is %d, want %d", test.addr, code, test.code)
+		}
+	}
+	// the web tiles stay public
+	if code := getGameMap(handler, "/territoryTiles/0/0/0.png", "10.2.0.1:5000", nil); code != http.StatusOK {
+		t.Errorf("tile from outside the allowlist is %d, want 200", code)
+	}
+}
+
+func TestGameAccessRequiresTheKey(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.GameArtifactAccess.Key = "s3cret" })
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	handler := newHTTPHandler(nil)
+
+	for _, test := range []struct {
+		name    string
+		target  string
+		headers map[string]string
+		code    int
+	}{
+		{"no key", "/gameTiles/world.map", nil, http.StatusForbidden},
+		{"header", "/gameTiles/world.map", map[string]string{gameKeyHeader: "s3cret"}, http.StatusOK},
+		{"wrong header", "/gameTiles/world.map", map[string]string{gameKeyHeader: "guess"}, http.StatusForbidden},
+		{"query", "/gameTiles/world.map?t=1&key=s3cret", nil, http.StatusOK},
+		{"wrong query", "/gameTiles/world.map?key=s3cre", nil, http.StatusForbidden},
+	} {
+		if code := getGameMap(handler, test.target, "192.0.2.1:5000", test.headers); code != test.code {
+			t.Errorf("%s: %d, want %d", test.name, code, test.code)
+		}
+	}
+}
+
+func TestGameAccessCoversEveryCaseOfGameTiles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.GameArtifactAccess.Key = "s3cret" })
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	writeOutput(t, "robots.txt", []byte("page"))
+	handler := newHTTPHandler(nil)
+
+	// a case-insensitive filesystem serves these from gameTiles
+	for _, target := range []string{"/GameTiles/world.map", "/GAMETILES/world.map", "/gametiles/", "/gameTILES"} {
+		if code := getGameMap(handler, target, "192.0.2.1:5000", nil); code != http.StatusForbidden {
+			t.Errorf("%s without the key: %d, want 403", target, code)
+		}
+		if code := getGameMap(handler, target, "192.0.2.1:5000", map[string]string{gameKeyHeader: "s3cret"}); code == http.StatusForbidden {
+			t.Errorf("%s with the key: 403", target)
+		}
+	}
+	// the rest of the files stay public
+	if code := getGameMap(handler, "/robots.txt", "192.0.2.1:5000", nil); code != http.StatusOK {
+		t.Errorf("robots.txt without the key: %d, want 200", code)
+	}
+}
+
+func TestGameAccessKeyInPublishedURLs(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GameArtifactAccess.Key = "a b&c"
+		cfg.GameArtifactAccess.KeyInURL = true
+	})
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	_, client := newTestRedis(t)
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 7); !written {
+		t.Fatalf("URLs weren't written")
+	}
+	published, err := client.HGet("territory_urls", "world").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(published, "/gameTiles/world.map?t=7&key=a+b%26c") {
+		t.Fatalf("published %q, want the escaped key in the query", published)
+	}
+
+	// the published URL gets through the check
+	target := published[strings.Index(published, "/gameTiles/"):]
+	if code := getGameMap(newHTTPHandler(nil), target, "192.0.2.1:5000", nil); code != http.StatusOK {
+		t.Errorf("published URL is %d, want 200", code)
+	}
+}
+
+func TestGameAccessTrustsOnlyConfiguredProxies(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GameArtifactAccess.AllowedIPs = []string{"203.0.113.0/24"}
+		cfg.GameArtifactAccess.TrustedProxies = []string{"10.0.0.0/8", "fd00::/8"}
+	})
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	handler := newHTTPHandler(nil)
+
+	for _, test := range []struct {
+		name string
+		addr string
+		xff  string
+		code int
+	}{
+		{"trusted proxy forwards an allowed client", "10.0.0.1:5000", "203.0.113.9", http.StatusOK},
+		{"trusted IPv6 proxy", "[fd00::1]:5000", "203.0.113.9", http.StatusOK},
+		{"chain of trusted proxies", "10.0.0.1:5000", "203.0.113.9, 10.0.0.2", http.StatusOK},
+		{"spoofed hop left of an untrusted one", "10.0.0.1:5000", "203.0.113.9, 198.51.100.4", http.StatusForbidden},
+		{"untrusted peer can't claim an address", "198.51.100.4:5000", "203.0.113.9", http.StatusForbidden},
+		{"allowed peer without a proxy", "203.0.113.9:5000", "", http.StatusOK},
+		{"trusted proxy forwarding nothing", "10.0.0.1:5000", "", http.StatusForbidden},
+	} {
+		headers := map[string]string{}
+		if test.xff != "" {
+			headers["X-Forwarded-For"] = test.xff
+		}
+		if code := getGameMap(handler, "/gameTiles/world.map", test.addr, headers); code != test.code {
+			t.Errorf("%s: %d, want %d", test.name, code, test.code)
+		}
+	}
+}
+
+func TestGameAccessInvalidAllowlistStaysClosed(t *testing.T) {
+	useLogBuffer(t)
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GameArtifactAccess.AllowedIPs = []string{"10.0.0.0/33", "10.0.0.1O"}
+	})
+	writeOutput(t, "gameTiles/world.map", []byte("map"))
+	handler := newHTTPHandler(nil)
+	for _, addr := range []string{"10.0.0.1:5000", "198.51.100.4:5000", "[::1]:5000"} {
+		if code := getGameMap(handler, "/gameTiles/world.map", addr, nil); code != http.StatusForbidden {
+			t.Errorf("world.map from %s with no valid allowlist entry is %d, want 403", addr, code)
+		}
+	}
+
+	for _, access := range []GameAccessConfig{
+		{AllowedIPs: []string{"10.0.0.0/8", "10.0.0.0/33"}},
+		{AllowedIPs: []string{"10.0.0.0/8"}, TrustedProxies: []string{"proxy.internal"}},
+	} {
+		cfg := config
+		cfg.GameArtifactAccess = access
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "GameArtifactAccess") {
+			t.Errorf("Validate of %+v returned %v, want an error naming the entry", access, err)
+		}
+	}
+	cfg := config
+	cfg.GameArtifactAccess = GameAccessConfig{AllowedIPs: []string{" 10.0.0.0/8", "2001:db8::1"}, TrustedProxies: []string{"192.0.2.1"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate of valid entries: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package territory
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// GenerationResult is everything the API serves from one game cycle. It is built during the cycle
+// and published whole once the cycle completes, never modified afterwards, so a request that
+// holds one returns values that all come from the same snapshot. Parts a cycle didn't recompute
+// are carried over from the previous result
+type GenerationResult struct {
+	CRC         uint32
+	Stats       []publicStat // /api/stats, nil before the first snapshot
+	Servers     []byte       // /api/servers JSON, nil before the first snapshot
+	Leaderboard *Leaderboard // nil with EnableTopTribes off
+	Diff        *MarkerDiff  // changes from the snapshot before, nil until there are two
+	Markers     []Marker     // the public snapshot in a stable order, for /api/markers
+	FetchedAt   time.Time    // when Markers was fetched, zero before the first snapshot
+}
+
+// currentGeneration holds the last published *GenerationResult
+var currentGeneration atomic.Value
+
+// latestGeneration is the last completed cycle's result, nil before the first
+func latestGeneration() *GenerationResult {
+	result, _ := currentGeneration.Load().(*GenerationResult)
+	return result
+}
+
+// nextGeneration starts a cycle's result from the last published one
+func nextGeneration() *GenerationResult {
+	if previous := latestGeneration(); previous != nil {
+		next := *previous
+		return &next
+	}
+	return &GenerationResult{}
+}
+
+// publishGeneration makes a completed cycle's result visible to the API, requests already
+// holding the previous one finish with it
+func publishGeneration(result *GenerationResult) {
+	currentGeneration.Store(result)
+}
+
+// setGenerationHeader tags a response with the CRC of the result it was served from
+func setGenerationHeader(w http.ResponseWriter, result *GenerationResult) {
+	w.Header().Set("X-Atlas-Generation-CRC", fmt.Sprintf("%08x", result.CRC))
+}
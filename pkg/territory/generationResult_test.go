@@ -0,0 +1,199 @@
+package territory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// generationFixture is a result and what every API response served from it must report
+type generationFixture struct {
+	result       *GenerationResult
+	claims       int
+	largestTribe int // claims of the tribe with the most
+	topTribe     int // claims of the tribe ranked first by score
+}
+
+// buildGeneration builds a result the way a game cycle does, from count claims
+func buildGeneration(t *testing.T, crc uint32, count int) generationFixture {
+	t.Helper()
+	_, client := newTestRedis(t)
+	markers := worldClaims(count)
+	counts := make(map[uint64]*TribeCount)
+	for _, marker := range markers {
+		countTribeClaim(counts, marker)
+	}
+	result := &GenerationResult{CRC: crc, Stats: computePublicStats(markers, nil), Markers: sortedPublicMarkers(markers, nil)}
+	result.Servers, _ = json.Marshal(summarizeServers(markers, nil))
+	result.Leaderboard, _ = publishTopTribes(client, markers, counts, nil, nil)
+	result.FetchedAt = time.Now().UTC()
+	largest := 0
+	for _, count := range counts {
+		largest = Max(largest, int(count.count))
+	}
+	return generationFixture{result: result, claims: count, largestTribe: largest, topTribe: int(result.Leaderboard.entries[0].Count)}
+}
+
+// checkGenerationResponse checks a response agrees with the fixture of the generation it's tagged with
+func checkGenerationResponse(path string, body []byte, fixture generationFixture) error {
+	switch path {
+	case "/api/markers":
+		var markers []MarkerJSON
+		if err := json.Unmarshal(body, &markers); err != nil {
+			return err
+		}
+		if len(markers) != fixture.claims {
+			return fmt.Errorf("%d markers, want %d", len(markers), fixture.claims)
+		}
+	case "/api/stats":
+		var stats map[string]int
+		if err := json.Unmarshal(body, &stats); err != nil {
+			return err
+		}
+		if stats["totalClaims"] != fixture.claims || stats["largestTribeClaims"] != fixture.largestTribe {
+			return fmt.Errorf("stats %v, want %d claims and %d for the largest tribe", stats, fixture.claims, fixture.largestTribe)
+		}
+	case "/api/servers":
+		var servers []ServerSummary
+		if err := json.Unmarshal(body, &servers); err != nil {
+			return err
+		}
+		claims := 0
+		for _, server := range servers {
+			claims += server.Claims
+		}
+		if claims != fixture.claims {
+			return fmt.Errorf("servers add up to %d claims, want %d", claims, fixture.claims)
+		}
+	case "/api/topTribes.csv":
+		rows, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+		if err != nil {
+			return err
+		}
+		if len(rows) < 2 {
+			return fmt.Errorf("no tribes ranked")
+		}
+		if top, _ := strconv.Atoi(rows[1][3]); top != fixture.topTribe {
+			return fmt.Errorf("top tribe has %s claims, want %d", rows[1][3], fixture.topTribe)
+		}
+	}
+	return nil
+}
+
+// TestAPIServesOneGenerationDuringSwaps reads every API while generations are published, each
+// response must match the generation its CRC header names. Run with -race
+func TestAPIServesOneGenerationDuringSwaps(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.EnableTopTribes = true
+		cfg.StatsFields = []string{"totalClaims", "largestTribeClaims"}
+	})
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+
+	fixtures := make(map[string]generationFixture)
+	var results []*GenerationResult
+	for n := 1; n <= 5; n++ {
+		fixture := buildGeneration(t, uint32(n), 40*n)
+		fixtures[fmt.Sprintf("%08x", n)] = fixture
+		results = append(results, fixture.result)
+	}
+	publishGeneration(results[0])
+
+	handler := newHTTPHandler(nil)
+	done := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				publishGeneration(results[i%len(results)])
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	// each reader keeps going until it has been served every generation
+	paths := []string{"/api/markers", "/api/stats", "/api/servers", "/api/topTribes.csv"}
+	errs := make(chan error, len(paths))
+	var readers sync.WaitGroup
+	for _, path := range paths {
+		readers.Add(1)
+		go func(path string) {
+			defer readers.Done()
+			seen := make(map[string]bool)
+			deadline := time.Now().Add(5 * time.Second)
+			for i := 0; i < 200 || len(seen) < len(fixtures); i++ {
+				if time.Now().After(deadline) {
+					errs <- fmt.Errorf("%s was only served from generations %v, the swaps didn't overlap the reads", path, seen)
+					return
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != http.StatusOK {
+					errs <- fmt.Errorf("%s returned %d: %s", path, w.Code, w.Body.String())
+					return
+				}
+				crc := w.Header().Get("X-Atlas-Generation-CRC")
+				fixture, ok := fixtures[crc]
+				if !ok {
+					errs <- fmt.Errorf("%s tagged with unknown generation %q", path, crc)
+					return
+				}
+				if err := checkGenerationResponse(path, w.Body.Bytes(), fixture); err != nil {
+					errs <- fmt.Errorf("%s of generation %s: %v", path, crc, err)
+					return
+				}
+				seen[crc] = true
+			}
+		}(path)
+	}
+	readers.Wait()
+	close(done)
+	<-swapped
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestNextGenerationLeavesPublishedResultAlone checks a cycle building its result can't change
+// the one requests are still reading
+func TestNextGenerationLeavesPublishedResultAlone(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.EnableTopTribes = true })
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+
+	first := buildGeneration(t, 1, 40)
+	publishGeneration(first.result)
+	held := latestGeneration()
+
+	next := nextGeneration()
+	second := buildGeneration(t, 2, 80)
+	next.Stats, next.Markers, next.Servers = second.result.Stats, second.result.Markers, second.result.Servers
+	next.CRC = 2
+
+	if held.CRC != 1 || len(held.Markers) != 40 || held.Leaderboard != first.result.Leaderboard {
+		t.Errorf("building the next generation changed the published one: CRC %d with %d markers", held.CRC, len(held.Markers))
+	}
+	if next.Leaderboard != first.result.Leaderboard {
+		t.Errorf("the leaderboard the cycle didn't recompute wasn't carried over")
+	}
+	if latestGeneration() != held {
+		t.Errorf("the next generation was visible before it was published")
+	}
+	publishGeneration(next)
+	if latestGeneration().CRC != 2 || held.CRC != 1 {
+		t.Errorf("publishing swapped in CRC %d and left the held result at %d", latestGeneration().CRC, held.CRC)
+	}
+}
@@ -0,0 +1,308 @@
+package territory
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// GenerationState is the generation progress kept in the state store so an interrupted tile
+// cycle can resume. It was the whole StateFile before the state store, legacy files are migrated
+type GenerationState struct {
+	SettingsHash uint32          `json:"settingsHash"`          // renderSettingsHash the tiles were generated with
+	ZoomCrcs     map[uint]uint32 `json:"zoomCrcs"`              // zoom -> marker CRC of its completed tiles
+	ZoomDigests  map[uint]uint32 `json:"zoomDigests,omitempty"` // zoom -> tilesDigest of its completed tiles
+
+	Artifacts map[string]ArtifactMeta `json:"artifacts,omitempty"` // freshness of generated files
+}
+
+// generationZooms is the generation/zooms state, saved by the tiles worker only
+type generationZooms struct {
+	SettingsHash uint32          `json:"settingsHash"`
+	ZoomCrcs     map[uint]uint32 `json:"zoomCrcs"`
+	ZoomDigests  map[uint]uint32 `json:"zoomDigests,omitempty"`
+}
+
+// tileProgress is the zooms the tiles worker completed
+type tileProgress struct {
+	sync.Mutex
+	zoomCrcs    map[uint]uint32 // zoom -> marker CRC of its completed tiles
+	zoomDigests map[uint]uint32 // zoom -> tilesDigest of its completed tiles, checked before resuming
+	// grid CRCs each zoom was rendered from by this process, zooms without one render every tile
+	zoomGridCrcs map[uint]map[GridID]uint32
+}
+
+func newTileProgress() *tileProgress {
+	return &tileProgress{
+		zoomCrcs:     make(map[uint]uint32),
+		zoomDigests:  make(map[uint]uint32),
+		zoomGridCrcs: make(map[uint]map[GridID]uint32),
+	}
+}
+
+// complete records the zoom's tiles as rendered from crc, returning false when they can't be read
+// back and the zoom has to render again next cycle
+func (p *tileProgress) complete(tilePath string, zoom uint, crc uint32, grids map[GridID]uint32) bool {
+	digest, err := tilesDigest(tilePath, zoom)
+	if err != nil {
+		log.Printf("Warning! zoom %d rendered but its tiles can't be read back: %v", zoom, err)
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.zoomCrcs[zoom] = crc
+	p.zoomDigests[zoom] = digest
+	p.zoomGridCrcs[zoom] = grids
+	return true
+}
+
+// regenerated records the zoom's tiles of grid as re-rendered from the fresh grids, the zoom
+// becomes current for crc, and regenerated returns true, once every grid it was rendered from
+// matches them
+func (p *tileProgress) regenerated(tilePath string, zoom uint, grid GridID, grids map[GridID]uint32, crc uint32) bool {
+	p.Lock()
+	defer p.Unlock()
+	previous, rendered := p.zoomGridCrcs[zoom]
+	if _, complete := p.zoomCrcs[zoom]; !complete && !rendered {
+		return false // nothing recorded, the next cycle renders every tile anyway
+	}
+	// the tiles changed on disk, a complete zoom stays complete with them
+	digest, err := tilesDigest(tilePath, zoom)
+	if err != nil {
+		log.Printf("Warning! zoom %d regenerated but its tiles can't be read back: %v", zoom, err)
+		delete(p.zoomCrcs, zoom)
+		delete(p.zoomDigests, zoom)
+		return false
+	}
+	if _, complete := p.zoomCrcs[zoom]; complete {
+		p.zoomDigests[zoom] = digest
+	}
+	if !rendered {
+		return false // rendered by an earlier process, the next change renders every tile
+	}
+
+	// the map is shared with the other zooms rendered from the same snapshot
+	updated := make(map[GridID]uint32, len(previous))
+	for id, gridCrc := range previous {
+		updated[id] = gridCrc
+	}
+	if gridCrc, ok := grids[grid]; ok {
+		updated[grid] = gridCrc
+	} else {
+		delete(updated, grid)
+	}
+	p.zoomGridCrcs[zoom] = updated
+	if len(changedGrids(updated, grids)) > 0 {
+		return false
+	}
+	p.zoomCrcs[zoom] = crc
+	p.zoomDigests[zoom] = digest
+	return true
+}
+
+// renderSettingsHash covers every config value that changes tile pixels, tiles generated under
+// different settings are never reused
+func renderSettingsHash() uint32 {
+	settings := struct {
+		ServersX, ServersY  int
+		TileSize            int
+		MaxZoom             uint
+		GridSize            float64
+		LandRadiusUE        float64
+		WaterRadiusUE       float64
+		CircleAlpha         uint8
+		EnableClaimTrend    bool
+		ClaimGrowthColor    string
+		ClaimShrinkColor    string
+		ClaimTrendMaxBlend  float64
+		ClaimOutlineOnly    bool
+		ClaimOutlineWidth   float64
+		OpaqueClaims        bool
+		MapRotation         int
+		MapFlipHorizontal   bool
+		MapFlipVertical     bool
+		RenderOrder         string
+		PerCircleAlpha      bool
+		ClaimAlphaCap       uint8
+		EnableContested     bool
+		ContestedColor      string
+		ContestedAlpha      uint8
+		ContestedPattern    string
+		ContestedMinOwners  int
+		SmallClaimPolicy    string
+		SmallClaimMinPixels float64
+		Regions             []RegionConfig
+		EnableFog           bool
+		FogColor            string
+		FogAlpha            uint8
+		FogRadiusUE         float64
+		CoincidentPolicy    string
+		CoincidentOffset    float64
+		TribeColorMode      string
+		TribeColorSat       float64
+		TribeColorValue     float64
+		ClaimColorBy        string
+		LandClaimColor      string
+		WaterClaimColor     string
+		ClaimFalloff        string
+		Projection          int
+		SharedTribeColors   string
+		TileBoundsOnly      bool
+		TileBoundsMargin    int
+	}{
+		config.ServersX, config.ServersY,
+		config.TileSize,
+		config.MaxZoom,
+		config.GridSize,
+		config.LandRadiusUE,
+		config.WaterRadiusUE,
+		config.CircleAlpha,
+		config.EnableClaimTrend,
+		config.ClaimGrowthColor,
+		config.ClaimShrinkColor,
+		config.ClaimTrendMaxBlend,
+		config.ClaimOutlineOnly,
+		config.ClaimOutlineWidth,
+		config.OpaqueClaims,
+		config.MapRotation,
+		config.MapFlipHorizontal,
+		config.MapFlipVertical,
+		config.RenderOrder,
+		config.PerCircleAlpha,
+		config.ClaimAlphaCap,
+		config.EnableContested,
+		config.ContestedColor,
+		config.ContestedAlpha,
+		config.ContestedPattern,
+		config.ContestedMinOwners,
+		config.SmallClaimPolicy,
+		config.SmallClaimMinPixels,
+		config.Regions,
+		config.EnableFog,
+		config.FogColor,
+		config.FogAlpha,
+		config.FogRadiusUE,
+		config.CoincidentPolicy,
+		config.CoincidentOffsetPixels,
+		config.TribeColorMode,
+		config.TribeColorSaturation,
+		config.TribeColorValue,
+		config.ClaimColorBy,
+		config.LandClaimColor,
+		config.WaterClaimColor,
+		config.ClaimFalloff,
+		projectionVersion,
+		config.SharedTribeColorsKey,
+		config.TileBoundsOnly,
+		config.TileBoundsMarginTiles,
+	}
+	js, _ := json.Marshal(settings)
+	return crc32.ChecksumIEEE(js)
+}
+
+// aggregationSettingsHash covers the config values that change leaderboards but not tile pixels,
+// a change re-derives the leaderboards without regenerating tiles
+func aggregationSettingsHash() uint32 {
+	js, _ := json.Marshal(config.ClaimWeights)
+	return crc32.ChecksumIEEE(js)
+}
+
+// saveGenerationState saves the artifact metadata to the state store, and the tiles worker's
+// progress unless it's nil
+func saveGenerationState(progress *tileProgress) {
+	if progress != nil {
+		progress.Lock()
+		err := stateStore.Set("generation", "zooms", generationZooms{SettingsHash: renderSettingsHash(), ZoomCrcs: progress.zoomCrcs, ZoomDigests: progress.zoomDigests})
+		progress.Unlock()
+		if err != nil {
+			log.Printf("Warning! %v", err)
+		}
+	}
+	if err := stateStore.Set("generation", "artifacts", artifactMetaSnapshot()); err != nil {
+		log.Printf("Warning! %v", err)
+	}
+}
+
+// readGenerationState reads the generation state from store, ok is false if nothing was saved
+func readGenerationState(store StateStore) (state GenerationState, ok bool) {
+	var zooms generationZooms
+	hasZooms, err := store.Get("generation", "zooms", &zooms)
+	if err != nil {
+		log.Printf("Warning! ignoring %v", err)
+	}
+	hasArtifacts, err := store.Get("generation", "artifacts", &state.Artifacts)
+	if err != nil {
+		log.Printf("Warning! ignoring %v", err)
+	}
+	state.SettingsHash, state.ZoomCrcs, state.ZoomDigests = zooms.SettingsHash, zooms.ZoomCrcs, zooms.ZoomDigests
+	return state, hasZooms || hasArtifacts
+}
+
+// restoreGenerationState loads artifact metadata before the workers start
+func restoreGenerationState() {
+	state, ok := readGenerationState(stateStore)
+	if !ok {
+		return
+	}
+	restoreArtifactMeta(state.Artifacts)
+}
+
+// loadTileProgress returns the completed zooms from a previous run, dropping any whose render
+// settings changed or whose tiles on disk no longer match the digest recorded when they completed
+func loadTileProgress(tilePath string) *tileProgress {
+	progress := newTileProgress()
+	state, ok := readGenerationState(stateStore)
+	if !ok {
+		return progress
+	}
+	if state.SettingsHash != renderSettingsHash() {
+		log.Println("Render settings changed since last run, regenerating all tiles")
+		return progress
+	}
+
+	for zoom, crc := range state.ZoomCrcs {
+		recorded, ok := state.ZoomDigests[zoom]
+		if zoom >= config.MaxZoom || !ok {
+			continue
+		}
+		if digest, err := tilesDigest(tilePath, zoom); err != nil || digest != recorded {
+			log.Printf("Zoom %d tiles changed since they were generated, regenerating it", zoom)
+			continue
+		}
+		progress.zoomCrcs[zoom] = crc
+		progress.zoomDigests[zoom] = recorded
+	}
+	return progress
+}
+
+// tilesDigest is the CRC of every tile of the zoom level in tile order. Missing tiles count as
+// missing rather than failing, TileBoundsOnly never writes the tiles outside its bounds
+func tilesDigest(tilePath string, zoom uint) (uint32, error) {
+	digest := crc32.NewIEEE()
+	tiles := 1 << zoom
+	var length [4]byte
+	for tileX := 0; tileX < tiles; tileX++ {
+		for tileY := 0; tileY < tiles; tileY++ {
+			filename := path.Join(tilePath, strconv.Itoa(int(zoom)), strconv.Itoa(tileX), strconv.Itoa(tileY)+".png")
+			data, err := ioutil.ReadFile(filename)
+			if os.IsNotExist(err) {
+				binary.LittleEndian.PutUint32(length[:], math.MaxUint32)
+				digest.Write(length[:])
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			binary.LittleEndian.PutUint32(length[:], uint32(len(data)))
+			digest.Write(length[:])
+			digest.Write(data)
+		}
+	}
+	return digest.Sum32(), nil
+}
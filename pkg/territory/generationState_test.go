@@ -0,0 +1,164 @@
+package territory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// cancelAfter is cancelled once Err has been asked checks times, generateTileRange asks before
+// every tile so it kills a cycle partway through
+type cancelAfter struct {
+	context.Context
+	checks int32
+}
+
+func (c *cancelAfter) Err() error {
+	if atomic.AddInt32(&c.checks, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// resetTileCounts forgets every zoom's counts so a test sees which zooms the next cycle rendered
+func resetTileCounts() {
+	tileCounts.Lock()
+	tileCounts.zooms = make(map[uint]ZoomTileCount)
+	tileCounts.Unlock()
+}
+
+func renderedZooms() []uint {
+	var zooms []uint
+	for _, count := range getZoomTileCounts() {
+		zooms = append(zooms, count.Zoom)
+	}
+	return zooms
+}
+
+func useTestStateStore(t *testing.T) {
+	previous := stateStore
+	stateStore = newFileStateStore("", nil)
+	t.Cleanup(func() { stateStore = previous })
+}
+
+func TestResumeRendersOnlyUnfinishedZooms(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	useTestStateStore(t)
+	resetTileCounts()
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	const crc = 7
+
+	// zoom 2 has 16 tiles so it can't finish before the cycle is killed
+	progress := loadTileProgress(tilePath)
+	ctx := &cancelAfter{Context: context.Background(), checks: 8}
+	generateZooms(ctx, tilePath, dueZooms(progress, crc, 0), testMarkers(), crc, nil, progress)
+	if _, ok := progress.zoomCrcs[2]; ok {
+		t.Fatalf("zoom 2 recorded as complete after the cycle was killed")
+	}
+
+	// the restarted worker trusts exactly the zooms that finished
+	resumed := loadTileProgress(tilePath)
+	if !reflect.DeepEqual(resumed.zoomCrcs, progress.zoomCrcs) {
+		t.Fatalf("resumed with %v, want the finished zooms %v", resumed.zoomCrcs, progress.zoomCrcs)
+	}
+	var remainder []uint
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		if _, ok := progress.zoomCrcs[zoom]; !ok {
+			remainder = append(remainder, zoom)
+		}
+	}
+	zooms := dueZooms(resumed, crc, 0)
+	if !reflect.DeepEqual(zooms, remainder) {
+		t.Fatalf("resumed cycle due zooms %v, want %v", zooms, remainder)
+	}
+
+	resetTileCounts()
+	generateZooms(context.Background(), tilePath, zooms, testMarkers(), crc, nil, resumed)
+	if rendered := renderedZooms(); !reflect.DeepEqual(rendered, remainder) {
+		t.Fatalf("resumed cycle rendered zooms %v, want only %v", rendered, remainder)
+	}
+	if zooms := dueZooms(resumed, crc, 0); len(zooms) != 0 {
+		t.Fatalf("zooms %v still due after the resumed cycle", zooms)
+	}
+}
+
+func TestResumeRegeneratesZoomsWhoseTilesChanged(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	useTestStateStore(t)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	const crc = 7
+
+	progress := loadTileProgress(tilePath)
+	generateZooms(context.Background(), tilePath, dueZooms(progress, crc, 0), testMarkers(), crc, nil, progress)
+	if err := ioutil.WriteFile(filepath.Join(tilePath, "1", "0", "1.png"), []byte("not a tile"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := loadTileProgress(tilePath)
+	if zooms := dueZooms(resumed, crc, 0); !reflect.DeepEqual(zooms, []uint{1}) {
+		t.Fatalf("due zooms %v, want the zoom whose tile changed", zooms)
+	}
+}
+
+func TestResumeIgnoresZoomsWithoutDigest(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 2 })
+	useTestStateStore(t)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	generateZooms(context.Background(), tilePath, []uint{0, 1}, testMarkers(), 7, nil, newTileProgress())
+
+	// state saved before digests were recorded can't be verified
+	legacy := generationZooms{SettingsHash: renderSettingsHash(), ZoomCrcs: map[uint]uint32{0: 7, 1: 7}}
+	if err := stateStore.Set("generation", "zooms", legacy); err != nil {
+		t.Fatal(err)
+	}
+	if resumed := loadTileProgress(tilePath); len(resumed.zoomCrcs) != 0 {
+		t.Fatalf("resumed %v, want nothing trusted without a digest", resumed.zoomCrcs)
+	}
+}
+
+func TestResumeTrustsZoomsWithTilesOutsideBounds(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 4
+		cfg.TileBoundsOnly = true
+		cfg.TileBoundsMarginTiles = 0
+	})
+	useTestStateStore(t)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	markers := []Marker{{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand}}
+
+	progress := newTileProgress()
+	generateZooms(context.Background(), tilePath, []uint{0, 1, 2, 3}, markers, 7, nil, progress)
+	if len(progress.zoomCrcs) != 4 {
+		t.Fatalf("completed zooms %v, want every zoom with its tiles outside the bounds never written", progress.zoomCrcs)
+	}
+	if resumed := loadTileProgress(tilePath); !reflect.DeepEqual(resumed.zoomCrcs, progress.zoomCrcs) {
+		t.Fatalf("resumed %v, want %v", resumed.zoomCrcs, progress.zoomCrcs)
+	}
+
+	if err := os.Remove(filepath.Join(tilePath, "3", "0", "0.png")); err != nil {
+		t.Fatal(err)
+	}
+	if zooms := dueZooms(loadTileProgress(tilePath), 7, 0); !reflect.DeepEqual(zooms, []uint{3}) {
+		t.Fatalf("due zooms %v, want the zoom missing a tile within its bounds", zooms)
+	}
+}
+
+func TestRenderSettingsHashCoversTileSettings(t *testing.T) {
+	for name, edit := range map[string]func(cfg *Configuration){
+		"SharedTribeColorsKey":  func(cfg *Configuration) { cfg.SharedTribeColorsKey = "othercolors" },
+		"TileBoundsOnly":        func(cfg *Configuration) { cfg.TileBoundsOnly = !cfg.TileBoundsOnly },
+		"TileBoundsMarginTiles": func(cfg *Configuration) { cfg.TileBoundsMarginTiles++ },
+	} {
+		useTestConfig(t, nil)
+		before := renderSettingsHash()
+		edit(&config)
+		if renderSettingsHash() == before {
+			t.Errorf("changing %s kept the render settings hash", name)
+		}
+	}
+}
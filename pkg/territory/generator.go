@@ -0,0 +1,180 @@
+package territory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// Config is the generator's configuration, the settings of config.json
+type Config = Configuration
+
+// LoadConfig reads a config.json, settings it leaves out keep their defaults
+func LoadConfig(path string) (Config, error) {
+	return loadConfig(path)
+}
+
+// Generator renders the territory outputs for a program embedding the generator. The pipeline
+// reads its settings from the package so a process runs one Generator at a time
+type Generator struct {
+	territoryDB *redis.Client
+	defaultDB   *redis.Client
+}
+
+// Snapshot is the claims read by FetchOnce, the outputs are generated from it
+type Snapshot struct {
+	markers    []Marker
+	optOut     map[uint64]bool
+	crc        uint32
+	mapVersion uint16
+}
+
+// CRC identifies the snapshot's claims, snapshots with the same CRC render the same outputs
+func (s *Snapshot) CRC() uint32 {
+	return s.crc
+}
+
+// Claims is the number of claims in the snapshot
+func (s *Snapshot) Claims() int {
+	return len(s.markers)
+}
+
+// activeGenerator is set while a Generator is open
+var activeGenerator = struct {
+	sync.Mutex
+	open bool
+}{}
+
+// New validates cfg and opens a Generator with it, Close releases it for the next one
+func New(cfg Config) (*Generator, error) {
+	cfg.expandAlternativeURL()
+	if err := cfg.Validate(); err != nil {
+		return nil, classify(ErrConfig, "config", err)
+	}
+	defaultDbCfg, err := cfg.getDatabaseByName("Default")
+	if err != nil {
+		return nil, classify(ErrConfig, "config", err)
+	}
+	dbCfg, err := cfg.getDatabaseByName("TerritoryDB")
+	if err != nil {
+		return nil, classify(ErrConfig, "config", err)
+	}
+
+	activeGenerator.Lock()
+	defer activeGenerator.Unlock()
+	if activeGenerator.open {
+		return nil, errors.New("a Generator is already open in this process")
+	}
+
+	config = cfg
+	configuredGrids = loadActiveGrids()
+	stateStore = openStateStore(config.StateFile)
+	restoreGenerationState()
+	tileCache = newTileCache()
+	outboundClient, err = newOutboundHTTPClient()
+	if err != nil {
+		return nil, classify(ErrConfig, "config", fmt.Errorf("outbound HTTP client: %v", err))
+	}
+	tileGeneration.Lock()
+	tileGeneration.progress = loadTileProgress(path.Join(config.WWWDir, "territoryTiles"))
+	tileGeneration.trends = nil
+	tileGeneration.Unlock()
+
+	activeGenerator.open = true
+	return &Generator{
+		territoryDB: newRedisClient(dbCfg, dbCfg.credentialProvider()),
+		defaultDB:   newRedisClient(defaultDbCfg, defaultDbCfg.credentialProvider()),
+	}, nil
+}
+
+// Close closes the Generator's redis connections
+func (g *Generator) Close() error {
+	err := g.territoryDB.Close()
+	if defaultErr := g.defaultDB.Close(); err == nil {
+		err = defaultErr
+	}
+	activeGenerator.Lock()
+	activeGenerator.open = false
+	activeGenerator.Unlock()
+	return err
+}
+
+// FetchOnce reads every claim from the TerritoryDB. Grids that fail to load are left out and
+// recorded like the workers' fetch errors
+func (g *Generator) FetchOnce(ctx context.Context) (*Snapshot, error) {
+	client := g.territoryDB.WithContext(ctx)
+	if err := client.Ping().Err(); err != nil {
+		return nil, classify(ErrTransient, "fetch", err)
+	}
+	markers, crc, _ := fetchClaimMarkers(client, false, nil)
+	optOut, optOutCrc := fetchOptOutOwners(client)
+	crc = combineCrcs(crc, optOutCrc)
+	crc = withSharedTribeColors(client, markers, crc)
+	mapVersion := negotiateMapVersion(fetchGameCapabilities(client))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &Snapshot{markers: markers, optOut: optOut, crc: crc, mapVersion: mapVersion}, nil
+}
+
+// GenerateTiles renders the zoom tiles that are out of date with the snapshot. Once ctx is
+// cancelled the unfinished zooms stop, the next call renders them
+func (g *Generator) GenerateTiles(ctx context.Context, snapshot *Snapshot) error {
+	tilePath := path.Join(config.WWWDir, "territoryTiles")
+	markers := withoutOptedOut(snapshot.markers, snapshot.optOut)
+
+	tileGeneration.Lock()
+	defer tileGeneration.Unlock()
+	progress := tileGeneration.progress
+	failed := 0
+	if zooms := dueZooms(progress, snapshot.crc, 0); len(zooms) > 0 {
+		beginGeneration()
+		failed = generateZooms(withUploadBreaker(ctx), tilePath, zooms, markers, snapshot.crc, tileGeneration.trends, progress)
+		endGeneration()
+		refreshTileCache()
+	}
+	progress.Lock()
+	updateZoomStaleness(progress.zoomCrcs, snapshot.crc)
+	progress.Unlock()
+	saveGenerationState(progress)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return classify(ErrStorage, "render", fmt.Errorf("%d tiles failed", failed))
+	}
+	return nil
+}
+
+// GenerateGameMap writes the game's .map files, and the heatmap when enabled, from the snapshot
+func (g *Generator) GenerateGameMap(ctx context.Context, snapshot *Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	beginGeneration()
+	err := generateGame(withUploadBreaker(ctx), path.Join(config.WWWDir, "gameTiles"), snapshot.markers, snapshot.mapVersion)
+	endGeneration()
+	if err != nil {
+		recordError(err)
+		return err
+	}
+	setGameArtifactMeta(snapshot.crc)
+	saveGenerationState(nil)
+	return nil
+}
+
+// Handler serves the outputs and the API, below BasePath when it's set
+func (g *Generator) Handler() http.Handler {
+	return newHTTPHandler(g.territoryDB)
+}
+
+// Mount registers the Handler on mux at BasePath, or at the root without one
+func (g *Generator) Mount(mux *http.ServeMux) {
+	mux.Handle(config.BasePath+"/", g.Handler())
+}
@@ -0,0 +1,203 @@
+package territory
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// openTestGenerator opens a Generator on cfg, restoring the package state New replaces after the
+// test
+func openTestGenerator(t *testing.T, cfg Config) *Generator {
+	t.Helper()
+	previousConfig, previousGrids, previousStore, previousCache, previousClient := config, configuredGrids, stateStore, tileCache, outboundClient
+	tileGeneration.Lock()
+	previousProgress, previousTrends := tileGeneration.progress, tileGeneration.trends
+	tileGeneration.Unlock()
+	t.Cleanup(func() {
+		config, configuredGrids, stateStore, tileCache, outboundClient = previousConfig, previousGrids, previousStore, previousCache, previousClient
+		tileGeneration.Lock()
+		tileGeneration.progress, tileGeneration.trends = previousProgress, previousTrends
+		tileGeneration.Unlock()
+	})
+
+	generator, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { generator.Close() })
+	return generator
+}
+
+// generatorConfig is the test config with both databases on the miniredis at host:port
+func generatorConfig(t *testing.T, host string, port int) Config {
+	t.Helper()
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MaxZoom = 2
+		for i := range cfg.DatabaseConnections {
+			cfg.DatabaseConnections[i].URL, cfg.DatabaseConnections[i].Port = host, port
+			cfg.DatabaseConnections[i].Password = ""
+		}
+	})
+	return config
+}
+
+func TestGeneratorRendersAndServesSnapshot(t *testing.T) {
+	server, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 1, Y: 0}, 1, 0.5, 0.5, MarkerLand)
+	port, _ := strconv.Atoi(server.Port())
+	generator := openTestGenerator(t, generatorConfig(t, server.Host(), port))
+	ctx := context.Background()
+
+	snapshot, err := generator.FetchOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Claims() != 1 {
+		t.Fatalf("fetched %d claims, want 1", snapshot.Claims())
+	}
+	if err := generator.GenerateTiles(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.GenerateGameMap(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	generator.Mount(mux)
+	for _, file := range []string{"/territoryTiles/1/1/0.png", "/gameTiles/world.map"} {
+		if _, err := os.Stat(filepath.Join(config.WWWDir, filepath.FromSlash(file))); err != nil {
+			t.Fatalf("%s wasn't generated: %v", file, err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, file, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d", file, w.Code)
+		}
+	}
+}
+
+func TestGeneratorSkipsTilesOfUnchangedSnapshot(t *testing.T) {
+	server, client := newTestRedis(t)
+	addClaim(t, client, GridID{}, 1, 0.5, 0.5, MarkerLand)
+	port, _ := strconv.Atoi(server.Port())
+	generator := openTestGenerator(t, generatorConfig(t, server.Host(), port))
+	ctx := context.Background()
+
+	snapshot, err := generator.FetchOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.GenerateTiles(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	resetTileCounts()
+	if err := generator.GenerateTiles(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if rendered := renderedZooms(); len(rendered) != 0 {
+		t.Fatalf("rendered zooms %v again for the same snapshot", rendered)
+	}
+}
+
+func TestGeneratorIsOnePerProcess(t *testing.T) {
+	server, _ := newTestRedis(t)
+	port, _ := strconv.Atoi(server.Port())
+	cfg := generatorConfig(t, server.Host(), port)
+	generator := openTestGenerator(t, cfg)
+
+	if _, err := New(cfg); err == nil {
+		t.Fatalf("opened a second Generator while the first was open")
+	}
+	generator.Close()
+	second, err := New(cfg)
+	if err != nil {
+		t.Fatalf("couldn't open a Generator after Close: %v", err)
+	}
+	second.Close()
+}
+
+func TestGeneratorRejectsInvalidConfig(t *testing.T) {
+	cfg := generatorConfig(t, "localhost", 6379)
+	cfg.GridSize = 0
+	if _, err := New(cfg); err == nil {
+		t.Fatalf("opened a Generator with GridSize 0")
+	}
+}
+
+func TestGeneratorExpandsAlternativeURL(t *testing.T) {
+	server, _ := newTestRedis(t)
+	port, _ := strconv.Atoi(server.Port())
+	cfg := generatorConfig(t, server.Host(), port)
+	// an embedder building the Config in code rather than loading it
+	cfg.AlternativeURL = "cdn.example.com"
+	cfg.AlternativeURLs = nil
+	openTestGenerator(t, cfg)
+
+	if endpoint := publicEndpoint(); endpoint != "cdn.example.com" {
+		t.Errorf("published %s, want the AlternativeURL", endpoint)
+	}
+}
+
+func TestS3FailurePolicies(t *testing.T) {
+	for _, policy := range []string{S3FailureContinue, S3FailureFailCycle} {
+		t.Run(policy, func(t *testing.T) {
+			server, client := newTestRedis(t)
+			addClaim(t, client, GridID{X: 1, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+			port, _ := strconv.Atoi(server.Port())
+			cfg := generatorConfig(t, server.Host(), port)
+			cfg.S3FailurePolicy = policy
+			// the failures aren't passing, don't wait for them
+			cfg.TransientRetries = 0
+			generator := openTestGenerator(t, cfg)
+			fake := useFakeS3(t)
+			fake.failPuts = true
+			ctx := context.Background()
+			resetTileCounts()
+			logs := useLogBuffer(t)
+
+			snapshot, err := generator.FetchOnce(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tilesErr := generator.GenerateTiles(ctx, snapshot)
+			mapErr := generator.GenerateGameMap(ctx, snapshot)
+			if policy == S3FailureContinue {
+				if tilesErr != nil || mapErr != nil {
+					t.Fatalf("failed uploads failed the cycle: %v, %v", tilesErr, mapErr)
+				}
+				if !strings.Contains(logs.String(), "Warning!") {
+					t.Errorf("failed uploads weren't logged: %s", logs.String())
+				}
+			} else if tilesErr == nil || mapErr == nil {
+				t.Fatalf("failed uploads didn't fail the cycle: %v, %v", tilesErr, mapErr)
+			}
+			// the local outputs are written either way
+			if _, err := os.Stat(filepath.Join(config.WWWDir, "gameTiles", "world.map")); err != nil {
+				t.Errorf("world.map wasn't written: %v", err)
+			}
+
+			// once S3 is back only a failed cycle generates the tiles again
+			fake.Lock()
+			fake.failPuts = false
+			fake.Unlock()
+			resetTileCounts()
+			if err := generator.GenerateTiles(ctx, snapshot); err != nil {
+				t.Fatal(err)
+			}
+			rendered := len(renderedZooms()) > 0
+			if rendered != (policy == S3FailureFailCycle) {
+				t.Errorf("tiles generated again: %v, want %v", rendered, policy == S3FailureFailCycle)
+			}
+			if uploaded := fake.putCount("territoryTiles/1/1/0.png") > 0; uploaded != (policy == S3FailureFailCycle) {
+				t.Errorf("tile uploaded on the retry: %v, want %v", uploaded, policy == S3FailureFailCycle)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+// GeoJSONFeature is one claim as a point in world units (GridSize per server, y grows south)
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties GeoJSONClaimProperties `json:"properties"`
+}
+
+// GeoJSONPoint is a GeoJSON Point geometry
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// GeoJSONClaimProperties are the properties of each claim feature
+type GeoJSONClaimProperties struct {
+	OwnerID uint64  `json:"ownerID"`
+	IsTribe bool    `json:"isTribe"`
+	Type    string  `json:"type"` // "land" or "water"
+	ServerX int     `json:"serverX"`
+	ServerY int     `json:"serverY"`
+	Radius  float64 `json:"radius"` // claim radius in world units
+}
+
+// GeoJSONFeatureCollection is the root of the exported file
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// claimsGeoJSON converts the land and water markers to a feature collection
+func claimsGeoJSON(markers []Marker) GeoJSONFeatureCollection {
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, marker := range markers {
+		properties := GeoJSONClaimProperties{
+			OwnerID: marker.tribeOrOwnerID,
+			IsTribe: isTribeID(marker.tribeOrOwnerID),
+			ServerX: marker.serverX,
+			ServerY: marker.serverY,
+		}
+		switch marker.markerType {
+		case MarkerLand:
+			properties.Type, properties.Radius = "land", config.LandRadiusUE
+		case MarkerWater:
+			properties.Type, properties.Radius = "water", config.WaterRadiusUE
+		default:
+			continue
+		}
+
+		x := (float64(marker.serverX) + marker.relX) * config.GridSize
+		y := (float64(marker.serverY) + marker.relY) * config.GridSize
+		if !isFinite(x) || !isFinite(y) {
+			continue
+		}
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:       "Feature",
+			Geometry:   GeoJSONPoint{Type: "Point", Coordinates: [2]float64{x, y}},
+			Properties: properties,
+		})
+	}
+	return collection
+}
+
+// generateGeoJSON writes the claims as a GeoJSON file next to the game outputs
+func generateGeoJSON(ctx context.Context, filename string, markers []Marker) {
+	js, err := json.Marshal(claimsGeoJSON(markers))
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+
+	// save the a tmp file
+	dir := path.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("Warning! Failed to create directory %s: %v", dir, err)
+		return
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".geojson"))
+	if err := ioutil.WriteFile(tmpFilename, js, 0600); err != nil {
+		log.Printf("Warning! Failed to write %s: %v", tmpFilename, err)
+		return
+	}
+
+	// delete old file and rename tmp
+	os.Remove(filename)
+	os.Rename(tmpFilename, filename)
+
+	uploadToS3(ctx, filename)
+}
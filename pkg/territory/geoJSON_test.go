@@ -0,0 +1,70 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGeoJSONOfKnownClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GridSize = 1000000
+		cfg.LandRadiusUE = 10000
+		cfg.WaterRadiusUE = 21000
+	})
+	markers := []Marker{
+		{serverX: 1, serverY: 0, tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.25, markerType: MarkerLand},
+		{serverX: 0, serverY: 2, tribeOrOwnerID: 42, relX: 0.75, relY: 0.5, markerType: MarkerWater},
+		// neither a land nor a water claim
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: 7},
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1000050001, relX: math.NaN(), relY: 0.5, markerType: MarkerLand},
+	}
+	filename := filepath.Join(config.WWWDir, "gameTiles", "claims.geojson")
+	generateGeoJSON(context.Background(), filename, markers)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{
+		"type": "FeatureCollection",
+		"features": [
+			{
+				"type": "Feature",
+				"geometry": {"type": "Point", "coordinates": [1500000, 250000]},
+				"properties": {"ownerID": 1000050001, "isTribe": true, "type": "land", "serverX": 1, "serverY": 0, "radius": 10000}
+			},
+			{
+				"type": "Feature",
+				"geometry": {"type": "Point", "coordinates": [750000, 2500000]},
+				"properties": {"ownerID": 42, "isTribe": false, "type": "water", "serverX": 0, "serverY": 2, "radius": 21000}
+			}
+		]
+	}`
+	var got, expected interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GeoJSON is\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestGeoJSONWithoutClaimsIsAnEmptyCollection(t *testing.T) {
+	useTestConfig(t, nil)
+	js, err := json.Marshal(claimsGeoJSON(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GeoJSON requires the features array, null isn't valid
+	if string(js) != `{"type":"FeatureCollection","features":[]}` {
+		t.Errorf("empty GeoJSON is %s", js)
+	}
+}
@@ -0,0 +1,127 @@
+package territory
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FailingGrid is a grid whose fetch has failed for consecutive cycles, reported by /health
+type FailingGrid struct {
+	Worker    string    `json:"worker"`
+	Grid      string    `json:"grid"` // packed x<<16|y
+	Cycles    int       `json:"cycles"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"lastError"`
+	Escalated bool      `json:"escalated"` // failing for GridErrorAfterCycles or more
+}
+
+// gridFailures deduplicates one worker's per grid fetch warnings across cycles: the first failure
+// is logged, then a summary every GridWarningEveryCycles, an error once GridErrorAfterCycles pass
+// and a recovery line when the grid fetches again. A nil *gridFailures logs every failure
+type gridFailures struct {
+	worker  string
+	cycle   int
+	failing map[GridID]*gridFailure
+}
+
+type gridFailure struct {
+	cycles    int
+	since     time.Time
+	lastError string
+	seen      int // last cycle the grid was fetched, grids no longer fetched are forgotten
+}
+
+// failingGrids is every worker's current FailingGrid set for /health
+var failingGrids = struct {
+	sync.Mutex
+	byWorker map[string][]FailingGrid
+}{byWorker: make(map[string][]FailingGrid)}
+
+func newGridFailures(worker string) *gridFailures {
+	return &gridFailures{worker: worker, failing: make(map[GridID]*gridFailure)}
+}
+
+// observe records a grid's fetch this cycle, err is nil when it succeeded
+func (f *gridFailures) observe(grid GridID, err error) {
+	if f == nil {
+		if err != nil {
+			log.Printf("Warning! %v", err)
+		}
+		return
+	}
+	failure, ok := f.failing[grid]
+	if err == nil {
+		if ok {
+			log.Printf("grid %d,%d fetch recovered after %d failed cycles", grid.X, grid.Y, failure.cycles)
+			delete(f.failing, grid)
+		}
+		return
+	}
+
+	if !ok {
+		failure = &gridFailure{since: time.Now().UTC()}
+		f.failing[grid] = failure
+	}
+	failure.cycles++
+	failure.lastError = err.Error()
+	failure.seen = f.cycle
+	switch {
+	case failure.cycles == 1:
+		log.Printf("Warning! grid %d,%d fetch failed: %v", grid.X, grid.Y, err)
+	case failure.cycles == config.GridErrorAfterCycles:
+		log.Printf("Error! grid %d,%d fetch failing for %d consecutive cycles, last error: %v", grid.X, grid.Y, failure.cycles, err)
+	case config.GridWarningEveryCycles > 0 && (failure.cycles-1)%config.GridWarningEveryCycles == 0:
+		level := "Warning!"
+		if config.GridErrorAfterCycles > 0 && failure.cycles > config.GridErrorAfterCycles {
+			level = "Error!"
+		}
+		log.Printf("%s grid %d,%d fetch failing for %d consecutive cycles, last error: %v", level, grid.X, grid.Y, failure.cycles, err)
+	}
+}
+
+// endCycle forgets grids that weren't fetched this cycle, e.g. dropped from the grid set, and
+// publishes the failing grids for /health
+func (f *gridFailures) endCycle() {
+	if f == nil {
+		return
+	}
+	var grids []FailingGrid
+	for grid, failure := range f.failing {
+		if failure.seen != f.cycle {
+			delete(f.failing, grid)
+			continue
+		}
+		grids = append(grids, FailingGrid{
+			Worker:    f.worker,
+			Grid:      packedGridID(grid),
+			Cycles:    failure.cycles,
+			Since:     failure.since,
+			LastError: failure.lastError,
+			Escalated: config.GridErrorAfterCycles > 0 && failure.cycles >= config.GridErrorAfterCycles,
+		})
+	}
+	sort.Slice(grids, func(i, j int) bool { return grids[i].Grid < grids[j].Grid })
+	f.cycle++
+
+	failingGrids.Lock()
+	failingGrids.byWorker[f.worker] = grids
+	failingGrids.Unlock()
+}
+
+// currentFailingGrids is every worker's failing grids, by worker then grid
+func currentFailingGrids() []FailingGrid {
+	failingGrids.Lock()
+	defer failingGrids.Unlock()
+	var workers []string
+	for worker := range failingGrids.byWorker {
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	var grids []FailingGrid
+	for _, worker := range workers {
+		grids = append(grids, failingGrids.byWorker[worker]...)
+	}
+	return grids
+}
@@ -0,0 +1,138 @@
+package territory
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useFailingGrids clears every worker's failing grids for the test
+func useFailingGrids(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		failingGrids.Lock()
+		failingGrids.byWorker = make(map[string][]FailingGrid)
+		failingGrids.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestGridFailureLogSequence(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GridWarningEveryCycles = 10
+		cfg.GridErrorAfterCycles = 25
+	})
+	useFailingGrids(t)
+	buf := useLogBuffer(t)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+
+	failures := newGridFailures("game")
+	dead, healthy := GridID{X: 1, Y: 0}, GridID{X: 0, Y: 0}
+	for cycle := 1; cycle <= 34; cycle++ {
+		failures.observe(healthy, nil)
+		failures.observe(dead, fmt.Errorf("WRONGTYPE cycle %d", cycle))
+		failures.endCycle()
+
+		grids := currentFailingGrids()
+		if len(grids) != 1 || grids[0].Cycles != cycle || grids[0].Grid != packedGridID(dead) {
+			t.Fatalf("cycle %d: failing grids %+v", cycle, grids)
+		}
+		if escalated := cycle >= 25; grids[0].Escalated != escalated {
+			t.Errorf("cycle %d: escalated %v, want %v", cycle, grids[0].Escalated, escalated)
+		}
+		if status := evaluateHealth(nil, grids).Status; (status == "degraded") != (cycle >= 25) {
+			t.Errorf("cycle %d: health %s", cycle, status)
+		}
+	}
+	failures.observe(dead, nil)
+	failures.endCycle()
+	if grids := currentFailingGrids(); len(grids) != 0 {
+		t.Errorf("failing grids %+v after the grid recovered", grids)
+	}
+	failures.observe(dead, nil)
+	failures.endCycle()
+
+	want := []string{
+		"Warning! grid 1,0 fetch failed: WRONGTYPE cycle 1",
+		"Warning! grid 1,0 fetch failing for 11 consecutive cycles, last error: WRONGTYPE cycle 11",
+		"Warning! grid 1,0 fetch failing for 21 consecutive cycles, last error: WRONGTYPE cycle 21",
+		"Error! grid 1,0 fetch failing for 25 consecutive cycles, last error: WRONGTYPE cycle 25",
+		"Error! grid 1,0 fetch failing for 31 consecutive cycles, last error: WRONGTYPE cycle 31",
+		"grid 1,0 fetch recovered after 34 failed cycles",
+	}
+	if got := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGridFailuresForgetGridsLeavingTheSet(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GridWarningEveryCycles = 10
+		cfg.GridErrorAfterCycles = 25
+	})
+	useFailingGrids(t)
+	buf := useLogBuffer(t)
+	log.SetFlags(0)
+	defer log.SetFlags(log.LstdFlags)
+
+	failures := newGridFailures("tiles")
+	dropped := GridID{X: 2, Y: 2}
+	for cycle := 0; cycle < 5; cycle++ {
+		failures.observe(dropped, errors.New("WRONGTYPE"))
+		failures.endCycle()
+	}
+	// a reload dropped the grid, it isn't fetched and isn't reported as recovered
+	failures.endCycle()
+	if grids := currentFailingGrids(); len(grids) != 0 {
+		t.Errorf("failing grids %+v after the grid left the set", grids)
+	}
+	// back in the set and failing, it starts over
+	failures.observe(dropped, errors.New("WRONGTYPE"))
+	failures.endCycle()
+	if grids := currentFailingGrids(); len(grids) != 1 || grids[0].Cycles != 1 {
+		t.Errorf("failing grids %+v after the grid came back, want 1 cycle", grids)
+	}
+
+	want := []string{
+		"Warning! grid 2,2 fetch failed: WRONGTYPE",
+		"Warning! grid 2,2 fetch failed: WRONGTYPE",
+	}
+	if got := strings.Split(strings.TrimSpace(buf.String()), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestFetchWarnsOnceForADeadGridKey fetches a grid whose key has the wrong type every cycle
+func TestFetchWarnsOnceForADeadGridKey(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 1
+		cfg.GridWarningEveryCycles = 0
+		cfg.GridErrorAfterCycles = 0
+		cfg.TransientRetries = 0
+	})
+	useFailingGrids(t)
+	usePipelineErrors(t)
+	buf := useLogBuffer(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1, 0.5, 0.5, MarkerLand)
+	client.Set("territorymapdata:"+packedGridID(GridID{X: 1, Y: 0}), "not a set", 0)
+
+	failures := newGridFailures("game")
+	for cycle := 0; cycle < 20; cycle++ {
+		markers, _, _ := fetchClaimMarkers(client, false, failures)
+		if len(markers) != 1 {
+			t.Fatalf("cycle %d: fetched %d markers, want the healthy grid's 1", cycle, len(markers))
+		}
+	}
+	if n := strings.Count(buf.String(), "grid 1,0 fetch"); n != 1 {
+		t.Errorf("logged %d lines about the dead grid in 20 cycles, want 1:\n%s", n, buf.String())
+	}
+	if grids := currentFailingGrids(); len(grids) != 1 || grids[0].Cycles != 20 || grids[0].Escalated {
+		t.Errorf("failing grids %+v, want the dead grid failing for 20 cycles without escalating", grids)
+	}
+}
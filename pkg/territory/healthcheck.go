@@ -0,0 +1,95 @@
+package territory
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runHealthcheck checks a server for container healthchecks without needing curl in the image,
+// printing a one line summary and returning the process exit code. --http asks the running
+// server's /health, --local runs the same checks in process from the state file and redis. A
+// degraded server passes, restarting it doesn't bring a failing grid back
+func runHealthcheck(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	local := flags.Bool("local", false, "check the state file and redis instead of asking the server")
+	flags.Bool("http", true, "ask the running server's /health, the default")
+	url := flags.String("url", "", "/health URL for --http, defaults to the configured Host and Port")
+	timeout := flags.Duration("timeout", 5*time.Second, "time limit for the check")
+	flags.Parse(args)
+
+	var health HealthStatus
+	var err error
+	if *local {
+		health, err = localHealth()
+	} else {
+		if len(*url) == 0 {
+			host := config.Host
+			if len(host) == 0 {
+				host = "127.0.0.1"
+			}
+			*url = fmt.Sprintf("http://%s%s/health", net.JoinHostPort(host, strconv.Itoa(int(config.Port))), config.BasePath)
+		}
+		health, err = fetchHealth(*url, *timeout)
+	}
+	if err != nil {
+		fmt.Printf("unhealthy: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: %d stale artifacts, oldest %ds, %d failing grids\n", health.Status, health.StaleArtifacts, health.OldestAgeSeconds, len(health.FailingGrids))
+	if health.Status != "ok" && health.Status != "degraded" {
+		return 1
+	}
+	return 0
+}
+
+// localHealth evaluates the artifacts of the state file like /health and checks redis is reachable
+func localHealth() (HealthStatus, error) {
+	if len(config.StateFile) == 0 {
+		return HealthStatus{}, fmt.Errorf("--local needs a StateFile")
+	}
+	if _, err := os.Stat(config.StateFile); err != nil {
+		return HealthStatus{}, fmt.Errorf("state file: %v", err)
+	}
+	store, err := loadStateStore(config.StateFile)
+	if err != nil {
+		return HealthStatus{}, fmt.Errorf("state file %s is unreadable: %v", config.StateFile, err)
+	}
+	state, _ := readGenerationState(store)
+	for _, name := range requiredDatabases {
+		dbCfg, err := config.getDatabaseByName(name)
+		if err != nil {
+			return HealthStatus{}, err
+		}
+		client := newRedisClient(dbCfg, dbCfg.credentialProvider())
+		err = client.Ping().Err()
+		client.Close()
+		if err != nil {
+			return HealthStatus{}, fmt.Errorf("redis %s: %v", name, err)
+		}
+	}
+	return evaluateHealth(state.Artifacts, nil), nil
+}
+
+// fetchHealth asks a running server's /health
+func fetchHealth(url string, timeout time.Duration) (HealthStatus, error) {
+	var health HealthStatus
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return health, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return health, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return health, fmt.Errorf("%s: %v", url, err)
+	}
+	return health, nil
+}
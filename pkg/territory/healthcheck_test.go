@@ -0,0 +1,114 @@
+package territory
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHealthcheckHTTP(t *testing.T) {
+	useTestConfig(t, nil)
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   int
+	}{
+		{"ok", http.StatusOK, `{"status":"ok"}`, 0},
+		{"degraded", http.StatusOK, `{"status":"degraded","failingGrids":[{"grid":"A1","escalated":true}]}`, 0},
+		{"stale", http.StatusOK, `{"status":"stale","staleArtifacts":2}`, 1},
+		{"server error", http.StatusInternalServerError, `{"status":"ok"}`, 1},
+		{"garbage", http.StatusOK, `not json`, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer srv.Close()
+			if code := runHealthcheck([]string{"--http", "--url", srv.URL + "/health"}); code != test.want {
+				t.Errorf("exit code %d, want %d", code, test.want)
+			}
+		})
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL + "/health"
+	srv.Close()
+	if code := runHealthcheck([]string{"--http", "--url", url, "--timeout", "1s"}); code != 1 {
+		t.Errorf("unreachable server: exit code %d, want 1", code)
+	}
+}
+
+// useLocalHealth points the config at a miniredis and a state file holding known
+func useLocalHealth(t *testing.T, known map[string]ArtifactMeta) {
+	t.Helper()
+	server, _ := newTestRedis(t)
+	port, _ := strconv.Atoi(server.Port())
+	generatorConfig(t, server.Host(), port)
+	config.StaleAfterSeconds = 60
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	store := openStateStore(config.StateFile)
+	if err := store.Set("generation", "artifacts", known); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthcheckLocal(t *testing.T) {
+	now := time.Now().UTC()
+	fresh := map[string]ArtifactMeta{"territory.json": {GeneratedAt: now, CheckedAt: now, CRC: 1}}
+	old := now.Add(-time.Hour)
+	stale := map[string]ArtifactMeta{"territory.json": {GeneratedAt: old, CheckedAt: old, CRC: 1}}
+
+	useLocalHealth(t, fresh)
+	if code := runHealthcheck([]string{"--local"}); code != 0 {
+		t.Errorf("fresh artifacts: exit code %d, want 0", code)
+	}
+
+	useLocalHealth(t, stale)
+	if code := runHealthcheck([]string{"--local"}); code != 1 {
+		t.Errorf("stale artifacts: exit code %d, want 1", code)
+	}
+
+	useLocalHealth(t, fresh)
+	config.DatabaseConnections[0].Port = 1
+	if code := runHealthcheck([]string{"--local"}); code != 1 {
+		t.Errorf("redis down: exit code %d, want 1", code)
+	}
+
+	useLocalHealth(t, fresh)
+	config.StateFile = filepath.Join(t.TempDir(), "missing.json")
+	if code := runHealthcheck([]string{"--local"}); code != 1 {
+		t.Errorf("missing state file: exit code %d, want 1", code)
+	}
+}
+
+// TestHealthcheckMatchesEndpoint checks --local and /health agree on the same artifacts
+func TestHealthcheckMatchesEndpoint(t *testing.T) {
+	useArtifactMeta(t)
+	now := time.Now().UTC()
+	old := now.Add(-time.Hour)
+	known := map[string]ArtifactMeta{
+		"territory.json":   {GeneratedAt: now, CheckedAt: now, CRC: 1},
+		"territoryTiles/2": {GeneratedAt: old, CheckedAt: old, CRC: 2},
+	}
+	useLocalHealth(t, known)
+	restoreArtifactMeta(known)
+
+	local, err := localHealth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := evaluateHealth(artifactMetaSnapshot(), currentFailingGrids())
+	if local.Status != served.Status || local.StaleArtifacts != served.StaleArtifacts || local.OldestAgeSeconds != served.OldestAgeSeconds {
+		t.Errorf("--local reports %+v, /health %+v", local, served)
+	}
+	if local.Status != "stale" || local.StaleArtifacts != 1 {
+		t.Errorf("got %s with %d stale artifacts, want stale with 1", local.Status, local.StaleArtifacts)
+	}
+}
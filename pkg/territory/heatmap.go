@@ -0,0 +1,70 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"path"
+)
+
+// serverClaimCounts tallies markers per server, indexed [x][y]
+func serverClaimCounts(markers []Marker) [][]int {
+	counts := make([][]int, config.ServersX)
+	for x := range counts {
+		counts[x] = make([]int, config.ServersY)
+	}
+	for _, marker := range markers {
+		if marker.serverX < config.ServersX && marker.serverY < config.ServersY {
+			counts[marker.serverX][marker.serverY]++
+		}
+	}
+	return counts
+}
+
+// generateHeatmap saves a ServersX by ServersY grid image where each cell's intensity is its claim count
+func generateHeatmap(ctx context.Context, filename string, counts [][]int) {
+	cellPixels := config.HeatmapCellPixels
+	maxCount := 0
+	for x := range counts {
+		for y := range counts[x] {
+			maxCount = Max(maxCount, counts[x][y])
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, config.ServersX*cellPixels, config.ServersY*cellPixels))
+	for x := range counts {
+		for y := range counts[x] {
+			intensity := 0.0
+			if maxCount > 0 {
+				intensity = float64(counts[x][y]) / float64(maxCount)
+			}
+			cell := image.Rect(x*cellPixels, y*cellPixels, (x+1)*cellPixels, (y+1)*cellPixels)
+			cellColor := blendColor(colorValues["black"], colorValues["red"], intensity)
+			draw.Draw(img, cell, image.NewUniform(cellColor), image.ZP, draw.Src)
+		}
+	}
+
+	// save the a tmp file
+	dir := path.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("Warning! Failed to create directory %s: %v", dir, err)
+		return
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".png"))
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("Warning! Failed to create %s: %v", tmpFilename, err)
+		return
+	}
+	png.Encode(f, img)
+	f.Close()
+
+	// delete old file and rename tmp
+	os.Remove(filename)
+	os.Rename(tmpFilename, filename)
+
+	uploadToS3(ctx, filename)
+}
@@ -0,0 +1,65 @@
+package territory
+
+import (
+	"context"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHeatmapCellIntensityFollowsClaimCounts(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 3, 2
+		cfg.HeatmapCellPixels = 4
+	})
+	var markers []Marker
+	for server, claims := range map[GridID]int{{X: 0, Y: 0}: 4, {X: 1, Y: 0}: 2, {X: 2, Y: 1}: 1, {X: 5, Y: 5}: 9} {
+		for i := 0; i < claims; i++ {
+			markers = append(markers, Marker{serverX: int(server.X), serverY: int(server.Y), tribeOrOwnerID: 1, relX: 0.5, relY: 0.5})
+		}
+	}
+	counts := serverClaimCounts(markers)
+	// the claims outside the world aren't counted
+	if want := [][]int{{4, 0}, {2, 0}, {0, 1}}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts %v, want %v", counts, want)
+	}
+
+	filename := filepath.Join(config.WWWDir, "heatmap.png")
+	generateHeatmap(context.Background(), filename, counts)
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 12 || size.Y != 8 {
+		t.Fatalf("heatmap is %v, want 3x2 cells of 4 pixels", size)
+	}
+	for x := range counts {
+		for y := range counts[x] {
+			want := blendColor(colorValues["black"], colorValues["red"], float64(counts[x][y])/4)
+			// every pixel of the cell has its intensity
+			for _, offset := range [][2]int{{0, 0}, {3, 3}} {
+				r, g, b, _ := img.At(x*4+offset[0], y*4+offset[1]).RGBA()
+				if uint8(r>>8) != want.R || uint8(g>>8) != want.G || uint8(b>>8) != want.B {
+					t.Errorf("cell %d/%d is %d/%d/%d, want %v for %d claims", x, y, r>>8, g>>8, b>>8, want, counts[x][y])
+				}
+			}
+		}
+	}
+}
+
+func TestHeatmapSkipsDirectoryThatCantBeCreated(t *testing.T) {
+	useTestConfig(t, nil)
+	filename := filepath.Join(blockedDir(t), "heatmap.png")
+
+	generateHeatmap(context.Background(), filename, serverClaimCounts(testMarkers()))
+	if _, err := os.Stat(filename); err == nil {
+		t.Fatalf("%s was written", filename)
+	}
+}
@@ -0,0 +1,286 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// useTestConfig installs the loadConfig defaults, with WWWDir in a temporary directory and edit
+// applied, as the global config for the test
+func useTestConfig(t *testing.T, edit func(cfg *Configuration)) {
+	t.Helper()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(filename, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.WWWDir = filepath.Join(dir, "www")
+	cfg.StateFile = ""
+	if edit != nil {
+		edit(&cfg)
+	}
+
+	previous, previousGrids := config, configuredGrids
+	config = cfg
+	configuredGrids = loadActiveGrids()
+	t.Cleanup(func() {
+		config, configuredGrids = previous, previousGrids
+	})
+}
+
+// newTestRedis starts a miniredis for the test and a client of it
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// addClaim stores a claim in territorymapdata the way the game does
+func addClaim(t *testing.T, client *redis.Client, grid GridID, owner uint64, relX, relY float64, markerType uint8) {
+	t.Helper()
+	key := "territorymapdata:" + packedGridID(grid)
+	if err := client.SAdd(key, encodeClaim(owner, relX, relY, markerType, 16)).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// renderWorld renders the markers over the whole world into a size x size image, nil when
+// nothing was drawn
+func renderWorld(markers []Marker, opts MapOptions, size int) *image.RGBA {
+	opts.actualPixels, opts.virtualPixels = size, size
+	opts.virtualClip = image.Rect(0, 0, size, size)
+	img, _ := renderImage(&opts, createQuadTree(&opts, markers))
+	return img
+}
+
+// worldPixel is the color of img, a renderWorld of size pixels, at the marker's position
+func worldPixel(img *image.RGBA, marker Marker, size int) color.RGBA {
+	servers := config.ServersX
+	if config.ServersY > servers {
+		servers = config.ServersY
+	}
+	pixelsPerServer := float64(size / servers)
+	x := (float64(marker.serverX) + marker.relX) * pixelsPerServer
+	y := (float64(marker.serverY) + marker.relY) * pixelsPerServer
+	return img.RGBAAt(int(x), int(y))
+}
+
+// useLogBuffer collects the log output of the test
+func useLogBuffer(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// checkGolden compares img pixel by pixel with testdata/<name>.png, -update rewrites it
+func checkGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	filename := filepath.Join("testdata", name+".png")
+	if *updateGolden {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("%v, run the test with -update to create it", err)
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("image is %v, golden %s is %v", img.Bounds(), filename, golden.Bounds())
+	}
+	want, got := image.NewNRGBA(golden.Bounds()), image.NewNRGBA(img.Bounds())
+	draw.Draw(want, want.Bounds(), golden, golden.Bounds().Min, draw.Src)
+	draw.Draw(got, got.Bounds(), img, img.Bounds().Min, draw.Src)
+	if differing := countDifferentPixels(want, got); differing > 0 {
+		t.Fatalf("%d pixels differ from %s, run the test with -update if the change is intended", differing, filename)
+	}
+}
+
+func countDifferentPixels(a, b *image.NRGBA) int {
+	differing := 0
+	for i := 0; i < len(a.Pix); i += 4 {
+		if !bytes.Equal(a.Pix[i:i+4], b.Pix[i:i+4]) {
+			differing++
+		}
+	}
+	return differing
+}
+
+// fakeS3 is an in memory S3 bucket answering the outbound client's requests
+type fakeS3 struct {
+	sync.Mutex
+	objects        map[string][]byte
+	storageClasses map[string]string
+	puts           map[string]int
+	heads          int
+	failPuts       bool           // answer every PUT with a 500
+	noBucket       bool           // answer a HEAD of the bucket with a 404
+	truncate       map[string]int // the next n PUTs of a key store only half the body
+}
+
+// useFakeS3 configures S3 uploads for the test, to a fakeS3
+func useFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{
+		objects:        make(map[string][]byte),
+		storageClasses: make(map[string]string),
+		puts:           make(map[string]int),
+		truncate:       make(map[string]int),
+	}
+	// a CA bundle from the environment needs an *http.Transport
+	t.Setenv("AWS_CA_BUNDLE", "")
+	config.AtlasS3AccessID, config.AtlasS3SecretKey = "id", "secret"
+	config.AtlasS3BucketName, config.AtlasS3Region = "bucket", "us-east-1"
+	previous := outboundClient
+	outboundClient = &http.Client{Transport: fake}
+	t.Cleanup(func() { outboundClient = previous })
+	return fake
+}
+
+func (f *fakeS3) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("")), Request: r}
+	switch r.Method {
+	case http.MethodPut:
+		if f.failPuts {
+			resp.StatusCode = http.StatusInternalServerError
+			return resp, nil
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		f.puts[key]++
+		f.storageClasses[key] = r.Header.Get("X-Amz-Storage-Class")
+		sum := md5.Sum(body)
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		if f.truncate[key] > 0 {
+			f.truncate[key]--
+			body = body[:len(body)/2]
+		}
+		f.objects[key] = body
+	case http.MethodHead:
+		f.heads++
+		if key == "" {
+			if f.noBucket {
+				resp.StatusCode = http.StatusNotFound
+			}
+			return resp, nil
+		}
+		body, ok := f.objects[key]
+		if !ok {
+			resp.StatusCode = http.StatusNotFound
+			return resp, nil
+		}
+		sum := md5.Sum(body)
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		resp.StatusCode = http.StatusNoContent
+	default:
+		resp.StatusCode = http.StatusNotImplemented
+	}
+	return resp, nil
+}
+
+// putCount is the number of times key was uploaded
+func (f *fakeS3) putCount(key string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.puts[key]
+}
+
+// writeOutput writes data to relPath below WWWDir and returns the filename
+func writeOutput(t *testing.T, relPath string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(config.WWWDir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// startGameWorker runs the game worker on client with a fake clock until the test ends. It returns
+// once the first cycle is published, the returned func runs the next cycle and waits for its result
+func startGameWorker(t *testing.T, client *redis.Client) func() *GenerationResult {
+	t.Helper()
+	fake := useFakeClock(t)
+	currentGeneration.Store((*GenerationResult)(nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	var firstCycle sync.WaitGroup
+	firstCycle.Add(1)
+	go func() {
+		defer close(stopped)
+		gameBackgroundWorker(ctx, client, client, &firstCycle)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	firstCycle.Wait()
+
+	return func() *GenerationResult {
+		t.Helper()
+		previous := latestGeneration()
+		fake.tick()
+		deadline := time.Now().Add(5 * time.Second)
+		for latestGeneration() == previous {
+			if time.Now().After(deadline) {
+				t.Fatalf("the game cycle didn't publish a result")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return latestGeneration()
+	}
+}
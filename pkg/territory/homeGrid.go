@@ -0,0 +1,67 @@
+package territory
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// homeGrids finds each owner's home, the grid holding the most of their land claims or of their
+// water claims when they have no land ones. Ties go to the lowest X and then the lowest Y
+func homeGrids(markers []Marker) map[uint64]GridID {
+	type tally struct{ land, water map[GridID]int }
+	tallies := make(map[uint64]*tally)
+	for _, marker := range markers {
+		t, ok := tallies[marker.tribeOrOwnerID]
+		if !ok {
+			t = &tally{land: make(map[GridID]int), water: make(map[GridID]int)}
+			tallies[marker.tribeOrOwnerID] = t
+		}
+		grid := GridID{X: marker.serverX, Y: marker.serverY}
+		switch marker.markerType {
+		case MarkerLand:
+			t.land[grid]++
+		case MarkerWater:
+			t.water[grid]++
+		}
+	}
+
+	homes := make(map[uint64]GridID, len(tallies))
+	for owner, t := range tallies {
+		byGrid := t.land
+		if len(byGrid) == 0 {
+			byGrid = t.water
+		}
+		best, bestCount := GridID{}, 0
+		for grid, count := range byGrid {
+			if count > bestCount || (count == bestCount && (grid.X < best.X || (grid.X == best.X && grid.Y < best.Y))) {
+				best, bestCount = grid, count
+			}
+		}
+		if bestCount > 0 {
+			homes[owner] = best
+		}
+	}
+	return homes
+}
+
+// packedGridID formats a grid as a packed server ID, the same form ActiveGrids uses
+func packedGridID(grid GridID) string {
+	return strconv.Itoa(grid.X<<16 | grid.Y)
+}
+
+// homeGridFilter parses a homeGrid filter, either a packed server ID or the name of one of the Regions
+func homeGridFilter(value string) (func(GridID) bool, error) {
+	for _, region := range config.Regions {
+		if region.Name == value {
+			return func(grid GridID) bool {
+				return grid.X >= region.MinX && grid.X <= region.MaxX && grid.Y >= region.MinY && grid.Y <= region.MaxY
+			}, nil
+		}
+	}
+	split, err := parseServerID(value)
+	if err != nil {
+		return nil, fmt.Errorf("homeGrid must be a packed server ID or a region name")
+	}
+	want := GridID{X: int(split[0]), Y: int(split[1])}
+	return func(grid GridID) bool { return grid == want }, nil
+}
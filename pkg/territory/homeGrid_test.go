@@ -0,0 +1,148 @@
+package territory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// claimsIn is count claims of owner in a grid
+func claimsIn(owner uint64, grid GridID, markerType uint8, count int) []Marker {
+	var markers []Marker
+	for i := 0; i < count; i++ {
+		markers = append(markers, Marker{tribeOrOwnerID: owner, serverX: grid.X, serverY: grid.Y, relX: float64(i+1) / float64(count+1), relY: 0.5, markerType: markerType})
+	}
+	return markers
+}
+
+func TestHomeGrids(t *testing.T) {
+	const tied, tiedOnX, waterOnly, landWins = 1000050001, 1000050002, 1000050003, 1000050004
+	var markers []Marker
+	markers = append(markers, claimsIn(tied, GridID{X: 2, Y: 0}, MarkerLand, 2)...)
+	markers = append(markers, claimsIn(tied, GridID{X: 0, Y: 3}, MarkerLand, 2)...)
+	markers = append(markers, claimsIn(tied, GridID{X: 1, Y: 1}, MarkerLand, 1)...)
+	markers = append(markers, claimsIn(tiedOnX, GridID{X: 1, Y: 2}, MarkerLand, 2)...)
+	markers = append(markers, claimsIn(tiedOnX, GridID{X: 1, Y: 1}, MarkerLand, 2)...)
+	markers = append(markers, claimsIn(waterOnly, GridID{X: 0, Y: 0}, MarkerWater, 1)...)
+	markers = append(markers, claimsIn(waterOnly, GridID{X: 3, Y: 1}, MarkerWater, 3)...)
+	// water claims don't count once an owner has a land claim
+	markers = append(markers, claimsIn(landWins, GridID{X: 0, Y: 0}, MarkerWater, 5)...)
+	markers = append(markers, claimsIn(landWins, GridID{X: 2, Y: 2}, MarkerLand, 1)...)
+
+	want := map[uint64]GridID{
+		tied:      {X: 0, Y: 3},
+		tiedOnX:   {X: 1, Y: 1},
+		waterOnly: {X: 3, Y: 1},
+		landWins:  {X: 2, Y: 2},
+	}
+	// the claims' order doesn't change the tie-break
+	for _, order := range [][]Marker{markers, reversedMarkers(markers)} {
+		if got := homeGrids(order); !reflect.DeepEqual(got, want) {
+			t.Errorf("homes %v, want %v", got, want)
+		}
+	}
+}
+
+func reversedMarkers(markers []Marker) []Marker {
+	reversed := make([]Marker, len(markers))
+	for i, marker := range markers {
+		reversed[len(markers)-1-i] = marker
+	}
+	return reversed
+}
+
+func TestLeaderboardFiltersByHomeGrid(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 2
+		cfg.Regions = []RegionConfig{
+			{Name: "west", MinX: 0, MaxX: 1, MinY: 0, MaxY: 1},
+			{Name: "east", MinX: 2, MaxX: 3, MinY: 0, MaxY: 1},
+		}
+	})
+	_, client := newTestRedis(t)
+
+	// a dozen big eastern tribes push the western ones out of the overall top 10
+	var markers []Marker
+	for i := 0; i < 12; i++ {
+		markers = append(markers, claimsIn(1000050100+uint64(i), GridID{X: 2 + i%2, Y: i % 2}, MarkerLand, 20-i)...)
+	}
+	const west, westWater, hidden = 1000050001, 1000050002, 1000050003
+	markers = append(markers, claimsIn(west, GridID{X: 1, Y: 0}, MarkerLand, 3)...)
+	markers = append(markers, claimsIn(west, GridID{X: 2, Y: 0}, MarkerLand, 2)...)
+	markers = append(markers, claimsIn(westWater, GridID{X: 0, Y: 1}, MarkerWater, 2)...)
+	// an opted-out owner's home grid isn't published
+	markers = append(markers, claimsIn(hidden, GridID{X: 0, Y: 0}, MarkerLand, 4)...)
+	optOut := map[uint64]bool{hidden: true}
+
+	counts := make(map[uint64]*TribeCount)
+	for _, marker := range markers {
+		countTribeClaim(counts, marker)
+	}
+	board, published := publishTopTribes(client, markers, counts, optOut, nil)
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+	publishGeneration(&GenerationResult{CRC: 1, Leaderboard: board})
+
+	// the game's toptribes carry the home grid
+	var first GameTribeOutput
+	if err := json.Unmarshal([]byte(published[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.TribeID != 1000050100 || first.HomeGrid != packedGridID(GridID{X: 2, Y: 0}) {
+		t.Errorf("top tribe %+v, want 1000050100 at home in grid 2,0", first)
+	}
+
+	handler := topTribesCSVHandler(client)
+	homes := func(query string) (ids []string, homeGrids []string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/topTribes.csv"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s is %d: %s", query, w.Code, w.Body.String())
+		}
+		rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows[1:] {
+			ids = append(ids, row[1])
+			homeGrids = append(homeGrids, row[4])
+		}
+		return ids, homeGrids
+	}
+
+	if ids, _ := homes(""); len(ids) != leaderboardSize || strings.Contains(strings.Join(ids, ","), "100005000") {
+		t.Errorf("overall leaderboard %v, want only the eastern tribes", ids)
+	}
+	ids, grids := homes("?homeGrid=west")
+	if want := []string{"1000050001", "1000050002"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("west leaderboard %v, want %v", ids, want)
+	}
+	if want := []string{packedGridID(GridID{X: 1, Y: 0}), packedGridID(GridID{X: 0, Y: 1})}; !reflect.DeepEqual(grids, want) {
+		t.Errorf("west home grids %v, want %v", grids, want)
+	}
+	ids, _ = homes("?homeGrid=" + packedGridID(GridID{X: 3, Y: 1}))
+	if len(ids) != 6 {
+		t.Errorf("grid 3,1 leaderboard %v, want its 6 tribes", ids)
+	}
+	for _, id := range ids {
+		n, _ := strconv.ParseUint(id, 10, 64)
+		if (n-1000050100)%2 != 1 {
+			t.Errorf("tribe %s isn't at home in grid 3,1", id)
+		}
+	}
+	if ids, _ := homes("?homeGrid=" + packedGridID(GridID{X: 0, Y: 0})); len(ids) != 0 {
+		t.Errorf("grid 0,0 leaderboard %v, want the opted-out owner left out", ids)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/topTribes.csv?homeGrid=north", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown region is %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package territory
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+// JSONError is the error envelope returned by /api/ and /admin/ routes
+type JSONError struct {
+	Error     string `json:"error"`
+	RequestID string `json:"requestID"`
+	Status    int    `json:"status"`
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// isAPIPath checks if errors for the path should use the JSON envelope. The path may still have
+// BasePath, requestMiddleware sees it before it's stripped
+func isAPIPath(urlPath string) bool {
+	if len(config.BasePath) > 0 && strings.HasPrefix(urlPath, config.BasePath+"/") {
+		urlPath = strings.TrimPrefix(urlPath, config.BasePath)
+	}
+	return strings.HasPrefix(urlPath, "/api/") || strings.HasPrefix(urlPath, "/admin/")
+}
+
+// writeError responds with the JSON envelope on API routes and plain text elsewhere
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	requestID := requestIDFromContext(r.Context())
+	if status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s: %s", requestID, r.Method, r.URL.Path, message)
+	}
+	if !isAPIPath(r.URL.Path) {
+		http.Error(w, message, status)
+		return
+	}
+	js, _ := json.Marshal(JSONError{Error: message, RequestID: requestID, Status: status})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// statusRecorder captures the response status for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool // a panic after this can't change the response
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.wroteHeader = true
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// requestMiddleware tags every request with an ID, recovers handler panics and writes the access log
+func requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := newRequestID()
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, requestID))
+		w.Header().Set("X-Request-ID", requestID)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("[%s] panic serving %s: %v", requestID, r.URL.Path, err)
+				if !rec.wroteHeader {
+					writeError(rec, r, http.StatusInternalServerError, "internal server error")
+				}
+			}
+			if config.EnableAccessLog {
+				log.Printf("[%s] %s %s %s %d %v", requestID, r.RemoteAddr, r.Method, r.URL.Path, rec.status, time.Since(start))
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "not found")
+}
+
+// newHTTPHandler builds the server's mux rather than relying on http.DefaultServeMux
+func newHTTPHandler(client *redis.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/api/tiles/counts", tileCountsHandler)
+	mux.HandleFunc("/api/diff", diffHandler)
+	mux.HandleFunc("/api/stats", statsHandler)
+	mux.HandleFunc("/api/servers", serversHandler)
+	mux.HandleFunc("/api/markers", markersHandler)
+	mux.HandleFunc("/api/topTribes.csv", topTribesCSVHandler(client))
+	mux.HandleFunc("/api/tileForPoint", tileForPointHandler)
+	mux.HandleFunc("/api/artifacts", artifactsHandler)
+	mux.HandleFunc("/admin/audit", requireAdmin(auditHandler))
+	mux.HandleFunc("/admin/verify", requireAdmin(verifyHandler(client)))
+	mux.HandleFunc("/admin/regenerate/server/", requireAdmin(admitRender(regenerateServerHandler(client))))
+	mux.HandleFunc("/admin/poster", requireAdmin(posterHandler(client)))
+	mux.HandleFunc("/admin/poster/", requireAdmin(posterHandler(client)))
+	mux.HandleFunc("/admin/renders", requireAdmin(renderAdmissionHandler))
+	mux.HandleFunc("/admin/caches", requireAdmin(cachesHandler))
+	mux.HandleFunc("/admin/errors", requireAdmin(errorsHandler))
+	mux.HandleFunc("/admin/logs", requireAdmin(logsHandler))
+	mux.HandleFunc("/admin/zoomAdvice", requireAdmin(zoomAdviceHandler))
+	// unknown API routes get the JSON envelope instead of falling through to the file server
+	mux.HandleFunc("/api/", notFoundHandler)
+	mux.HandleFunc("/admin/", notFoundHandler)
+	fileHandler := &fileHandlerWithCacheControl{fileServer: http.FileServer(http.Dir(config.WWWDir))}
+	mux.Handle("/territoryTiles/", &tileRangeHandler{prefix: "/territoryTiles/", next: &tileFormatHandler{next: &tileCacheHandler{next: fileHandler}}})
+	gameTiles := newGameAccessHandler(fileHandler)
+	mux.Handle("/gameTiles/", gameTiles)
+	mux.Handle("/", &gameTilesAnyCase{gameTiles: gameTiles, next: fileHandler})
+
+	// mount everything under BasePath when running behind a proxy at a subpath
+	if len(config.BasePath) == 0 {
+		return requestMiddleware(mux)
+	}
+	root := http.NewServeMux()
+	root.Handle(config.BasePath+"/", http.StripPrefix(config.BasePath, mux))
+	return requestMiddleware(root)
+}
@@ -0,0 +1,161 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIErrorsUseJSONEnvelope(t *testing.T) {
+	useTestConfig(t, nil)
+	handler := newHTTPHandler(nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/tiles/counts", nil))
+	requestID := w.Header().Get("X-Request-ID")
+	if len(requestID) == 0 {
+		t.Fatalf("no X-Request-ID header")
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type %q, want JSON", contentType)
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	want := map[string]interface{}{"error": "method not allowed", "requestID": requestID, "status": float64(http.StatusMethodNotAllowed)}
+	if len(envelope) != len(want) {
+		t.Fatalf("envelope %v, want exactly %v", envelope, want)
+	}
+	for key, value := range want {
+		if envelope[key] != value {
+			t.Errorf("envelope %s is %v, want %v", key, envelope[key], value)
+		}
+	}
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestStaticRoutesKeepPlainErrors(t *testing.T) {
+	useTestConfig(t, nil)
+	handler := newHTTPHandler(nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing.html", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got %d, want 404", w.Code)
+	}
+	if len(w.Header().Get("X-Request-ID")) == 0 {
+		t.Fatalf("no X-Request-ID header")
+	}
+	if strings.HasPrefix(w.Body.String(), "{") {
+		t.Fatalf("static route answered with the JSON envelope: %s", w.Body.String())
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	useTestConfig(t, nil)
+	handler := newHTTPHandler(nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/tiles/counts", nil))
+		id := w.Header().Get("X-Request-ID")
+		if seen[id] {
+			t.Fatalf("request ID %q handed out twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestHandlerPanicRecoveredIntoJSON(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.EnableAccessLog = true })
+	logged := useLogBuffer(t)
+	calls := 0
+	handler := requestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler broke")
+		}
+		w.Write([]byte("ok"))
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope JSONError
+	json.NewDecoder(resp.Body).Decode(&envelope)
+	resp.Body.Close()
+	requestID := resp.Header.Get("X-Request-ID")
+	if resp.StatusCode != http.StatusInternalServerError || envelope.Status != http.StatusInternalServerError || envelope.RequestID != requestID {
+		t.Fatalf("got %d %+v, want a 500 envelope with request ID %q", resp.StatusCode, envelope, requestID)
+	}
+	// the access log and the panic's error log carry the request ID
+	for _, line := range []string{"[" + requestID + "] panic serving /api/broken", "GET /api/broken 500"} {
+		if !strings.Contains(logged.String(), line) {
+			t.Fatalf("log doesn't have %q: %s", line, logged.String())
+		}
+	}
+	if !strings.Contains(logged.String(), "["+requestID+"] 127.0.0.1") {
+		t.Fatalf("access log without the request ID: %s", logged.String())
+	}
+
+	// the server keeps serving
+	resp, err = http.Get(server.URL + "/api/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d after the panic, want 200", resp.StatusCode)
+	}
+}
+
+func TestUnknownAPIRoutesUseJSONEnvelope(t *testing.T) {
+	for _, basePath := range []string{"", "/atlasmap"} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.BasePath = basePath })
+		handler := newHTTPHandler(nil)
+		for _, route := range []string{"/api/missing", "/admin/missing"} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, basePath+route, nil))
+			var envelope JSONError
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil || w.Code != http.StatusNotFound || envelope.Status != http.StatusNotFound {
+				t.Errorf("GET %s got %d %s, want a 404 envelope", basePath+route, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestPanicAfterTheHeaderKeepsTheResponse(t *testing.T) {
+	useTestConfig(t, nil)
+	useLogBuffer(t)
+	handler := requestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("handler broke")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/broken", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Fatalf("got %d %q, want the response the handler started", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerPanicUnderBasePathUsesJSON(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.BasePath = "/atlasmap" })
+	useLogBuffer(t)
+	handler := requestMiddleware(http.StripPrefix(config.BasePath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler broke")
+	})))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/atlasmap/api/broken", nil))
+	var envelope JSONError
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil || envelope.Status != http.StatusInternalServerError {
+		t.Fatalf("got %d %s, want a 500 envelope", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,262 @@
+package territory
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// importBatchSize is the number of claims written per pipeline
+const importBatchSize = 1000
+
+// ImportResult summarises an import
+type ImportResult struct {
+	Rows     int            `json:"rows"`
+	Rejected map[string]int `json:"rejected"` // by reason
+	Written  map[string]int `json:"written"`  // claims per packed server ID
+	Cleared  int            `json:"cleared"`  // territorymapdata keys removed by --replace
+	DryRun   bool           `json:"dryRun"`
+}
+
+// encodeClaim packs a claim the way the game stores it: owner ID, relX and relY as uint16 and the
+// marker type, padded to the size the game writes
+func encodeClaim(owner uint64, relX, relY float64, markerType uint8, size int) string {
+	raw := make([]byte, size)
+	binary.LittleEndian.PutUint64(raw[0:8], owner)
+	binary.LittleEndian.PutUint16(raw[8:10], uint16(math.Round(relX*math.MaxUint16)))
+	binary.LittleEndian.PutUint16(raw[10:12], uint16(math.Round(relY*math.MaxUint16)))
+	raw[12] = markerType
+	return string(raw)
+}
+
+// importClaimRaw rebuilds the raw claim of an export line, the reason is set when it's invalid.
+// Exports don't keep the payload's padding so the size whose CRC matches the claim's ID is used
+func importClaimRaw(claim ExportClaim) (grid GridID, raw string, reason string) {
+	if claim.Type != "claim" {
+		return grid, "", "not a claim"
+	}
+	grid = GridID{X: claim.ServerID >> 16, Y: claim.ServerID & 0xffff}
+	if claim.ServerID < 0 || grid.X >= config.ServersX || grid.Y >= config.ServersY {
+		return grid, "", "grid out of range"
+	}
+	relX := claim.WorldX/config.GridSize - float64(grid.X)
+	relY := claim.WorldY/config.GridSize - float64(grid.Y)
+	// world coordinates carry float error, a claim on the grid's edge can land just outside it
+	const slack = 1e-9
+	if !isFinite(relX) || !isFinite(relY) || relX < -slack || relX > 1+slack || relY < -slack || relY > 1+slack {
+		return grid, "", "position outside its grid"
+	}
+	relX, relY = math.Max(0, math.Min(1, relX)), math.Max(0, math.Min(1, relY))
+	var markerType uint8
+	switch claim.MarkerType {
+	case "land":
+		markerType = MarkerLand
+	case "water":
+		markerType = MarkerWater
+	default:
+		return grid, "", "unknown marker type"
+	}
+	for _, size := range []int{16, 13} {
+		raw = encodeClaim(claim.OwnerID, relX, relY, markerType, size)
+		if exportClaimID(raw) == claim.ID {
+			return grid, raw, ""
+		}
+	}
+	// an edited or foreign export, the game's size is used
+	return grid, encodeClaim(claim.OwnerID, relX, relY, markerType, 16), ""
+}
+
+// clearTerritoryKeys deletes every territorymapdata key, returning how many there were
+func clearTerritoryKeys(client *redis.Client, dryRun bool) (int, error) {
+	var keys []string
+	iter := client.Scan(0, "territorymapdata:*", 1000).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun || len(keys) == 0 {
+		return len(keys), nil
+	}
+	for start := 0; start < len(keys); start += importBatchSize {
+		if err := client.Del(keys[start:Min(start+importBatchSize, len(keys))]...).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// openExport opens an export for reading, gunzipping .gz files
+func openExport(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// runImport is the import subcommand, returning the process exit code. It seeds territorymapdata
+// from a full export so a new or wiped redis can be rebuilt. Claims are added to sets so running
+// it again is harmless, --skip resumes after a failure without re-reading the written lines
+func runImport(client *redis.Client, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "validate and print what would be written without writing")
+	replace := flags.Bool("replace", false, "delete every territorymapdata key before importing")
+	yes := flags.Bool("yes", false, "don't ask for confirmation before --replace deletes")
+	skip := flags.Int("skip", 0, "lines already imported, to resume after a failure")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-dry-run] [-replace [-yes]] [-skip lines] <claims.jsonl.gz>")
+		return 2
+	}
+	filename := flags.Arg(0)
+
+	in, err := openExport(filename)
+	if err != nil {
+		log.Printf("Import failed: %v", err)
+		return 1
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	if !scanner.Scan() {
+		log.Printf("Import failed: %s is empty", filename)
+		return 1
+	}
+	var header ExportHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" {
+		log.Printf("Import failed: %s doesn't start with an export header", filename)
+		return 1
+	}
+	if header.SchemaVersion != exportSchemaVersion {
+		log.Printf("Import failed: %s is schema version %d, expected %d", filename, header.SchemaVersion, exportSchemaVersion)
+		return 1
+	}
+	if !header.Since.IsZero() {
+		log.Printf("Import failed: %s is incremental, import needs a full export", filename)
+		return 1
+	}
+	if header.ServersX != config.ServersX || header.ServersY != config.ServersY || header.GridSize != config.GridSize {
+		log.Printf("Warning! %s was exported from a %dx%d world of GridSize %v, importing into %dx%d of GridSize %v",
+			filename, header.ServersX, header.ServersY, header.GridSize, config.ServersX, config.ServersY, config.GridSize)
+	}
+
+	result := ImportResult{Rejected: make(map[string]int), Written: make(map[string]int), DryRun: *dryRun}
+	if *replace {
+		if !*dryRun && !*yes {
+			fmt.Printf("Delete every territorymapdata key in %s before importing? Type yes to continue: ", client.Options().Addr)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != "yes" {
+				fmt.Println("Import cancelled")
+				return 1
+			}
+		}
+		if result.Cleared, err = clearTerritoryKeys(client, *dryRun); err != nil {
+			log.Printf("Import failed clearing territorymapdata: %v", err)
+			return 1
+		}
+	}
+
+	type pendingClaim struct {
+		key string
+		raw string
+	}
+	var batch []pendingClaim
+	written := Max(1, *skip) // lines done, the header included
+	flush := func(line int) error {
+		if !*dryRun && len(batch) > 0 {
+			err := retryTransient(client.Context(), func() error {
+				pipe := client.Pipeline()
+				defer pipe.Close()
+				for _, claim := range batch {
+					pipe.SAdd(claim.key, claim.raw)
+				}
+				_, err := pipe.Exec()
+				return classify(ErrTransient, "publish", err)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		written = line
+		return nil
+	}
+
+	line := 1
+	for scanner.Scan() {
+		line++
+		if line <= *skip {
+			continue
+		}
+		result.Rows++
+		var claim ExportClaim
+		if err := json.Unmarshal(scanner.Bytes(), &claim); err != nil {
+			result.Rejected["unreadable line"]++
+			continue
+		}
+		grid, raw, reason := importClaimRaw(claim)
+		if len(reason) > 0 {
+			result.Rejected[reason]++
+			continue
+		}
+		batch = append(batch, pendingClaim{key: fmt.Sprintf("territorymapdata:%d", grid.X<<16|grid.Y), raw: raw})
+		result.Written[packedGridID(grid)]++
+		if len(batch) == importBatchSize {
+			if err := flush(line); err != nil {
+				log.Printf("Import failed after line %d, resume with -skip %d: %v", written, written, err)
+				return 1
+			}
+		}
+		if result.Rows%100000 == 0 {
+			log.Printf("Imported %d rows", result.Rows)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Import failed reading line %d, resume with -skip %d: %v", line+1, written, err)
+		return 1
+	}
+	if err := flush(line); err != nil {
+		log.Printf("Import failed after line %d, resume with -skip %d: %v", written, written, err)
+		return 1
+	}
+
+	if *dryRun {
+		if *replace {
+			fmt.Printf("would delete %d territorymapdata keys\n", result.Cleared)
+		}
+		var grids []string
+		for grid := range result.Written {
+			grids = append(grids, grid)
+		}
+		sort.Strings(grids)
+		for _, grid := range grids {
+			fmt.Printf("would add %d claims to territorymapdata:%s\n", result.Written[grid], grid)
+		}
+	}
+	js, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(js))
+	return 0
+}
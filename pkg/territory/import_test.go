@@ -0,0 +1,236 @@
+package territory
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		output <- string(out)
+	}()
+	fn()
+	os.Stdout = previous
+	w.Close()
+	return <-output
+}
+
+// runTestImport runs the import subcommand, returning its exit code and summary
+func runTestImport(t *testing.T, client *redis.Client, args ...string) (int, ImportResult) {
+	t.Helper()
+	var code int
+	out := captureStdout(t, func() { code = runImport(client, args) })
+	var result ImportResult
+	// the summary is the last thing printed
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] == '{' && (i == 0 || out[i-1] == '\n') {
+			json.Unmarshal([]byte(out[i:]), &result)
+			break
+		}
+	}
+	return code, result
+}
+
+// territorySets reads every territorymapdata set, members sorted
+func territorySets(t *testing.T, client *redis.Client) map[string][]string {
+	t.Helper()
+	keys, err := client.Keys("territorymapdata:*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sets := make(map[string][]string)
+	for _, key := range keys {
+		members := client.SMembers(key).Val()
+		sort.Strings(members)
+		sets[key] = members
+	}
+	return sets
+}
+
+// writeImportFile writes an export of the given lines, the header first
+func writeImportFile(t *testing.T, header ExportHeader, lines ...interface{}) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "claims.jsonl.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	encoder := json.NewEncoder(gz)
+	encoder.Encode(header)
+	for _, line := range lines {
+		if raw, ok := line.(string); ok {
+			gz.Write([]byte(raw + "\n"))
+			continue
+		}
+		encoder.Encode(line)
+	}
+	return filename
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 3, 3 })
+	useArtifactMeta(t)
+	_, client := newTestRedis(t)
+	random := rand.New(rand.NewSource(1))
+	// more than a batch, with claims on the grid edges and the game's older 13 byte claims
+	for i := 0; i < 2500; i++ {
+		grid := GridID{X: random.Intn(3), Y: random.Intn(3)}
+		relX, relY := random.Float64(), random.Float64()
+		switch i % 50 {
+		case 0:
+			relX, relY = 0, 1
+		case 1:
+			relX, relY = 1, 0
+		}
+		markerType := MarkerLand
+		if random.Intn(4) == 0 {
+			markerType = MarkerWater
+		}
+		owner := 1000050001 + uint64(random.Intn(40))
+		if i%7 == 0 {
+			owner = uint64(random.Intn(1000) + 1)
+		}
+		size := 16
+		if i%10 == 0 {
+			size = 13
+		}
+		client.SAdd("territorymapdata:"+packedGridID(grid), encodeClaim(owner, relX, relY, markerType, size))
+	}
+	before := territorySets(t, client)
+	if len(before) != 9 {
+		t.Fatalf("seeded %d grids, want 9", len(before))
+	}
+
+	filename := filepath.Join(config.WWWDir, exportArtifact)
+	writeTestExport(t, client, filename, "")
+	client.FlushAll()
+
+	code, result := runTestImport(t, client, filename)
+	if code != 0 {
+		t.Fatalf("import exited %d", code)
+	}
+	written := 0
+	for _, n := range result.Written {
+		written += n
+	}
+	if result.Rows != written || len(result.Rejected) != 0 {
+		t.Errorf("read %d rows, wrote %d, rejected %v", result.Rows, written, result.Rejected)
+	}
+	if after := territorySets(t, client); !reflect.DeepEqual(after, before) {
+		t.Errorf("the imported sets differ from the exported ones")
+		for key, members := range before {
+			if !reflect.DeepEqual(after[key], members) {
+				t.Errorf("%s has %d claims, exported %d", key, len(after[key]), len(members))
+			}
+		}
+	}
+
+	// importing again is harmless
+	if code, _ := runTestImport(t, client, filename); code != 0 {
+		t.Fatalf("second import exited %d", code)
+	}
+	if after := territorySets(t, client); !reflect.DeepEqual(after, before) {
+		t.Errorf("importing twice changed the sets")
+	}
+}
+
+func TestImportValidatesRows(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 2, 2 })
+	_, client := newTestRedis(t)
+	header := ExportHeader{Type: "header", SchemaVersion: exportSchemaVersion, ServersX: 2, ServersY: 2, GridSize: config.GridSize}
+	grid := config.GridSize
+	valid := ExportClaim{Type: "claim", OwnerID: 1000050001, ServerID: 1 << 16, WorldX: 1.5 * grid, WorldY: 0.25 * grid, MarkerType: "land"}
+	outOfRange := valid
+	outOfRange.ServerID = 5 << 16
+	outside := valid
+	outside.WorldY = 1.5 * grid
+	unknownType := valid
+	unknownType.MarkerType = "lava"
+	filename := writeImportFile(t, header, valid, outOfRange, outside, unknownType, "not json")
+
+	code, result := runTestImport(t, client, filename)
+	if code != 0 {
+		t.Fatalf("import exited %d", code)
+	}
+	want := map[string]int{"grid out of range": 1, "position outside its grid": 1, "unknown marker type": 1, "unreadable line": 1}
+	if result.Rows != 5 || !reflect.DeepEqual(result.Rejected, want) {
+		t.Errorf("read %d rows, rejected %v, want 5 rows and %v", result.Rows, result.Rejected, want)
+	}
+	sets := territorySets(t, client)
+	if len(sets) != 1 || len(sets["territorymapdata:"+strconv.Itoa(1<<16)]) != 1 {
+		t.Errorf("imported %v, want the one valid claim on grid 1,0", sets)
+	}
+
+	// incremental exports and other schema versions aren't imported
+	incremental := header
+	incremental.Since = header.GeneratedAt.AddDate(0, 0, 1)
+	if code, _ := runTestImport(t, client, writeImportFile(t, incremental, valid)); code != 1 {
+		t.Errorf("importing an incremental export exited %d, want 1", code)
+	}
+	future := header
+	future.SchemaVersion = exportSchemaVersion + 1
+	if code, _ := runTestImport(t, client, writeImportFile(t, future, valid)); code != 1 {
+		t.Errorf("importing schema version %d exited %d, want 1", future.SchemaVersion, code)
+	}
+}
+
+func TestImportDryRunReplaceAndSkip(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 2, 2 })
+	_, client := newTestRedis(t)
+	header := ExportHeader{Type: "header", SchemaVersion: exportSchemaVersion, ServersX: 2, ServersY: 2, GridSize: config.GridSize}
+	var claims []interface{}
+	for i := 0; i < 4; i++ {
+		claims = append(claims, ExportClaim{Type: "claim", OwnerID: 1000050001 + uint64(i), ServerID: 0, WorldX: 0.5 * config.GridSize, WorldY: 0.5 * config.GridSize, MarkerType: "land"})
+	}
+	filename := writeImportFile(t, header, claims...)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 7, 0.5, 0.5, MarkerWater)
+	stray := territorySets(t, client)
+
+	code, result := runTestImport(t, client, "--dry-run", "--replace", filename)
+	if code != 0 || !result.DryRun || result.Cleared != 1 || result.Written["0"] != 4 {
+		t.Errorf("dry run exited %d with %+v, want 1 key to clear and 4 claims to write", code, result)
+	}
+	if sets := territorySets(t, client); !reflect.DeepEqual(sets, stray) {
+		t.Errorf("the dry run changed redis: %v", sets)
+	}
+
+	// resuming after the header and two claims imports the last two
+	if code, result := runTestImport(t, client, "--skip", "3", filename); code != 0 || result.Rows != 2 {
+		t.Errorf("resumed import exited %d after %d rows, want 2", code, result.Rows)
+	}
+	if n := len(territorySets(t, client)["territorymapdata:0"]); n != 2 {
+		t.Errorf("resumed import wrote %d claims, want 2", n)
+	}
+
+	code, result = runTestImport(t, client, "--replace", "--yes", filename)
+	if code != 0 || result.Cleared != 2 {
+		t.Errorf("replace exited %d clearing %d keys, want 2", code, result.Cleared)
+	}
+	sets := territorySets(t, client)
+	if len(sets) != 1 || len(sets["territorymapdata:0"]) != 4 {
+		t.Errorf("after --replace redis has %v, want only the 4 imported claims", sets)
+	}
+}
@@ -0,0 +1,173 @@
+package territory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// renewLeaderScript extends the lock only while this instance still holds it
+var renewLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLeaderScript deletes the lock only while this instance still holds it
+var releaseLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// leadership is this instance's view of the generator lock, with LeaderLockKey set only the
+// holder generates and publishes URLs
+var leadership = struct {
+	sync.Mutex
+	id     string
+	leader bool
+	term   int // incremented each time the lock is acquired
+}{}
+
+func leaderElectionEnabled() bool {
+	return len(config.LeaderLockKey) > 0
+}
+
+func leaderLockTTL() time.Duration {
+	return time.Duration(config.LeaderLockTTLSeconds) * time.Second
+}
+
+// leaderID identifies this instance in the lock
+func leaderID() string {
+	leadership.Lock()
+	defer leadership.Unlock()
+	if len(leadership.id) == 0 {
+		host, _ := os.Hostname()
+		leadership.id = fmt.Sprintf("%s:%d:%08x", host, config.Port, rand.Uint32())
+	}
+	return leadership.id
+}
+
+// isLeader reports whether this instance should generate and the term it holds the lock in,
+// always true with leader election disabled
+func isLeader() (bool, int) {
+	if !leaderElectionEnabled() {
+		return true, 0
+	}
+	leadership.Lock()
+	defer leadership.Unlock()
+	return leadership.leader, leadership.term
+}
+
+func setLeader(leader bool) {
+	leadership.Lock()
+	defer leadership.Unlock()
+	if leader == leadership.leader {
+		return
+	}
+	leadership.leader = leader
+	if leader {
+		leadership.term++
+		log.Printf("Acquired generator lock %s, generating as leader", config.LeaderLockKey)
+	} else {
+		log.Printf("Warning! Lost generator lock %s, following", config.LeaderLockKey)
+	}
+}
+
+// campaign renews the lock when held and otherwise tries to take it. Leadership is only given up
+// once the lock is confirmed held by someone else or gone, a redis error alone changes nothing
+func campaign(client *redis.Client) {
+	id := leaderID()
+	if leader, _ := isLeader(); leader {
+		if renewLeadership(client, id) {
+			return
+		}
+	}
+	acquired, err := client.SetNX(config.LeaderLockKey, id, leaderLockTTL()).Result()
+	if err != nil {
+		log.Printf("Warning! Failed to take generator lock: %v", err)
+		return
+	}
+	if acquired {
+		setLeader(true)
+		return
+	}
+
+	// the lock may still be this instance's own, e.g. from before a failed renew
+	holder, err := client.Get(config.LeaderLockKey).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("Warning! Failed to check generator lock: %v", err)
+		return
+	}
+	if holder == id {
+		renewLeadership(client, id)
+	}
+}
+
+// renewLeadership extends the lock and keeps leadership while it is held, it returns false once
+// the lock is confirmed lost. Errors keep the current role
+func renewLeadership(client *redis.Client, id string) bool {
+	renewed, err := renewLeaderScript.Run(client, []string{config.LeaderLockKey}, id, leaderLockTTL().Nanoseconds()/int64(time.Millisecond)).Int()
+	if err != nil {
+		log.Printf("Warning! Failed to renew generator lock: %v", err)
+		return true
+	}
+	setLeader(renewed == 1)
+	return renewed == 1
+}
+
+// leaderElectionWorker keeps campaigning a few times per TTL so a held lock never lapses and a
+// follower takes over within a TTL of the leader disappearing
+func leaderElectionWorker(ctx context.Context, client *redis.Client) {
+	schedule := newIntervalSchedule(leaderLockTTL() / 3)
+	defer schedule.stop()
+	for schedule.wait(ctx) {
+		campaign(client)
+	}
+}
+
+// confirmLeadership checks the lock itself right before publishing, a leader that stalled past
+// its TTL mid-cycle may have been replaced without noticing yet
+func confirmLeadership(client *redis.Client) bool {
+	if !leaderElectionEnabled() {
+		return true
+	}
+	holder, err := client.Get(config.LeaderLockKey).Result()
+	if err != nil && err != redis.Nil {
+		// not confirmed either way, skip this publish but keep leadership
+		log.Printf("Warning! Failed to check generator lock: %v", err)
+		return false
+	}
+	held := holder == leaderID()
+	if !held {
+		setLeader(false)
+	}
+	return held
+}
+
+// releaseLeadership gives up the lock at shutdown so a follower takes over
+// immediately rather than after the TTL
+func releaseLeadership(client *redis.Client) {
+	if leader, _ := isLeader(); leader {
+		if err := releaseLeaderScript.Run(client, []string{config.LeaderLockKey}, leaderID()).Err(); err != nil {
+			log.Printf("Warning! Failed to release generator lock: %v", err)
+		}
+	}
+}
+
+// leadershipRole is reported by /health, empty with leader election disabled
+func leadershipRole() string {
+	if !leaderElectionEnabled() {
+		return ""
+	}
+	if leader, _ := isLeader(); leader {
+		return "leader"
+	}
+	return "follower"
+}
@@ -0,0 +1,213 @@
+package territory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// testInstance is one generator instance's leadership state, the process only has room for one
+// so instances take turns installing theirs
+type testInstance struct {
+	name      string
+	id        string
+	leader    bool
+	term      int
+	published int
+}
+
+// as runs fn with the instance's leadership installed and keeps what fn changed
+func (i *testInstance) as(fn func()) {
+	leadership.Lock()
+	leadership.id, leadership.leader, leadership.term = i.id, i.leader, i.term
+	leadership.Unlock()
+	config.URLPublisherName = i.name
+	fn()
+	leadership.Lock()
+	i.leader, i.term = leadership.leader, leadership.term
+	leadership.Unlock()
+}
+
+// cycle is one generation of the instance: campaign, then publish only while holding the lock
+func (i *testInstance) cycle(client *redis.Client, generation int) {
+	i.as(func() {
+		campaign(client)
+		if leader, _ := isLeader(); leader && confirmLeadership(client) {
+			if written, _ := writeUrlsToRedis(client, ArtifactMeta{CRC: uint32(generation)}, int32(generation)); written {
+				i.published++
+			}
+		}
+	})
+}
+
+func useLeaderElection(t *testing.T) (*testInstance, *testInstance) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.LeaderLockKey = "territory_generator_lock"
+		cfg.LeaderLockTTLSeconds = 30
+	})
+	leadership.Lock()
+	id, leader, term := leadership.id, leadership.leader, leadership.term
+	leadership.Unlock()
+	t.Cleanup(func() {
+		leadership.Lock()
+		leadership.id, leadership.leader, leadership.term = id, leader, term
+		leadership.Unlock()
+	})
+	return &testInstance{name: "a", id: "a:1"}, &testInstance{name: "b", id: "b:1"}
+}
+
+func publisherOf(t *testing.T, client *redis.Client) string {
+	t.Helper()
+	publisher, err := client.HGet("territory_urls", "publisher").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publisher
+}
+
+func TestLeaderElectionPublishesOncePerCycle(t *testing.T) {
+	a, b := useLeaderElection(t)
+	server, client := newTestRedis(t)
+
+	generation := 0
+	run := func(cycles int, instances ...*testInstance) {
+		for n := 0; n < cycles; n++ {
+			generation++
+			before := a.published + b.published
+			for _, instance := range instances {
+				instance.cycle(client, generation)
+			}
+			if published := a.published + b.published - before; published != 1 {
+				t.Fatalf("generation %d published %d times, want once", generation, published)
+			}
+			// a cycle is a third of the TTL, renewals keep the lock
+			server.FastForward(10 * time.Second)
+		}
+	}
+
+	run(5, a, b)
+	if !a.leader || b.leader || a.published != 5 || publisherOf(t, client) != "a" {
+		t.Fatalf("a leader %v published %d, b leader %v published %d, want a alone", a.leader, a.published, b.leader, b.published)
+	}
+	b.as(func() {
+		if role := leadershipRole(); role != "follower" {
+			t.Errorf("b's /health role is %q, want follower", role)
+		}
+	})
+
+	// a is killed, b takes over within the TTL
+	for elapsed := time.Duration(0); !b.leader; elapsed += 10 * time.Second {
+		if elapsed > 30*time.Second {
+			t.Fatalf("b didn't take over within the TTL")
+		}
+		server.FastForward(10 * time.Second)
+		b.as(func() { campaign(client) })
+	}
+	run(3, b)
+	if b.published != 3 || publisherOf(t, client) != "b" || b.term != 1 {
+		t.Errorf("b published %d in term %d, publisher %s", b.published, b.term, publisherOf(t, client))
+	}
+
+	// a restarts as a follower, b shuts down cleanly and a takes over on its next cycle without
+	// waiting out the TTL
+	*a = testInstance{name: "a", id: "a:2"}
+	run(1, a, b)
+	b.as(func() { releaseLeadership(client) })
+	run(2, a)
+	if a.published != 2 || publisherOf(t, client) != "a" || a.term != 1 {
+		t.Errorf("a published %d in term %d after b released the lock", a.published, a.term)
+	}
+}
+
+func TestDeposedLeaderDoesNotPublish(t *testing.T) {
+	a, b := useLeaderElection(t)
+	server, client := newTestRedis(t)
+	a.cycle(client, 1)
+	if !a.leader {
+		t.Fatalf("a didn't take the free lock")
+	}
+
+	// a stalls mid-cycle past the TTL while b takes the lock
+	server.FastForward(31 * time.Second)
+	b.as(func() { campaign(client) })
+	if !b.leader {
+		t.Fatalf("b didn't take the lapsed lock")
+	}
+
+	// a still thinks it leads until it checks the lock before publishing
+	a.as(func() {
+		if leader, _ := isLeader(); !leader {
+			t.Fatalf("a noticed the lock loss before checking it")
+		}
+		if confirmLeadership(client) {
+			t.Errorf("a confirmed leadership of b's lock")
+		}
+		if leader, _ := isLeader(); leader {
+			t.Errorf("a still leads after failing to confirm")
+		}
+	})
+	if publisher := publisherOf(t, client); publisher != "a" {
+		t.Errorf("territory_urls published by %s, want a's generation 1 left alone", publisher)
+	}
+	if holder, _ := client.Get("territory_generator_lock").Result(); holder != b.id {
+		t.Errorf("lock held by %q, want b", holder)
+	}
+
+	// a's renewal can't steal the lock back
+	a.leader = true
+	a.as(func() { campaign(client) })
+	if a.leader {
+		t.Errorf("a renewed b's lock")
+	}
+	if holder, _ := client.Get("territory_generator_lock").Result(); holder != b.id {
+		t.Errorf("lock held by %q after a's renewal, want b", holder)
+	}
+}
+
+func TestRedisErrorsKeepLeadership(t *testing.T) {
+	a, b := useLeaderElection(t)
+	server, client := newTestRedis(t)
+	a.cycle(client, 1)
+	if !a.leader {
+		t.Fatalf("a didn't take the free lock")
+	}
+
+	// a renew and a publish check failing on a redis blip don't demote a
+	server.SetError("LOADING redis is loading the dataset in memory")
+	a.as(func() {
+		campaign(client)
+		if confirmLeadership(client) {
+			t.Errorf("a confirmed leadership without reaching redis")
+		}
+	})
+	server.SetError("")
+	if !a.leader {
+		t.Fatalf("a was demoted by a redis error")
+	}
+
+	// nobody else takes over and a keeps generating once redis is back
+	b.cycle(client, 2)
+	a.cycle(client, 2)
+	if !a.leader || b.leader || a.published != 2 || a.term != 1 {
+		t.Errorf("a leader %v published %d in term %d, b leader %v, want a to carry on", a.leader, a.published, a.term, b.leader)
+	}
+}
+
+func TestFollowerReclaimsItsOwnLock(t *testing.T) {
+	a, _ := useLeaderElection(t)
+	server, client := newTestRedis(t)
+	a.cycle(client, 1)
+
+	// a believes it follows but the lock still names it, it takes it back rather than waiting
+	// out the TTL
+	a.leader = false
+	server.FastForward(20 * time.Second)
+	a.cycle(client, 2)
+	if !a.leader || a.published != 2 {
+		t.Fatalf("a leader %v published %d, want it to lead again", a.leader, a.published)
+	}
+	if ttl := server.TTL("territory_generator_lock"); ttl != 30*time.Second {
+		t.Errorf("lock TTL %v, want it renewed to 30s", ttl)
+	}
+}
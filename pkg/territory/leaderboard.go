@@ -0,0 +1,176 @@
+package territory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-redis/redis"
+)
+
+// LeaderboardEntry is one ranked tribe from the last top tribes computation
+type LeaderboardEntry struct {
+	Index     int
+	TribeID   uint64
+	TribeName string
+	Count     uint32  // raw claims of every type
+	HomeGrid  string  `json:",omitempty"` // packed server ID of the owner's home grid
+	Score     float64 // claims weighted by ClaimWeights, what the ranking is by
+	Land      uint32
+	Water     uint32
+}
+
+// newLeaderboardEntry ranks a tribe's count at index
+func newLeaderboardEntry(index int, count *TribeCount, tribeName string) LeaderboardEntry {
+	return LeaderboardEntry{
+		Index:     index,
+		TribeID:   count.tribeID,
+		TribeName: tribeName,
+		Count:     count.count,
+		Score:     count.score,
+		Land:      count.land,
+		Water:     count.water,
+	}
+}
+
+// leaderboardSize is the number of top tribes published
+const leaderboardSize = 10
+
+// Leaderboard is the ranking of one generation, part of its GenerationResult and never modified
+type Leaderboard struct {
+	entries []LeaderboardEntry // the top tribes
+	ranked  []uint64           // every public tribe, largest first, for filtered leaderboards
+	counts  map[uint64]*TribeCount
+	homes   map[uint64]GridID
+}
+
+// publishTopTribes ranks the public tribes and pushes the top tribes to the game's toptribes list
+// when they changed from previous, returning the leaderboard and what the list now holds
+func publishTopTribes(client *redis.Client, markers []Marker, counts map[uint64]*TribeCount, optOut map[uint64]bool, previous []string) (*Leaderboard, []string) {
+	log.Println("Generating top N tribes")
+	publicCounts := countsWithoutOptedOut(counts, optOut)
+	homes := homeGrids(withoutOptedOut(markers, optOut))
+	ranked := TopNTribes(len(publicCounts), publicCounts)
+	top := ranked[:Min(leaderboardSize, len(ranked))]
+
+	var gameTribeOutput []string
+	var entries []LeaderboardEntry
+	for i, tribeID := range top {
+		entry := newLeaderboardEntry(i, publicCounts[tribeID], lookupTribeName(client, tribeID))
+		if home, ok := homes[tribeID]; ok {
+			entry.HomeGrid = packedGridID(home)
+		}
+		game := GameTribeOutput{
+			TribeID:   tribeID,
+			TribeName: entry.TribeName,
+			Index:     i,
+			HomeGrid:  entry.HomeGrid,
+			Score:     entry.Score,
+			Land:      entry.Land,
+			Water:     entry.Water,
+		}
+		js, _ := json.Marshal(game)
+		gameTribeOutput = append(gameTribeOutput, string(js))
+		entries = append(entries, entry)
+	}
+	board := &Leaderboard{entries: entries, ranked: ranked, counts: publicCounts, homes: homes}
+
+	if stringSliceEq(previous, gameTribeOutput) || !confirmLeadership(client) {
+		return board, previous
+	}
+	_, err := client.Del("toptribes").Result()
+	if err != nil {
+		log.Println(err)
+	}
+	if len(gameTribeOutput) > 0 {
+		_, err = client.RPush("toptribes", gameTribeOutput).Result()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	client.Publish("GeneralNotifications:GlobalCommands", "ReloadTopTribes")
+	return board, gameTribeOutput
+}
+
+// lookupTribeName reads a tribe's name from redis, tribes without one are "<abandoned>"
+func lookupTribeName(client *redis.Client, tribeID uint64) string {
+	tribe, err := client.HMGet("tribedata:"+strconv.FormatUint(tribeID, 10), "TribeName").Result()
+	if err != nil {
+		log.Println(err)
+	}
+	if len(tribe) > 0 {
+		if name, ok := tribe[0].(string); ok {
+			return name
+		}
+	}
+	return "<abandoned>"
+}
+
+// filteredLeaderboard ranks the top n tribes of board whose home grid passes the filter
+func filteredLeaderboard(client *redis.Client, board *Leaderboard, n int, filter func(GridID) bool) []LeaderboardEntry {
+	var matched []uint64
+	for _, id := range board.ranked {
+		if home, ok := board.homes[id]; ok && filter(home) {
+			matched = append(matched, id)
+			if len(matched) == n {
+				break
+			}
+		}
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(matched))
+	for i, id := range matched {
+		entry := newLeaderboardEntry(i, board.counts[id], lookupTribeName(client, id))
+		entry.HomeGrid = packedGridID(board.homes[id])
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// topTribesCSVHandler serves GET /api/topTribes.csv, optionally ?homeGrid=<packed server ID or region>
+func topTribesCSVHandler(client *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		result := latestGeneration()
+		if result == nil || result.Leaderboard == nil {
+			writeError(w, r, http.StatusNotFound, "no leaderboard available yet")
+			return
+		}
+		entries := result.Leaderboard.entries
+		if value := r.URL.Query().Get("homeGrid"); len(value) > 0 {
+			filter, err := homeGridFilter(value)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			entries = filteredLeaderboard(client, result.Leaderboard, leaderboardSize, filter)
+		}
+		setGenerationHeader(w, result)
+		writeLeaderboardCSV(w, entries)
+	}
+}
+
+func writeLeaderboardCSV(w http.ResponseWriter, entries []LeaderboardEntry) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	out := csv.NewWriter(w)
+	out.Write([]string{"index", "tribeID", "tribeName", "count", "homeGrid", "score", "land", "water"})
+	for _, entry := range entries {
+		out.Write([]string{
+			strconv.Itoa(entry.Index),
+			strconv.FormatUint(entry.TribeID, 10),
+			entry.TribeName,
+			strconv.FormatUint(uint64(entry.Count), 10),
+			entry.HomeGrid,
+			strconv.FormatFloat(entry.Score, 'f', -1, 64),
+			strconv.FormatUint(uint64(entry.Land), 10),
+			strconv.FormatUint(uint64(entry.Water), 10),
+		})
+	}
+	out.Flush()
+}
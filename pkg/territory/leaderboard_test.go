@@ -0,0 +1,69 @@
+package territory
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopTribesCSVEscapesNames(t *testing.T) {
+	useTestConfig(t, nil)
+	_, client := newTestRedis(t)
+	const comma, quoted, plain = 1000050001, 1000050002, 1000050003
+	client.HSet("tribedata:1000050001", "TribeName", "Comma, Inc")
+	client.HSet("tribedata:1000050002", "TribeName", `The "Quoted" Ones`)
+	client.HSet("tribedata:1000050003", "TribeName", "Plain")
+	var markers []Marker
+	for i, claims := range map[uint64]int{comma: 3, quoted: 2, plain: 1} {
+		for j := 0; j < claims; j++ {
+			markers = append(markers, Marker{tribeOrOwnerID: i, relX: float64(j) / 4, relY: 0.5, markerType: MarkerLand})
+		}
+	}
+	counts := make(map[uint64]*TribeCount)
+	for _, marker := range markers {
+		countTribeClaim(counts, marker)
+	}
+	board, _ := publishTopTribes(client, markers, counts, nil, nil)
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+	publishGeneration(&GenerationResult{CRC: 1, Leaderboard: board})
+
+	w := httptest.NewRecorder()
+	topTribesCSVHandler(client)(w, httptest.NewRequest(http.MethodGet, "/api/topTribes.csv", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+		t.Errorf("Content-Type %q, want text/csv", contentType)
+	}
+	body := w.Body.String()
+	for _, escaped := range []string{`,"Comma, Inc",`, `,"The ""Quoted"" Ones",`, `,Plain,`} {
+		if !strings.Contains(body, escaped) {
+			t.Errorf("CSV doesn't contain %s:\n%s", escaped, body)
+		}
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"index", "tribeID", "tribeName", "count", "homeGrid", "score", "land", "water"}; !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("header %v, want %v", rows[0], want)
+	}
+	want := [][]string{
+		{"0", "1000050001", "Comma, Inc", "3"},
+		{"1", "1000050002", `The "Quoted" Ones`, "2"},
+		{"2", "1000050003", "Plain", "1"},
+	}
+	if len(rows) != len(want)+1 {
+		t.Fatalf("%d rows, want a header and %d tribes", len(rows), len(want))
+	}
+	for i, row := range rows[1:] {
+		if len(row) != len(rows[0]) || !reflect.DeepEqual(row[:4], want[i]) {
+			t.Errorf("row %d is %v, want it to start with %v", i, row, want[i])
+		}
+	}
+}
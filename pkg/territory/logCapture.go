@@ -0,0 +1,175 @@
+package territory
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels of captured records, inferred from the message since the standard logger has none
+const (
+	logLevelInfo = iota
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"info", "warn", "error"}
+
+// maxLogMessageBytes truncates captured messages so every record has a bounded size
+const maxLogMessageBytes = 1024
+
+// LogRecord is one line of GET /admin/logs
+type LogRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+}
+
+// capturedLog is one record of the ring, preformatted as its JSON line
+type capturedLog struct {
+	at    time.Time
+	level int
+	msg   string // redacted and truncated, what grep matches
+	line  []byte
+}
+
+// logCapture keeps the last LogBufferRecords log records whatever the log output is
+var logCapture = struct {
+	sync.Mutex
+	records  []capturedLog
+	next     int // index the next record is written to
+	full     bool
+	redactor *strings.Replacer
+}{}
+
+// startLogCapture sizes the ring and collects the secrets to redact, call it once the config is loaded
+func startLogCapture() {
+	var secrets []string
+	addSecret := func(secret string) {
+		if len(secret) > 0 {
+			secrets = append(secrets, secret, "[redacted]")
+		}
+	}
+	addSecret(config.AtlasS3SecretKey)
+	addSecret(config.AdminToken)
+	for _, token := range config.AdminTokens {
+		addSecret(token)
+	}
+	addSecret(config.GameArtifactAccess.Key)
+	for _, db := range config.DatabaseConnections {
+		addSecret(db.Password)
+	}
+
+	logCapture.Lock()
+	defer logCapture.Unlock()
+	logCapture.records = make([]capturedLog, config.LogBufferRecords)
+	logCapture.next = 0
+	logCapture.full = false
+	logCapture.redactor = strings.NewReplacer(secrets...)
+}
+
+// logCaptureWriter is added to the log output, each Write is one record from the log package
+type logCaptureWriter struct{}
+
+func (logCaptureWriter) Write(p []byte) (int, error) {
+	captureLog(time.Now().UTC(), string(p))
+	return len(p), nil
+}
+
+// captureLog adds a record to the ring, dropping the standard logger's timestamp prefix
+func captureLog(at time.Time, msg string) {
+	msg = strings.TrimRight(msg, "\n")
+	if len(msg) >= 20 && msg[4] == '/' && msg[7] == '/' && msg[13] == ':' && msg[19] == ' ' {
+		msg = msg[20:]
+	}
+
+	logCapture.Lock()
+	defer logCapture.Unlock()
+	if len(logCapture.records) == 0 {
+		return
+	}
+	msg = logCapture.redactor.Replace(msg)
+	if len(msg) > maxLogMessageBytes {
+		msg = msg[:maxLogMessageBytes] + "..."
+	}
+	level := logLevelInfo
+	switch {
+	case strings.HasPrefix(msg, "Warning"):
+		level = logLevelWarn
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Fatal"), strings.HasPrefix(msg, "panic"):
+		level = logLevelError
+	}
+
+	// the line buffer of the record being overwritten is reused
+	record := &logCapture.records[logCapture.next]
+	js, _ := json.Marshal(LogRecord{Time: at, Level: logLevelNames[level], Message: msg})
+	record.at, record.level, record.msg = at, level, msg
+	record.line = append(append(record.line[:0], js...), '\n')
+	logCapture.next = (logCapture.next + 1) % len(logCapture.records)
+	if logCapture.next == 0 {
+		logCapture.full = true
+	}
+}
+
+// capturedLogs writes the records at level or above, newer than since and containing grep,
+// oldest first
+func capturedLogs(buf *bytes.Buffer, level int, since time.Time, grep string) {
+	logCapture.Lock()
+	defer logCapture.Unlock()
+	start, n := 0, logCapture.next
+	if logCapture.full {
+		start, n = logCapture.next, len(logCapture.records)
+	}
+	for i := 0; i < n; i++ {
+		record := &logCapture.records[(start+i)%len(logCapture.records)]
+		if record.level < level || !record.at.After(since) || !strings.Contains(record.msg, grep) {
+			continue
+		}
+		buf.Write(record.line)
+	}
+}
+
+// logsHandler serves GET /admin/logs?level=&since=&grep= as JSON lines, newest last. since is
+// RFC 3339 or unix seconds
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	level := logLevelInfo
+	if value := query.Get("level"); len(value) > 0 {
+		level = -1
+		for i, name := range logLevelNames {
+			if name == value {
+				level = i
+			}
+		}
+		if level < 0 {
+			writeError(w, r, http.StatusBadRequest, "level must be info, warn or error")
+			return
+		}
+	}
+	var since time.Time
+	if value := query.Get("since"); len(value) > 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "since must be RFC 3339 or unix seconds")
+				return
+			}
+			since = time.Unix(seconds, 0)
+		}
+	}
+
+	var buf bytes.Buffer
+	capturedLogs(&buf, level, since, query.Get("grep"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
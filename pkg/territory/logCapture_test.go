@@ -0,0 +1,177 @@
+package territory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useLogCapture starts a ring of n records for the test, with edit applied to the config first
+func useLogCapture(t *testing.T, n int, edit func(cfg *Configuration)) {
+	t.Helper()
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.LogBufferRecords = n
+		if edit != nil {
+			edit(cfg)
+		}
+	})
+	startLogCapture()
+	t.Cleanup(func() {
+		logCapture.Lock()
+		logCapture.records, logCapture.next, logCapture.full = nil, 0, false
+		logCapture.Unlock()
+	})
+}
+
+// getLogs reads GET /admin/logs with query
+func getLogs(t *testing.T, query string) []LogRecord {
+	t.Helper()
+	w := httptest.NewRecorder()
+	logsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/logs?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /admin/logs?%s is %d: %s", query, w.Code, w.Body.String())
+	}
+	var records []LogRecord
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var record LogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%v: %s", err, scanner.Text())
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func logMessages(records []LogRecord) []string {
+	var messages []string
+	for _, record := range records {
+		messages = append(messages, record.Message)
+	}
+	return messages
+}
+
+func TestLogCaptureFilters(t *testing.T) {
+	useLogCapture(t, 10, nil)
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, msg := range []string{
+		"Getting markers for game image",
+		"Warning! Failed to upload gameTiles/world.map: timeout",
+		"Error loading config",
+		"Generating tiles for zoom 3",
+		"Warning! 2 tiles failed at zoom 3",
+	} {
+		captureLog(start.Add(time.Duration(i)*time.Minute), msg)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Getting markers for game image", "Warning! Failed to upload gameTiles/world.map: timeout", "Error loading config", "Generating tiles for zoom 3", "Warning! 2 tiles failed at zoom 3"}},
+		{"level=warn", []string{"Warning! Failed to upload gameTiles/world.map: timeout", "Error loading config", "Warning! 2 tiles failed at zoom 3"}},
+		{"level=error", []string{"Error loading config"}},
+		{"grep=zoom+3", []string{"Generating tiles for zoom 3", "Warning! 2 tiles failed at zoom 3"}},
+		{"since=" + start.Add(2*time.Minute).Format(time.RFC3339), []string{"Generating tiles for zoom 3", "Warning! 2 tiles failed at zoom 3"}},
+		{"since=" + strconv.FormatInt(start.Add(2*time.Minute).Unix(), 10), []string{"Generating tiles for zoom 3", "Warning! 2 tiles failed at zoom 3"}},
+		{"level=warn&grep=zoom&since=" + start.Format(time.RFC3339), []string{"Warning! 2 tiles failed at zoom 3"}},
+	} {
+		if got := logMessages(getLogs(t, test.query)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("?%s: %q, want %q", test.query, got, test.want)
+		}
+	}
+	if records := getLogs(t, "level=warn"); records[0].Level != "warn" || !records[0].Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("record %+v, want level and time kept", records[0])
+	}
+
+	for _, query := range []string{"level=debug", "since=yesterday"} {
+		w := httptest.NewRecorder()
+		logsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/logs?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("?%s answered %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestLogCaptureRedactsSecrets(t *testing.T) {
+	useLogCapture(t, 10, func(cfg *Configuration) {
+		cfg.AtlasS3SecretKey = "s3-secret"
+		cfg.AdminToken = "admin-token"
+		cfg.GameArtifactAccess.Key = "game-key"
+		cfg.DatabaseConnections = []RedisConfiguration{{Name: "Default", Password: "hunter2"}}
+	})
+	captureLog(time.Now(), "Warning! AUTH hunter2 failed, retrying with s3-secret")
+	captureLog(time.Now(), "published ?key=game-key for admin-token")
+
+	got := logMessages(getLogs(t, ""))
+	want := []string{"Warning! AUTH [redacted] failed, retrying with [redacted]", "published ?key=[redacted] for [redacted]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("captured %q, want %q", got, want)
+	}
+	// secrets can't be probed for with grep either
+	if records := getLogs(t, "grep=hunter2"); len(records) != 0 {
+		t.Errorf("grep for a secret found %q", logMessages(records))
+	}
+}
+
+func TestLogCaptureWrapsAround(t *testing.T) {
+	useLogCapture(t, 3, nil)
+	for i := 1; i <= 7; i++ {
+		captureLog(time.Now(), fmt.Sprintf("record %d", i))
+	}
+	if got, want := logMessages(getLogs(t, "")), []string{"record 5", "record 6", "record 7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("captured %q, want the newest 3 oldest first", got)
+	}
+
+	// records keep a bounded size however long the message
+	captureLog(time.Now(), strings.Repeat("x", 4*maxLogMessageBytes))
+	records := getLogs(t, "grep=xxx")
+	if len(records) != 1 {
+		t.Fatalf("long message captured as %d records", len(records))
+	}
+	if got := len(records[0].Message); got != maxLogMessageBytes+len("...") {
+		t.Errorf("long message captured as %d bytes, want it truncated to %d", got, maxLogMessageBytes)
+	}
+}
+
+func TestLogCaptureWriterStripsTheTimestamp(t *testing.T) {
+	useLogCapture(t, 10, nil)
+	logger := log.New(logCaptureWriter{}, "", log.LstdFlags)
+	logger.Printf("Warning! %d grids failed", 2)
+	records := getLogs(t, "")
+	if len(records) != 1 || records[0].Message != "Warning! 2 grids failed" || records[0].Level != "warn" {
+		t.Errorf("captured %+v", records)
+	}
+}
+
+func TestLogCaptureIsConcurrentSafe(t *testing.T) {
+	useLogCapture(t, 64, nil)
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				captureLog(time.Now(), fmt.Sprintf("writer %d record %d", writer, i))
+			}
+		}(writer)
+	}
+	for i := 0; i < 50; i++ {
+		var buf bytes.Buffer
+		capturedLogs(&buf, logLevelInfo, time.Time{}, "writer")
+	}
+	wg.Wait()
+	if records := getLogs(t, ""); len(records) != 64 {
+		t.Errorf("%d records after the writers finished, want the ring of 64", len(records))
+	}
+}
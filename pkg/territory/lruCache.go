@@ -0,0 +1,160 @@
+package territory
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lruCache is a bounded map evicting the least recently used entry, with an optional TTL and
+// an optional budget on the total size of the entries
+type lruCache struct {
+	sync.Mutex
+	capacity int
+	maxBytes int64         // 0 for no size budget
+	ttl      time.Duration // 0 for no expiry
+	entries  map[interface{}]*list.Element
+	order    *list.List // front is most recently used
+	bytes    int64
+	stats    CacheStats
+}
+
+type lruEntry struct {
+	key     interface{}
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// CacheStats are the counters served by GET /admin/caches
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	MaxBytes  int64  `json:"maxBytes,omitempty"`
+}
+
+// caches is every named lruCache so their stats can be reported
+var caches = struct {
+	sync.Mutex
+	byName map[string]*lruCache
+}{byName: make(map[string]*lruCache)}
+
+// newLRUCache creates and registers a cache, capacity <= 0 is treated as 1
+func newLRUCache(name string, capacity int, ttl time.Duration) *lruCache {
+	c := &lruCache{
+		capacity: Max(1, capacity),
+		ttl:      ttl,
+		entries:  make(map[interface{}]*list.Element),
+		order:    list.New(),
+	}
+	caches.Lock()
+	caches.byName[name] = c
+	caches.Unlock()
+	return c
+}
+
+// Get returns the value and marks it recently used, expired entries are misses
+func (c *lruCache) Get(key interface{}) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if ok && c.ttl > 0 && time.Now().After(elem.Value.(*lruEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Add stores the value, evicting the least recently used entry when full
+func (c *lruCache) Add(key, value interface{}) {
+	c.AddSized(key, value, 0)
+}
+
+// AddSized stores the value counting size bytes against the cache's budget, evicting the least
+// recently used entries until both the capacity and the budget are met
+func (c *lruCache) AddSized(key, value interface{}, size int64) {
+	c.Lock()
+	defer c.Unlock()
+	entry := &lruEntry{key: key, value: value, size: size}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.bytes += size - elem.Value.(*lruEntry).size
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(entry)
+		c.bytes += size
+	}
+	for c.order.Len() > c.capacity || (c.maxBytes > 0 && c.bytes > c.maxBytes && c.order.Len() > 0) {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Purge drops every entry
+func (c *lruCache) Purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[interface{}]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *lruCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+// cachesHandler serves GET /admin/caches with each cache's counters
+func cachesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	caches.Lock()
+	names := make([]string, 0, len(caches.byName))
+	for name := range caches.byName {
+		names = append(names, name)
+	}
+	caches.Unlock()
+	sort.Strings(names)
+
+	stats := make(map[string]CacheStats, len(names))
+	for _, name := range names {
+		caches.Lock()
+		c := caches.byName[name]
+		caches.Unlock()
+		stats[name] = c.Stats()
+	}
+	js, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,98 @@
+package territory
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsUnderPressure(t *testing.T) {
+	cache := newLRUCache("testPressure", 3, 0)
+	cache.Add("hot", 0)
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i)
+		// keeping the hot entry in use saves it from eviction
+		if _, ok := cache.Get("hot"); !ok {
+			t.Fatalf("hot entry evicted after %d adds", i+1)
+		}
+	}
+	if _, ok := cache.Get(99); !ok {
+		t.Errorf("newest entry missing")
+	}
+	if _, ok := cache.Get(0); ok {
+		t.Errorf("oldest entry survived")
+	}
+	stats := cache.Stats()
+	if stats.Size != 3 || stats.Capacity != 3 {
+		t.Errorf("size %d of %d, want 3 of 3", stats.Size, stats.Capacity)
+	}
+	if stats.Evictions != 98 || stats.Hits != 101 || stats.Misses != 1 {
+		t.Errorf("stats %+v, want 98 evictions, 101 hits and 1 miss", stats)
+	}
+}
+
+func TestLRUCacheByteBudgetAndTTL(t *testing.T) {
+	cache := newLRUCache("testBudget", 10, 0)
+	cache.maxBytes = 100
+	cache.AddSized("a", nil, 60)
+	cache.AddSized("b", nil, 30)
+	cache.AddSized("c", nil, 30)
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("entry over the byte budget wasn't evicted")
+	}
+	if stats := cache.Stats(); stats.Bytes != 60 || stats.Size != 2 {
+		t.Errorf("%d bytes in %d entries, want 60 in 2", stats.Bytes, stats.Size)
+	}
+
+	expiring := newLRUCache("testTTL", 10, 10*time.Millisecond)
+	expiring.Add("a", 1)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := expiring.Get("a"); ok {
+		t.Errorf("expired entry was a hit")
+	}
+	if stats := expiring.Stats(); stats.Size != 0 || stats.Misses != 1 {
+		t.Errorf("stats %+v after expiry, want it removed and a miss", stats)
+	}
+
+	w := httptest.NewRecorder()
+	cachesHandler(w, httptest.NewRequest(http.MethodGet, "/admin/caches", nil))
+	var served map[string]CacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if served["testBudget"].Bytes != 60 || served["testTTL"].Misses != 1 {
+		t.Errorf("/admin/caches served %+v", served)
+	}
+}
+
+func TestQuarantineRewritesOnlyEvictedPayloads(t *testing.T) {
+	quarantineFile := filepath.Join(t.TempDir(), "quarantine.log")
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ZeroPositionQuarantineFile = quarantineFile
+		cfg.QuarantineDedupeCapacity = 2
+	})
+	quarantined.Lock()
+	previous := quarantined.payloads
+	quarantined.payloads = nil
+	quarantined.Unlock()
+	t.Cleanup(func() { quarantined.payloads = previous })
+
+	a, b, c := encodeClaim(1, 0, 0, MarkerLand, 16), encodeClaim(2, 0, 0, MarkerLand, 16), encodeClaim(3, 0, 0, MarkerLand, 16)
+	quarantineMarkers(0, 0, []string{a, b, c})
+	// c is still remembered, a was evicted by it so is written once more
+	quarantineMarkers(0, 0, []string{c})
+	quarantineMarkers(0, 0, []string{a})
+
+	data, err := ioutil.ReadFile(quarantineFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Errorf("%d quarantine lines, want 3 payloads and the evicted one again:\n%s", lines, data)
+	}
+}
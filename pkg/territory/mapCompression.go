@@ -0,0 +1,130 @@
+package territory
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// MapCompression values
+const (
+	MapCompressionNone = "none" // v4 CompressionType 0, the body as is, for debugging
+	MapCompressionZlib = "zlib" // v4 CompressionType 1, the default for games that negotiate v4
+)
+
+// .map CompressionType header values
+const (
+	mapCompressionTypeNone uint16 = 0x0000
+	mapCompressionTypeZlib uint16 = 0x0001
+)
+
+// mapZlibVersion is the first .map version with a compressed body. Older versions always carried
+// CompressionType 1 over an uncompressed body, and still do so their files stay byte-identical
+const mapZlibVersion uint16 = 4
+
+// mapCompressionType is the CompressionType header of a .map of mapVersion, MapCompression for v4
+func mapCompressionType(mapVersion uint16) uint16 {
+	if mapVersion < mapZlibVersion {
+		return mapCompressionTypeZlib
+	}
+	if config.MapCompression == MapCompressionNone {
+		return mapCompressionTypeNone
+	}
+	return mapCompressionTypeZlib
+}
+
+// mapBodyCompression is how the body of a .map of mapVersion with the compressionType header is
+// actually compressed, never below mapZlibVersion
+func mapBodyCompression(mapVersion, compressionType uint16) uint16 {
+	if mapVersion < mapZlibVersion {
+		return mapCompressionTypeNone
+	}
+	return compressionType
+}
+
+// writeMapBody streams everything after the fixed header, as written by body, through w. Zlib
+// bodies are the compressed length as a uint32 followed by the zlib stream, so the game can read
+// the whole stream before inflating it. The length is a placeholder until the stream is done,
+// then filled in at its offset in f, which w writes to
+func writeMapBody(f *os.File, w *bufio.Writer, compressionType uint16, body func(w io.Writer) error) error {
+	if compressionType == mapCompressionTypeNone {
+		return body(w)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(0)); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	zw := zlib.NewWriter(w)
+	if err := body(zw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// seek back to the placeholder, then to the end again for anything written after the body
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(end-start))
+	if _, err := f.Seek(start-4, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write(length); err != nil {
+		return err
+	}
+	_, err = f.Seek(end, io.SeekStart)
+	return err
+}
+
+// readMapBody returns a reader of the body after the fixed header, inflating zlib bodies. Zlib
+// bodies must be the rest of the file
+func readMapBody(r *bufio.Reader, compressionType uint16) (*bufio.Reader, error) {
+	switch compressionType {
+	case mapCompressionTypeNone:
+		return r, nil
+	case mapCompressionTypeZlib:
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", compressionType)
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, fmt.Errorf("failed to read compressed length: %v", err)
+	}
+	compressed := make([]byte, length)
+	if _, err := io.ReadFull(r, compressed); err != nil {
+		return nil, fmt.Errorf("failed to read compressed body: %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the compressed body")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate body: %v", err)
+	}
+	defer zr.Close()
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inflate body: %v", err)
+	}
+	return bufio.NewReader(bytes.NewReader(body)), nil
+}
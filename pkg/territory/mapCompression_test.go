@@ -0,0 +1,142 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// manyClaims is enough repetitive claims for zlib to shrink the body
+func manyClaims() []Marker {
+	var markers []Marker
+	for i := 0; i < 200; i++ {
+		markers = append(markers, Marker{serverX: i % 2, serverY: 0, tribeOrOwnerID: uint64(1 + i%3), relX: float64(i%10) / 10, relY: 0.5, markerType: MarkerLand})
+	}
+	return append(markers, Marker{serverX: 1, serverY: 1, tribeOrOwnerID: 2, relX: 0.25, relY: 0.75, markerType: MarkerWater})
+}
+
+func TestMapFileRoundTrip(t *testing.T) {
+	for _, compression := range []string{MapCompressionNone, MapCompressionZlib} {
+		t.Run(compression, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.MapCompression = compression
+				cfg.MapColorTable = true
+			})
+			owners, _, _ := buildMapOwners(manyClaims())
+			opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: mapZlibVersion}
+			if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+				t.Fatal(err)
+			}
+
+			header, read, _, err := readMapFile(opts.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.CompressionType != mapCompressionType(mapZlibVersion) || int(header.OwnerCount) != len(owners) {
+				t.Fatalf("header %+v, want CompressionType %d and %d owners", header, mapCompressionType(mapZlibVersion), len(owners))
+			}
+			if len(read) != len(owners) {
+				t.Fatalf("read %d owners, want %d", len(read), len(owners))
+			}
+			for i := range owners {
+				if read[i].TribeOrPlayerID != owners[i].TribeOrPlayerID ||
+					!reflect.DeepEqual(read[i].LandClaims, owners[i].LandClaims) ||
+					!reflect.DeepEqual(read[i].WaterClaims, owners[i].WaterClaims) {
+					t.Errorf("owner %d read as %+v, want %+v", i, read[i], owners[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMapFileZlibIsTheV4Default(t *testing.T) {
+	sizes := make(map[string]int64)
+	for _, compression := range []string{"", MapCompressionNone} {
+		useTestConfig(t, func(cfg *Configuration) {
+			if compression != "" {
+				cfg.MapCompression = compression
+			}
+		})
+		owners, _, _ := buildMapOwners(manyClaims())
+		opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: mapZlibVersion}
+		if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+			t.Fatal(err)
+		}
+		header, _, _, err := readMapFile(opts.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := mapCompressionTypeZlib
+		if compression == MapCompressionNone {
+			want = mapCompressionTypeNone
+		}
+		if header.CompressionType != want {
+			t.Fatalf("MapCompression %q wrote CompressionType %d, want %d", compression, header.CompressionType, want)
+		}
+		info, err := os.Stat(opts.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[compression] = info.Size()
+	}
+	if sizes[""] >= sizes[MapCompressionNone] {
+		t.Fatalf("default zlib file is %d bytes, uncompressed %d", sizes[""], sizes[MapCompressionNone])
+	}
+}
+
+func TestMapFileBeforeZlibVersionIsUncompressed(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MapCompression = MapCompressionZlib })
+	owners, _, _ := buildMapOwners(manyClaims())
+	for _, version := range []uint16{2, 3} {
+		opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: version}
+		if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+			t.Fatal(err)
+		}
+		header, read, _, err := readMapFile(opts.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the header has always said zlib, the body never was
+		if header.CompressionType != mapCompressionTypeZlib || len(read) != len(owners) {
+			t.Errorf("v%d wrote CompressionType %d and %d owners, want %d and an uncompressed body of %d", version, header.CompressionType, len(read), mapCompressionTypeZlib, len(owners))
+		}
+	}
+}
+
+// goldenMapMarkers are claims in the order the baseline generator wrote them, which didn't sort
+// them, for every kind of owner it exported
+func goldenMapMarkers() []Marker {
+	var markers []Marker
+	for i := 0; i < 12; i++ {
+		markers = append(markers, Marker{serverX: i / 6, serverY: i % 2, tribeOrOwnerID: []uint64{1000050001, 1000050002, 42}[i%3], relX: float64(i%6) / 8, relY: 0.25 + float64(i)/32, markerType: MarkerLand})
+	}
+	return append(markers, Marker{serverX: 1, serverY: 1, tribeOrOwnerID: 1000050002, relX: 0.5, relY: 0.75, markerType: MarkerWater})
+}
+
+func TestMapFileV2MatchesTheBaseline(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.GameSize = 1024
+		cfg.ServersX, cfg.ServersY = 2, 2
+	})
+	owners, _, _ := buildMapOwners(goldenMapMarkers())
+	opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: 2}
+	if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(opts.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testdata/world_v2.map was written by the generator before .map versions were negotiated
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "world_v2.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("v2 .map differs from the baseline\ngot  %x\nwant %x", got, want)
+	}
+}
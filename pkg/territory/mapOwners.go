@@ -0,0 +1,283 @@
+package territory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+)
+
+// mapOwners is what a .map is written from, one owner at a time so the claims of every owner don't
+// have to be in memory at once
+type mapOwners interface {
+	Len() int
+	// ClaimCount is the number of claims owner i exports, without loading them
+	ClaimCount(i int) int
+	// Owner returns owner i with its claims, which may only be valid until the next call
+	Owner(i int) (FlagOwnerOutputHeader, error)
+}
+
+// mapOwnerList is a mapOwners held in memory, as aggregated by buildMapOwners or read back from a .map
+type mapOwnerList []FlagOwnerOutputHeader
+
+func (l mapOwnerList) Len() int             { return len(l) }
+func (l mapOwnerList) ClaimCount(i int) int { return len(l[i].LandClaims) + len(l[i].WaterClaims) }
+func (l mapOwnerList) Owner(i int) (FlagOwnerOutputHeader, error) {
+	return l[i], nil
+}
+
+// mapClaimCounts is how many land and water claims an owner has
+type mapClaimCounts struct{ land, water int }
+
+// mapExport converts markers to .map claims for GameSize, shared by every aggregation
+type mapExport struct {
+	perServerX, perServerY float64
+}
+
+func newMapExport() mapExport {
+	pixels := mapSrcPixels(config.GameSize)
+	return mapExport{perServerX: float64(pixels / config.ServersX), perServerY: float64(pixels / config.ServersY)}
+}
+
+// exported checks if a marker belongs in the .map at all
+func (e mapExport) exported(marker Marker) bool {
+	// optionally export tribe claims only, player and unowned claims are dropped
+	if !config.MapIncludePlayerClaims && !isTribeID(marker.tribeOrOwnerID) {
+		return false
+	}
+	if marker.markerType != MarkerLand && marker.markerType != MarkerWater {
+		return false
+	}
+	// skipped small claims are skipped in the game too
+	return config.SmallClaimPolicy != SmallClaimSkip || gameClaimRadiusPixels(marker.markerType) >= config.SmallClaimMinPixels
+}
+
+// position converts a marker to game image space, ok is false for unusable coordinates
+func (e mapExport) position(marker Marker) (ClaimFlagOutputEntry, bool) {
+	// marker adjusted to world space
+	vServerOffsetX := float64(marker.serverX) * e.perServerX
+	vServerOffsetY := float64(marker.serverY) * e.perServerY
+	iX := (float64(marker.relX) * e.perServerX) + vServerOffsetX
+	iY := (float64(marker.relY) * e.perServerY) + vServerOffsetY
+	if !isFinite(iX) || !isFinite(iY) {
+		return ClaimFlagOutputEntry{}, false
+	}
+	return ClaimFlagOutputEntry{X: uint16(iX), Y: uint16(iY)}, true
+}
+
+// countMapOwners is the first pass of every aggregation, it only counts the exported claims of
+// each owner. owners are sorted by ID without claims, counts line up with them
+func countMapOwners(markers []Marker, export mapExport) (owners []FlagOwnerOutputHeader, counts []mapClaimCounts, invalid int) {
+	byID := make(map[uint64]*mapClaimCounts)
+	for _, marker := range markers {
+		if !export.exported(marker) {
+			continue
+		}
+		if _, ok := export.position(marker); !ok {
+			invalid++
+			continue
+		}
+		count, ok := byID[marker.tribeOrOwnerID]
+		if !ok {
+			count = &mapClaimCounts{}
+			byID[marker.tribeOrOwnerID] = count
+		}
+		if marker.markerType == MarkerLand {
+			count.land++
+		} else {
+			count.water++
+		}
+	}
+
+	owners = make([]FlagOwnerOutputHeader, 0, len(byID))
+	for id := range byID {
+		owners = append(owners, FlagOwnerOutputHeader{TribeOrPlayerID: id, Color: getTribeColor(id)})
+	}
+	sort.Sort(ByTribeOrPlayerID(owners))
+	counts = make([]mapClaimCounts, len(owners))
+	for i, owner := range owners {
+		counts[i] = *byID[owner.TribeOrPlayerID]
+	}
+	return owners, counts, invalid
+}
+
+// cappedMapCounts is how many claims of each kind an owner keeps under MapMaxClaimsPerOwner, split
+// in proportion to what it has
+func cappedMapCounts(counts mapClaimCounts) (kept mapClaimCounts, capped bool) {
+	max := config.MapMaxClaimsPerOwner
+	if max <= 0 || counts.land+counts.water <= max {
+		return counts, false
+	}
+	land := int(math.Round(float64(max) * float64(counts.land) / float64(counts.land+counts.water)))
+	return mapClaimCounts{land: land, water: max - land}, true
+}
+
+// finishMapClaims sorts an owner's claims so identical input is byte-identical, redis sets have no
+// order, then optionally caps them so one megatribe can't dominate the file size
+func finishMapClaims(land, water []ClaimFlagOutputEntry) ([]ClaimFlagOutputEntry, []ClaimFlagOutputEntry) {
+	sortClaims(land)
+	sortClaims(water)
+	if kept, capped := cappedMapCounts(mapClaimCounts{land: len(land), water: len(water)}); capped {
+		land = sampleClaims(land, kept.land)
+		water = sampleClaims(water, kept.water)
+	}
+	return land, water
+}
+
+// mapSpillFlushClaims is how many claims spillMapOwners buffers before writing them to the spill
+const mapSpillFlushClaims = 64 * 1024
+
+// mapClaimSpill is a mapOwners whose claims wait in a temp file, grouped by owner. Only the
+// per-owner counts and offsets are in memory, and one owner's claims while it is loaded
+type mapClaimSpill struct {
+	f       *os.File
+	owners  []FlagOwnerOutputHeader // without claims
+	counts  []mapClaimCounts        // spilled, before the cap
+	offsets []int64                 // of each owner's land claims, its water claims follow them
+	claims  []ClaimFlagOutputEntry  // the loaded owner's claims, reused
+	raw     []byte
+}
+
+// spillMapOwners aggregates the markers exported to the .map like buildMapOwners, but spills the
+// claims to a temp file in dir. invalid is the number of exported markers dropped for unusable
+// coordinates and capped the number of owners cut down to MapMaxClaimsPerOwner. Close removes the file
+func spillMapOwners(markers []Marker, dir string) (spill *mapClaimSpill, invalid, capped int, err error) {
+	export := newMapExport()
+	spill = &mapClaimSpill{}
+	spill.owners, spill.counts, invalid = countMapOwners(markers, export)
+
+	// every owner's land then water claims get an exactly sized region of the file, in file order.
+	// Runs are where the next claim of each kind goes, land of owner i is run 2i and water 2i+1
+	spill.offsets = make([]int64, len(spill.owners))
+	runs := make([]int64, 2*len(spill.owners))
+	index := make(map[uint64]int, len(spill.owners))
+	var offset int64
+	for i, owner := range spill.owners {
+		spill.offsets[i] = offset
+		runs[2*i], runs[2*i+1] = offset, offset+int64(4*spill.counts[i].land)
+		offset += int64(4 * (spill.counts[i].land + spill.counts[i].water))
+		index[owner.TribeOrPlayerID] = i
+		if _, ok := cappedMapCounts(spill.counts[i]); ok {
+			capped++
+		}
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, invalid, capped, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	filename := path.Join(dir, tempFileName("tmp_", ".claims"))
+	if spill.f, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return nil, invalid, capped, fmt.Errorf("failed to create %s: %v", filename, err)
+	}
+
+	// second pass buffers a bounded number of claims, then writes each run's share of them in one
+	// go. Claims are sorted when loaded so their order within a run doesn't matter
+	type pendingClaim struct {
+		run   int
+		claim ClaimFlagOutputEntry
+	}
+	batch := Max(1, Min(mapSpillFlushClaims, int(offset/4)))
+	pending := make([]pendingClaim, 0, batch)
+	raw := make([]byte, 0, 4*batch)
+	flush := func() error {
+		sort.Slice(pending, func(i, j int) bool { return pending[i].run < pending[j].run })
+		for start := 0; start < len(pending); {
+			run := pending[start].run
+			raw = raw[:0]
+			end := start
+			for ; end < len(pending) && pending[end].run == run; end++ {
+				c := pending[end].claim
+				raw = append(raw, byte(c.X), byte(c.X>>8), byte(c.Y), byte(c.Y>>8))
+			}
+			if _, err := spill.f.WriteAt(raw, runs[run]); err != nil {
+				return fmt.Errorf("failed to write %s: %v", filename, err)
+			}
+			runs[run] += int64(len(raw))
+			start = end
+		}
+		pending = pending[:0]
+		return nil
+	}
+	for _, marker := range markers {
+		if !export.exported(marker) {
+			continue
+		}
+		claim, ok := export.position(marker)
+		if !ok {
+			continue
+		}
+		run := 2 * index[marker.tribeOrOwnerID]
+		if marker.markerType != MarkerLand {
+			run++
+		}
+		pending = append(pending, pendingClaim{run: run, claim: claim})
+		if len(pending) == cap(pending) {
+			if err := flush(); err != nil {
+				spill.Close()
+				return nil, invalid, capped, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		spill.Close()
+		return nil, invalid, capped, err
+	}
+	return spill, invalid, capped, nil
+}
+
+func (s *mapClaimSpill) Len() int { return len(s.owners) }
+
+func (s *mapClaimSpill) ClaimCount(i int) int {
+	kept, _ := cappedMapCounts(s.counts[i])
+	return kept.land + kept.water
+}
+
+// Owner loads owner i's claims from the spill, they are only valid until the next call
+func (s *mapClaimSpill) Owner(i int) (FlagOwnerOutputHeader, error) {
+	owner := s.owners[i]
+	counts := s.counts[i]
+	total := counts.land + counts.water
+	if cap(s.claims) < total {
+		s.claims = make([]ClaimFlagOutputEntry, total)
+		s.raw = make([]byte, 4*total)
+	}
+	claims, raw := s.claims[:total], s.raw[:4*total]
+	if _, err := s.f.ReadAt(raw, s.offsets[i]); err != nil {
+		return owner, fmt.Errorf("failed to read %s: %v", s.f.Name(), err)
+	}
+	for j := range claims {
+		claims[j] = ClaimFlagOutputEntry{X: binary.LittleEndian.Uint16(raw[4*j:]), Y: binary.LittleEndian.Uint16(raw[4*j+2:])}
+	}
+	owner.LandClaims, owner.WaterClaims = finishMapClaims(claims[:counts.land:counts.land], claims[counts.land:])
+	return owner, nil
+}
+
+// Close removes the spill
+func (s *mapClaimSpill) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// scaledMapOwners converts owners aggregated for GameSize to another game size as they are loaded,
+// see scaleMapClaims
+type scaledMapOwners struct {
+	mapOwners
+	gameSize int
+	claims   []ClaimFlagOutputEntry // reused
+}
+
+func (s *scaledMapOwners) Owner(i int) (FlagOwnerOutputHeader, error) {
+	owner, err := s.mapOwners.Owner(i)
+	if err != nil {
+		return owner, err
+	}
+	land, water := len(owner.LandClaims), len(owner.WaterClaims)
+	if cap(s.claims) < land+water {
+		s.claims = make([]ClaimFlagOutputEntry, land+water)
+	}
+	owner.LandClaims = scaleMapClaims(s.claims[:land:land], owner.LandClaims, s.gameSize)
+	owner.WaterClaims = scaleMapClaims(s.claims[land:land+water], owner.WaterClaims, s.gameSize)
+	return owner, nil
+}
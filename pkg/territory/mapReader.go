@@ -0,0 +1,95 @@
+package territory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+)
+
+// MapFileHeader is the fixed header at the start of a .map file, Flags only exists from v3
+type MapFileHeader struct {
+	Version         uint16
+	CompressionType uint16
+	SrcPixels       uint16
+	DestPixels      uint16
+	OwnerCount      uint32
+	Flags           uint32
+}
+
+// readMapFile decodes a .map file as written by generateCompressedFile, coverage is nil unless
+// the file has the MapFlagCoverage section
+func readMapFile(filename string) (header MapFileHeader, owners []FlagOwnerOutputHeader, coverage *MapCoverage, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return header, nil, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var base struct {
+		Version, CompressionType, SrcPixels, DestPixels uint16
+		OwnerCount                                      uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &base); err != nil {
+		return header, nil, nil, fmt.Errorf("failed to read header of %s: %v", filename, err)
+	}
+	header = MapFileHeader{base.Version, base.CompressionType, base.SrcPixels, base.DestPixels, base.OwnerCount, 0}
+	if header.Version >= 3 {
+		if err := binary.Read(r, binary.LittleEndian, &header.Flags); err != nil {
+			return header, nil, nil, fmt.Errorf("failed to read flags of %s: %v", filename, err)
+		}
+	}
+	if r, err = readMapBody(r, mapBodyCompression(header.Version, header.CompressionType)); err != nil {
+		return header, nil, nil, fmt.Errorf("%v in %s", err, filename)
+	}
+
+	owners = make([]FlagOwnerOutputHeader, 0, header.OwnerCount)
+	for i := uint32(0); i < header.OwnerCount; i++ {
+		var entry struct {
+			TribeOrPlayerID uint64
+			LandClaims      uint32
+			WaterClaims     uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &entry); err != nil {
+			return header, nil, nil, fmt.Errorf("failed to read owner %d of %s: %v", i, filename, err)
+		}
+		owner := FlagOwnerOutputHeader{
+			TribeOrPlayerID: entry.TribeOrPlayerID,
+			LandClaims:      make([]ClaimFlagOutputEntry, entry.LandClaims),
+			WaterClaims:     make([]ClaimFlagOutputEntry, entry.WaterClaims),
+		}
+		if err := binary.Read(r, binary.LittleEndian, owner.LandClaims); err != nil {
+			return header, nil, nil, fmt.Errorf("failed to read land claims of %d in %s: %v", owner.TribeOrPlayerID, filename, err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, owner.WaterClaims); err != nil {
+			return header, nil, nil, fmt.Errorf("failed to read water claims of %d in %s: %v", owner.TribeOrPlayerID, filename, err)
+		}
+		owners = append(owners, owner)
+	}
+
+	if header.Flags&MapFlagColorTable != 0 {
+		for i := range owners {
+			rgba := make([]byte, 4)
+			if _, err := io.ReadFull(r, rgba); err != nil {
+				return header, nil, nil, fmt.Errorf("failed to read color table of %s: %v", filename, err)
+			}
+			owners[i].Color = color.NRGBA{rgba[0], rgba[1], rgba[2], rgba[3]}
+		}
+	}
+
+	if header.Flags&MapFlagCoverage != 0 {
+		decoded, err := readCoverage(r, len(owners))
+		if err != nil {
+			return header, owners, nil, fmt.Errorf("%v in %s", err, filename)
+		}
+		coverage = &decoded
+	}
+
+	if _, err := r.ReadByte(); err != io.EOF {
+		return header, owners, coverage, fmt.Errorf("unexpected trailing data in %s", filename)
+	}
+	return header, owners, coverage, nil
+}
@@ -0,0 +1,186 @@
+package territory
+
+import (
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMapColorTableRoundTrip(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.MapColorTable = true
+		cfg.TribeColorMode = TribeColorHash
+	})
+	markers := []Marker{
+		{tribeOrOwnerID: 1000050001, relX: 0.1, relY: 0.1, markerType: MarkerLand},
+		{tribeOrOwnerID: 1000050002, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: 7, relX: 0.9, relY: 0.9, markerType: MarkerWater},
+	}
+	owners, _, _ := buildMapOwners(markers)
+	filename := filepath.Join(config.WWWDir, "world.map")
+	write := func(version uint16) (MapFileHeader, []FlagOwnerOutputHeader) {
+		t.Helper()
+		opts := MapOptions{filename: filename, mapVersion: version}
+		if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+			t.Fatal(err)
+		}
+		header, read, _, err := readMapFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header, read
+	}
+
+	header, read := write(3)
+	if header.Flags&MapFlagColorTable == 0 {
+		t.Fatalf("v3 flags %#x, want the color table", header.Flags)
+	}
+	for _, owner := range read {
+		// the game gets the color the web tiles draw the owner with
+		if want := getTribeColor(owner.TribeOrPlayerID); owner.Color != want {
+			t.Errorf("owner %d read with color %v, want the web color %v", owner.TribeOrPlayerID, owner.Color, want)
+		}
+	}
+
+	// older clients get v2 without the table, and MapColorTable leaves it out of v3
+	if header, read := write(2); header.Flags != 0 || read[0].Color != (color.NRGBA{}) {
+		t.Errorf("v2 read with flags %#x and color %v, want no color table", header.Flags, read[0].Color)
+	}
+	config.MapColorTable = false
+	if header, read := write(3); header.Flags&MapFlagColorTable != 0 || read[0].Color != (color.NRGBA{}) {
+		t.Errorf("v3 without MapColorTable read with flags %#x and color %v", header.Flags, read[0].Color)
+	}
+}
+
+// writeCoverageMap writes owners as a v3 .map with the coverage raster and reads it back
+func writeCoverageMap(t *testing.T, owners []FlagOwnerOutputHeader) (MapFileHeader, []FlagOwnerOutputHeader, *MapCoverage) {
+	t.Helper()
+	opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: 3}
+	if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+		t.Fatal(err)
+	}
+	header, read, coverage, err := readMapFile(opts.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Flags&MapFlagCoverage == 0 || coverage == nil {
+		t.Fatalf("v3 flags %#x, want the coverage section", header.Flags)
+	}
+	return header, read, coverage
+}
+
+func TestMapCoverageRoundTrip(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.MapCoverage = true
+		cfg.ServersX, cfg.ServersY = 2, 2
+	})
+	width := config.GameSize / coverageScale
+
+	t.Run("unclaimed", func(t *testing.T) {
+		_, _, coverage := writeCoverageMap(t, nil)
+		if coverage.Width != width || coverage.Height != width {
+			t.Fatalf("coverage is %dx%d, want %dx%d", coverage.Width, coverage.Height, width, width)
+		}
+		for i, cell := range coverage.Cells {
+			if cell != coverageUnclaimed {
+				t.Fatalf("cell %d is %d with no owners", i, cell)
+			}
+		}
+	})
+
+	t.Run("one owner everywhere", func(t *testing.T) {
+		config.LandRadiusUE = 4 * config.GridSize
+		owners, _, _ := buildMapOwners([]Marker{{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}})
+		_, _, coverage := writeCoverageMap(t, owners)
+		for i, cell := range coverage.Cells {
+			if cell != 0 {
+				t.Fatalf("cell %d is %d, want the only owner everywhere", i, cell)
+			}
+		}
+	})
+
+	t.Run("overlapping owners", func(t *testing.T) {
+		config.LandRadiusUE = 140000
+		// the later owner in render order wins where the two overlap
+		owners, _, _ := buildMapOwners([]Marker{
+			{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+			{tribeOrOwnerID: 1000050002, serverX: 1, relX: 0.1, relY: 0.5, markerType: MarkerLand},
+			{tribeOrOwnerID: 1000050002, relX: 0.6, relY: 0.5, markerType: MarkerLand},
+		})
+		_, read, coverage := writeCoverageMap(t, owners)
+		want, _, _ := rasterizeCoverage(mapOwnerList(owners), config.GameSize)
+		if !reflect.DeepEqual(*coverage, want) {
+			t.Fatalf("coverage didn't round trip")
+		}
+		cell := func(serverX int, relX float64) uint16 {
+			x := int((float64(serverX) + relX) * float64(width) / 2)
+			return coverage.Cells[width/4*width+x]
+		}
+		if owner := cell(0, 0.55); read[owner].TribeOrPlayerID != 1000050002 {
+			t.Errorf("overlap owned by %d, want the later 1000050002", read[owner].TribeOrPlayerID)
+		}
+		if owner := cell(0, 0.42); read[owner].TribeOrPlayerID != 1000050001 {
+			t.Errorf("1000050001's side owned by %d, want 1000050001", read[owner].TribeOrPlayerID)
+		}
+		if owner := cell(1, 0.9); owner != coverageUnclaimed {
+			t.Errorf("empty sea owned by %d", owner)
+		}
+	})
+
+	// v2 clients and MapCoverage off get no section
+	config.MapCoverage = false
+	opts := MapOptions{filename: filepath.Join(config.WWWDir, "world.map"), mapVersion: 3}
+	if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(nil), config.GameSize); err != nil {
+		t.Fatal(err)
+	}
+	if header, _, coverage, err := readMapFile(opts.filename); err != nil || header.Flags&MapFlagCoverage != 0 || coverage != nil {
+		t.Errorf("MapCoverage off read flags %#x, coverage %v, err %v", header.Flags, coverage, err)
+	}
+}
+
+func TestMapCoverageIsSmallerThanDenseClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.LandRadiusUE = 140000
+	})
+	// a tribe per grid with its claims packed together, the dense case
+	var markers []Marker
+	for grid := 0; grid < 16; grid++ {
+		for i := 0; i < 900; i++ {
+			markers = append(markers, Marker{
+				tribeOrOwnerID: 1000050001 + uint64(grid),
+				serverX:        grid % 4,
+				serverY:        grid / 4,
+				relX:           0.2 + float64(i%30)*0.02,
+				relY:           0.2 + float64(i/30)*0.02,
+				markerType:     MarkerLand,
+			})
+		}
+	}
+	owners, _, _ := buildMapOwners(markers)
+	filename := filepath.Join(config.WWWDir, "world.map")
+	size := func(withCoverage bool) int64 {
+		config.MapCoverage = withCoverage
+		opts := MapOptions{filename: filename, mapVersion: 3}
+		if err := generateCompressedFile(context.Background(), &opts, mapOwnerList(owners), config.GameSize); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	without := size(false)
+	section := size(true) - without
+	claims := int64(0)
+	for _, owner := range owners {
+		claims += int64(4 * (len(owner.LandClaims) + len(owner.WaterClaims)))
+	}
+	if section <= 0 || section*2 > claims {
+		t.Errorf("coverage section is %d bytes, want well under the %d bytes of claims", section, claims)
+	}
+}
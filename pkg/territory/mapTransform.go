@@ -0,0 +1,22 @@
+package territory
+
+// transformVirtual applies the configured flips and then the clockwise MapRotation to a point in
+// a width x height world anchored at the origin, the result stays anchored at the origin so tile
+// numbering always matches the displayed map
+func transformVirtual(x, y, width, height float64) (float64, float64) {
+	if config.MapFlipHorizontal {
+		x = width - x
+	}
+	if config.MapFlipVertical {
+		y = height - y
+	}
+	switch config.MapRotation {
+	case 90:
+		return height - y, x
+	case 180:
+		return width - x, height - y
+	case 270:
+		return y, width - x
+	}
+	return x, y
+}
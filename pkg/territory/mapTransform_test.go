@@ -0,0 +1,58 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMapRotationMovesMarkerClockwise(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.OpaqueClaims = true
+		cfg.MapRotation = 90
+	})
+	const size = 500
+	marker := Marker{tribeOrOwnerID: 1000050001, relX: 0.2, relY: 0.1, markerType: MarkerLand}
+	img := renderWorld([]Marker{marker}, MapOptions{}, size)
+
+	// clockwise the top edge becomes the right edge: (x, y) lands on (1-y, x)
+	if got := img.RGBAAt(int(0.9*size), int(0.2*size)); colorDistance(got, getTribeColor(marker.tribeOrOwnerID)) != 0 {
+		t.Errorf("rotated position is %v, want the claim color", got)
+	}
+	if got := worldPixel(img, marker, size); got.A != 0 {
+		t.Errorf("unrotated position is %v, want transparent", got)
+	}
+}
+
+func TestMapRotationKeepsTileNumbering(t *testing.T) {
+	// a claim in the top-left quarter of the world
+	marker := Marker{serverX: 0, serverY: 0, tribeOrOwnerID: 1000050001, relX: 0.25, relY: 0.25, markerType: MarkerLand}
+	for _, test := range []struct {
+		rotation int
+		tile     TileCoord
+	}{
+		{0, TileCoord{X: 0, Y: 0}},
+		{90, TileCoord{X: 1, Y: 0}},
+		{180, TileCoord{X: 1, Y: 1}},
+		{270, TileCoord{X: 0, Y: 1}},
+	} {
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.ServersX, cfg.ServersY = 2, 2
+			cfg.MaxZoom = 2
+			cfg.MapRotation = test.rotation
+		})
+		tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+		count := generateTileRange(context.Background(), tilePath, 1, newTileSnapshot([]Marker{marker}, 0, 0), MapOptions{}, image.Rect(0, 0, 2, 2))
+		if want := map[TileCoord]bool{test.tile: true}; !reflect.DeepEqual(count.nonEmptyTiles, want) {
+			t.Errorf("rotation %d: drawn in %v, want %v", test.rotation, count.nonEmptyTiles, test.tile)
+		}
+		// /api/tileForPoint agrees with where the claim was drawn
+		worldX, worldY := marker.relX*config.GridSize, marker.relY*config.GridSize
+		if x, y := tileForPoint(worldX, worldY, 1); x != test.tile.X || y != test.tile.Y {
+			t.Errorf("rotation %d: tileForPoint is %d/%d, want %d/%d", test.rotation, x, y, test.tile.X, test.tile.Y)
+		}
+	}
+}
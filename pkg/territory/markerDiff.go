@@ -0,0 +1,160 @@
+package territory
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// MarkerDiffEntry is the JSON structure of a single claim in a diff
+type MarkerDiffEntry struct {
+	TribeOrOwnerID uint64  `json:"tribeOrOwnerID"`
+	ServerX        int     `json:"serverX"`
+	ServerY        int     `json:"serverY"`
+	RelX           float64 `json:"relX"`
+	RelY           float64 `json:"relY"`
+	MarkerType     uint8   `json:"markerType"`
+}
+
+// MarkerMove is a claim removed and re-added nearby by the same owner
+type MarkerMove struct {
+	From MarkerDiffEntry `json:"from"`
+	To   MarkerDiffEntry `json:"to"`
+}
+
+// MarkerDiff is the change in claims between two generations
+type MarkerDiff struct {
+	GeneratedAt string            `json:"generatedAt"`
+	Added       []MarkerDiffEntry `json:"added"`
+	Removed     []MarkerDiffEntry `json:"removed"`
+	Moved       []MarkerMove      `json:"moved"`
+	TribeDeltas map[uint64]int    `json:"tribeDeltas"` // claims added minus removed per owner
+	Truncated   bool              `json:"truncated"`
+}
+
+// Changes returns the number of claims that changed
+func (d *MarkerDiff) Changes() int {
+	return len(d.Added) + len(d.Removed) + len(d.Moved)
+}
+
+func newMarkerDiffEntry(m Marker) MarkerDiffEntry {
+	return MarkerDiffEntry{
+		TribeOrOwnerID: m.tribeOrOwnerID,
+		ServerX:        m.serverX,
+		ServerY:        m.serverY,
+		RelX:           m.relX,
+		RelY:           m.relY,
+		MarkerType:     m.markerType,
+	}
+}
+
+// diffMarkers compares two marker sets, pairing removed and added claims of the same
+// owner, type and server as moves
+func diffMarkers(previous, current []Marker) *MarkerDiff {
+	remaining := make(map[Marker]int)
+	for _, m := range previous {
+		remaining[m]++
+	}
+	var added []Marker
+	for _, m := range current {
+		if remaining[m] > 0 {
+			remaining[m]--
+			continue
+		}
+		added = append(added, m)
+	}
+	var removed []Marker
+	for _, m := range previous {
+		if remaining[m] > 0 {
+			remaining[m]--
+			removed = append(removed, m)
+		}
+	}
+
+	type moveGroup struct {
+		owner      uint64
+		serverX    int
+		serverY    int
+		markerType uint8
+	}
+	groupOf := func(m Marker) moveGroup {
+		return moveGroup{m.tribeOrOwnerID, m.serverX, m.serverY, m.markerType}
+	}
+	addedByGroup := make(map[moveGroup][]int)
+	for i, m := range added {
+		addedByGroup[groupOf(m)] = append(addedByGroup[groupOf(m)], i)
+	}
+	moved := make([]bool, len(added))
+
+	diff := &MarkerDiff{
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Added:       []MarkerDiffEntry{},
+		Removed:     []MarkerDiffEntry{},
+		Moved:       []MarkerMove{},
+		TribeDeltas: make(map[uint64]int),
+	}
+	for _, from := range removed {
+		candidates := addedByGroup[groupOf(from)]
+		if len(candidates) == 0 {
+			diff.Removed = append(diff.Removed, newMarkerDiffEntry(from))
+			diff.TribeDeltas[from.tribeOrOwnerID]--
+			continue
+		}
+		nearest := 0
+		nearestDist := math.MaxFloat64
+		for i, idx := range candidates {
+			to := added[idx]
+			if dist := math.Hypot(to.relX-from.relX, to.relY-from.relY); dist < nearestDist {
+				nearest, nearestDist = i, dist
+			}
+		}
+		moved[candidates[nearest]] = true
+		diff.Moved = append(diff.Moved, MarkerMove{From: newMarkerDiffEntry(from), To: newMarkerDiffEntry(added[candidates[nearest]])})
+		addedByGroup[groupOf(from)] = append(candidates[:nearest], candidates[nearest+1:]...)
+	}
+	for i, m := range added {
+		if !moved[i] {
+			diff.Added = append(diff.Added, newMarkerDiffEntry(m))
+			diff.TribeDeltas[m.tribeOrOwnerID]++
+		}
+	}
+	return diff
+}
+
+// diffHandler serves GET /api/diff, each list is capped to MaxDiffEntries
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	result := latestGeneration()
+	if result == nil || result.Diff == nil {
+		writeError(w, r, http.StatusNotFound, "no diff available yet")
+		return
+	}
+	diff := result.Diff
+
+	capped := *diff
+	if max := config.MaxDiffEntries; max > 0 {
+		if len(capped.Added) > max {
+			capped.Added, capped.Truncated = capped.Added[:max], true
+		}
+		if len(capped.Removed) > max {
+			capped.Removed, capped.Truncated = capped.Removed[:max], true
+		}
+		if len(capped.Moved) > max {
+			capped.Moved, capped.Truncated = capped.Moved[:max], true
+		}
+	}
+
+	js, err := json.Marshal(capped)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	setGenerationHeader(w, result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
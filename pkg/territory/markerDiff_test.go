@@ -0,0 +1,87 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDiffMarkersPairsMovesWithinOwnerAndServer(t *testing.T) {
+	previous := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.1, relY: 0.1, markerType: MarkerLand},
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 1, serverY: 0, tribeOrOwnerID: 2, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+	}
+	current := []Marker{
+		previous[0],
+		// owner 1's second claim moved within the server
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.6, relY: 0.5, markerType: MarkerLand},
+		// owner 2 lost its claim and claimed another server, that's no move
+		{serverX: 2, serverY: 0, tribeOrOwnerID: 2, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 2, serverY: 0, tribeOrOwnerID: 3, relX: 0.5, relY: 0.5, markerType: MarkerWater},
+	}
+
+	diff := diffMarkers(previous, current)
+	if len(diff.Moved) != 1 || diff.Moved[0].From != newMarkerDiffEntry(previous[1]) || diff.Moved[0].To != newMarkerDiffEntry(current[1]) {
+		t.Fatalf("moved %+v, want owner 1's claim", diff.Moved)
+	}
+	if want := []MarkerDiffEntry{newMarkerDiffEntry(current[2]), newMarkerDiffEntry(current[3])}; !reflect.DeepEqual(diff.Added, want) {
+		t.Fatalf("added %+v, want %+v", diff.Added, want)
+	}
+	if want := []MarkerDiffEntry{newMarkerDiffEntry(previous[2])}; !reflect.DeepEqual(diff.Removed, want) {
+		t.Fatalf("removed %+v, want %+v", diff.Removed, want)
+	}
+	if want := map[uint64]int{2: 0, 3: 1}; !reflect.DeepEqual(diff.TribeDeltas, want) {
+		t.Fatalf("tribe deltas %v, want %v", diff.TribeDeltas, want)
+	}
+	if diff.Changes() != 4 {
+		t.Fatalf("%d changes, want 4", diff.Changes())
+	}
+}
+
+// getDiff requests /api/diff
+func getDiff(t *testing.T) (int, MarkerDiff) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	diffHandler(w, httptest.NewRequest(http.MethodGet, "/api/diff", nil))
+	var diff MarkerDiff
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, diff
+}
+
+func TestDiffEndpointAfterTwoCycles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MaxDiffEntries = 2
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	nextCycle := startGameWorker(t, client)
+
+	if code, _ := getDiff(t); code != http.StatusNotFound {
+		t.Fatalf("got %d after one cycle, want 404 until there are two", code)
+	}
+
+	for _, grid := range []GridID{{X: 1, Y: 0}, {X: 0, Y: 1}, {X: 1, Y: 1}} {
+		addClaim(t, client, grid, 1000050002, 0.5, 0.5, MarkerLand)
+	}
+	nextCycle()
+	code, diff := getDiff(t)
+	if code != http.StatusOK {
+		t.Fatalf("got %d after the second cycle", code)
+	}
+	// three claims were added, the list is capped at two
+	if len(diff.Added) != 2 || !diff.Truncated || len(diff.Removed) != 0 || len(diff.Moved) != 0 {
+		t.Fatalf("got %+v, want 2 of the 3 added claims and truncated", diff)
+	}
+	if diff.TribeDeltas[1000050002] != 3 {
+		t.Fatalf("tribe deltas %v, want the uncapped +3", diff.TribeDeltas)
+	}
+}
@@ -0,0 +1,111 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MarkerJSON is one claim of GET /api/markers
+type MarkerJSON struct {
+	TribeOrOwnerID uint64  `json:"tribeOrOwnerId"`
+	ServerX        int     `json:"serverX"`
+	ServerY        int     `json:"serverY"`
+	RelX           float64 `json:"relX"`
+	RelY           float64 `json:"relY"`
+	MarkerType     uint8   `json:"markerType"`
+}
+
+// sortedPublicMarkers is a marker snapshot without opted out owners in a stable order, redis
+// returns set members in any order
+func sortedPublicMarkers(markers []Marker, optOut map[uint64]bool) []Marker {
+	public := append([]Marker(nil), withoutOptedOut(markers, optOut)...)
+	sort.Slice(public, func(i, j int) bool {
+		a, b := public[i], public[j]
+		if a.serverX != b.serverX {
+			return a.serverX < b.serverX
+		}
+		if a.serverY != b.serverY {
+			return a.serverY < b.serverY
+		}
+		if a.tribeOrOwnerID != b.tribeOrOwnerID {
+			return a.tribeOrOwnerID < b.tribeOrOwnerID
+		}
+		if a.relX != b.relX {
+			return a.relX < b.relX
+		}
+		if a.relY != b.relY {
+			return a.relY < b.relY
+		}
+		return a.markerType < b.markerType
+	})
+	return public
+}
+
+// parseServerFilter parses "X,Y"
+func parseServerFilter(value string) (GridID, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return GridID{}, false
+	}
+	x, errX := strconv.Atoi(strings.TrimSpace(parts[0]))
+	y, errY := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errX != nil || errY != nil || x < 0 || y < 0 || x >= config.ServersX || y >= config.ServersY {
+		return GridID{}, false
+	}
+	return GridID{X: x, Y: y}, true
+}
+
+// markersHandler serves GET /api/markers, optionally ?server=X,Y, from the last generation's
+// snapshot. Opted out owners are left out like every public output
+func markersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	result := latestGeneration()
+	if result == nil || result.FetchedAt.IsZero() {
+		writeError(w, r, http.StatusNotFound, "no markers available yet")
+		return
+	}
+	filter, filtered := GridID{}, false
+	if value := r.URL.Query().Get("server"); len(value) > 0 {
+		if filter, filtered = parseServerFilter(value); !filtered {
+			writeError(w, r, http.StatusBadRequest, "server must be X,Y within the world")
+			return
+		}
+	}
+
+	setGenerationHeader(w, result)
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Last-Modified", result.FetchedAt.Format(http.TimeFormat))
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !result.FetchedAt.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	markers := make([]MarkerJSON, 0, len(result.Markers))
+	for _, m := range result.Markers {
+		if filtered && (m.serverX != filter.X || m.serverY != filter.Y) {
+			continue
+		}
+		markers = append(markers, MarkerJSON{
+			TribeOrOwnerID: m.tribeOrOwnerID,
+			ServerX:        m.serverX,
+			ServerY:        m.serverY,
+			RelX:           m.relX,
+			RelY:           m.relY,
+			MarkerType:     m.markerType,
+		})
+	}
+	js, err := json.Marshal(markers)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
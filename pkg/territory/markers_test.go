@@ -0,0 +1,90 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getMarkers requests path from the markers handler
+func getMarkers(path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	markersHandler(w, r)
+	return w
+}
+
+func TestMarkersEndpoint(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ServersX, cfg.ServersY = 2, 2 })
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+
+	currentGeneration.Store((*GenerationResult)(nil))
+	if w := getMarkers("/api/markers", nil); w.Code != http.StatusNotFound {
+		t.Errorf("before the first snapshot got %d, want 404", w.Code)
+	}
+
+	fetchedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	markers := testMarkers()
+	// redis hands the members back in any order
+	shuffled := []Marker{markers[2], markers[0], markers[1]}
+	publishGeneration(&GenerationResult{CRC: 0x1234, Markers: sortedPublicMarkers(shuffled, nil), FetchedAt: fetchedAt})
+
+	w := getMarkers("/api/markers", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	want := `[{"tribeOrOwnerId":1,"serverX":0,"serverY":0,"relX":0.5,"relY":0.5,"markerType":0},` +
+		`{"tribeOrOwnerId":2,"serverX":1,"serverY":0,"relX":0.25,"relY":0.75,"markerType":0},` +
+		`{"tribeOrOwnerId":3,"serverX":1,"serverY":1,"relX":0.1,"relY":0.1,"markerType":1}]`
+	if w.Body.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", w.Body.String(), want)
+	}
+	if again := getMarkers("/api/markers", nil); again.Body.String() != w.Body.String() {
+		t.Errorf("the same snapshot served different JSON:\n%s\n%s", w.Body.String(), again.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+	if lastModified := w.Header().Get("Last-Modified"); lastModified != fetchedAt.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified %q, want the fetch time %s", lastModified, fetchedAt.Format(http.TimeFormat))
+	}
+	if crc := w.Header().Get("X-Atlas-Generation-CRC"); crc != "00001234" {
+		t.Errorf("X-Atlas-Generation-CRC %q", crc)
+	}
+
+	notModified := getMarkers("/api/markers", http.Header{"If-Modified-Since": {fetchedAt.Format(http.TimeFormat)}})
+	if notModified.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the fetch time got %d, want 304", notModified.Code)
+	}
+	modified := getMarkers("/api/markers", http.Header{"If-Modified-Since": {fetchedAt.Add(-time.Minute).Format(http.TimeFormat)}})
+	if modified.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since before the fetch got %d, want 200", modified.Code)
+	}
+
+	filtered := getMarkers("/api/markers?server=1,0", nil)
+	var got []MarkerJSON
+	json.Unmarshal(filtered.Body.Bytes(), &got)
+	if len(got) != 1 || got[0].TribeOrOwnerID != 2 || got[0].ServerX != 1 || got[0].ServerY != 0 {
+		t.Errorf("?server=1,0 returned %s", filtered.Body.String())
+	}
+	if empty := getMarkers("/api/markers?server=0,1", nil); empty.Body.String() != "[]" {
+		t.Errorf("a server without claims returned %s, want []", empty.Body.String())
+	}
+	for _, bad := range []string{"2,0", "1", "a,b", "-1,0"} {
+		if w := getMarkers("/api/markers?server="+bad, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("?server=%s got %d, want 400", bad, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	markersHandler(w, httptest.NewRequest(http.MethodPost, "/api/markers", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %d, want 405", w.Code)
+	}
+}
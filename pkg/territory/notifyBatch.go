@@ -0,0 +1,40 @@
+package territory
+
+import (
+	"time"
+)
+
+// notifyBatch decides when game servers are told the URLs changed. Every notification makes
+// connected clients re-download the .map, so small marker changes are batched until
+// NotifyMinChangedMarkers of them add up or the oldest has waited NotifyMaxDelaySeconds
+type notifyBatch struct {
+	pending int       // changed markers since the last notification
+	since   time.Time // when the oldest pending change was seen
+	force   bool      // notify whatever the count, e.g. a new map version or on taking over
+}
+
+// add records changes changed markers, a negative count is an unknown change and forces the next
+// notification
+func (b *notifyBatch) add(changes int, now time.Time) {
+	if changes < 0 {
+		b.force = true
+		return
+	}
+	if b.pending == 0 && changes > 0 {
+		b.since = now
+	}
+	b.pending += changes
+}
+
+// due reports whether the next publish should notify
+func (b *notifyBatch) due(now time.Time) bool {
+	if b.force || b.pending >= config.NotifyMinChangedMarkers {
+		return true
+	}
+	return b.pending > 0 && config.NotifyMaxDelaySeconds > 0 && now.Sub(b.since) >= time.Duration(config.NotifyMaxDelaySeconds)*time.Second
+}
+
+// notified resets the batch after a notification
+func (b *notifyBatch) notified() {
+	*b = notifyBatch{}
+}
@@ -0,0 +1,134 @@
+package territory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// subscribeNotifications counts the URL change notifications game servers receive
+func subscribeNotifications(t *testing.T, client *redis.Client) func() int {
+	t.Helper()
+	pubsub := client.Subscribe("GeneralNotifications:GlobalCommands")
+	t.Cleanup(func() { pubsub.Close() })
+	if _, err := pubsub.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	messages := pubsub.Channel()
+	return func() int {
+		n := 0
+		for {
+			select {
+			case message := <-messages:
+				if message.Payload == "RefreshTerrityoryUrls" {
+					n++
+				}
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+}
+
+func TestSmallChangesDontNotify(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.NotifyMinChangedMarkers = 5
+		cfg.NotifyMaxDelaySeconds = 0
+	})
+	useTestStateStore(t)
+	useLogBuffer(t)
+	_, client := newTestRedis(t)
+	notifications := subscribeNotifications(t, client)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	nextCycle := startGameWorker(t, client)
+	// the first generation is always announced
+	if n := notifications(); n == 0 {
+		t.Fatalf("first generation wasn't notified")
+	}
+
+	// one moved flag is generated but held back
+	addClaim(t, client, GridID{X: 1, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	small := nextCycle()
+	if small.Diff == nil || small.Diff.Changes() != 1 {
+		t.Fatalf("diff %+v, want the one added claim", small.Diff)
+	}
+	if meta, _ := artifactMetaFor("gameTiles/world.map"); meta.CRC != small.CRC {
+		t.Errorf("world.map is from %08x, want the small change %08x generated", meta.CRC, small.CRC)
+	}
+	if n := notifications(); n != 0 {
+		t.Errorf("%d notifications for 1 changed marker", n)
+	}
+
+	// the batch reaches the threshold with four more
+	for i := 0; i < 4; i++ {
+		addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, float64(i+1)/5, 0.5, MarkerLand)
+	}
+	nextCycle()
+	if n := notifications(); n != 1 {
+		t.Errorf("%d notifications once 5 markers changed, want 1", n)
+	}
+
+	// and starts over after notifying
+	addClaim(t, client, GridID{X: 0, Y: 1}, 1000050002, 0.5, 0.5, MarkerLand)
+	nextCycle()
+	if n := notifications(); n != 0 {
+		t.Errorf("%d notifications for 1 marker after the batch went out", n)
+	}
+}
+
+func TestNotifyBatchWaitsAtMostTheMaxDelay(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.NotifyMinChangedMarkers = 100
+		cfg.NotifyMaxDelaySeconds = 60
+	})
+	start := time.Now()
+	var batch notifyBatch
+	if batch.due(start) {
+		t.Errorf("due without changes")
+	}
+	batch.add(3, start)
+	batch.add(2, start.Add(30*time.Second))
+	if batch.due(start.Add(59 * time.Second)) {
+		t.Errorf("5 changes due before the delay passed")
+	}
+	// the delay runs from the oldest change
+	if !batch.due(start.Add(60 * time.Second)) {
+		t.Errorf("5 changes not due once the oldest waited 60s")
+	}
+	batch.notified()
+	batch.add(-1, start)
+	if !batch.due(start) {
+		t.Errorf("an unknown change wasn't due immediately")
+	}
+}
+
+func TestNotifyDelayFollowsTheClock(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.NotifyMinChangedMarkers = 100
+		cfg.NotifyMaxDelaySeconds = 60
+	})
+	useTestStateStore(t)
+	useLogBuffer(t)
+	_, client := newTestRedis(t)
+	notifications := subscribeNotifications(t, client)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	nextCycle := startGameWorker(t, client)
+	fake := clock.(*fakeClock)
+	notifications()
+
+	addClaim(t, client, GridID{X: 1, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	nextCycle()
+	if n := notifications(); n != 0 {
+		t.Errorf("%d notifications before the delay passed", n)
+	}
+	// no wall clock time passes, only the clock's
+	fake.advance(60 * time.Second)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050001, 0.5, 0.5, MarkerLand)
+	nextCycle()
+	if n := notifications(); n != 1 {
+		t.Errorf("%d notifications once the clock passed the delay, want 1", n)
+	}
+}
@@ -0,0 +1,77 @@
+package territory
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis"
+)
+
+// fetchOptOutOwners reads the owners who asked to be left off public outputs (web tiles, APIs and
+// leaderboards). They are still included in the in-game world.map and in aggregate statistics.
+func fetchOptOutOwners(client *redis.Client) (map[uint64]bool, uint32) {
+	optOut := make(map[uint64]bool)
+	results, err := client.SMembers("territory_optout").Result()
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return optOut, 0
+	}
+
+	ids := make([]uint64, 0, len(results))
+	for _, v := range results {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Printf("Warning! invalid territory_optout entry %q", v)
+			continue
+		}
+		optOut[id] = true
+		ids = append(ids, id)
+	}
+
+	// CRC so opting out or back in is picked up by change detection
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	hash := crc32.NewIEEE()
+	for _, id := range ids {
+		binary.Write(hash, binary.LittleEndian, id)
+	}
+	return optOut, hash.Sum32()
+}
+
+// combineCrcs folds the opt-out CRC into the markers CRC
+func combineCrcs(a, b uint32) uint32 {
+	hash := crc32.NewIEEE()
+	binary.Write(hash, binary.LittleEndian, a)
+	binary.Write(hash, binary.LittleEndian, b)
+	return hash.Sum32()
+}
+
+// withoutOptedOut returns the markers for public outputs
+func withoutOptedOut(markers []Marker, optOut map[uint64]bool) []Marker {
+	if len(optOut) == 0 {
+		return markers
+	}
+	public := make([]Marker, 0, len(markers))
+	for _, m := range markers {
+		if !optOut[m.tribeOrOwnerID] {
+			public = append(public, m)
+		}
+	}
+	return public
+}
+
+// countsWithoutOptedOut returns the tribe counts for public leaderboards
+func countsWithoutOptedOut(counts map[uint64]*TribeCount, optOut map[uint64]bool) map[uint64]*TribeCount {
+	if len(optOut) == 0 {
+		return counts
+	}
+	public := make(map[uint64]*TribeCount, len(counts))
+	for id, v := range counts {
+		if !optOut[id] {
+			public[id] = v
+		}
+	}
+	return public
+}
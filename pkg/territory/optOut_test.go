@@ -0,0 +1,72 @@
+package territory
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// markerOwners lists the distinct owners of markers in order of appearance
+func markerOwners(markers []Marker) []uint64 {
+	var owners []uint64
+	seen := make(map[uint64]bool)
+	for _, marker := range markers {
+		if !seen[marker.tribeOrOwnerID] {
+			seen[marker.tribeOrOwnerID] = true
+			owners = append(owners, marker.tribeOrOwnerID)
+		}
+	}
+	return owners
+}
+
+func TestOwnerOptsOutAndBackInAcrossCycles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	const stays, optsOut = 1000050001, 1000050002
+	addClaim(t, client, GridID{X: 0, Y: 0}, stays, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 0}, optsOut, 0.5, 0.5, MarkerLand)
+	nextCycle := startGameWorker(t, client)
+
+	check := func(cycle string, result *GenerationResult, public []uint64) {
+		t.Helper()
+		if got := markerOwners(result.Markers); !reflect.DeepEqual(got, public) {
+			t.Errorf("%s: /api/markers owners %v, want %v", cycle, got, public)
+		}
+		tileMarkers, _, _ := fetchTileMarkers(client, false, nil)
+		if got := markerOwners(tileMarkers); !reflect.DeepEqual(got, public) {
+			t.Errorf("%s: tile owners %v, want %v", cycle, got, public)
+		}
+		// the in-game map isn't public, it keeps everyone
+		_, owners, _, err := readMapFile(filepath.Join(config.WWWDir, "gameTiles", "world.map"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(owners) != 2 {
+			t.Errorf("%s: world.map has %d owners, want both", cycle, len(owners))
+		}
+	}
+
+	first := latestGeneration()
+	check("before opting out", first, []uint64{stays, optsOut})
+
+	if err := client.SAdd("territory_optout", optsOut).Err(); err != nil {
+		t.Fatal(err)
+	}
+	optedOut := nextCycle()
+	if optedOut.CRC == first.CRC {
+		t.Errorf("opting out left the CRC at %08x", first.CRC)
+	}
+	check("opted out", optedOut, []uint64{stays})
+
+	if err := client.SRem("territory_optout", optsOut).Err(); err != nil {
+		t.Fatal(err)
+	}
+	optedIn := nextCycle()
+	if optedIn.CRC == optedOut.CRC {
+		t.Errorf("opting back in left the CRC at %08x", optedOut.CRC)
+	}
+	check("opted back in", optedIn, []uint64{stays, optsOut})
+}
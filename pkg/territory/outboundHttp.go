@@ -0,0 +1,49 @@
+package territory
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// outboundClient is shared by everything that talks to the outside world (S3, etc.)
+var outboundClient = http.DefaultClient
+
+// newOutboundHTTPClient builds an http.Client honoring HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// and the outbound TLS settings from the configuration
+func newOutboundHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(config.OutboundCAFile) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(config.OutboundCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.OutboundCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.InsecureSkipVerify {
+		log.Println("!!! WARNING !!! InsecureSkipVerify is enabled, outbound TLS certificates will NOT be verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.OutboundTimeoutSeconds) * time.Second,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package territory
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// writeServerCA writes the self signed certificate of server as a PEM bundle
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestOutboundClientTrustsCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := writeServerCA(t, server)
+
+	for _, test := range []struct {
+		name     string
+		edit     func(cfg *Configuration)
+		wantFail bool
+	}{
+		{"default", nil, true},
+		{"OutboundCAFile", func(cfg *Configuration) { cfg.OutboundCAFile = caFile }, false},
+		{"InsecureSkipVerify", func(cfg *Configuration) { cfg.InsecureSkipVerify = true }, false},
+	} {
+		useTestConfig(t, test.edit)
+		client, err := newOutboundHTTPClient()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if failed := err != nil; failed != test.wantFail {
+			t.Errorf("%s: got error %v, want failure %v", test.name, err, test.wantFail)
+		}
+	}
+}
+
+func TestOutboundClientRejectsCAFileWithoutCertificates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(filename, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, caFile := range []string{filename, filepath.Join(t.TempDir(), "missing.pem")} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.OutboundCAFile = caFile })
+		if _, err := newOutboundHTTPClient(); err == nil {
+			t.Errorf("%s: built a client, want an error", caFile)
+		}
+	}
+}
+
+func TestS3ClientUsesOutboundClient(t *testing.T) {
+	useTestConfig(t, nil)
+	previous := outboundClient
+	outboundClient = &http.Client{}
+	defer func() { outboundClient = previous }()
+
+	svc, err := newS3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Config.HTTPClient != outboundClient {
+		t.Fatalf("the S3 session doesn't use the outbound client")
+	}
+}
@@ -0,0 +1,78 @@
+package territory
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// rotateOutputs keeps the newest keep files of dir named prefix*ext, older versions are deleted
+// locally and from S3. Temp files are never touched and keep <= 0 keeps everything
+func rotateOutputs(ctx context.Context, dir, prefix, ext string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Warning! Failed to list %s for rotation: %v", dir, err)
+		return
+	}
+	var versions []os.FileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, "tmp_") || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		versions = append(versions, entry)
+	}
+	if len(versions) <= keep {
+		return
+	}
+
+	// newest first, names break ties so the result doesn't depend on the listing order
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].ModTime().Equal(versions[j].ModTime()) {
+			return versions[i].ModTime().After(versions[j].ModTime())
+		}
+		return versions[i].Name() > versions[j].Name()
+	})
+	for _, version := range versions[keep:] {
+		filename := path.Join(dir, version.Name())
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning! Failed to remove old version %s: %v", filename, err)
+			continue
+		}
+		artifactHashes.Lock()
+		delete(artifactHashes.byPath, filename)
+		artifactHashes.Unlock()
+		if err := deleteFromS3(ctx, filename); err != nil {
+			recordError(err)
+			log.Printf("Warning! %v", err)
+		}
+	}
+	log.Printf("Removed %d old versions of %s*%s", len(versions)-keep, dir+"/"+prefix, ext)
+}
+
+// deleteFromS3 removes the object uploadToS3 created for a local file
+func deleteFromS3(ctx context.Context, file string) error {
+	// Punt if no S3 config info
+	if len(config.AtlasS3AccessID) == 0 {
+		return nil
+	}
+	svc, err := newS3Client()
+	if err != nil {
+		return classify(ErrConfig, "delete", err)
+	}
+	key := config.AtlasS3KeyPrefix + strings.TrimPrefix(file, path.Clean(config.WWWDir)+"/")
+	err = retryTransient(ctx, func() error {
+		_, err := svc.DeleteObject(&s3.DeleteObjectInput{Bucket: &config.AtlasS3BucketName, Key: &key})
+		return classifyS3Error("delete", err)
+	})
+	return err
+}
@@ -0,0 +1,104 @@
+package territory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeVersions writes posters/<name> for each name, each a minute newer than the one before,
+// and uploads it
+func writeVersions(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := filepath.Join(config.WWWDir, "posters")
+	start := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		filename := writeOutput(t, "posters/"+name, []byte(name))
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := uploadToS3(context.Background(), filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func (f *fakeS3) keys() []string {
+	f.Lock()
+	defer f.Unlock()
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRotateOutputsKeepsNewestVersions(t *testing.T) {
+	useTestConfig(t, nil)
+	useLogBuffer(t)
+	fake := useFakeS3(t)
+	dir := writeVersions(t, "a.png", "b.png", "c.png", "d.png", "e.png", "tmp_upload.png", "index.json")
+
+	rotateOutputs(context.Background(), dir, "", ".png", 2)
+	want := []string{"d.png", "e.png", "index.json", "tmp_upload.png"}
+	if got := listDir(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("left %v, want %v", got, want)
+	}
+	wantKeys := []string{"posters/d.png", "posters/e.png", "posters/index.json", "posters/tmp_upload.png"}
+	if got := fake.keys(); !reflect.DeepEqual(got, wantKeys) {
+		t.Errorf("S3 has %v, want %v", got, wantKeys)
+	}
+
+	// rotating again with nothing new removes nothing
+	rotateOutputs(context.Background(), dir, "", ".png", 2)
+	if got := listDir(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("second rotation left %v, want %v", got, want)
+	}
+}
+
+func TestRotateOutputsKeepsEverythingByDefault(t *testing.T) {
+	useTestConfig(t, nil)
+	useFakeS3(t)
+	dir := writeVersions(t, "a.png", "b.png", "c.png")
+	rotateOutputs(context.Background(), dir, "", ".png", config.RetainVersions)
+	if got := listDir(t, dir); len(got) != 3 {
+		t.Errorf("RetainVersions 0 left %v, want all 3", got)
+	}
+}
+
+func TestRotateOutputsBreaksTiesByName(t *testing.T) {
+	useTestConfig(t, nil)
+	useLogBuffer(t)
+	dir := writeVersions(t, "a.png", "c.png", "b.png")
+	modTime := time.Now().Add(-time.Minute)
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotateOutputs(context.Background(), dir, "", ".png", 1)
+	if got := listDir(t, dir); !reflect.DeepEqual(got, []string{"c.png"}) {
+		t.Errorf("left %v, want the last name kept", got)
+	}
+}
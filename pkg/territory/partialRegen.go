@@ -0,0 +1,240 @@
+package territory
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// serverTileRange returns the tiles of a zoom level a server's claims can touch, as a half-open
+// rectangle of tile indices, including claims overhanging the server's edges and the fog they clear
+func serverTileRange(zoom uint, serverX, serverY int) image.Rectangle {
+	virtualPixels := config.TileSize * (1 << (config.MaxZoom - 1))
+	var virtualPixelsPerServer float64
+	if config.ServersX >= config.ServersY {
+		virtualPixelsPerServer = float64(virtualPixels / config.ServersX)
+	} else {
+		virtualPixelsPerServer = float64(virtualPixels / config.ServersY)
+	}
+	tiles := 1 << zoom
+	virtualPixelsPerTile := float64(virtualPixels / tiles)
+	margin := claimReach(zoom, virtualPixelsPerServer)
+	worldWidth := float64(config.ServersX) * virtualPixelsPerServer
+	worldHeight := float64(config.ServersY) * virtualPixelsPerServer
+
+	// transform the server's corners since tiles follow any rotation or flip
+	x0, y0 := transformVirtual(float64(serverX)*virtualPixelsPerServer, float64(serverY)*virtualPixelsPerServer, worldWidth, worldHeight)
+	x1, y1 := transformVirtual(float64(serverX+1)*virtualPixelsPerServer, float64(serverY+1)*virtualPixelsPerServer, worldWidth, worldHeight)
+	minX, maxX := math.Min(x0, x1)-margin, math.Max(x0, x1)+margin
+	minY, maxY := math.Min(y0, y1)-margin, math.Max(y0, y1)+margin
+
+	tileRange := image.Rect(
+		int(math.Floor(minX/virtualPixelsPerTile)),
+		int(math.Floor(minY/virtualPixelsPerTile)),
+		int(math.Floor(maxX/virtualPixelsPerTile))+1,
+		int(math.Floor(maxY/virtualPixelsPerTile))+1,
+	)
+	return tileRange.Intersect(image.Rect(0, 0, tiles, tiles))
+}
+
+// claimReach is how far from a claim's center, in virtual pixels, the claim can change the tiles
+// of a zoom level: its radius or the fog it clears, plus the sizes in the tile's pixels of claims
+// enlarged to SmallClaimMinPixels, coincident offsets, outlines and antialiasing
+func claimReach(zoom uint, virtualPixelsPerServer float64) float64 {
+	reachUE := math.Max(config.LandRadiusUE, config.WaterRadiusUE)
+	if config.EnableFog {
+		reachUE = math.Max(reachUE, config.FogRadiusUE)
+	}
+	virtualPixelsPerTile := float64(tileVirtualPixels() / (1 << zoom))
+	pixelReach := config.SmallClaimMinPixels + config.CoincidentOffsetPixels + config.ClaimOutlineWidth + 1
+	return virtualPixelsPerServer*reachUE/config.GridSize + pixelReach*virtualPixelsPerTile/float64(config.TileSize)
+}
+
+// gridCrcs is the CRC of what each grid's claims render from: the claims and, for each owner with
+// claims in the grid, its size for size based RenderOrder, its trend and its shared color. A grid
+// with an unchanged CRC draws the same pixels
+func gridCrcs(markers []Marker, trends map[uint64]float64) map[GridID]uint32 {
+	// sizes is nil unless RenderOrder is size based, an owner's claims elsewhere only change the
+	// grid's pixels through the paint order
+	sizes := ownerClaimSizes(markers)
+	perGrid := make(map[GridID][]uint32)
+	var buf [45]byte
+	for _, m := range markers {
+		binary.LittleEndian.PutUint64(buf[0:8], m.tribeOrOwnerID)
+		binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(m.relX))
+		binary.LittleEndian.PutUint64(buf[16:24], math.Float64bits(m.relY))
+		buf[24] = m.markerType
+		binary.LittleEndian.PutUint64(buf[25:33], math.Float64bits(trends[m.tribeOrOwnerID]))
+		c, _ := sharedTribeColor(m.tribeOrOwnerID)
+		buf[33], buf[34], buf[35], buf[36] = c.R, c.G, c.B, c.A
+		n := 37
+		if sizes != nil {
+			binary.LittleEndian.PutUint64(buf[37:45], uint64(sizes[m.tribeOrOwnerID]))
+			n = 45
+		}
+		grid := GridID{X: m.serverX, Y: m.serverY}
+		perGrid[grid] = append(perGrid[grid], crc32.ChecksumIEEE(buf[:n]))
+	}
+
+	crcs := make(map[GridID]uint32, len(perGrid))
+	for grid, markerCrcs := range perGrid {
+		sort.Slice(markerCrcs, func(i, j int) bool { return markerCrcs[i] < markerCrcs[j] })
+		hash := crc32.NewIEEE()
+		binary.Write(hash, binary.LittleEndian, markerCrcs)
+		crcs[grid] = hash.Sum32()
+	}
+	return crcs
+}
+
+// changedGrids lists the grids whose CRC differs, including grids that gained their first claim or
+// lost their last
+func changedGrids(previous, current map[GridID]uint32) []GridID {
+	var changed []GridID
+	for grid, crc := range current {
+		if previousCrc, ok := previous[grid]; !ok || previousCrc != crc {
+			changed = append(changed, grid)
+		}
+	}
+	for grid := range previous {
+		if _, ok := current[grid]; !ok {
+			changed = append(changed, grid)
+		}
+	}
+	return changed
+}
+
+// canRegenerateChanged checks a zoom's tiles can be re-rendered in part: tiles outside
+// TileBoundsOnly's bounds aren't kept current, and tiles missing or changed on disk since recorded,
+// the tilesDigest of the zoom when it was last rendered, need every tile rendered again
+func canRegenerateChanged(tilePath string, zoom uint, recorded uint32) bool {
+	if config.TileBoundsOnly {
+		return false
+	}
+	digest, err := tilesDigest(tilePath, zoom)
+	return err == nil && digest == recorded
+}
+
+// generateChangedTiles re-renders the tiles of a zoom level the changed grids' claims can touch
+// and the tiles that failed last time, returning how many were rendered
+func generateChangedTiles(ctx context.Context, tilePath string, zoomLevel uint, snapshot *tileSnapshot, trends map[uint64]float64, changed []GridID) int {
+	dirty := make(map[TileCoord]bool)
+	if previous, ok := zoomTileCount(zoomLevel); ok {
+		for _, tile := range previous.FailedTiles {
+			dirty[tile] = true
+		}
+	}
+	for _, grid := range changed {
+		tileRange := serverTileRange(zoomLevel, grid.X, grid.Y)
+		for tileX := tileRange.Min.X; tileX < tileRange.Max.X; tileX++ {
+			for tileY := tileRange.Min.Y; tileY < tileRange.Max.Y; tileY++ {
+				dirty[TileCoord{X: tileX, Y: tileY}] = true
+			}
+		}
+	}
+
+	count := ZoomTileCount{Zoom: zoomLevel, nonEmptyTiles: make(map[TileCoord]bool)}
+	base := MapOptions{tribeTrends: trends}
+	for tile := range dirty {
+		tileCount := generateTileRange(ctx, tilePath, zoomLevel, snapshot, base, image.Rect(tile.X, tile.Y, tile.X+1, tile.Y+1))
+		count.FailedTiles = append(count.FailedTiles, tileCount.FailedTiles...)
+		for nonEmpty := range tileCount.nonEmptyTiles {
+			count.nonEmptyTiles[nonEmpty] = true
+		}
+	}
+	mergeZoomTileCount(count, dirty)
+	if len(changed) > 0 {
+		log.Printf("Zoom %d: %d grids changed, re-rendered %d tiles", zoomLevel, len(changed), len(dirty))
+	}
+	return len(dirty)
+}
+
+// RegenerateResult is the response of a partial regeneration
+type RegenerateResult struct {
+	ServerX     int `json:"serverX"`
+	ServerY     int `json:"serverY"`
+	Tiles       int `json:"tiles"`
+	NonEmpty    int `json:"nonEmpty"`
+	FailedTiles int `json:"failedTiles"`
+}
+
+// regenerateServerHandler serves POST /admin/regenerate/server/{x}/{y}, re-rendering only the
+// tiles the server's claims can touch from a fresh marker snapshot. It renders with the tiles
+// worker's trends under its lock, and records the server's grid as current so the worker doesn't
+// render the same tiles again
+func regenerateServerHandler(client *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/regenerate/server/"), "/"), "/")
+		if len(parts) != 2 {
+			writeError(w, r, http.StatusNotFound, "expected /admin/regenerate/server/{x}/{y}")
+			return
+		}
+		serverX, errX := strconv.Atoi(parts[0])
+		serverY, errY := strconv.Atoi(parts[1])
+		if errX != nil || errY != nil || serverX < 0 || serverY < 0 || serverX >= config.ServersX || serverY >= config.ServersY {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("server must be within 0-%d, 0-%d", config.ServersX-1, config.ServersY-1))
+			return
+		}
+
+		tileGeneration.Lock()
+		defer tileGeneration.Unlock()
+		progress, trends := tileGeneration.progress, tileGeneration.trends
+
+		// same snapshot as the tile worker, claims from neighbouring servers overlap the affected
+		// tiles so every marker is rendered
+		markers, crc, _ := fetchTileMarkers(client, false, nil)
+		grids := gridCrcs(markers, trends)
+
+		beginGeneration()
+		ctx := withUploadBreaker(r.Context())
+		tilePath := path.Join(config.WWWDir, "territoryTiles")
+		result := RegenerateResult{ServerX: serverX, ServerY: serverY}
+		snapshot := newTileSnapshot(markers, 0, 0)
+		for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+			tileRange := serverTileRange(zoom, serverX, serverY)
+			count := generateTileRange(ctx, tilePath, zoom, snapshot, MapOptions{tribeTrends: trends}, tileRange)
+			if ctx.Err() != nil {
+				break // the client went away, the worker catches up with the rest
+			}
+			rendered := make(map[TileCoord]bool, count.Total)
+			for tileX := tileRange.Min.X; tileX < tileRange.Max.X; tileX++ {
+				for tileY := tileRange.Min.Y; tileY < tileRange.Max.Y; tileY++ {
+					rendered[TileCoord{X: tileX, Y: tileY}] = true
+				}
+			}
+			mergeZoomTileCount(count, rendered)
+			if len(count.FailedTiles) == 0 && progress.regenerated(tilePath, zoom, GridID{X: serverX, Y: serverY}, grids, crc) {
+				setArtifactMeta(fmt.Sprintf("territoryTiles/%d", zoom), crc)
+			}
+			result.Tiles += count.Total
+			result.NonEmpty += count.NonEmpty
+			result.FailedTiles += len(count.FailedTiles)
+		}
+		endGeneration()
+
+		progress.Lock()
+		updateZoomStaleness(progress.zoomCrcs, crc)
+		progress.Unlock()
+		saveGenerationState(progress)
+		refreshTileCache()
+
+		js, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
@@ -0,0 +1,266 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useTileGeneration installs the tiles worker's state for the test
+func useTileGeneration(t *testing.T, progress *tileProgress, trends map[uint64]float64) {
+	t.Helper()
+	tileGeneration.Lock()
+	previousProgress, previousTrends := tileGeneration.progress, tileGeneration.trends
+	tileGeneration.progress, tileGeneration.trends = progress, trends
+	tileGeneration.Unlock()
+	t.Cleanup(func() {
+		tileGeneration.Lock()
+		tileGeneration.progress, tileGeneration.trends = previousProgress, previousTrends
+		tileGeneration.Unlock()
+	})
+}
+
+// tilesUnder lists the "<z>/<x>/<y>.png" tiles below tilePath
+func tilesUnder(t *testing.T, tilePath string) []string {
+	t.Helper()
+	var tiles []string
+	filepath.Walk(tilePath, func(filename string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(filename, ".png") {
+			rel, _ := filepath.Rel(tilePath, filename)
+			tiles = append(tiles, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(tiles)
+	return tiles
+}
+
+func regenerateServer(t *testing.T, handler http.HandlerFunc, serverX, serverY int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/admin/regenerate/server/"+strconv.Itoa(serverX)+"/"+strconv.Itoa(serverY), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRegenerateServerRendersOnlyAffectedTiles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 4
+	})
+	useTestStateStore(t)
+	useTileGeneration(t, newTileProgress(), nil)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 3, Y: 3}, 2, 0.5, 0.5, MarkerLand)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+	regenerateServer(t, regenerateServerHandler(client), 3, 3)
+
+	var want []string
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		tileRange := serverTileRange(zoom, 3, 3)
+		for tileX := tileRange.Min.X; tileX < tileRange.Max.X; tileX++ {
+			for tileY := tileRange.Min.Y; tileY < tileRange.Max.Y; tileY++ {
+				want = append(want, strconv.Itoa(int(zoom))+"/"+strconv.Itoa(tileX)+"/"+strconv.Itoa(tileY)+".png")
+			}
+		}
+	}
+	sort.Strings(want)
+	if got := tilesUnder(t, tilePath); !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrote tiles %v, want only the server's %v", got, want)
+	}
+}
+
+func TestRegenerateServerKeepsWorkerCurrent(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 3
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 2, Y: 1}, 2, 0.5, 0.5, MarkerLand)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	trends := map[uint64]float64{1: 0.5, 2: -0.5}
+
+	// the worker's cycle
+	progress := newTileProgress()
+	useTileGeneration(t, progress, trends)
+	markers, crc, _ := fetchTileMarkers(client, false, nil)
+	generateZooms(context.Background(), tilePath, dueZooms(progress, crc, 0), markers, crc, trends, progress)
+
+	addClaim(t, client, GridID{X: 2, Y: 1}, 2, 0.25, 0.25, MarkerWater)
+	regenerateServer(t, regenerateServerHandler(client), 2, 1)
+
+	_, fresh, _ := fetchTileMarkers(client, false, nil)
+	if zooms := dueZooms(progress, fresh, 0); len(zooms) != 0 {
+		t.Fatalf("zooms %v still due, want the regenerated grid recorded with the worker's trends", zooms)
+	}
+	if resumed := loadTileProgress(tilePath); !reflect.DeepEqual(resumed.zoomCrcs, progress.zoomCrcs) {
+		t.Fatalf("saved zooms %v, want %v with digests of the regenerated tiles", resumed.zoomCrcs, progress.zoomCrcs)
+	}
+}
+
+func TestRegenerateServerLeavesOtherChangesDue(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 3
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1, 0.5, 0.5, MarkerLand)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+	progress := newTileProgress()
+	useTileGeneration(t, progress, nil)
+	markers, crc, _ := fetchTileMarkers(client, false, nil)
+	generateZooms(context.Background(), tilePath, dueZooms(progress, crc, 0), markers, crc, nil, progress)
+
+	addClaim(t, client, GridID{X: 2, Y: 1}, 2, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 3, Y: 3}, 3, 0.5, 0.5, MarkerLand)
+	regenerateServer(t, regenerateServerHandler(client), 2, 1)
+
+	freshMarkers, fresh, _ := fetchTileMarkers(client, false, nil)
+	if zooms := dueZooms(progress, fresh, 0); len(zooms) != int(config.MaxZoom) {
+		t.Fatalf("due zooms %v, want every zoom for the other changed grid", zooms)
+	}
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		if changed := changedGrids(progress.zoomGridCrcs[zoom], gridCrcs(freshMarkers, nil)); !reflect.DeepEqual(changed, []GridID{{X: 3, Y: 3}}) {
+			t.Fatalf("zoom %d changed grids %v, want only the grid that wasn't regenerated", zoom, changed)
+		}
+	}
+}
+
+func TestGridCrcsIncludeOwnerSizeOnlyForSizeOrder(t *testing.T) {
+	for _, test := range []struct {
+		order      string
+		wantChange bool
+	}{
+		{RenderOrderOwnerID, false},
+		{RenderOrderSizeDescending, true},
+		{RenderOrderSizeAscending, true},
+	} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.RenderOrder = test.order })
+		markers := testMarkers()
+		// owner 1 grows in another grid, only the paint order can change grid 0/0's pixels
+		grown := append(testMarkers(), Marker{serverX: 1, serverY: 1, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand})
+
+		before, after := gridCrcs(markers, nil), gridCrcs(grown, nil)
+		if changed := before[GridID{}] != after[GridID{}]; changed != test.wantChange {
+			t.Errorf("%s: grid 0/0 changed %v, want %v", test.order, changed, test.wantChange)
+		}
+	}
+}
+
+// readTiles reads every tile below tilePath
+func readTiles(t *testing.T, tilePath string) map[string][]byte {
+	t.Helper()
+	tiles := make(map[string][]byte)
+	for _, tile := range tilesUnder(t, tilePath) {
+		data, err := ioutil.ReadFile(filepath.Join(tilePath, tile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles[tile] = data
+	}
+	return tiles
+}
+
+func TestChangedTilesMatchFullRender(t *testing.T) {
+	for name, edit := range map[string]func(cfg *Configuration){
+		"default":        nil,
+		"size order":     func(cfg *Configuration) { cfg.RenderOrder = RenderOrderSizeDescending },
+		"fog":            func(cfg *Configuration) { cfg.EnableFog = true },
+		"small claims":   func(cfg *Configuration) { cfg.SmallClaimMinPixels = 12 },
+		"claim outlines": func(cfg *Configuration) { cfg.ClaimOutlineOnly = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 4, 4
+				cfg.MaxZoom = 4
+				if edit != nil {
+					edit(cfg)
+				}
+			})
+			useTestStateStore(t)
+			markers := []Marker{
+				{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+				{serverX: 1, serverY: 0, tribeOrOwnerID: 2, relX: 0.05, relY: 0.5, markerType: MarkerLand},
+				{serverX: 3, serverY: 3, tribeOrOwnerID: 3, relX: 0.9, relY: 0.9, markerType: MarkerWater},
+			}
+			// owner 1 claims on the edge of another grid, owner 2 loses a claim
+			changed := []Marker{
+				markers[0],
+				markers[2],
+				{serverX: 2, serverY: 1, tribeOrOwnerID: 1, relX: 0.99, relY: 0.01, markerType: MarkerLand},
+			}
+
+			partialPath := filepath.Join(config.WWWDir, "partial")
+			progress := newTileProgress()
+			generateZooms(context.Background(), partialPath, dueZooms(progress, 1, 0), markers, 1, nil, progress)
+			generateZooms(context.Background(), partialPath, dueZooms(progress, 2, 0), changed, 2, nil, progress)
+
+			fullPath := filepath.Join(config.WWWDir, "full")
+			generateZooms(context.Background(), fullPath, dueZooms(newTileProgress(), 2, 0), changed, 2, nil, newTileProgress())
+
+			partial, full := readTiles(t, partialPath), readTiles(t, fullPath)
+			if len(partial) != len(full) {
+				t.Fatalf("%d tiles after the partial render, %d after the full one", len(partial), len(full))
+			}
+			for tile, data := range full {
+				if !bytes.Equal(partial[tile], data) {
+					t.Errorf("tile %s differs from the full render", tile)
+				}
+			}
+		})
+	}
+}
+
+func TestTilesChangedOnDiskRenderInFull(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 3
+	})
+	useTestStateStore(t)
+	markers := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 3, serverY: 3, tribeOrOwnerID: 2, relX: 0.5, relY: 0.5, markerType: MarkerWater},
+	}
+	changed := append([]Marker{{serverX: 1, serverY: 1, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand}}, markers...)
+
+	partialPath := filepath.Join(config.WWWDir, "partial")
+	progress := newTileProgress()
+	generateZooms(context.Background(), partialPath, dueZooms(progress, 1, 0), markers, 1, nil, progress)
+	// zoom 1 keeps its directory but loses every tile, zoom 2 has a tile of another render
+	for _, tile := range tilesUnder(t, filepath.Join(partialPath, "1")) {
+		os.Remove(filepath.Join(partialPath, "1", tile))
+	}
+	if err := ioutil.WriteFile(filepath.Join(partialPath, "2", "3", "3.png"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	generateZooms(context.Background(), partialPath, dueZooms(progress, 2, 0), changed, 2, nil, progress)
+
+	fullPath := filepath.Join(config.WWWDir, "full")
+	generateZooms(context.Background(), fullPath, dueZooms(newTileProgress(), 2, 0), changed, 2, nil, newTileProgress())
+
+	partial, full := readTiles(t, partialPath), readTiles(t, fullPath)
+	if len(partial) != len(full) {
+		t.Fatalf("%d tiles after the partial render, %d after the full one", len(partial), len(full))
+	}
+	for tile, data := range full {
+		if !bytes.Equal(partial[tile], data) {
+			t.Errorf("tile %s differs from the full render", tile)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Error classes, a PipelineError matches its class with errors.Is
+var (
+	ErrTransient   = errors.New("transient")    // worth retrying within the cycle, e.g. a redis or S3 timeout
+	ErrConfig      = errors.New("config")       // won't succeed until the configuration changes
+	ErrDataCorrupt = errors.New("data corrupt") // bad input, retrying gets the same result
+	ErrStorage     = errors.New("storage")      // local disk or a stored object is unusable
+)
+
+// PipelineError is an error classified at the boundary it crossed
+type PipelineError struct {
+	Class error  // one of the Err* classes
+	Op    string // "fetch", "parse", "render", "write", "upload", "delete" or "publish"
+	Err   error
+}
+
+func (e *PipelineError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PipelineError) Is(target error) bool {
+	return target == e.Class
+}
+
+// classify wraps err with its class and boundary, errors that were already classified further
+// down keep their class
+func classify(class error, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *PipelineError
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &PipelineError{Class: class, Op: op, Err: err}
+}
+
+// errorClass names the class of err for reports
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrTransient):
+		return "transient"
+	case errors.Is(err, ErrConfig):
+		return "config"
+	case errors.Is(err, ErrDataCorrupt):
+		return "dataCorrupt"
+	case errors.Is(err, ErrStorage):
+		return "storage"
+	}
+	return "unclassified"
+}
+
+// ErrorReport is the latest error of a class
+type ErrorReport struct {
+	Op    string    `json:"op,omitempty"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+}
+
+// ErrorSummary is the GET /admin/errors response
+type ErrorSummary struct {
+	Counts map[string]uint64      `json:"counts"`
+	Last   map[string]ErrorReport `json:"last"`
+}
+
+var pipelineErrors = struct {
+	sync.Mutex
+	counts map[string]uint64
+	last   map[string]ErrorReport
+}{counts: make(map[string]uint64), last: make(map[string]ErrorReport)}
+
+// recordError counts err by class for /admin/errors, the caller still logs it
+func recordError(err error) {
+	if err == nil {
+		return
+	}
+	report := ErrorReport{Error: err.Error(), At: time.Now().UTC()}
+	var classified *PipelineError
+	if errors.As(err, &classified) {
+		report.Op = classified.Op
+	}
+	class := errorClass(err)
+
+	pipelineErrors.Lock()
+	defer pipelineErrors.Unlock()
+	pipelineErrors.counts[class]++
+	pipelineErrors.last[class] = report
+}
+
+// retryTransient runs fn until it succeeds, fails with anything but a transient error or runs
+// out of TransientRetries, backing off from TransientBackoffMillis and doubling each attempt.
+// Once ctx is cancelled the backoff is cut short and the last error returned
+func retryTransient(ctx context.Context, fn func() error) error {
+	backoff := time.Duration(config.TransientBackoffMillis) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !errors.Is(err, ErrTransient) || attempt >= config.TransientRetries {
+			return err
+		}
+		recordError(err)
+		log.Printf("Warning! %v, retrying in %v", err, backoff)
+		timer := clock.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C():
+		}
+		backoff *= 2
+	}
+}
+
+// errorsHandler serves GET /admin/errors
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	summary := ErrorSummary{Counts: make(map[string]uint64), Last: make(map[string]ErrorReport)}
+	pipelineErrors.Lock()
+	for class, count := range pipelineErrors.counts {
+		summary.Counts[class] = count
+	}
+	for class, report := range pipelineErrors.last {
+		summary.Last[class] = report
+	}
+	pipelineErrors.Unlock()
+
+	js, _ := json.Marshal(summary)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
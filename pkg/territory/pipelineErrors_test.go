@@ -0,0 +1,347 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// usePipelineErrors clears the error counts for the test
+func usePipelineErrors(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		pipelineErrors.Lock()
+		pipelineErrors.counts = make(map[string]uint64)
+		pipelineErrors.last = make(map[string]ErrorReport)
+		pipelineErrors.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// getErrors reads GET /admin/errors
+func getErrors(t *testing.T) ErrorSummary {
+	t.Helper()
+	w := httptest.NewRecorder()
+	errorsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/errors", nil))
+	var summary ErrorSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	return summary
+}
+
+// waitForErrors waits up to 10s for n errors of class to be recorded
+func waitForErrors(class string, n uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		pipelineErrors.Lock()
+		count := pipelineErrors.counts[class]
+		pipelineErrors.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClassifiedErrorsKeepTheirCause(t *testing.T) {
+	_, cause := os.Open(filepath.Join(t.TempDir(), "missing"))
+	err := classify(ErrStorage, "write", cause)
+	var pathErr *os.PathError
+	if !errors.Is(err, ErrStorage) || !errors.Is(err, os.ErrNotExist) || !errors.As(err, &pathErr) {
+		t.Errorf("%v lost its class or cause", err)
+	}
+	if errors.Is(err, ErrTransient) {
+		t.Errorf("%v matches another class", err)
+	}
+	// an error classified further down keeps its class when it crosses another boundary
+	if outer := classify(ErrTransient, "upload", fmt.Errorf("wrapped: %w", err)); !errors.Is(outer, ErrStorage) || errors.Is(outer, ErrTransient) {
+		t.Errorf("reclassified %v as %s", outer, errorClass(outer))
+	}
+	if classify(ErrConfig, "config", nil) != nil {
+		t.Errorf("nil was classified")
+	}
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{classify(ErrTransient, "fetch", errors.New("i/o timeout")), "transient"},
+		{classify(ErrConfig, "config", errors.New("no bucket")), "config"},
+		{classify(ErrDataCorrupt, "parse", errors.New("short claim")), "dataCorrupt"},
+		{err, "storage"},
+		{errors.New("plain"), "unclassified"},
+	} {
+		if got := errorClass(test.err); got != test.want {
+			t.Errorf("%v is %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryTransientDecisions(t *testing.T) {
+	useLogBuffer(t)
+	for _, test := range []struct {
+		class    error
+		failures int // attempts failing before one succeeds
+		attempts int
+		fails    bool
+	}{
+		{ErrTransient, 2, 3, false},
+		{ErrTransient, 10, 4, true},
+		{ErrConfig, 10, 1, true},
+		{ErrDataCorrupt, 10, 1, true},
+		{ErrStorage, 10, 1, true},
+		{nil, 10, 1, true},
+	} {
+		t.Run(fmt.Sprintf("%s %d failures", errorClass(test.class), test.failures), func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 3, 1 })
+			usePipelineErrors(t)
+			attempts := 0
+			err := retryTransient(context.Background(), func() error {
+				attempts++
+				if attempts > test.failures {
+					return nil
+				}
+				cause := errors.New("failed")
+				if test.class == nil {
+					return cause
+				}
+				return classify(test.class, "fetch", cause)
+			})
+			if attempts != test.attempts || (err != nil) != test.fails {
+				t.Errorf("%d attempts ending in %v, want %d attempts failing %v", attempts, err, test.attempts, test.fails)
+			}
+			if test.fails && test.class != nil && !errors.Is(err, test.class) {
+				t.Errorf("returned %v, want its %s class kept", err, errorClass(test.class))
+			}
+		})
+	}
+}
+
+func TestRetryTransientStopsWithTheContext(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 3, 1000 })
+	usePipelineErrors(t)
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- retryTransient(ctx, func() error {
+			attempts++
+			return classify(ErrTransient, "upload", errors.New("timeout"))
+		})
+	}()
+
+	// the backoff waits on the clock, not the wall clock
+	waitForTimer(t, fake)
+	fake.advance(time.Second)
+	waitForTimer(t, fake)
+	cancel()
+	select {
+	case err := <-done:
+		if attempts != 2 || !errors.Is(err, ErrTransient) {
+			t.Errorf("%d attempts ending in %v, want 2 and the transient error", attempts, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retryTransient kept backing off after ctx was cancelled")
+	}
+}
+
+func TestS3ErrorCodes(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class error
+	}{
+		{awserr.New("AccessDenied", "Access Denied", nil), ErrConfig},
+		{awserr.New("NoSuchBucket", "The specified bucket does not exist", nil), ErrConfig},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.New("InvalidAccessKeyId", "unknown key", nil)), ErrConfig},
+		{awserr.New("InternalError", "We encountered an internal error", nil), ErrTransient},
+		{awserr.New("RequestError", "send request failed", errors.New("connection reset")), ErrTransient},
+		{errors.New("timeout"), ErrTransient},
+	} {
+		if err := classifyS3Error("upload", test.err); !errors.Is(err, test.class) {
+			t.Errorf("%v classified %s, want %s", test.err, errorClass(err), errorClass(test.class))
+		}
+	}
+}
+
+func TestRedisFetchErrorsAreTransient(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 1, 1 })
+	useLogBuffer(t)
+	usePipelineErrors(t)
+	server, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	server.SetError("LOADING redis is loading the dataset")
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	if len(markers) != 0 {
+		t.Fatalf("read %d markers from a failing redis", len(markers))
+	}
+	summary := getErrors(t)
+	if summary.Counts["transient"] == 0 || summary.Last["transient"].Op != "fetch" {
+		t.Errorf("fetch failures reported as %+v", summary)
+	}
+}
+
+func TestShortClaimsAreCorruptData(t *testing.T) {
+	useTestConfig(t, nil)
+	useLogBuffer(t)
+	usePipelineErrors(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	client.SAdd("territorymapdata:"+packedGridID(GridID{X: 0, Y: 0}), "short")
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	if len(markers) != 1 {
+		t.Fatalf("read %d markers, want the intact claim", len(markers))
+	}
+	summary := getErrors(t)
+	if summary.Counts["dataCorrupt"] != 1 || summary.Last["dataCorrupt"].Op != "parse" || summary.Counts["transient"] != 0 {
+		t.Errorf("short claim reported as %+v", summary)
+	}
+}
+
+func TestRenderPanicIsCorruptData(t *testing.T) {
+	useTestConfig(t, nil)
+	previous := encodePNG
+	encodePNG = func(w io.Writer, m image.Image) error { panic("bad image") }
+	defer func() { encodePNG = previous }()
+
+	opts := MapOptions{actualPixels: 64, virtualPixels: 64, virtualClip: image.Rect(0, 0, 64, 64)}
+	opts.filename = filepath.Join(config.WWWDir, "image.png")
+	_, err := generateTile(context.Background(), &opts, createQuadTree(&opts, testMarkers()))
+	var classified *PipelineError
+	if !errors.Is(err, ErrDataCorrupt) || !errors.As(err, &classified) || classified.Op != "render" {
+		t.Errorf("render panic returned %v, want corrupt data at render", err)
+	}
+}
+
+func TestPublishRetriesTransientFailuresWithinTheCall(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 2, 200 })
+	useLogBuffer(t)
+	usePipelineErrors(t)
+	server, client := newTestRedis(t)
+	server.SetError("LOADING redis is loading the dataset")
+	// redis comes back during the backoff after the first failure
+	go func() {
+		waitForErrors("transient", 1)
+		server.SetError("")
+	}()
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 7); !written {
+		t.Fatalf("URLs weren't written after redis recovered")
+	}
+	if world, _ := client.HGet("territory_urls", "world").Result(); world == "" {
+		t.Errorf("territory_urls has no world URL")
+	}
+	if summary := getErrors(t); summary.Counts["transient"] != 1 || summary.Last["transient"].Op != "publish" {
+		t.Errorf("publish failures reported as %+v", summary)
+	}
+
+	// redis staying down gives up after the retries
+	usePipelineErrors(t)
+	config.TransientBackoffMillis = 1
+	server.SetError("LOADING redis is loading the dataset")
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 8); written {
+		t.Errorf("URLs written to a failing redis")
+	}
+	if summary := getErrors(t); summary.Counts["transient"] != 3 {
+		t.Errorf("%d transient errors, want the 2 retries and the final failure", summary.Counts["transient"])
+	}
+}
+
+func TestUploadErrorClasses(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 1, 1 })
+	useLogBuffer(t)
+	usePipelineErrors(t)
+	fake := useFakeS3(t)
+	file := writeOutput(t, "gameTiles/world.map", []byte("map"))
+
+	fake.Lock()
+	fake.failPuts = true
+	fake.Unlock()
+	err := uploadToS3(context.Background(), file)
+	if !errors.Is(err, ErrTransient) {
+		t.Fatalf("failed PUTs returned %v, want a transient error", err)
+	}
+	// the retry is recorded, the final failure is the caller's to report
+	if summary := getErrors(t); summary.Counts["transient"] != 1 || summary.Last["transient"].Op != "upload" {
+		t.Errorf("upload failures reported as %+v", summary)
+	}
+
+	// S3 recovering during the backoff lands the upload in the same call
+	usePipelineErrors(t)
+	config.TransientBackoffMillis = 200
+	go func() {
+		waitForErrors("transient", 1)
+		fake.Lock()
+		fake.failPuts = false
+		fake.Unlock()
+	}()
+	if err := uploadToS3(context.Background(), file); err != nil {
+		t.Fatalf("upload failed after S3 recovered: %v", err)
+	}
+	if puts := fake.putCount("gameTiles/world.map"); puts != 1 {
+		t.Errorf("%d PUTs landed, want 1", puts)
+	}
+
+	// a file that can't be read isn't retried
+	usePipelineErrors(t)
+	err = uploadToS3(context.Background(), filepath.Join(config.WWWDir, "gameTiles", "missing.map"))
+	if !errors.Is(err, ErrStorage) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file returned %v, want a storage error", err)
+	}
+	if summary := getErrors(t); summary.Counts["transient"] != 0 {
+		t.Errorf("storage error retried: %+v", summary)
+	}
+}
+
+func TestGameCycleAbortsOnStorageErrors(t *testing.T) {
+	useTestConfig(t, nil)
+	logs := useLogBuffer(t)
+	usePipelineErrors(t)
+	useArtifactMeta(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	// a file where gameTiles should be makes every map write fail
+	gamePath := filepath.Join(config.WWWDir, "gameTiles")
+	if err := os.MkdirAll(config.WWWDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(gamePath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	nextCycle := startGameWorker(t, client)
+	if _, ok := artifactMetaFor("gameTiles/world.map"); ok {
+		t.Errorf("game maps recorded as generated after failing to write")
+	}
+	if !strings.Contains(logs.String(), "Game generation failed (storage), not publishing URLs") {
+		t.Errorf("the aborted cycle wasn't reported:\n%s", logs)
+	}
+	summary := getErrors(t)
+	if summary.Counts["storage"] == 0 || summary.Last["storage"].Op != "write" || summary.Counts["transient"] != 0 {
+		t.Errorf("failed cycle reported as %+v", summary)
+	}
+
+	// the next cycle tries again
+	if err := os.Remove(gamePath); err != nil {
+		t.Fatal(err)
+	}
+	nextCycle()
+	if _, ok := artifactMetaFor("gameTiles/world.map"); !ok {
+		t.Errorf("game maps weren't generated once they could be written")
+	}
+}
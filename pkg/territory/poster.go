@@ -0,0 +1,515 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // PosterBackground may be a JPEG
+	"image/png"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GrapeshotGames/goquadtree/quadtree"
+	"github.com/go-redis/redis"
+)
+
+const (
+	PosterLayerClaims = "claims"
+	PosterLayerGrid   = "grid"
+	PosterLayerLabels = "labels"
+	PosterLayerLegend = "legend"
+)
+
+// posterLegendTribes is how many of the top tribes the legend lists
+const posterLegendTribes = 10
+
+// posterBlockMargin is the pixels rendered around each block of claims and cropped off
+const posterBlockMargin = 2
+
+// PosterRequest is the body of POST /admin/poster
+type PosterRequest struct {
+	Width  int           `json:"width"`            // pixels, the poster is square plus the legend strip
+	Layers []string      `json:"layers"`           // any of claims, grid, labels and legend, all when empty
+	Region *RegionConfig `json:"region,omitempty"` // grids to clip to, the whole world when nil
+}
+
+// PosterJob is a queued, running or finished poster render
+type PosterJob struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"` // "queued", "running", "done" or "failed"
+	Request    PosterRequest `json:"request"`
+	Strips     int           `json:"strips"`
+	StripsDone int           `json:"stripsDone"`
+	URL        string        `json:"url,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+}
+
+// posters holds every job since startup, a single worker renders them in order
+var posters = struct {
+	sync.Mutex
+	jobs   map[string]*PosterJob
+	queue  chan string
+	worker sync.Once
+}{jobs: make(map[string]*PosterJob)}
+
+// generationActivity counts tile and game generations in progress, posters wait for them
+// between strips
+var generationActivity = struct {
+	sync.Mutex
+	active int
+}{}
+
+func beginGeneration() {
+	generationActivity.Lock()
+	generationActivity.active++
+	generationActivity.Unlock()
+}
+
+func endGeneration() {
+	generationActivity.Lock()
+	generationActivity.active--
+	generationActivity.Unlock()
+}
+
+func generationActive() bool {
+	generationActivity.Lock()
+	defer generationActivity.Unlock()
+	return generationActivity.active > 0
+}
+
+// posterHandler serves POST /admin/poster to queue a job and GET /admin/poster/{id} for its status
+func posterHandler(client *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/poster"), "/")
+		switch {
+		case len(id) == 0 && r.Method == http.MethodPost:
+			queuePoster(client, w, r)
+		case len(id) > 0 && r.Method == http.MethodGet:
+			posters.Lock()
+			job, ok := posters.jobs[id]
+			var js []byte
+			if ok {
+				js, _ = json.Marshal(job)
+			}
+			posters.Unlock()
+			if !ok {
+				writeError(w, r, http.StatusNotFound, "no poster job "+id)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// validatePosterRequest fills in the default width and layers and rejects what can't be rendered
+func validatePosterRequest(req *PosterRequest) error {
+	if req.Width == 0 {
+		req.Width = 8192
+	}
+	if req.Width < config.TileSize || req.Width > config.PosterMaxPixels {
+		return fmt.Errorf("width must be between %d and %d", config.TileSize, config.PosterMaxPixels)
+	}
+	if len(req.Layers) == 0 {
+		req.Layers = []string{PosterLayerClaims, PosterLayerGrid, PosterLayerLabels, PosterLayerLegend}
+	}
+	for _, layer := range req.Layers {
+		if layer != PosterLayerClaims && layer != PosterLayerGrid && layer != PosterLayerLabels && layer != PosterLayerLegend {
+			return fmt.Errorf("unknown layer %q", layer)
+		}
+	}
+	if req.Region != nil {
+		if len(req.Region.Name) == 0 {
+			req.Region.Name = "poster"
+		}
+		if len(validRegions([]RegionConfig{*req.Region}, config.ServersX, config.ServersY)) == 0 {
+			return fmt.Errorf("region must be a rectangle of grids inside the world")
+		}
+	}
+	return nil
+}
+
+func queuePoster(client *redis.Client, w http.ResponseWriter, r *http.Request) {
+	var req PosterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid poster request: %v", err))
+		return
+	}
+	if err := validatePosterRequest(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	posters.worker.Do(func() {
+		posters.queue = make(chan string, config.PosterQueueSize)
+		go posterWorker(client)
+	})
+	job := &PosterJob{
+		ID:        fmt.Sprintf("%d-%04x", time.Now().Unix(), rand.Intn(0x10000)),
+		Status:    "queued",
+		Request:   req,
+		CreatedAt: time.Now().UTC(),
+	}
+	posters.Lock()
+	select {
+	case posters.queue <- job.ID:
+		posters.jobs[job.ID] = job
+	default:
+		posters.Unlock()
+		writeError(w, r, http.StatusServiceUnavailable, "poster queue is full")
+		return
+	}
+	js, _ := json.Marshal(job)
+	posters.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", config.BasePath+"/admin/poster/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+func posterWorker(client *redis.Client) {
+	for id := range posters.queue {
+		posters.Lock()
+		job := posters.jobs[id]
+		job.Status = "running"
+		req := job.Request
+		posters.Unlock()
+
+		url, err := renderPoster(client.Context(), client, id, req)
+
+		posters.Lock()
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+			log.Printf("Warning! Poster %s failed: %v", id, err)
+		} else {
+			job.Status = "done"
+			job.URL = url
+		}
+		posters.Unlock()
+	}
+}
+
+// renderPoster writes posters/<id>.png from a fresh marker snapshot, returning its URL
+func renderPoster(ctx context.Context, client *redis.Client, id string, req PosterRequest) (url string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	optOut, _ := fetchOptOutOwners(client)
+	markers = withoutOptedOut(markers, optOut)
+	region := RegionConfig{MaxX: config.ServersX - 1, MaxY: config.ServersY - 1}
+	if req.Region != nil {
+		region = *req.Region
+	}
+	markers = regionMarkers(region, markers)
+
+	poster := newPosterImage(id, req, region, markers)
+	if poster.layers[PosterLayerLegend] {
+		poster.legend = posterLegend(markers, func(tribeID uint64) string { return lookupTribeName(client, tribeID) })
+	}
+	if len(config.PosterBackground) > 0 {
+		if poster.background, err = loadPosterBackground(config.PosterBackground); err != nil {
+			return "", err
+		}
+	}
+	posters.Lock()
+	posters.jobs[id].Strips = poster.strips()
+	posters.Unlock()
+
+	dir := path.Join(config.WWWDir, "posters")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	filename := path.Join(dir, id+".png")
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".png"))
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return "", err
+	}
+	if err := png.Encode(f, poster); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return "", err
+	}
+	os.Remove(filename)
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return "", err
+	}
+	if err := uploadToS3(ctx, filename); err != nil {
+		return "", err
+	}
+	rotateOutputs(ctx, dir, "", ".png", config.RetainVersions)
+	return fmt.Sprintf("%s/posters/%s.png", publicBaseURL(), id), nil
+}
+
+func loadPosterBackground(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// posterLegendEntry is one tribe listed along the bottom of a poster
+type posterLegendEntry struct {
+	name  string
+	color color.RGBA
+}
+
+func posterLegend(markers []Marker, tribeName func(tribeID uint64) string) []posterLegendEntry {
+	counts := make(map[uint64]*TribeCount)
+	for _, marker := range markers {
+		countTribeClaim(counts, marker)
+	}
+	var legend []posterLegendEntry
+	for _, tribeID := range TopNTribes(posterLegendTribes, counts) {
+		c := getTribeColor(tribeID)
+		legend = append(legend, posterLegendEntry{name: tribeName(tribeID), color: color.RGBA{c.R, c.G, c.B, 0xff}})
+	}
+	return legend
+}
+
+// posterImage renders the poster lazily one horizontal strip at a time as the PNG encoder reads
+// its rows, so memory stays at a strip however large the poster
+type posterImage struct {
+	id           string
+	width        int // of the map area, which is square
+	legendHeight int
+	stripHeight  int
+	layers       map[string]bool
+	region       RegionConfig
+	opts         MapOptions
+	quadTree     *quadtree.QuadTree
+	background   image.Image
+	legend       []posterLegendEntry
+	caption      string // drawn in the top left corner, e.g. a replay frame's time
+
+	strip    *image.RGBA
+	stripTop int // -1 before the first strip
+}
+
+func newPosterImage(id string, req PosterRequest, region RegionConfig, markers []Marker) *posterImage {
+	p := &posterImage{
+		id:          id,
+		width:       req.Width,
+		stripHeight: Min(config.PosterStripPixels, req.Width),
+		layers:      make(map[string]bool),
+		region:      region,
+		stripTop:    -1,
+	}
+	for _, layer := range req.Layers {
+		p.layers[layer] = true
+	}
+	if p.layers[PosterLayerLegend] {
+		p.legendHeight = Max(64, p.width/16)
+	}
+
+	// one virtual pixel per poster pixel, with the region as the world
+	p.opts = MapOptions{
+		actualPixels:  p.stripHeight,
+		virtualPixels: p.width,
+		serversX:      region.width(),
+		serversY:      region.height(),
+	}
+	p.opts.ownerSizes = ownerClaimSizes(markers)
+	p.quadTree = createQuadTree(&p.opts, markers)
+	p.strip = image.NewRGBA(image.Rect(0, 0, p.width, p.stripHeight))
+	return p
+}
+
+func (p *posterImage) strips() int {
+	return (p.width + p.legendHeight + p.stripHeight - 1) / p.stripHeight
+}
+
+func (p *posterImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (p *posterImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, p.width, p.width+p.legendHeight)
+}
+
+func (p *posterImage) At(x, y int) color.Color {
+	if p.stripTop < 0 || y < p.stripTop || y >= p.stripTop+p.stripHeight {
+		p.renderStrip(y / p.stripHeight * p.stripHeight)
+	}
+	return p.strip.RGBAAt(x, y-p.stripTop)
+}
+
+// virtualPixelsPerServer matches createQuadTree's scale for the poster's world
+func (p *posterImage) virtualPixelsPerServer() float64 {
+	if p.region.width() >= p.region.height() {
+		return float64(p.width / p.region.width())
+	}
+	return float64(p.width / p.region.height())
+}
+
+// renderStrip draws the strip starting at row top, after waiting out any generation cycle
+func (p *posterImage) renderStrip(top int) {
+	for generationActive() {
+		timer := clock.NewTimer(time.Second)
+		<-timer.C()
+	}
+	p.stripTop = top
+	draw.Draw(p.strip, p.strip.Bounds(), image.Transparent, image.ZP, draw.Src)
+
+	if top < p.width {
+		if p.background != nil {
+			p.drawBackground()
+		}
+		if p.layers[PosterLayerClaims] {
+			// square blocks of the strip's height, the last one may hang off the right edge. Each
+			// is rendered with a margin that's cropped off, the rasterizer can miss the edge of a
+			// circle in an image's first row, which would show as a seam between blocks
+			for left := 0; left < p.width; left += p.stripHeight {
+				opts := p.opts
+				opts.actualPixels = p.stripHeight + 2*posterBlockMargin
+				opts.virtualClip = image.Rect(left, top, left+p.stripHeight, top+p.stripHeight).Inset(-posterBlockMargin)
+				if block, _ := renderImage(&opts, p.quadTree); block != nil {
+					draw.Draw(p.strip, image.Rect(left, 0, left+p.stripHeight, p.stripHeight), block, image.Pt(posterBlockMargin, posterBlockMargin), draw.Over)
+				}
+			}
+		}
+		if p.layers[PosterLayerGrid] {
+			p.drawGrid()
+		}
+		if p.layers[PosterLayerLabels] {
+			p.drawLabels()
+		}
+		if len(p.caption) > 0 {
+			p.drawCaption()
+		}
+	}
+	if p.legendHeight > 0 && top+p.stripHeight > p.width {
+		p.drawLegend()
+	}
+
+	// replay frames render without a job
+	posters.Lock()
+	if job, ok := posters.jobs[p.id]; ok {
+		job.StripsDone++
+	}
+	posters.Unlock()
+}
+
+// drawBackground samples the background, which covers the whole world, nearest neighbour
+func (p *posterImage) drawBackground() {
+	bounds := p.background.Bounds()
+	vpps := p.virtualPixelsPerServer()
+	for y := 0; y < p.stripHeight && p.stripTop+y < p.width; y++ {
+		v := (float64(p.region.MinY) + float64(p.stripTop+y)/vpps) / float64(config.ServersY)
+		by := bounds.Min.Y + int(v*float64(bounds.Dy()))
+		if by >= bounds.Max.Y {
+			continue
+		}
+		for x := 0; x < p.width; x++ {
+			u := (float64(p.region.MinX) + float64(x)/vpps) / float64(config.ServersX)
+			bx := bounds.Min.X + int(u*float64(bounds.Dx()))
+			if bx >= bounds.Max.X {
+				continue
+			}
+			p.strip.Set(x, y, p.background.At(bx, by))
+		}
+	}
+}
+
+// posterLineColor is used for the grid lines and labels
+var posterLineColor = color.RGBA{0x20, 0x20, 0x20, 0xff}
+
+func (p *posterImage) drawGrid() {
+	vpps := p.virtualPixelsPerServer()
+	lineWidth := Max(1, p.width/4096)
+	worldWidth := int(math.Round(float64(p.region.width()) * vpps))
+	worldHeight := int(math.Round(float64(p.region.height()) * vpps))
+	fill := func(r image.Rectangle) {
+		draw.Draw(p.strip, r.Sub(image.Pt(0, p.stripTop)).Intersect(p.strip.Bounds()), image.NewUniform(posterLineColor), image.ZP, draw.Src)
+	}
+	// lines on the outer edges are kept inside the map
+	for sx := 0; sx <= p.region.width(); sx++ {
+		x := Max(0, Min(int(math.Round(float64(sx)*vpps))-lineWidth/2, worldWidth-lineWidth))
+		fill(image.Rect(x, 0, x+lineWidth, Min(worldHeight, p.width)))
+	}
+	for sy := 0; sy <= p.region.height(); sy++ {
+		y := Max(0, Min(int(math.Round(float64(sy)*vpps))-lineWidth/2, worldHeight-lineWidth))
+		fill(image.Rect(0, y, Min(worldWidth, p.width), y+lineWidth))
+	}
+}
+
+// drawLabels writes each grid's reference near its top left corner, following any map rotation
+func (p *posterImage) drawLabels() {
+	vpps := p.virtualPixelsPerServer()
+	worldWidth := float64(p.region.width()) * vpps
+	worldHeight := float64(p.region.height()) * vpps
+	scale := Max(1, int(vpps/80))
+	for sx := 0; sx < p.region.width(); sx++ {
+		for sy := 0; sy < p.region.height(); sy++ {
+			// the corner nearest the origin after transforming both of the grid's corners
+			x0, y0 := transformVirtual(float64(sx)*vpps, float64(sy)*vpps, worldWidth, worldHeight)
+			x1, y1 := transformVirtual(float64(sx+1)*vpps, float64(sy+1)*vpps, worldWidth, worldHeight)
+			x := int(math.Min(x0, x1)) + 2*scale
+			y := int(math.Min(y0, y1)) + 2*scale - p.stripTop
+			if y+5*scale < 0 || y >= p.stripHeight {
+				continue
+			}
+			drawPosterText(p.strip, x, y, scale, gridReference(p.region.MinX+sx, p.region.MinY+sy), posterLineColor)
+		}
+	}
+}
+
+// drawCaption writes the caption on a white box in the top left corner
+func (p *posterImage) drawCaption() {
+	scale := Max(1, p.width/256)
+	box := image.Rect(0, 0, posterTextWidth(p.caption, scale)+3*scale, 7*scale).Sub(image.Pt(0, p.stripTop))
+	draw.Draw(p.strip, box.Intersect(p.strip.Bounds()), image.White, image.ZP, draw.Src)
+	drawPosterText(p.strip, 2*scale, scale-p.stripTop, scale, p.caption, posterLineColor)
+}
+
+// drawLegend fills the strip below the map with a swatch and the name of each top tribe
+func (p *posterImage) drawLegend() {
+	area := image.Rect(0, p.width, p.width, p.width+p.legendHeight).Sub(image.Pt(0, p.stripTop))
+	draw.Draw(p.strip, area.Intersect(p.strip.Bounds()), image.White, image.ZP, draw.Src)
+	if len(p.legend) == 0 {
+		return
+	}
+	cellWidth := p.width / len(p.legend)
+	swatch := p.legendHeight / 2
+	scale := Max(1, p.legendHeight/24)
+	for i, entry := range p.legend {
+		left := area.Min.X + i*cellWidth + swatch/2
+		top := area.Min.Y + (p.legendHeight-swatch)/2
+		swatchRect := image.Rect(left, top, left+swatch, top+swatch)
+		draw.Draw(p.strip, swatchRect.Intersect(p.strip.Bounds()), image.NewUniform(entry.color), image.ZP, draw.Src)
+
+		textLeft := left + swatch + scale*2
+		name := []rune(entry.name)
+		if maxChars := (area.Min.X + (i+1)*cellWidth - textLeft) / (4 * scale); len(name) > maxChars {
+			name = name[:Max(0, maxChars)]
+		}
+		drawPosterText(p.strip, textLeft, area.Min.Y+(p.legendHeight-5*scale)/2, scale, string(name), posterLineColor)
+	}
+}
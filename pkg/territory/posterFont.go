@@ -0,0 +1,78 @@
+package territory
+
+import (
+	"image"
+	"image/color"
+	"unicode"
+)
+
+// posterGlyphs is a 3x5 pixel font for poster labels, each row's low 3 bits left to right
+var posterGlyphs = map[rune][5]uint8{
+	'A': {0b010, 0b101, 0b111, 0b101, 0b101},
+	'B': {0b110, 0b101, 0b110, 0b101, 0b110},
+	'C': {0b011, 0b100, 0b100, 0b100, 0b011},
+	'D': {0b110, 0b101, 0b101, 0b101, 0b110},
+	'E': {0b111, 0b100, 0b110, 0b100, 0b111},
+	'F': {0b111, 0b100, 0b110, 0b100, 0b100},
+	'G': {0b011, 0b100, 0b101, 0b101, 0b011},
+	'H': {0b101, 0b101, 0b111, 0b101, 0b101},
+	'I': {0b111, 0b010, 0b010, 0b010, 0b111},
+	'J': {0b001, 0b001, 0b001, 0b101, 0b010},
+	'K': {0b101, 0b101, 0b110, 0b101, 0b101},
+	'L': {0b100, 0b100, 0b100, 0b100, 0b111},
+	'M': {0b101, 0b111, 0b111, 0b101, 0b101},
+	'N': {0b110, 0b101, 0b101, 0b101, 0b101},
+	'O': {0b010, 0b101, 0b101, 0b101, 0b010},
+	'P': {0b110, 0b101, 0b110, 0b100, 0b100},
+	'Q': {0b010, 0b101, 0b101, 0b110, 0b011},
+	'R': {0b110, 0b101, 0b110, 0b101, 0b101},
+	'S': {0b011, 0b100, 0b010, 0b001, 0b110},
+	'T': {0b111, 0b010, 0b010, 0b010, 0b010},
+	'U': {0b101, 0b101, 0b101, 0b101, 0b111},
+	'V': {0b101, 0b101, 0b101, 0b101, 0b010},
+	'W': {0b101, 0b101, 0b111, 0b111, 0b101},
+	'X': {0b101, 0b101, 0b010, 0b101, 0b101},
+	'Y': {0b101, 0b101, 0b010, 0b010, 0b010},
+	'Z': {0b111, 0b001, 0b010, 0b100, 0b111},
+	'0': {0b111, 0b101, 0b101, 0b101, 0b111},
+	'1': {0b010, 0b110, 0b010, 0b010, 0b111},
+	'2': {0b110, 0b001, 0b010, 0b100, 0b111},
+	'3': {0b110, 0b001, 0b010, 0b001, 0b110},
+	'4': {0b101, 0b101, 0b111, 0b001, 0b001},
+	'5': {0b111, 0b100, 0b110, 0b001, 0b110},
+	'6': {0b011, 0b100, 0b111, 0b101, 0b111},
+	'7': {0b111, 0b001, 0b010, 0b010, 0b010},
+	'8': {0b111, 0b101, 0b111, 0b101, 0b111},
+	'9': {0b111, 0b101, 0b111, 0b001, 0b110},
+	'-': {0b000, 0b000, 0b111, 0b000, 0b000},
+	':': {0b000, 0b010, 0b000, 0b010, 0b000},
+}
+
+// posterTextWidth is the width of text drawn at scale, every character advances 4 pixels
+func posterTextWidth(text string, scale int) int {
+	return len([]rune(text)) * 4 * scale
+}
+
+// drawPosterText draws text upper cased with its top left at x, y, characters without a glyph
+// are left blank. Pixels outside img are clipped
+func drawPosterText(img *image.RGBA, x, y, scale int, text string, c color.RGBA) {
+	for _, r := range text {
+		glyph, ok := posterGlyphs[unicode.ToUpper(r)]
+		if ok {
+			for row := 0; row < 5; row++ {
+				for col := 0; col < 3; col++ {
+					if glyph[row]&(0b100>>uint(col)) == 0 {
+						continue
+					}
+					dot := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale).Intersect(img.Bounds())
+					for py := dot.Min.Y; py < dot.Max.Y; py++ {
+						for px := dot.Min.X; px < dot.Max.X; px++ {
+							img.SetRGBA(px, py, c)
+						}
+					}
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
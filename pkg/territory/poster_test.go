@@ -0,0 +1,242 @@
+package territory
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// usePosters starts the test without poster jobs, stopping the worker it starts afterwards
+func usePosters(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		posters.Lock()
+		if posters.queue != nil {
+			close(posters.queue)
+		}
+		posters.queue = nil
+		posters.worker = sync.Once{}
+		posters.jobs = make(map[string]*PosterJob)
+		posters.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func postPoster(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/poster", strings.NewReader(body)))
+	return w
+}
+
+func getPosterJob(t *testing.T, handler http.Handler, id string) (int, PosterJob) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/poster/"+id, nil))
+	var job PosterJob
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+	}
+	return w.Code, job
+}
+
+// readPoster encodes the poster the way renderPoster does and decodes it again
+func readPoster(t *testing.T, poster image.Image) *image.RGBA {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, poster); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			rgba.Set(x, y, img.At(x, y))
+		}
+	}
+	return rgba
+}
+
+func TestPosterJobLifecycle(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.PosterStripPixels = 128
+		cfg.Host, cfg.Port = "maps.example.com", 8880
+	})
+	usePosters(t)
+	useLogBuffer(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050001, 0.5, 0.5, MarkerLand)
+	handler := posterHandler(client)
+
+	// a generation cycle in progress holds the poster back
+	beginGeneration()
+	w := postPoster(t, handler, `{"width": 512}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST answered %d: %s", w.Code, w.Body.String())
+	}
+	var queued PosterJob
+	if err := json.Unmarshal(w.Body.Bytes(), &queued); err != nil {
+		t.Fatal(err)
+	}
+	if location := w.Header().Get("Location"); location != "/admin/poster/"+queued.ID || queued.Status != "queued" {
+		t.Errorf("queued %+v at %q", queued, location)
+	}
+	if len(queued.Request.Layers) != 4 {
+		t.Errorf("layers %v, want all of them by default", queued.Request.Layers)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, job := getPosterJob(t, handler, queued.ID); job.Status == "done" || job.StripsDone != 0 {
+		t.Errorf("poster %+v rendered during a generation cycle", job)
+	}
+	endGeneration()
+
+	var job PosterJob
+	deadline := time.Now().Add(10 * time.Second)
+	for job.Status != "done" && job.Status != "failed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("poster still %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, job = getPosterJob(t, handler, queued.ID)
+	}
+	if job.Status != "done" || job.URL != "http://maps.example.com:8880/posters/"+queued.ID+".png" || job.FinishedAt == nil {
+		t.Fatalf("finished as %+v", job)
+	}
+	// 512 rows of map and the 64 row legend in 128 row strips
+	if job.Strips != 5 || job.StripsDone != job.Strips {
+		t.Errorf("%d of %d strips done, want 5", job.StripsDone, job.Strips)
+	}
+	f, err := os.Open(filepath.Join(config.WWWDir, "posters", queued.ID+".png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 512 || img.Height != 512+64 {
+		t.Errorf("poster is %dx%d, want 512x576", img.Width, img.Height)
+	}
+
+	if code, _ := getPosterJob(t, handler, "missing"); code != http.StatusNotFound {
+		t.Errorf("unknown job answered %d, want 404", code)
+	}
+}
+
+func TestPosterRequestLimits(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.PosterMaxPixels = 4096
+	})
+	usePosters(t)
+	_, client := newTestRedis(t)
+	handler := posterHandler(client)
+	for _, test := range []struct {
+		name string
+		body string
+	}{
+		{"over the cap", `{"width": 4097}`},
+		{"under a tile", `{"width": 255}`},
+		{"unknown layer", `{"width": 512, "layers": ["claims", "roads"]}`},
+		{"region outside the world", `{"width": 512, "region": {"minX": 1, "minY": 0, "maxX": 2, "maxY": 1}}`},
+		{"not JSON", `width=512`},
+	} {
+		if w := postPoster(t, handler, test.body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: answered %d, want 400", test.name, w.Code)
+		}
+	}
+	posters.Lock()
+	queued := len(posters.jobs)
+	posters.Unlock()
+	if queued != 0 {
+		t.Errorf("%d jobs queued from rejected requests", queued)
+	}
+}
+
+func TestPosterStripsMatchASingleRender(t *testing.T) {
+	usePosters(t)
+	// claims straddle the boundaries between 64 row strips, and between blocks of a strip
+	markers := []Marker{
+		{tribeOrOwnerID: 1000050001, relX: 0.3, relY: 0.25, markerType: MarkerLand},
+		{tribeOrOwnerID: 1000050002, relX: 0.25, relY: 0.5, markerType: MarkerWater},
+		{tribeOrOwnerID: 42, relX: 0.75, relY: 0.75, markerType: MarkerLand},
+	}
+	req := PosterRequest{Width: 256, Layers: []string{PosterLayerClaims, PosterLayerGrid, PosterLayerLabels}}
+	render := func(strip int) *image.RGBA {
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.ServersX, cfg.ServersY = 1, 1
+			cfg.OpaqueClaims = true
+			cfg.PosterStripPixels = strip
+		})
+		id := "strips"
+		posters.Lock()
+		posters.jobs[id] = &PosterJob{ID: id}
+		posters.Unlock()
+		return readPoster(t, newPosterImage(id, req, RegionConfig{}, markers))
+	}
+	whole, strips := render(256), render(64)
+
+	straddling := markers[0]
+	above, below := whole.RGBAAt(int(straddling.relX*256), 63), whole.RGBAAt(int(straddling.relX*256), 64)
+	if colorDistance(above, getTribeColor(straddling.tribeOrOwnerID)) != 0 || colorDistance(below, getTribeColor(straddling.tribeOrOwnerID)) != 0 {
+		t.Fatalf("claim across the strip boundary is %v above and %v below, want its color", above, below)
+	}
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			if a, b := whole.RGBAAt(x, y), strips.RGBAAt(x, y); a != b {
+				t.Fatalf("pixel %d,%d is %v in one strip and %v in 64 row strips", x, y, a, b)
+			}
+		}
+	}
+}
+
+func TestPosterStripWaitsOutGenerationOnTheClock(t *testing.T) {
+	usePosters(t)
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.PosterStripPixels = 64
+	})
+	fake := useFakeClock(t)
+	id := "waiting"
+	posters.Lock()
+	posters.jobs[id] = &PosterJob{ID: id}
+	posters.Unlock()
+	p := newPosterImage(id, PosterRequest{Width: 64, Layers: []string{PosterLayerGrid}}, RegionConfig{}, nil)
+
+	beginGeneration()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.renderStrip(0)
+	}()
+	waitForTimer(t, fake)
+	endGeneration()
+	select {
+	case <-done:
+		t.Fatalf("strip rendered before the clock moved")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("strip still waiting after the generation ended and the clock moved")
+	}
+}
@@ -0,0 +1,40 @@
+package territory
+
+import (
+	"image"
+	"math"
+)
+
+// projectionVersion changes whenever Projection places pixels differently, so tiles rendered by an
+// older convention are regenerated
+const projectionVersion = 2
+
+// Projection maps virtual coordinates to one image's pixels. Virtual coordinates are the deepest
+// zoom's pixels, so every tile's transform is the deepest zoom's scaled by an exact power of two.
+//
+// Pixel i covers [i, i+1) and its center is i+0.5. Marker centers are snapped to the center of
+// their virtual pixel, rounding half away from zero, before scaling. Scaling by a power of two
+// then keeps a marker's center at zoom N inside the parent pixel of its center at zoom N+1
+type Projection struct {
+	origin image.Point // virtual coordinate of the image's top left, the clip's Min
+	scale  float64     // image pixels per virtual pixel
+}
+
+func newProjection(virtualClip image.Rectangle, actualPixels int) Projection {
+	return Projection{origin: virtualClip.Min, scale: float64(actualPixels) / float64(virtualClip.Dx())}
+}
+
+// snapVirtual is the center of the virtual pixel nearest v
+func snapVirtual(v float64) float64 {
+	return math.Round(v) + 0.5
+}
+
+// center is a marker's snapped center in image coordinates
+func (p Projection) center(vx, vy float64) (float64, float64) {
+	return (snapVirtual(vx) - float64(p.origin.X)) * p.scale, (snapVirtual(vy) - float64(p.origin.Y)) * p.scale
+}
+
+// length is a virtual distance, e.g. a radius, in image pixels
+func (p Projection) length(v float64) float64 {
+	return v * p.scale
+}
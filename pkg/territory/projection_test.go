@@ -0,0 +1,94 @@
+package territory
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestSnapVirtualRoundsHalfAwayFromZero(t *testing.T) {
+	for v, want := range map[float64]float64{0: 0.5, 0.49: 0.5, 0.5: 1.5, 2.5: 3.5, 2.4999: 2.5, -0.5: -0.5, -2.5: -2.5} {
+		if got := snapVirtual(v); got != want {
+			t.Errorf("snapVirtual(%v) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// TestMarkerCentersKeepTheirParentPixel checks a marker's center at zoom N is in the parent pixel
+// of its center at zoom N+1, for markers at awkward fractional positions on tile edges
+func TestMarkerCentersKeepTheirParentPixel(t *testing.T) {
+	const tileSize, maxZoom = 256, 4
+	const virtualPixels = tileSize << maxZoom
+	positions := []float64{0, 0.49, 0.5, 127.5, 255.5, 256.4999, 1023.5, 1024, 2047.5, 2048.5, 3000.3333, 4095.4}
+
+	// the global pixel of v at zoom, from the tile it falls in like the tile worker renders it
+	pixelAt := func(v float64, zoom int) int {
+		tileVirtual := virtualPixels >> zoom
+		tile := int(snapVirtual(v)) / tileVirtual
+		clip := image.Rect(tile*tileVirtual, 0, (tile+1)*tileVirtual, tileVirtual)
+		x, _ := newProjection(clip, tileSize).center(v, 0)
+		if x < 0 || x >= tileSize {
+			t.Fatalf("%v at zoom %d is at %v outside its tile %d", v, zoom, x, tile)
+		}
+		return tile*tileSize + int(math.Floor(x))
+	}
+	for _, v := range positions {
+		for zoom := 0; zoom < maxZoom; zoom++ {
+			parent, child := pixelAt(v, zoom), pixelAt(v, zoom+1)
+			if child/2 != parent {
+				t.Errorf("%v is in pixel %d at zoom %d but %d at zoom %d, whose parent is %d", v, parent, zoom, child, zoom+1, child/2)
+			}
+		}
+		// the deepest zoom draws the marker at the center of its snapped virtual pixel
+		if x, _ := newProjection(image.Rect(0, 0, virtualPixels, virtualPixels), virtualPixels).center(v, 0); x != snapVirtual(v) {
+			t.Errorf("%v is drawn at %v at the deepest zoom, want %v", v, x, snapVirtual(v))
+		}
+	}
+}
+
+// renderedCenter is the alpha weighted centroid of img
+func renderedCenter(img *image.RGBA) (float64, float64) {
+	var sumX, sumY, total float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := float64(img.RGBAAt(x, y).A)
+			sumX += a * (float64(x) + 0.5)
+			sumY += a * (float64(y) + 0.5)
+			total += a
+		}
+	}
+	return sumX / total, sumY / total
+}
+
+func TestRenderedCentersAlignAcrossZooms(t *testing.T) {
+	const virtualPixels = 1024
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		// 40 virtual pixels, 10 at the shallowest zoom
+		cfg.LandRadiusUE = 40.0 / virtualPixels * cfg.GridSize
+		cfg.OpaqueClaims = true
+	})
+	for _, v := range [][2]float64{{300.5, 511.4999}, {700.25, 128.5}, {511.5, 512.5}} {
+		marker := Marker{tribeOrOwnerID: 1000050001, relX: v[0] / virtualPixels, relY: v[1] / virtualPixels, markerType: MarkerLand}
+		wantX, wantY := snapVirtual(marker.relX*virtualPixels), snapVirtual(marker.relY*virtualPixels)
+		for zoom := 0; zoom <= 2; zoom++ {
+			opts := MapOptions{actualPixels: 256 << zoom, virtualPixels: virtualPixels, virtualClip: image.Rect(0, 0, virtualPixels, virtualPixels)}
+			img, _ := renderImage(&opts, createQuadTree(&opts, []Marker{marker}))
+			scale := float64(opts.actualPixels) / virtualPixels
+			// anti-aliasing moves the centroid by a fraction of a pixel, the jumps were whole pixels
+			x, y := renderedCenter(img)
+			if math.Abs(x-wantX*scale) > 0.1 || math.Abs(y-wantY*scale) > 0.1 {
+				t.Errorf("marker at %v is centered at %.3f,%.3f at zoom %d, want %.3f,%.3f", v, x, y, zoom, wantX*scale, wantY*scale)
+			}
+		}
+	}
+
+	var markers []Marker
+	for i, v := range [][2]float64{{300.5, 511.4999}, {700.25, 128.5}, {511.5, 512.5}, {900.75, 900.25}} {
+		markers = append(markers, Marker{tribeOrOwnerID: 1000050001 + uint64(i), relX: v[0] / virtualPixels, relY: v[1] / virtualPixels, markerType: MarkerLand})
+	}
+	opts := MapOptions{actualPixels: 512, virtualPixels: virtualPixels, virtualClip: image.Rect(0, 0, virtualPixels, virtualPixels)}
+	img, _ := renderImage(&opts, createQuadTree(&opts, markers))
+	checkGolden(t, "zoomAlignment", img)
+}
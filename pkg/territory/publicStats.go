@@ -0,0 +1,175 @@
+package territory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// publicStatFields is every field /api/stats can expose, in output order. largestTribeID also
+// needs StatsExposeTopTribeID since it identifies a tribe, ownersAbove is one field per
+// ConcentrationBuckets threshold
+var publicStatFields = []string{
+	"totalClaims",
+	"landClaims",
+	"waterClaims",
+	"tribeOwners",
+	"playerOwners",
+	"largestTribeClaims",
+	"largestTribeID",
+	"activeGrids",
+	"generatedAt",
+	"gini",
+	"top1Share",
+	"top5Share",
+	"top10Share",
+	"ownersAbove",
+}
+
+// publicRatioFields are the publicStatFields that are fractions rather than counts
+var publicRatioFields = map[string]bool{"gini": true, "top1Share": true, "top5Share": true, "top10Share": true}
+
+// publicStat is one whitelisted aggregate
+type publicStat struct {
+	name    string
+	value   uint64
+	ratio   float64
+	isRatio bool
+}
+
+// text formats the stat's value for JSON and OpenMetrics
+func (s publicStat) text() string {
+	if s.isRatio {
+		return strconv.FormatFloat(s.ratio, 'f', -1, 64)
+	}
+	return strconv.FormatUint(s.value, 10)
+}
+
+// computePublicStats computes the aggregates for /api/stats from a marker snapshot. The largest
+// tribe's ID honors opt outs, as do the concentration metrics so they agree with the leaderboard,
+// the counts are aggregates of every claim
+func computePublicStats(markers []Marker, optOut map[uint64]bool) []publicStat {
+	values := make(map[string]uint64)
+	owners := make(map[uint64]uint64)
+	grids := make(map[int]bool)
+	for _, marker := range markers {
+		switch marker.markerType {
+		case MarkerLand:
+			values["landClaims"]++
+		case MarkerWater:
+			values["waterClaims"]++
+		default:
+			continue
+		}
+		values["totalClaims"]++
+		owners[marker.tribeOrOwnerID]++
+		grids[marker.serverX<<16|marker.serverY] = true
+	}
+	var largestID uint64
+	for id, count := range owners {
+		if isTribeID(id) {
+			values["tribeOwners"]++
+			if count > values["largestTribeClaims"] || (count == values["largestTribeClaims"] && id < largestID) {
+				values["largestTribeClaims"], largestID = count, id
+			}
+		} else {
+			values["playerOwners"]++
+		}
+	}
+	values["activeGrids"] = uint64(len(grids))
+	values["generatedAt"] = uint64(time.Now().Unix())
+
+	// concentration of the ClaimWeights scores
+	scores := ownerScores(markers, optOut)
+	ratios := map[string]float64{
+		"gini":       giniCoefficient(scores),
+		"top1Share":  topShare(scores, 1),
+		"top5Share":  topShare(scores, 5),
+		"top10Share": topShare(scores, 10),
+	}
+
+	exposeID := config.StatsExposeTopTribeID && largestID != 0 && !optOut[largestID]
+	whitelist := make(map[string]bool)
+	for _, name := range config.StatsFields {
+		whitelist[name] = true
+	}
+	// not nil even when nothing is whitelisted, nil means no snapshot yet
+	stats := []publicStat{}
+	for _, name := range publicStatFields {
+		if !whitelist[name] || (name == "largestTribeID" && !exposeID) {
+			continue
+		}
+		if name == "ownersAbove" {
+			for _, threshold := range config.ConcentrationBuckets {
+				stats = append(stats, publicStat{name: fmt.Sprintf("ownersAbove%d", threshold), value: uint64(ownersAbove(scores, float64(threshold)))})
+			}
+			continue
+		}
+		if publicRatioFields[name] {
+			stats = append(stats, publicStat{name: name, ratio: ratios[name], isRatio: true})
+			continue
+		}
+		value := values[name]
+		if name == "largestTribeID" {
+			value = largestID
+		}
+		stats = append(stats, publicStat{name: name, value: value})
+	}
+	return stats
+}
+
+// statsHandler serves GET /api/stats as JSON, or OpenMetrics text with ?format=openmetrics
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	result := latestGeneration()
+	if result == nil || result.Stats == nil {
+		writeError(w, r, http.StatusNotFound, "no stats available yet")
+		return
+	}
+	stats, etag := result.Stats, fmt.Sprintf(`"%08x"`, result.CRC)
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "openmetrics" {
+		writeError(w, r, http.StatusBadRequest, "invalid format")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", etag)
+	setGenerationHeader(w, result)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if format == "openmetrics" {
+		var buf bytes.Buffer
+		for _, stat := range stats {
+			fmt.Fprintf(&buf, "# TYPE atlas_territory_%s gauge\n", stat.name)
+			fmt.Fprintf(&buf, "atlas_territory_%s %s\n", stat.name, stat.text())
+		}
+		buf.WriteString("# EOF\n")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	doc := make(map[string]json.Number, len(stats))
+	for _, stat := range stats {
+		doc[stat.name] = json.Number(stat.text())
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
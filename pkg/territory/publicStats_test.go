@@ -0,0 +1,111 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// servedStatNames requests /api/stats in the format and returns the names of the stats served
+func servedStatNames(t *testing.T, format string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats?format="+format, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/api/stats?format=%s answered %d", format, w.Code)
+	}
+	var names []string
+	if format == "openmetrics" {
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, "atlas_territory_") {
+				names = append(names, strings.TrimPrefix(strings.Fields(line)[0], "atlas_territory_"))
+			}
+		}
+		return names
+	}
+	var doc map[string]json.Number
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for name := range doc {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestPublicStatsOnlyExposeWhitelistedFields(t *testing.T) {
+	const largest = 1000050001
+	markers := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: largest, markerType: MarkerLand},
+		{serverX: 0, serverY: 1, tribeOrOwnerID: largest, markerType: MarkerWater},
+		{serverX: 1, serverY: 0, tribeOrOwnerID: 1000050002, markerType: MarkerLand},
+		{serverX: 1, serverY: 0, tribeOrOwnerID: 42, markerType: MarkerLand},
+	}
+	whitelists := [][]string{nil, {"secret", "tribeID", "ownersAbove100"}}
+	for _, field := range publicStatFields {
+		whitelists = append(whitelists, []string{field}, []string{field, "secret"})
+	}
+	whitelists = append(whitelists, publicStatFields)
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+
+	for _, whitelist := range whitelists {
+		for _, exposeID := range []bool{false, true} {
+			for _, optedOut := range []bool{false, true} {
+				useTestConfig(t, func(cfg *Configuration) {
+					cfg.StatsFields = whitelist
+					cfg.StatsExposeTopTribeID = exposeID
+					cfg.ConcentrationBuckets = []int{1, 100}
+				})
+				optOut := map[uint64]bool{}
+				if optedOut {
+					optOut[largest] = true
+				}
+				currentGeneration.Store(&GenerationResult{CRC: 1, Stats: computePublicStats(markers, optOut)})
+
+				allowed := make(map[string]bool)
+				for _, name := range whitelist {
+					allowed[name] = true
+				}
+				if allowed["ownersAbove"] {
+					allowed["ownersAbove1"], allowed["ownersAbove100"] = true, true
+				}
+				allowed["ownersAbove"] = false
+				if !exposeID || optedOut {
+					allowed["largestTribeID"] = false
+				}
+				for _, format := range []string{"json", "openmetrics"} {
+					for _, name := range servedStatNames(t, format) {
+						if !allowed[name] {
+							t.Errorf("%s served %q with StatsFields %v, StatsExposeTopTribeID %v and the largest tribe opted out %v",
+								format, name, whitelist, exposeID, optedOut)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPublicStatsHonorGenerationETag(t *testing.T) {
+	useTestConfig(t, nil)
+	previous := latestGeneration()
+	defer currentGeneration.Store(previous)
+	currentGeneration.Store(&GenerationResult{CRC: 0xabcd, Stats: computePublicStats(testMarkers(), nil)})
+
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag != `"0000abcd"` {
+		t.Fatalf("got %d with ETag %s, want 200 with the generation's CRC", w.Code, etag)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	statsHandler(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("revalidation answered %d, want 304", w.Code)
+	}
+}
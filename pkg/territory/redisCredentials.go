@@ -0,0 +1,61 @@
+package territory
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// CredentialProvider supplies the redis password every time a new connection is made,
+// so short lived credentials (e.g. ElastiCache IAM tokens) are refreshed on reconnect
+type CredentialProvider interface {
+	Password() (string, error)
+}
+
+// staticCredentials is the plain Password from the config
+type staticCredentials string
+
+func (s staticCredentials) Password() (string, error) {
+	return string(s), nil
+}
+
+// fileCredentials re-reads the password from a file kept up to date by an external token refresher
+type fileCredentials string
+
+func (f fileCredentials) Password() (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (r *RedisConfiguration) credentialProvider() CredentialProvider {
+	if len(r.PasswordFile) > 0 {
+		return fileCredentials(r.PasswordFile)
+	}
+	return staticCredentials(r.Password)
+}
+
+// newRedisClient creates a client which authenticates each new connection through the credential provider
+func newRedisClient(cfg RedisConfiguration, provider CredentialProvider) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr: cfg.URL + ":" + strconv.Itoa(cfg.Port),
+		DB:   0,
+		OnConnect: func(conn *redis.Conn) error {
+			password, err := provider.Password()
+			if err != nil {
+				return err
+			}
+			if len(password) == 0 {
+				return nil
+			}
+			if len(cfg.Username) > 0 {
+				return conn.Do("auth", cfg.Username, password).Err()
+			}
+			return conn.Auth(password).Err()
+		},
+	})
+}
@@ -0,0 +1,117 @@
+package territory
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// rotatingCredentials hands out the current token of a rotation
+type rotatingCredentials struct {
+	sync.Mutex
+	token string
+	calls int
+}
+
+func (r *rotatingCredentials) Password() (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	return r.token, nil
+}
+
+func (r *rotatingCredentials) rotate(token string) {
+	r.Lock()
+	r.token = token
+	r.Unlock()
+}
+
+// testRedisConfiguration points a RedisConfiguration at server
+func testRedisConfiguration(t *testing.T, server *miniredis.Miniredis) RedisConfiguration {
+	t.Helper()
+	port, err := strconv.Atoi(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return RedisConfiguration{Name: "TerritoryDB", URL: server.Host(), Port: port}
+}
+
+// pingAfterReconnect drops the client's connections by restarting server and pings until a new
+// connection answers
+func pingAfterReconnect(t *testing.T, server *miniredis.Miniredis, ping func() error) error {
+	t.Helper()
+	server.Close()
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for i := 0; i < 3; i++ {
+		if err = ping(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func TestRedisClientUsesRotatedTokenOnReconnect(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("token-1")
+	provider := &rotatingCredentials{token: "token-1"}
+	client := newRedisClient(testRedisConfiguration(t, server), provider)
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		t.Fatalf("first token: %v", err)
+	}
+	// the token expires and the server only accepts its successor
+	server.RequireAuth("token-2")
+	provider.rotate("token-2")
+	if err := pingAfterReconnect(t, server, func() error { return client.Ping().Err() }); err != nil {
+		t.Fatalf("rotated token: %v", err)
+	}
+	if provider.calls < 2 {
+		t.Fatalf("provider asked %d times, want once per connection", provider.calls)
+	}
+}
+
+func TestRedisClientAuthenticatesUsername(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("generator", "secret")
+	cfg := testRedisConfiguration(t, server)
+	cfg.Username, cfg.Password = "generator", "secret"
+	client := newRedisClient(cfg, cfg.credentialProvider())
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCredentialsRereadOnReconnect(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("token-1")
+	filename := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(filename, []byte("token-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testRedisConfiguration(t, server)
+	cfg.PasswordFile = filename
+	client := newRedisClient(cfg, cfg.credentialProvider())
+	defer client.Close()
+
+	if err := client.Ping().Err(); err != nil {
+		t.Fatalf("first token: %v", err)
+	}
+	// the external refresher rewrites the file
+	server.RequireAuth("token-2")
+	if err := ioutil.WriteFile(filename, []byte("token-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := pingAfterReconnect(t, server, func() error { return client.Ping().Err() }); err != nil {
+		t.Fatalf("rewritten token: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package territory
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// redisCheckKey and redisCheckChannel are the throwaway key and channel the permission checks use
+const (
+	redisCheckKey     = "territory_startup_check"
+	redisCheckChannel = "territory_startup_check"
+)
+
+// redisRequirements are the commands the generator runs on each connection, each is tried with
+// the throwaway key so a missing ACL permission is found at startup
+var redisRequirements = map[string][]string{
+	"Default":     {"publish"},
+	"TerritoryDB": {"smembers", "hmset", "publish"},
+}
+
+// tryRedisCommand runs a representative command without touching the generator's keys
+func tryRedisCommand(client *redis.Client, command string) error {
+	switch command {
+	case "smembers":
+		return client.SMembers(redisCheckKey).Err()
+	case "hmset":
+		err := client.HMSet(redisCheckKey, map[string]interface{}{"check": "1"}).Err()
+		if err == nil {
+			client.Del(redisCheckKey)
+		}
+		return err
+	case "publish":
+		return client.Publish(redisCheckChannel, "").Err()
+	}
+	return nil
+}
+
+// explainRedisError turns the common connection and authentication failures into what to fix
+func explainRedisError(err error) string {
+	msg := err.Error()
+	switch {
+	case os.IsNotExist(err) || os.IsPermission(err):
+		return fmt.Sprintf("cannot read PasswordFile (%v)", err)
+	case strings.Contains(msg, "connection refused"):
+		return "connection refused, check redis is running at URL and Port"
+	case strings.Contains(msg, "no such host"):
+		return "cannot resolve URL, check the host name"
+	case strings.Contains(msg, "i/o timeout"):
+		return "timed out connecting, check URL, Port and any firewall"
+	case strings.HasPrefix(msg, "NOAUTH"):
+		return "redis requires a password, set Password or PasswordFile (NOAUTH)"
+	case strings.HasPrefix(msg, "WRONGPASS"), strings.Contains(msg, "invalid password"), strings.Contains(msg, "invalid username-password pair"):
+		return "wrong password, or the ACL user needs Username set (WRONGPASS)"
+	case strings.Contains(msg, "without any password configured"), strings.Contains(msg, "no password is set"):
+		return "a password is configured but redis has none, clear Password"
+	}
+	return msg
+}
+
+// diagnoseRedis pings a connection and tries the commands it needs, returning one line per
+// problem naming the connection entry
+func diagnoseRedis(name string, client *redis.Client) []string {
+	prefix := fmt.Sprintf("redis %s (%s): ", name, client.Options().Addr)
+	if err := client.Ping().Err(); err != nil {
+		return []string{prefix + explainRedisError(err)}
+	}
+	var problems []string
+	for _, command := range redisRequirements[name] {
+		err := tryRedisCommand(client, command)
+		if err == nil {
+			continue
+		}
+		msg := err.Error()
+		switch {
+		case strings.HasPrefix(msg, "NOPERM") && strings.Contains(msg, "channel"):
+			// channel rules may allow the real channel but not ours, that can't be told here
+			log.Printf("Startup check: %scannot check PUBLISH permission on the real channel: %s", prefix, msg)
+		case strings.HasPrefix(msg, "NOPERM"):
+			problems = append(problems, fmt.Sprintf("%sthe user has no permission for %s (NOPERM)", prefix, strings.ToUpper(command)))
+		default:
+			problems = append(problems, fmt.Sprintf("%s%s failed: %s", prefix, strings.ToUpper(command), explainRedisError(err)))
+		}
+	}
+	return problems
+}
+
+// diagnoseRedisConnections logs a diagnostic line per problem on every connection, returning how
+// many were found. Run at startup so a bad password is one clear line rather than a warning per key
+func diagnoseRedisConnections(clients map[string]*redis.Client) int {
+	var names []string
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := 0
+	for _, name := range names {
+		diagnostics := diagnoseRedis(name, clients[name])
+		for _, diagnostic := range diagnostics {
+			log.Printf("Warning! %s", diagnostic)
+		}
+		problems += len(diagnostics)
+	}
+	return problems
+}
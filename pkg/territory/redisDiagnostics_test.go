@@ -0,0 +1,122 @@
+package territory
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis"
+)
+
+// diagnosticClient connects to addr the way the server does with the given credentials
+func diagnosticClient(t *testing.T, addr string, cfg RedisConfiguration) *redis.Client {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	cfg.URL = host
+	cfg.Port, _ = strconv.Atoi(port)
+	client := newRedisClient(cfg, cfg.credentialProvider())
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// aclRedis is a redis whose user may PING and HMSET but has no permission for SMEMBERS, and may
+// only PUBLISH on some channels, miniredis doesn't implement ACLs
+func aclRedis(t *testing.T) string {
+	t.Helper()
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	srv.Register("ping", func(c *server.Peer, cmd string, args []string) { c.WriteInline("PONG") })
+	srv.Register("hmset", func(c *server.Peer, cmd string, args []string) { c.WriteOK() })
+	srv.Register("del", func(c *server.Peer, cmd string, args []string) { c.WriteInt(1) })
+	srv.Register("smembers", func(c *server.Peer, cmd string, args []string) {
+		c.WriteError("NOPERM this user has no permissions to run the 'smembers' command")
+	})
+	srv.Register("publish", func(c *server.Peer, cmd string, args []string) {
+		c.WriteError("NOPERM this user has no permissions to access the '" + args[0] + "' channel")
+	})
+	return srv.Addr().String()
+}
+
+func TestDiagnoseRedis(t *testing.T) {
+	open := miniredis.RunT(t)
+	withPassword := miniredis.RunT(t)
+	withPassword.RequireAuth("secret")
+	withUser := miniredis.RunT(t)
+	withUser.RequireUserAuth("territory", "secret")
+	closed := miniredis.NewMiniRedis()
+	closed.Start()
+	refused := closed.Addr()
+	closed.Close()
+
+	for _, test := range []struct {
+		name string
+		addr string
+		cfg  RedisConfiguration
+		want []string
+	}{
+		{"healthy", open.Addr(), RedisConfiguration{}, nil},
+		{"refused", refused, RedisConfiguration{}, []string{"connection refused, check redis is running at URL and Port"}},
+		{"no password", withPassword.Addr(), RedisConfiguration{}, []string{"redis requires a password, set Password or PasswordFile (NOAUTH)"}},
+		{"wrong password", withPassword.Addr(), RedisConfiguration{Password: "guess"}, []string{"wrong password, or the ACL user needs Username set (WRONGPASS)"}},
+		{"missing username", withUser.Addr(), RedisConfiguration{Password: "secret"}, []string{"wrong password, or the ACL user needs Username set (WRONGPASS)"}},
+		{"username", withUser.Addr(), RedisConfiguration{Username: "territory", Password: "secret"}, nil},
+		{"unneeded password", open.Addr(), RedisConfiguration{Password: "secret"}, []string{"a password is configured but redis has none, clear Password"}},
+		{"missing password file", withPassword.Addr(), RedisConfiguration{PasswordFile: filepath.Join(t.TempDir(), "missing")}, []string{"cannot read PasswordFile"}},
+		{"no permission", aclRedis(t), RedisConfiguration{}, []string{"the user has no permission for SMEMBERS (NOPERM)"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := diagnosticClient(t, test.addr, test.cfg)
+			problems := diagnoseRedis("TerritoryDB", client)
+			if len(problems) != len(test.want) {
+				t.Fatalf("got %q, want %q", problems, test.want)
+			}
+			for i, problem := range problems {
+				prefix := "redis TerritoryDB (" + test.addr + "): "
+				if !strings.HasPrefix(problem, prefix) || !strings.Contains(problem, test.want[i]) {
+					t.Errorf("got %q, want %q%s", problem, prefix, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestExplainRedisNetworkErrors(t *testing.T) {
+	dns := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "redis.invalid"}}
+	if got := explainRedisError(dns); got != "cannot resolve URL, check the host name" {
+		t.Errorf("DNS failure explained as %q", got)
+	}
+	timeout := errors.New("dial tcp 10.0.0.1:6379: i/o timeout")
+	if got := explainRedisError(timeout); got != "timed out connecting, check URL, Port and any firewall" {
+		t.Errorf("timeout explained as %q", got)
+	}
+	other := errors.New("ERR something else")
+	if got := explainRedisError(other); got != other.Error() {
+		t.Errorf("unknown error explained as %q", got)
+	}
+}
+
+func TestDiagnoseRedisConnectionsLogsOneLinePerProblem(t *testing.T) {
+	buf := useLogBuffer(t)
+	withPassword := miniredis.RunT(t)
+	withPassword.RequireAuth("secret")
+	open := miniredis.RunT(t)
+	clients := map[string]*redis.Client{
+		"Default":     diagnosticClient(t, open.Addr(), RedisConfiguration{}),
+		"TerritoryDB": diagnosticClient(t, withPassword.Addr(), RedisConfiguration{Password: "guess"}),
+	}
+	if problems := diagnoseRedisConnections(clients); problems != 1 {
+		t.Errorf("found %d problems, want 1", problems)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "Warning! redis TerritoryDB") || !strings.Contains(lines[0], "WRONGPASS") {
+		t.Errorf("logged %q, want one WRONGPASS warning naming TerritoryDB", lines)
+	}
+}
@@ -0,0 +1,130 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/go-redis/redis"
+)
+
+// RegionConfig is a named rectangle of grids rendered as its own tile tree
+type RegionConfig struct {
+	Name      string // Directory name under territoryTiles/regions/
+	MinX      int    // First grid column, inclusive
+	MinY      int    // First grid row, inclusive
+	MaxX      int    // Last grid column, inclusive
+	MaxY      int    // Last grid row, inclusive
+	TopTribes bool   // Also write a toptribes.json computed from claims inside the region
+}
+
+var regionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validRegions drops regions with bad names, duplicate names or grid ranges outside the world
+func validRegions(regions []RegionConfig, serversX, serversY int) []RegionConfig {
+	var valid []RegionConfig
+	seen := make(map[string]bool)
+	for _, region := range regions {
+		switch {
+		case !regionNamePattern.MatchString(region.Name):
+			log.Printf("Warning! Ignoring region with invalid name %q", region.Name)
+		case seen[region.Name]:
+			log.Printf("Warning! Ignoring duplicate region %q", region.Name)
+		case region.MinX < 0 || region.MinY < 0 || region.MaxX >= serversX || region.MaxY >= serversY ||
+			region.MinX > region.MaxX || region.MinY > region.MaxY:
+			log.Printf("Warning! Ignoring region %q, grids (%d, %d)-(%d, %d) are not inside the %dx%d world",
+				region.Name, region.MinX, region.MinY, region.MaxX, region.MaxY, serversX, serversY)
+		default:
+			seen[region.Name] = true
+			valid = append(valid, region)
+		}
+	}
+	return valid
+}
+
+func (region RegionConfig) width() int  { return region.MaxX - region.MinX + 1 }
+func (region RegionConfig) height() int { return region.MaxY - region.MinY + 1 }
+
+// regionMarkers returns the markers inside the region with their server positions made
+// relative to the region's top left grid
+func regionMarkers(region RegionConfig, markers []Marker) []Marker {
+	var inside []Marker
+	for _, marker := range markers {
+		if marker.serverX < region.MinX || marker.serverX > region.MaxX ||
+			marker.serverY < region.MinY || marker.serverY > region.MaxY {
+			continue
+		}
+		marker.serverX -= region.MinX
+		marker.serverY -= region.MinY
+		inside = append(inside, marker)
+	}
+	return inside
+}
+
+// generateRegionTiles renders one zoom level of every region from its snapshot, the virtual space
+// of each region is clipped to its grids so zoom 0 shows the whole region
+func generateRegionTiles(ctx context.Context, tilePath string, zoomLevel uint, snapshots map[string]*tileSnapshot, trends map[uint64]float64) {
+	tiles := 1 << zoomLevel
+	for _, region := range config.Regions {
+		opts := MapOptions{tribeTrends: trends}
+		regionPath := path.Join(tilePath, "regions", region.Name)
+		count := generateTileRange(ctx, regionPath, zoomLevel, snapshots[region.Name], opts, image.Rect(0, 0, tiles, tiles))
+		if len(count.FailedTiles) > 0 {
+			log.Printf("Warning! %d tiles failed for region %s zoom %d", len(count.FailedTiles), region.Name, zoomLevel)
+		}
+	}
+}
+
+// generateRegionTopTribes writes toptribes.json for regions that want it, counting only the
+// claims inside the region
+func generateRegionTopTribes(ctx context.Context, client *redis.Client, tilePath string, markers []Marker) {
+	homes := homeGrids(markers)
+	for _, region := range config.Regions {
+		if !region.TopTribes {
+			continue
+		}
+
+		counts := make(map[uint64]*TribeCount)
+		for _, marker := range regionMarkers(region, markers) {
+			countTribeClaim(counts, marker)
+		}
+
+		var entries []LeaderboardEntry
+		for i, tribeID := range TopNTribes(leaderboardSize, counts) {
+			entry := newLeaderboardEntry(i, counts[tribeID], lookupTribeName(client, tribeID))
+			if home, ok := homes[tribeID]; ok {
+				entry.HomeGrid = packedGridID(home)
+			}
+			entries = append(entries, entry)
+		}
+		js, err := json.Marshal(entries)
+		if err != nil {
+			log.Printf("Warning! %v", err)
+			continue
+		}
+
+		// save the a tmp file
+		dir := path.Join(tilePath, "regions", region.Name)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			log.Printf("Warning! Failed to create directory %s: %v", dir, err)
+			continue
+		}
+		filename := path.Join(dir, "toptribes.json")
+		tmpFilename := path.Join(dir, tempFileName("tmp_", ".json"))
+		if err := ioutil.WriteFile(tmpFilename, js, 0600); err != nil {
+			log.Printf("Warning! Failed to write %s: %v", tmpFilename, err)
+			continue
+		}
+
+		// delete old file and rename tmp
+		os.Remove(filename)
+		os.Rename(tmpFilename, filename)
+
+		uploadToS3(ctx, filename)
+	}
+}
@@ -0,0 +1,62 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegionsOnlyShowTheirOwnClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 1
+		cfg.Regions = []RegionConfig{
+			{Name: "west", MinX: 0, MinY: 0, MaxX: 0, MaxY: 0, TopTribes: true},
+			{Name: "east", MinX: 1, MinY: 0, MaxX: 1, MaxY: 0, TopTribes: true},
+		}
+	})
+	_, client := newTestRedis(t)
+	const westTribe, eastTribe = 1000050001, 1000050002
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	west := Marker{serverX: 0, serverY: 0, tribeOrOwnerID: westTribe, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	east := Marker{serverX: 1, serverY: 0, tribeOrOwnerID: eastTribe, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	regionTile := func(name string) []byte {
+		t.Helper()
+		data, err := ioutil.ReadFile(tileFilename(filepath.Join(tilePath, "regions", name), 0, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// a claim in the west grid shows in the west tiles only
+	generateRegionTiles(context.Background(), tilePath, 0, newRegionSnapshots([]Marker{west}), nil)
+	if bytes.Equal(regionTile("west"), emptyTilePNG()) {
+		t.Errorf("west region's tile is empty, want its claim")
+	}
+	if !bytes.Equal(regionTile("east"), emptyTilePNG()) {
+		t.Errorf("east region's tile isn't empty, want the west claim left out")
+	}
+	generateRegionTiles(context.Background(), tilePath, 0, newRegionSnapshots([]Marker{east}), nil)
+	if !bytes.Equal(regionTile("west"), emptyTilePNG()) || bytes.Equal(regionTile("east"), emptyTilePNG()) {
+		t.Errorf("an east claim didn't render only in the east region")
+	}
+
+	// each region's leaderboard counts only its own claims
+	generateRegionTopTribes(context.Background(), client, tilePath, []Marker{west, east})
+	for name, want := range map[string]uint64{"west": westTribe, "east": eastTribe} {
+		js, err := ioutil.ReadFile(filepath.Join(tilePath, "regions", name, "toptribes.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []LeaderboardEntry
+		if err := json.Unmarshal(js, &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].TribeID != want {
+			t.Errorf("%s leaderboard %+v, want only tribe %d", name, entries, want)
+		}
+	}
+}
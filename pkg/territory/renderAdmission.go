@@ -0,0 +1,152 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// renderAdmission limits concurrent on-demand renders. Waiting requests are queued per client and
+// served round-robin across clients so one aggressive client can't starve the others
+var renderAdmission = struct {
+	sync.Mutex
+	running int
+	waiting int
+	queues  map[string][]chan struct{}
+	order   []string // clients with waiting requests, next to be served first
+	stats   RenderAdmissionStats
+}{queues: make(map[string][]chan struct{})}
+
+// RenderAdmissionStats is served by GET /admin/renders
+type RenderAdmissionStats struct {
+	Running        int     `json:"running"`
+	QueueDepth     int     `json:"queueDepth"`
+	Admitted       uint64  `json:"admitted"`
+	Rejected       uint64  `json:"rejected"`
+	TimedOut       uint64  `json:"timedOut"`
+	AverageWaitMs  float64 `json:"averageWaitMs"`
+	totalWaitNanos int64
+}
+
+// acquireRender waits for a render slot, ok is false when the queue is full or the wait timed out
+func acquireRender(client string) bool {
+	start := time.Now()
+	renderAdmission.Lock()
+	if renderAdmission.running < config.MaxConcurrentRenders && renderAdmission.waiting == 0 {
+		renderAdmission.running++
+		renderAdmission.stats.Admitted++
+		renderAdmission.Unlock()
+		return true
+	}
+	if renderAdmission.waiting >= config.RenderQueueSize {
+		renderAdmission.stats.Rejected++
+		renderAdmission.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	if len(renderAdmission.queues[client]) == 0 {
+		renderAdmission.order = append(renderAdmission.order, client)
+	}
+	renderAdmission.queues[client] = append(renderAdmission.queues[client], ready)
+	renderAdmission.waiting++
+	renderAdmission.Unlock()
+
+	timer := time.NewTimer(time.Duration(config.RenderQueueTimeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		renderAdmission.Lock()
+		renderAdmission.stats.Admitted++
+		renderAdmission.stats.totalWaitNanos += int64(time.Since(start))
+		renderAdmission.Unlock()
+		return true
+	case <-timer.C:
+	}
+
+	renderAdmission.Lock()
+	defer renderAdmission.Unlock()
+	queue := renderAdmission.queues[client]
+	for i, ch := range queue {
+		if ch == ready {
+			renderAdmission.queues[client] = append(queue[:i], queue[i+1:]...)
+			renderAdmission.waiting--
+			if len(renderAdmission.queues[client]) == 0 {
+				removeRenderClient(client)
+			}
+			renderAdmission.stats.TimedOut++
+			return false
+		}
+	}
+	// the slot was handed over while timing out, so keep it
+	renderAdmission.stats.Admitted++
+	renderAdmission.stats.totalWaitNanos += int64(time.Since(start))
+	return true
+}
+
+// releaseRender hands the slot to the next client in round-robin order, or frees it
+func releaseRender() {
+	renderAdmission.Lock()
+	defer renderAdmission.Unlock()
+	if renderAdmission.waiting == 0 {
+		renderAdmission.running--
+		return
+	}
+	client := renderAdmission.order[0]
+	queue := renderAdmission.queues[client]
+	next := queue[0]
+	renderAdmission.queues[client] = queue[1:]
+	renderAdmission.waiting--
+	renderAdmission.order = renderAdmission.order[1:]
+	if len(renderAdmission.queues[client]) > 0 {
+		renderAdmission.order = append(renderAdmission.order, client)
+	} else {
+		delete(renderAdmission.queues, client)
+	}
+	close(next)
+}
+
+// removeRenderClient drops a client without waiting requests from the round-robin order
+func removeRenderClient(client string) {
+	delete(renderAdmission.queues, client)
+	for i, c := range renderAdmission.order {
+		if c == client {
+			renderAdmission.order = append(renderAdmission.order[:i], renderAdmission.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// admitRender wraps an on-demand render handler with the admission controller
+func admitRender(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acquireRender(remoteIP(r)) {
+			w.Header().Set("Retry-After", strconv.Itoa(Max(1, config.RenderQueueTimeoutSeconds)))
+			writeError(w, r, http.StatusServiceUnavailable, "too many renders in progress")
+			return
+		}
+		defer releaseRender()
+		next(w, r)
+	}
+}
+
+// renderAdmissionHandler serves GET /admin/renders with the controller's counters
+func renderAdmissionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	renderAdmission.Lock()
+	stats := renderAdmission.stats
+	stats.Running = renderAdmission.running
+	stats.QueueDepth = renderAdmission.waiting
+	renderAdmission.Unlock()
+	if waited := stats.Admitted; waited > 0 {
+		stats.AverageWaitMs = float64(stats.totalWaitNanos) / float64(waited) / float64(time.Millisecond)
+	}
+
+	js, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
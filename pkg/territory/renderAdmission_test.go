@@ -0,0 +1,125 @@
+package territory
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetRenderAdmission starts the test with an idle controller
+func resetRenderAdmission() {
+	renderAdmission.Lock()
+	renderAdmission.running, renderAdmission.waiting = 0, 0
+	renderAdmission.queues = make(map[string][]chan struct{})
+	renderAdmission.order = nil
+	renderAdmission.stats = RenderAdmissionStats{}
+	renderAdmission.Unlock()
+}
+
+// waitForQueueDepth waits until depth requests are queued
+func waitForQueueDepth(t testing.TB, depth int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		renderAdmission.Lock()
+		waiting := renderAdmission.waiting
+		renderAdmission.Unlock()
+		if waiting == depth {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", waiting, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRenderAdmissionServesClientsRoundRobin(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.MaxConcurrentRenders = 1
+		cfg.RenderQueueSize = 4
+	})
+	resetRenderAdmission()
+	if !acquireRender("busy") {
+		t.Fatalf("idle controller refused a render")
+	}
+
+	// three requests of a greedy client queue before one of a polite client
+	admitted := make(chan string, 4)
+	for i, client := range []string{"greedy", "greedy", "greedy", "polite"} {
+		go func(client string) {
+			if acquireRender(client) {
+				admitted <- client
+			}
+		}(client)
+		waitForQueueDepth(t, i+1)
+	}
+	if acquireRender("late") {
+		t.Fatalf("full queue admitted another render")
+	}
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		releaseRender()
+		order = append(order, <-admitted)
+	}
+	releaseRender()
+	if got, want := fmt.Sprint(order), "[greedy polite greedy greedy]"; got != want {
+		t.Errorf("served %s, want %s", got, want)
+	}
+	if renderAdmission.stats.Rejected != 1 || renderAdmission.running != 0 {
+		t.Errorf("stats %+v with %d running, want 1 rejected and none running", renderAdmission.stats, renderAdmission.running)
+	}
+}
+
+// BenchmarkRenderAdmissionFairness runs one greedy client with many concurrent renders against
+// polite clients with one at a time. Round-robin across clients keeps the polite clients' share of
+// renders far above the 2/18 of their requests first come, first served would give them
+func BenchmarkRenderAdmissionFairness(b *testing.B) {
+	previous := config
+	defer func() { config = previous }()
+	config.MaxConcurrentRenders = 2
+	config.RenderQueueSize = 64
+	config.RenderQueueTimeoutSeconds = 10
+	resetRenderAdmission()
+
+	clients := []struct {
+		name        string
+		concurrency int
+	}{{"greedy", 16}, {"polite1", 1}, {"polite2", 1}}
+	var remaining int64 = int64(b.N)
+	admitted := make([]int64, len(clients))
+	var rejected int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i, client := range clients {
+		for j := 0; j < client.concurrency; j++ {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				for atomic.AddInt64(&remaining, -1) >= 0 {
+					if !acquireRender(name) {
+						atomic.AddInt64(&rejected, 1)
+						continue
+					}
+					atomic.AddInt64(&admitted[i], 1)
+					time.Sleep(50 * time.Microsecond)
+					releaseRender()
+				}
+			}(i, client.name)
+		}
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	total := admitted[0] + admitted[1] + admitted[2]
+	if total > 0 {
+		b.ReportMetric(float64(admitted[1]+admitted[2])/float64(total), "politeShare")
+	}
+	b.ReportMetric(float64(rejected)/float64(b.N), "rejected/op")
+	renderAdmission.Lock()
+	b.ReportMetric(float64(renderAdmission.stats.totalWaitNanos)/float64(Max(1, int(renderAdmission.stats.Admitted)))/float64(time.Microsecond), "waitus/render")
+	renderAdmission.Unlock()
+}
@@ -0,0 +1,69 @@
+package territory
+
+import (
+	"log"
+	"sort"
+)
+
+const (
+	RenderOrderOwnerID        = "ownerID"
+	RenderOrderSizeDescending = "sizeDescending"
+	RenderOrderSizeAscending  = "sizeAscending"
+)
+
+// ownerClaimSizes counts markers per owner for the size based render orders
+func ownerClaimSizes(markers []Marker) map[uint64]int {
+	if config.RenderOrder != RenderOrderSizeDescending && config.RenderOrder != RenderOrderSizeAscending {
+		return nil
+	}
+	sizes := make(map[uint64]int)
+	for _, marker := range markers {
+		sizes[marker.tribeOrOwnerID]++
+	}
+	return sizes
+}
+
+// sortForRendering orders markers so later ones paint on top, owners are ordered by RenderOrder
+// and each owner's markers by position so the result doesn't depend on quadtree or redis order
+func sortForRendering(vbs []VirtualBounds, sizes map[uint64]int) {
+	sort.Slice(vbs, func(i, j int) bool {
+		a, b := vbs[i], vbs[j]
+		if a.marker.tribeOrOwnerID != b.marker.tribeOrOwnerID {
+			sizeA, sizeB := sizes[a.marker.tribeOrOwnerID], sizes[b.marker.tribeOrOwnerID]
+			switch {
+			case config.RenderOrder == RenderOrderSizeDescending && sizeA != sizeB:
+				return sizeA > sizeB
+			case config.RenderOrder == RenderOrderSizeAscending && sizeA != sizeB:
+				return sizeA < sizeB
+			}
+			return a.marker.tribeOrOwnerID < b.marker.tribeOrOwnerID
+		}
+		if a.y != b.y {
+			return a.y < b.y
+		}
+		if a.x != b.x {
+			return a.x < b.x
+		}
+		return a.marker.markerType < b.marker.markerType
+	})
+}
+
+// sortClaims orders exported claims by position, the .map equivalent of sortForRendering
+func sortClaims(claims []ClaimFlagOutputEntry) {
+	sort.Slice(claims, func(i, j int) bool {
+		if claims[i].X != claims[j].X {
+			return claims[i].X < claims[j].X
+		}
+		return claims[i].Y < claims[j].Y
+	})
+}
+
+// validRenderOrder checks a RenderOrder value, unknown values fall back to ownerID
+func validRenderOrder(order string) string {
+	switch order {
+	case RenderOrderOwnerID, RenderOrderSizeDescending, RenderOrderSizeAscending:
+		return order
+	}
+	log.Printf("Warning! Unknown RenderOrder %q, using %s", order, RenderOrderOwnerID)
+	return RenderOrderOwnerID
+}
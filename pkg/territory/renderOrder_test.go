@@ -0,0 +1,100 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderOrderKeepsSmallOwnerOnTop(t *testing.T) {
+	const small, large = 1000050001, 1000050002
+	center := Marker{tribeOrOwnerID: small, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	markers := []Marker{center}
+	for _, offset := range [][2]float64{{0, 0}, {-0.05, 0}, {0.05, 0}, {0, -0.05}, {0, 0.05}} {
+		markers = append(markers, Marker{tribeOrOwnerID: large, relX: 0.5 + offset[0], relY: 0.5 + offset[1], markerType: MarkerLand})
+	}
+
+	for _, test := range []struct {
+		order string
+		top   uint64
+	}{
+		// the one-flag owner has the lower ID so it's painted first and buried
+		{RenderOrderOwnerID, large},
+		{RenderOrderSizeDescending, small},
+	} {
+		t.Run(test.order, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 1, 1
+				cfg.LandRadiusUE = 140000
+				cfg.OpaqueClaims = true
+				cfg.RenderOrder = test.order
+			})
+			const size = 256
+			img := renderWorld(markers, MapOptions{ownerSizes: ownerClaimSizes(markers)}, size)
+			if got := worldPixel(img, center, size); colorDistance(got, getTribeColor(test.top)) != 0 {
+				t.Errorf("center is %v, want %d's color %v on top", got, test.top, getTribeColor(test.top))
+			}
+			checkGolden(t, "renderOrder_"+test.order, img)
+		})
+	}
+}
+
+func TestIdenticalMarkersRenderByteIdentical(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.LandRadiusUE = 140000
+	})
+	var markers []Marker
+	for i := 0; i < 40; i++ {
+		markers = append(markers, Marker{
+			tribeOrOwnerID: 1000050001 + uint64(i%5),
+			serverX:        i % 2,
+			serverY:        i / 2 % 2,
+			relX:           0.3 + float64(i%7)*0.05,
+			relY:           0.3 + float64(i%3)*0.1,
+			markerType:     uint8(i % 2),
+		})
+	}
+	// the same claims in the opposite order, like two SMEMBERS replies
+	reversed := make([]Marker, len(markers))
+	for i, marker := range markers {
+		reversed[len(markers)-1-i] = marker
+	}
+
+	encode := func(markers []Marker) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, renderWorld(markers, MapOptions{ownerSizes: ownerClaimSizes(markers)}, 256)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if !bytes.Equal(encode(markers), encode(reversed)) {
+		t.Errorf("the tile image depends on the order the claims were read in")
+	}
+
+	first, second := t.TempDir(), t.TempDir()
+	if err := generateGame(context.Background(), first, markers, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateGame(context.Background(), second, reversed, 2); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		want, _ := ioutil.ReadFile(filepath.Join(first, file.Name()))
+		got, err := ioutil.ReadFile(filepath.Join(second, file.Name()))
+		if err != nil {
+			t.Errorf("second run didn't write %s: %v", file.Name(), err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s depends on the order the claims were read in", file.Name())
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package territory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayResult is printed by the replay subcommand
+type ReplayResult struct {
+	Frames  int      `json:"frames"`
+	Skipped []string `json:"skipped,omitempty"` // steps without an export near them
+	Failed  []string `json:"failed,omitempty"`  // steps whose export couldn't be read or frame written
+	Seconds float64  `json:"seconds"`
+}
+
+// replaySnapshot is a full export in the exports directory
+type replaySnapshot struct {
+	filename    string
+	generatedAt time.Time
+}
+
+// replayFrame is a step with the export it is rendered from
+type replayFrame struct {
+	at       time.Time
+	snapshot replaySnapshot
+}
+
+// findReplaySnapshots reads the header of every export in dir. Incremental exports and other
+// schema versions are skipped, the rest are returned oldest first
+func findReplaySnapshots(dir string) ([]replaySnapshot, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []replaySnapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, "tmp_") || !(strings.HasSuffix(name, ".jsonl.gz") || strings.HasSuffix(name, ".jsonl")) {
+			continue
+		}
+		filename := path.Join(dir, name)
+		header, err := readExportHeader(filename)
+		switch {
+		case err != nil:
+			log.Printf("Warning! Skipping %s: %v", filename, err)
+		case header.SchemaVersion != exportSchemaVersion:
+			log.Printf("Warning! Skipping %s: schema version %d, expected %d", filename, header.SchemaVersion, exportSchemaVersion)
+		case !header.Since.IsZero():
+			// incremental exports only hold the owners that changed
+		default:
+			snapshots = append(snapshots, replaySnapshot{filename: filename, generatedAt: header.GeneratedAt})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].generatedAt.Before(snapshots[j].generatedAt) })
+	return snapshots, nil
+}
+
+// readExportHeader reads the first line of an export
+func readExportHeader(filename string) (ExportHeader, error) {
+	var header ExportHeader
+	in, err := openExport(filename)
+	if err != nil {
+		return header, err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, err
+		}
+		return header, fmt.Errorf("empty export")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" {
+		return header, fmt.Errorf("doesn't start with an export header")
+	}
+	return header, nil
+}
+
+// nearestSnapshot is the snapshot closest to at, false when none is within tolerance. Ties go to
+// the earlier snapshot
+func nearestSnapshot(snapshots []replaySnapshot, at time.Time, tolerance time.Duration) (replaySnapshot, bool) {
+	// the first snapshot at or after at, the nearest is it or the one before
+	i := sort.Search(len(snapshots), func(i int) bool { return !snapshots[i].generatedAt.Before(at) })
+	best, bestDistance := replaySnapshot{}, time.Duration(math.MaxInt64)
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(snapshots) {
+			continue
+		}
+		distance := snapshots[j].generatedAt.Sub(at)
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance < bestDistance {
+			best, bestDistance = snapshots[j], distance
+		}
+	}
+	return best, bestDistance <= tolerance
+}
+
+// replayFrames picks the nearest snapshot for every step from from to to, steps with no
+// snapshot within half a step are skipped
+func replayFrames(snapshots []replaySnapshot, from, to time.Time, every time.Duration) (frames []replayFrame, skipped []time.Time) {
+	for at := from; !at.After(to); at = at.Add(every) {
+		snapshot, ok := nearestSnapshot(snapshots, at, every/2)
+		if !ok {
+			skipped = append(skipped, at)
+			continue
+		}
+		frames = append(frames, replayFrame{at: at, snapshot: snapshot})
+	}
+	return
+}
+
+// readExportMarkers reads the claims of an export as the markers redis would have returned,
+// with the owner names it records
+func readExportMarkers(filename string) ([]Marker, map[uint64]string, error) {
+	in, err := openExport(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	var markers []Marker
+	names := make(map[uint64]string)
+	rejected := 0
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			continue
+		}
+		var claim ExportClaim
+		if err := json.Unmarshal(scanner.Bytes(), &claim); err != nil {
+			rejected++
+			continue
+		}
+		grid, raw, reason := importClaimRaw(claim)
+		if len(reason) > 0 {
+			rejected++
+			continue
+		}
+		bytes := []byte(raw)
+		markers = append(markers, Marker{
+			serverX:        grid.X,
+			serverY:        grid.Y,
+			tribeOrOwnerID: claim.OwnerID,
+			relX:           float64(binary.LittleEndian.Uint16(bytes[8:10])) / float64(math.MaxUint16),
+			relY:           float64(binary.LittleEndian.Uint16(bytes[10:12])) / float64(math.MaxUint16),
+			markerType:     bytes[12],
+		})
+		if len(claim.OwnerName) > 0 {
+			names[claim.OwnerID] = claim.OwnerName
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if rejected > 0 {
+		log.Printf("Warning! Skipped %d unreadable claims of %s", rejected, filename)
+	}
+	return markers, names, nil
+}
+
+// renderReplayFrame renders the snapshot through the poster renderer with the step's time as
+// the caption and writes it to filename
+func renderReplayFrame(filename string, frame replayFrame, req PosterRequest) error {
+	markers, names, err := readExportMarkers(frame.snapshot.filename)
+	if err != nil {
+		return err
+	}
+	region := RegionConfig{MaxX: config.ServersX - 1, MaxY: config.ServersY - 1}
+	poster := newPosterImage(path.Base(filename), req, region, markers)
+	poster.caption = frame.at.UTC().Format("2006-01-02 15:04 UTC")
+	if poster.layers[PosterLayerLegend] {
+		poster.legend = posterLegend(markers, func(tribeID uint64) string {
+			if name, ok := names[tribeID]; ok {
+				return name
+			}
+			return strconv.FormatUint(tribeID, 10)
+		})
+	}
+
+	tmpFilename := path.Join(path.Dir(filename), tempFileName("tmp_", ".png"))
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, poster); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// runReplay is the replay subcommand, returning the process exit code. It renders a frame per
+// step from the nearest full export, numbered without gaps so ffmpeg can read them as a sequence
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	exportsDir := flags.String("exports", path.Join(config.WWWDir, "exports"), "directory of full claim exports, e.g. kept copies of the scheduled export")
+	fromFlag := flags.String("from", "", "first step, RFC 3339")
+	toFlag := flags.String("to", "", "last step, RFC 3339")
+	every := flags.Duration("every", time.Hour, "time between steps, each uses the export nearest it")
+	outDir := flags.String("out", "./replay", "directory for the frames")
+	width := flags.Int("width", 1024, "frame width in pixels")
+	layers := flags.String("layers", "", "comma separated poster layers, all when empty")
+	workers := flags.Int("workers", config.MaxConcurrentRenders, "frames rendered at once")
+	flags.Parse(args)
+
+	from, fromErr := time.Parse(time.RFC3339, *fromFlag)
+	to, toErr := time.Parse(time.RFC3339, *toFlag)
+	if fromErr != nil || toErr != nil || to.Before(from) || *every <= 0 || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay -from time -to time [-every duration] [-exports dir] [-out dir] [-width pixels] [-layers list] [-workers n]")
+		return 2
+	}
+	req := PosterRequest{Width: *width}
+	if len(*layers) > 0 {
+		req.Layers = strings.Split(*layers, ",")
+	}
+	if err := validatePosterRequest(&req); err != nil {
+		log.Printf("Replay failed: %v", err)
+		return 2
+	}
+
+	started := time.Now()
+	snapshots, err := findReplaySnapshots(*exportsDir)
+	if err != nil {
+		log.Printf("Replay failed: %v", err)
+		return 1
+	}
+	frames, skipped := replayFrames(snapshots, from, to, *every)
+	result := ReplayResult{}
+	for _, at := range skipped {
+		log.Printf("Warning! No export within %v of %s, skipping it", *every/2, at.UTC().Format(time.RFC3339))
+		result.Skipped = append(result.Skipped, at.UTC().Format(time.RFC3339))
+	}
+	if err := os.MkdirAll(*outDir, os.ModePerm); err != nil {
+		log.Printf("Replay failed: %v", err)
+		return 1
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, Max(1, *workers))
+	for i, frame := range frames {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, frame replayFrame) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			filename := path.Join(*outDir, fmt.Sprintf("frame_%05d.png", i+1))
+			err := renderReplayFrame(filename, frame, req)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.Printf("Warning! Frame %s from %s failed: %v", frame.at.UTC().Format(time.RFC3339), frame.snapshot.filename, err)
+				result.Failed = append(result.Failed, frame.at.UTC().Format(time.RFC3339))
+				return
+			}
+			result.Frames++
+		}(i, frame)
+	}
+	wg.Wait()
+	sort.Strings(result.Failed)
+	result.Seconds = time.Since(started).Seconds()
+
+	js, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(js))
+	if len(result.Failed) > 0 || result.Frames == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package territory
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFrame decodes a replay frame
+func readFrame(t *testing.T, filename string) image.Image {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// runTestReplay runs the replay subcommand, returning its exit code and summary
+func runTestReplay(t *testing.T, args ...string) (int, ReplayResult) {
+	t.Helper()
+	var code int
+	out := captureStdout(t, func() { code = runReplay(args) })
+	var result ReplayResult
+	json.Unmarshal([]byte(out), &result)
+	return code, result
+}
+
+func TestReplayRendersTheNearestExportPerStep(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		// claims 12.8 pixels in radius in a 256 pixel frame
+		cfg.LandRadiusUE = 0.1 * cfg.GridSize
+	})
+	useLogBuffer(t)
+	grid := config.GridSize
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	header := func(at time.Time) ExportHeader {
+		return ExportHeader{Type: "header", SchemaVersion: exportSchemaVersion, GeneratedAt: at, ServersX: 2, ServersY: 2, GridSize: grid}
+	}
+	claim := func(owner uint64, worldX, worldY float64) ExportClaim {
+		serverID := int(worldX/grid)<<16 | int(worldY/grid)
+		return ExportClaim{Type: "claim", OwnerID: owner, OwnerName: "Tribe", ServerID: serverID, WorldX: worldX, WorldY: worldY, MarkerType: "land"}
+	}
+	first := claim(1000050001, 0.5*grid, 0.5*grid)
+	second := claim(1000050002, 1.5*grid, 1.5*grid)
+
+	exports := t.TempDir()
+	for name, filename := range map[string]string{
+		"claims-0.jsonl.gz": writeImportFile(t, header(start.Add(-5*time.Minute)), first),
+		"claims-1.jsonl.gz": writeImportFile(t, header(start.Add(time.Hour+10*time.Minute)), first, second),
+		"claims-3.jsonl.gz": writeImportFile(t, header(start.Add(3*time.Hour)), second),
+		// an incremental export doesn't hold every claim, the 2h step has nothing near it
+		"claims-2.jsonl.gz": writeImportFile(t, ExportHeader{Type: "header", SchemaVersion: exportSchemaVersion, GeneratedAt: start.Add(2 * time.Hour), Since: start}, second),
+	} {
+		if err := os.Rename(filename, filepath.Join(exports, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(exports, "notes.jsonl"), []byte("not an export\n"), 0600)
+
+	out := filepath.Join(t.TempDir(), "frames")
+	args := []string{"-exports", exports, "-from", start.Format(time.RFC3339), "-to", start.Add(3 * time.Hour).Format(time.RFC3339), "-width", "256", "-out", out}
+	code, result := runTestReplay(t, append(args, "-workers", "3")...)
+	if code != 0 || result.Frames != 3 || !reflect.DeepEqual(result.Skipped, []string{start.Add(2 * time.Hour).Format(time.RFC3339)}) {
+		t.Fatalf("replay exited %d with %+v, want 3 frames and the 2h step skipped", code, result)
+	}
+	names, _ := filepath.Glob(filepath.Join(out, "*"))
+	if want := []string{"frame_00001.png", "frame_00002.png", "frame_00003.png"}; len(names) != len(want) {
+		t.Fatalf("wrote %v, want %v without gaps", names, want)
+	}
+
+	// each frame shows its export, 128 pixels per grid
+	alpha := func(img image.Image, x, y int) uint32 {
+		_, _, _, a := img.At(x, y).RGBA()
+		return a
+	}
+	for i, want := range []struct{ first, second bool }{{true, false}, {true, true}, {false, true}} {
+		img := readFrame(t, filepath.Join(out, "frame_0000"+string(rune('1'+i))+".png"))
+		if got := alpha(img, 64, 64) > 0; got != want.first {
+			t.Errorf("frame %d shows the first claim %v, want %v", i+1, got, want.first)
+		}
+		if got := alpha(img, 192, 192) > 0; got != want.second {
+			t.Errorf("frame %d shows the second claim %v, want %v", i+1, got, want.second)
+		}
+		// the caption's box
+		if r, g, b, a := img.At(1, 1).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+			t.Errorf("frame %d has no caption box in its corner", i+1)
+		}
+	}
+
+	// the frames don't depend on how many render at once
+	serial := filepath.Join(t.TempDir(), "frames")
+	args[len(args)-1] = serial
+	if code, _ := runTestReplay(t, append(args, "-workers", "1")...); code != 0 {
+		t.Fatalf("serial replay exited %d", code)
+	}
+	for _, name := range []string{"frame_00001.png", "frame_00002.png", "frame_00003.png"} {
+		a, _ := ioutil.ReadFile(filepath.Join(out, name))
+		b, _ := ioutil.ReadFile(filepath.Join(serial, name))
+		if len(a) == 0 || string(a) != string(b) {
+			t.Errorf("%s differs between 3 workers and 1", name)
+		}
+	}
+
+	if code, _ := runTestReplay(t, "-exports", exports, "-to", start.Format(time.RFC3339)); code != 2 {
+		t.Errorf("replay without -from exited %d, want 2", code)
+	}
+	empty := t.TempDir()
+	if code, result := runTestReplay(t, "-exports", empty, "-from", start.Format(time.RFC3339), "-to", start.Format(time.RFC3339), "-width", "256", "-out", out); code != 1 || len(result.Skipped) != 1 {
+		t.Errorf("replay of an empty directory exited %d with %+v, want 1 and the step skipped", code, result)
+	}
+}
@@ -0,0 +1,78 @@
+package territory
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3VerifyError is an uploaded object that doesn't match its local file
+type s3VerifyError struct {
+	key    string
+	reason string
+}
+
+func (e *s3VerifyError) Error() string {
+	return fmt.Sprintf("S3 object %s doesn't match local file: %s", e.key, e.reason)
+}
+
+// shouldVerifyUpload picks which uploads get verified, game outputs always are
+func shouldVerifyUpload(relPath string) bool {
+	if !config.S3VerifyUploads {
+		return false
+	}
+	if strings.HasPrefix(relPath, "gameTiles/") {
+		return true
+	}
+	return rand.Float64() < config.S3VerifySampleRate
+}
+
+// fileMD5 returns the hex MD5 of a local file
+func fileMD5(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyS3Object compares the object's size and, for single part uploads, its ETag with the local file
+func verifyS3Object(svc *s3.S3, key, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return classify(ErrStorage, "upload", err)
+	}
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: &config.AtlasS3BucketName, Key: &key})
+	if err != nil {
+		return classifyS3Error("upload", err)
+	}
+	if size := aws.Int64Value(head.ContentLength); size != info.Size() {
+		return classify(ErrStorage, "upload", &s3VerifyError{key: key, reason: fmt.Sprintf("size %d, expected %d", size, info.Size())})
+	}
+
+	// multipart ETags ("<hash>-<parts>") aren't the MD5 of the content so only the size is checked
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if len(etag) == 0 || strings.Contains(etag, "-") {
+		return nil
+	}
+	sum, err := fileMD5(file)
+	if err != nil {
+		return classify(ErrStorage, "upload", err)
+	}
+	if etag != sum {
+		return classify(ErrStorage, "upload", &s3VerifyError{key: key, reason: fmt.Sprintf("ETag %s, expected %s", etag, sum)})
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3VerifyReuploadsTruncatedObject(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.S3VerifyUploads = true
+		cfg.S3VerifyRetries = 1
+	})
+	fake := useFakeS3(t)
+	const key = "gameTiles/world.map"
+	data := bytes.Repeat([]byte("claims"), 100)
+	// the first upload reports success but stores half the object
+	fake.truncate[key] = 1
+
+	if err := uploadToS3(context.Background(), writeOutput(t, key, data)); err != nil {
+		t.Fatalf("upload failed after a re-upload: %v", err)
+	}
+	if puts := fake.putCount(key); puts != 2 {
+		t.Errorf("uploaded %d times, want the truncated object re-uploaded once", puts)
+	}
+	if fake.heads != 2 {
+		t.Errorf("%d HEAD requests, want each upload verified", fake.heads)
+	}
+	if !bytes.Equal(fake.objects[key], data) {
+		t.Errorf("stored %d bytes, want the %d of the file", len(fake.objects[key]), len(data))
+	}
+}
+
+func TestS3VerifyMismatchBlocksGameOutput(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.S3VerifyUploads = true
+		cfg.S3VerifyRetries = 1
+	})
+	fake := useFakeS3(t)
+	const key = "gameTiles/world.map"
+	fake.truncate[key] = 10
+
+	err := generateGame(context.Background(), filepath.Join(config.WWWDir, "gameTiles"), testMarkers(), 2)
+	var verifyErr *s3VerifyError
+	if !errors.As(err, &verifyErr) || verifyErr.key != key {
+		t.Fatalf("generateGame returned %v, want the verify mismatch of %s", err, key)
+	}
+	if !errors.Is(err, ErrStorage) {
+		t.Errorf("%v isn't a storage error", err)
+	}
+	if puts := fake.putCount(key); puts != 1+config.S3VerifyRetries {
+		t.Errorf("uploaded %d times, want 1 and %d retries", puts, config.S3VerifyRetries)
+	}
+}
+
+func TestS3VerifyIsOptIn(t *testing.T) {
+	useTestConfig(t, nil)
+	fake := useFakeS3(t)
+	fake.truncate["gameTiles/world.map"] = 1
+	if err := uploadToS3(context.Background(), writeOutput(t, "gameTiles/world.map", []byte("claims"))); err != nil {
+		t.Fatal(err)
+	}
+	if fake.heads != 0 {
+		t.Errorf("%d HEAD requests with S3VerifyUploads off", fake.heads)
+	}
+}
@@ -0,0 +1,99 @@
+package territory
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Clock is the time source of the background loops, tests replace it to step time by hand
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker, and of time.Timer, the loops use. A timer's channel fires once
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+func (systemClock) NewTimer(d time.Duration) Ticker { return systemTimer{time.NewTimer(d)} }
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+func (t systemTimer) Stop() { t.Timer.Stop() }
+
+// clock is the process' time source
+var clock Clock = systemClock{}
+
+// schedule paces a background loop, wait blocks until the next cycle is due and returns false
+// once ctx is cancelled and the loop should stop
+type schedule interface {
+	wait(ctx context.Context) bool
+	stop()
+}
+
+// newFetchSchedule paces the tile and game workers, on FetchSchedule when it's set and every
+// FetchRateInSeconds otherwise. The config was validated so the schedule parses
+func newFetchSchedule() schedule {
+	if len(config.FetchSchedule) > 0 {
+		location, err := time.LoadLocation(config.ScheduleTimeZone)
+		var cron *cronSchedule
+		if err == nil {
+			cron, err = parseCronSchedule(config.FetchSchedule, location)
+		}
+		if err == nil {
+			return cron
+		}
+		log.Printf("Warning! Ignoring FetchSchedule %q: %v", config.FetchSchedule, err)
+	}
+	return newIntervalSchedule(time.Duration(config.FetchRateInSeconds) * time.Second)
+}
+
+// intervalSchedule paces a background loop. Tickers run on the monotonic clock so a wall clock
+// step, like an NTP correction, neither bunches cycles together nor stalls them. A cycle that
+// overruns the interval is followed by the next straight away, not by the ticks it missed
+type intervalSchedule struct {
+	ticker Ticker
+}
+
+func newIntervalSchedule(interval time.Duration) *intervalSchedule {
+	return &intervalSchedule{ticker: clock.NewTicker(interval)}
+}
+
+// wait blocks until the next cycle is due, it returns false once ctx is cancelled and the loop
+// should stop
+func (s *intervalSchedule) wait(ctx context.Context) bool {
+	// a pending tick mustn't win over a cancellation
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-s.ticker.C():
+		return true
+	}
+}
+
+func (s *intervalSchedule) stop() {
+	s.ticker.Stop()
+}
@@ -0,0 +1,226 @@
+package territory
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {}
+
+// fakeClock only moves when the test says so
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+// fakeTimer fires once the fakeClock is advanced to its deadline
+type fakeTimer struct {
+	fakeTicker
+	deadline time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.Lock()
+	defer c.Unlock()
+	ticker := &fakeTicker{c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Ticker {
+	c.Lock()
+	defer c.Unlock()
+	timer := &fakeTimer{fakeTicker: fakeTicker{c: make(chan time.Time, 1)}, deadline: c.now.Add(d)}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// advance moves the clock forward by d, firing the timers that are due
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = pending
+}
+
+// tickerCount is the number of tickers created
+func (c *fakeClock) tickerCount() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.tickers)
+}
+
+// timerCount is the number of timers waiting to fire
+func (c *fakeClock) timerCount() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+// tick fires every ticker as if the interval passed, dropping ticks nobody took yet like time.Ticker
+func (c *fakeClock) tick() {
+	c.Lock()
+	defer c.Unlock()
+	for _, ticker := range c.tickers {
+		select {
+		case ticker.c <- c.now:
+		default:
+		}
+	}
+}
+
+// useFakeClock installs a fakeClock as the clock for the test
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	fake := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = fake
+	t.Cleanup(func() { clock = previous })
+	return fake
+}
+
+func TestIntervalScheduleWaitsForTick(t *testing.T) {
+	fake := useFakeClock(t)
+	schedule := newIntervalSchedule(time.Minute)
+	defer schedule.stop()
+
+	waited := make(chan bool)
+	go func() { waited <- schedule.wait(context.Background()) }()
+	select {
+	case <-waited:
+		t.Fatalf("wait returned before the tick")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fake.tick()
+	if !<-waited {
+		t.Fatalf("wait returned false on a tick")
+	}
+}
+
+func TestIntervalScheduleStopsOnCancel(t *testing.T) {
+	fake := useFakeClock(t)
+	schedule := newIntervalSchedule(time.Minute)
+	defer schedule.stop()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fake.tick()
+	cancel()
+	if schedule.wait(ctx) {
+		t.Fatalf("wait returned true after cancellation with a tick pending")
+	}
+}
+
+func TestTileWorkerStopsOnCancel(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.MaxZoom = 1
+	})
+	useFakeClock(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{}, 1, 0.5, 0.5, MarkerLand)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var firstCycle sync.WaitGroup
+	firstCycle.Add(1)
+	stopped := make(chan struct{})
+	go func() {
+		tileBackgroundWorker(ctx, client, &firstCycle)
+		close(stopped)
+	}()
+	firstCycle.Wait()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker still running after cancellation")
+	}
+}
+
+// sleepHookClock calls onSleep the first time a loop waits on one of its tickers
+type sleepHookClock struct {
+	*fakeClock
+	onSleep func()
+	once    sync.Once
+}
+
+func (c *sleepHookClock) NewTicker(d time.Duration) Ticker {
+	return &sleepHookTicker{Ticker: c.fakeClock.NewTicker(d), clock: c}
+}
+
+type sleepHookTicker struct {
+	Ticker
+	clock *sleepHookClock
+}
+
+func (t *sleepHookTicker) C() <-chan time.Time {
+	t.clock.once.Do(t.clock.onSleep)
+	return t.Ticker.C()
+}
+
+func TestTileWorkerGeneratesBeforeItsFirstSleep(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.MaxZoom = 1
+		cfg.WarmBeforeServing = true
+	})
+	fake := useFakeClock(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{}, 1000050001, 0.5, 0.5, MarkerLand)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	tiles := func() int {
+		matches, _ := filepath.Glob(filepath.Join(tilePath, "*", "*", "*.png"))
+		return len(matches)
+	}
+	tilesAtSleep := make(chan int, 1)
+	clock = &sleepHookClock{fakeClock: fake, onSleep: func() { tilesAtSleep <- tiles() }}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var firstCycle sync.WaitGroup
+	firstCycle.Add(1)
+	stopped := make(chan struct{})
+	go func() {
+		tileBackgroundWorker(ctx, client, &firstCycle)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	firstCycle.Wait()
+	if tiles() == 0 {
+		t.Fatalf("no tiles once the first cycle was done")
+	}
+	select {
+	case count := <-tilesAtSleep:
+		if count == 0 {
+			t.Fatalf("the worker slept before generating tiles")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the worker never waited for its next cycle")
+	}
+}
@@ -0,0 +1,95 @@
+package territory
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ServerSummary is one server of GET /api/servers
+type ServerSummary struct {
+	ID                  int     `json:"id"` // packed x<<16|y
+	X                   int     `json:"x"`
+	Y                   int     `json:"y"`
+	Claims              int     `json:"claims"`
+	Tribes              int     `json:"tribes"`                    // distinct tribes with claims on the server
+	DominantTribeID     uint64  `json:"dominantTribeId,omitempty"` // left out when it opted out of public outputs
+	DominantTribeClaims int     `json:"dominantTribeClaims,omitempty"`
+	ContestedArea       float64 `json:"contestedArea,omitempty"` // fraction of the grid claimed by ContestedMinOwners or more owners, with EnableContested
+}
+
+// summarizeServers tallies every server of the world from a marker snapshot, servers without
+// claims are included. The dominant tribe has the most claims, ties go to the lowest ID, and like
+// /api/stats only its ID honors opt outs
+func summarizeServers(markers []Marker, optOut map[uint64]bool) []ServerSummary {
+	var contested map[GridID]float64
+	if config.EnableContested {
+		contested = gridContestedAreas(markers)
+	}
+	type tally struct {
+		claims int
+		tribes map[uint64]int
+	}
+	tallies := make(map[GridID]*tally)
+	for _, marker := range markers {
+		if marker.markerType != MarkerLand && marker.markerType != MarkerWater {
+			continue
+		}
+		grid := GridID{X: marker.serverX, Y: marker.serverY}
+		t, ok := tallies[grid]
+		if !ok {
+			t = &tally{tribes: make(map[uint64]int)}
+			tallies[grid] = t
+		}
+		t.claims++
+		if isTribeID(marker.tribeOrOwnerID) {
+			t.tribes[marker.tribeOrOwnerID]++
+		}
+	}
+
+	summaries := make([]ServerSummary, 0, config.ServersX*config.ServersY)
+	for x := 0; x < config.ServersX; x++ {
+		for y := 0; y < config.ServersY; y++ {
+			summary := ServerSummary{ID: x<<16 | y, X: x, Y: y, ContestedArea: contested[GridID{X: x, Y: y}]}
+			if t, ok := tallies[GridID{X: x, Y: y}]; ok {
+				summary.Claims = t.claims
+				summary.Tribes = len(t.tribes)
+				var dominant uint64
+				for id, count := range t.tribes {
+					if count > summary.DominantTribeClaims || (count == summary.DominantTribeClaims && id < dominant) {
+						dominant, summary.DominantTribeClaims = id, count
+					}
+				}
+				if !optOut[dominant] {
+					summary.DominantTribeID = dominant
+				}
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries
+}
+
+// serversHandler serves GET /api/servers
+func serversHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	result := latestGeneration()
+	if result == nil || result.Servers == nil {
+		writeError(w, r, http.StatusNotFound, "no server summaries available yet")
+		return
+	}
+	etag := fmt.Sprintf(`"%08x"`, result.CRC)
+
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", etag)
+	setGenerationHeader(w, result)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result.Servers)
+}
@@ -0,0 +1,71 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServersSummarizesEachServer(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	const first, second, hidden, player = 1000050001, 1000050002, 1000050003, 42
+	seed := func(grid GridID, owner uint64, n int) {
+		// each owner on its own row so no two claims are the same set member
+		for i := 0; i < n; i++ {
+			addClaim(t, client, grid, owner, float64(i+1)/float64(n+1), float64(owner%10+1)/10, MarkerLand)
+		}
+	}
+	// players count as claims but not tribes
+	seed(GridID{X: 0, Y: 0}, first, 3)
+	seed(GridID{X: 0, Y: 0}, second, 2)
+	seed(GridID{X: 0, Y: 0}, player, 1)
+	// a tie goes to the lower ID
+	seed(GridID{X: 1, Y: 0}, second, 2)
+	seed(GridID{X: 1, Y: 0}, first, 2)
+	// an opted out tribe still counts, but isn't named
+	seed(GridID{X: 0, Y: 1}, hidden, 3)
+	seed(GridID{X: 0, Y: 1}, second, 1)
+	client.SAdd("territory_optout", hidden)
+	startGameWorker(t, client)
+
+	handler := newHTTPHandler(nil)
+	w := getGenerated(t, handler, "/api/servers")
+	var got []ServerSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ServerSummary{
+		{ID: 0, X: 0, Y: 0, Claims: 6, Tribes: 2, DominantTribeID: first, DominantTribeClaims: 3},
+		{ID: 1, X: 0, Y: 1, Claims: 4, Tribes: 2, DominantTribeClaims: 3},
+		{ID: 1 << 16, X: 1, Y: 0, Claims: 4, Tribes: 2, DominantTribeID: first, DominantTribeClaims: 2},
+		{ID: 1<<16 | 1, X: 1, Y: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("/api/servers\n%+v\nwant\n%+v", got, want)
+	}
+
+	// unchanged claims revalidate
+	r := httptest.NewRequest(http.MethodGet, "/api/servers", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("revalidation answered %d, want 304", w.Code)
+	}
+}
+
+func TestServersBeforeTheFirstGeneration(t *testing.T) {
+	useTestConfig(t, nil)
+	currentGeneration.Store((*GenerationResult)(nil))
+	w := httptest.NewRecorder()
+	newHTTPHandler(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/servers", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("answered %d before any generation, want 404", w.Code)
+	}
+}
@@ -0,0 +1,130 @@
+package territory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// sharedTribeColors mirrors the SharedTribeColorsKey hash of tribe ID -> "#rrggbb", the map is
+// replaced whole on every sync and never modified
+var sharedTribeColors = struct {
+	sync.Mutex
+	byTribe map[uint64]color.NRGBA
+	crc     uint32 // of the last successful sync
+}{}
+
+// sharedTribeColor is the tribe's shared color, ok is false when it has none yet
+func sharedTribeColor(tribeID uint64) (color.NRGBA, bool) {
+	sharedTribeColors.Lock()
+	c, ok := sharedTribeColors.byTribe[tribeID]
+	sharedTribeColors.Unlock()
+	return c, ok
+}
+
+func formatHexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func parseHexColor(value string) (color.NRGBA, bool) {
+	var c color.NRGBA
+	if len(value) != 7 || value[0] != '#' {
+		return c, false
+	}
+	rgb, err := strconv.ParseUint(value[1:], 16, 32)
+	if err != nil {
+		return c, false
+	}
+	return color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}, true
+}
+
+// syncSharedTribeColors reads the shared assignments and assigns the tribes of markers that have
+// none yet, each with the color this instance would pick. HSETNX lets the first instance to write
+// a tribe win and the winners are read back, so every instance ends up with the same colors. The
+// returned CRC covers the assignments of the markers' tribes so tiles regenerate when they change
+func syncSharedTribeColors(client *redis.Client, markers []Marker) (uint32, error) {
+	key := config.SharedTribeColorsKey
+	values, err := client.HGetAll(key).Result()
+	if err != nil {
+		return 0, classify(ErrTransient, "fetch", err)
+	}
+	byTribe := make(map[uint64]color.NRGBA, len(values))
+	for field, value := range values {
+		tribeID, err := strconv.ParseUint(field, 10, 64)
+		if c, ok := parseHexColor(value); err == nil && ok {
+			byTribe[tribeID] = c
+		}
+	}
+
+	var tribes []uint64
+	seen := make(map[uint64]bool)
+	for _, marker := range markers {
+		if id := marker.tribeOrOwnerID; isTribeID(id) && !seen[id] {
+			seen[id] = true
+			tribes = append(tribes, id)
+		}
+	}
+	sort.Slice(tribes, func(i, j int) bool { return tribes[i] < tribes[j] })
+
+	var missing []uint64
+	for _, tribeID := range tribes {
+		if _, ok := byTribe[tribeID]; !ok {
+			missing = append(missing, tribeID)
+		}
+	}
+	if len(missing) > 0 {
+		pipe := client.Pipeline()
+		for _, tribeID := range missing {
+			pipe.HSetNX(key, strconv.FormatUint(tribeID, 10), formatHexColor(localTribeColor(tribeID)))
+		}
+		reads := make([]*redis.StringCmd, len(missing))
+		for i, tribeID := range missing {
+			reads[i] = pipe.HGet(key, strconv.FormatUint(tribeID, 10))
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return 0, classify(ErrTransient, "publish", err)
+		}
+		for i, tribeID := range missing {
+			if c, ok := parseHexColor(reads[i].Val()); ok {
+				byTribe[tribeID] = c
+			}
+		}
+	}
+
+	hash := crc32.NewIEEE()
+	for _, tribeID := range tribes {
+		c := byTribe[tribeID]
+		binary.Write(hash, binary.LittleEndian, tribeID)
+		hash.Write([]byte{c.R, c.G, c.B})
+	}
+
+	sharedTribeColors.Lock()
+	sharedTribeColors.byTribe = byTribe
+	sharedTribeColors.crc = hash.Sum32()
+	sharedTribeColors.Unlock()
+	return hash.Sum32(), nil
+}
+
+// withSharedTribeColors syncs the shared colors for a snapshot and folds them into its CRC, a
+// failed sync keeps the previous colors and CRC. The CRC is unchanged with SharedTribeColorsKey unset
+func withSharedTribeColors(client *redis.Client, markers []Marker, crc uint32) uint32 {
+	if len(config.SharedTribeColorsKey) == 0 {
+		return crc
+	}
+	colorsCrc, err := syncSharedTribeColors(client, markers)
+	if err != nil {
+		recordError(err)
+		log.Printf("Warning! Failed to sync shared tribe colors: %v", err)
+		sharedTribeColors.Lock()
+		colorsCrc = sharedTribeColors.crc
+		sharedTribeColors.Unlock()
+	}
+	return combineCrcs(crc, colorsCrc)
+}
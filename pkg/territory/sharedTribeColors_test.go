@@ -0,0 +1,124 @@
+package territory
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+// colorInstance is one instance sharing tribe colors, with its own color mode and its own copy
+// of the shared assignments
+type colorInstance struct {
+	mode    string
+	byTribe map[uint64]color.NRGBA
+	crc     uint32
+}
+
+// sync runs an instance's sync of the markers' tribes and returns the CRC it folds into the snapshot
+func (i *colorInstance) sync(t *testing.T, client *redis.Client, markers []Marker) uint32 {
+	t.Helper()
+	i.as(func() {
+		var err error
+		if i.crc, err = syncSharedTribeColors(client, markers); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return i.crc
+}
+
+// as runs fn with the instance's color mode and shared colors installed and keeps what fn changed
+func (i *colorInstance) as(fn func()) {
+	config.TribeColorMode = i.mode
+	sharedTribeColors.Lock()
+	sharedTribeColors.byTribe, sharedTribeColors.crc = i.byTribe, i.crc
+	sharedTribeColors.Unlock()
+	fn()
+	sharedTribeColors.Lock()
+	i.byTribe, i.crc = sharedTribeColors.byTribe, sharedTribeColors.crc
+	sharedTribeColors.Unlock()
+}
+
+func (i *colorInstance) color(tribeID uint64) (c color.NRGBA) {
+	i.as(func() { c = getTribeColor(tribeID) })
+	return c
+}
+
+func useSharedTribeColors(t *testing.T) {
+	t.Helper()
+	useTestConfig(t, func(cfg *Configuration) { cfg.SharedTribeColorsKey = "territory_tribe_colors" })
+	sharedTribeColors.Lock()
+	byTribe, crc := sharedTribeColors.byTribe, sharedTribeColors.crc
+	sharedTribeColors.Unlock()
+	t.Cleanup(func() {
+		sharedTribeColors.Lock()
+		sharedTribeColors.byTribe, sharedTribeColors.crc = byTribe, crc
+		sharedTribeColors.Unlock()
+	})
+}
+
+func TestTwoInstancesAgreeOnTribeColors(t *testing.T) {
+	useSharedTribeColors(t)
+	_, client := newTestRedis(t)
+	const early, late = 1000050001, 1000050002
+	// the instances would pick different colors on their own
+	a, b := &colorInstance{mode: TribeColorPalette}, &colorInstance{mode: TribeColorHash}
+	if local := (&colorInstance{mode: TribeColorHash}).color(early); local == a.color(early) {
+		t.Fatalf("both modes pick %v, the test needs instances that disagree", local)
+	}
+
+	// a sees the early tribe first and assigns it
+	a.sync(t, client, []Marker{{tribeOrOwnerID: early}})
+	earlyColor := a.color(early)
+	if earlyColor != colorValues[colors[early%uint64(len(colors))]] {
+		t.Errorf("a assigned %v, want its palette color", earlyColor)
+	}
+	// b takes a's color for it and assigns the late tribe
+	bCrc := b.sync(t, client, []Marker{{tribeOrOwnerID: early}, {tribeOrOwnerID: late}})
+	if got := b.color(early); got != earlyColor {
+		t.Errorf("b colors the early tribe %v, a %v", got, earlyColor)
+	}
+	lateColor := b.color(late)
+	if lateColor != hashTribeColor(late) {
+		t.Errorf("b assigned %v, want its hash color", lateColor)
+	}
+	// and a picks that up on its next sync
+	if aCrc := a.sync(t, client, []Marker{{tribeOrOwnerID: early}, {tribeOrOwnerID: late}}); aCrc != bCrc {
+		t.Errorf("the instances' color CRCs differ, %08x and %08x", aCrc, bCrc)
+	}
+	if got := a.color(late); got != lateColor {
+		t.Errorf("a colors the late tribe %v, b %v", got, lateColor)
+	}
+	stored := client.HGetAll("territory_tribe_colors").Val()
+	if len(stored) != 2 || stored["1000050001"] != formatHexColor(earlyColor) || stored["1000050002"] != formatHexColor(lateColor) {
+		t.Errorf("redis holds %v", stored)
+	}
+
+	// a changed assignment changes the CRC so tiles are redrawn
+	client.HSet("territory_tribe_colors", "1000050002", "#123456")
+	if crc := a.sync(t, client, []Marker{{tribeOrOwnerID: early}, {tribeOrOwnerID: late}}); crc == bCrc {
+		t.Errorf("reassigning a color kept the CRC")
+	}
+	if got := a.color(late); got != (color.NRGBA{0x12, 0x34, 0x56, 0xff}) {
+		t.Errorf("late tribe is %v after reassigning it", got)
+	}
+}
+
+func TestSharedTribeColorsSurviveRedisFailures(t *testing.T) {
+	useSharedTribeColors(t)
+	useLogBuffer(t)
+	server, client := newTestRedis(t)
+	const tribe = 1000050001
+	markers := []Marker{{tribeOrOwnerID: tribe}}
+	crc := withSharedTribeColors(client, markers, 7)
+	assigned := getTribeColor(tribe)
+
+	client.HSet("territory_tribe_colors", "1000050001", "#123456")
+	server.SetError("LOADING redis is loading the dataset")
+	if got := withSharedTribeColors(client, markers, 7); got != crc {
+		t.Errorf("failed sync CRC %08x, want the previous %08x", got, crc)
+	}
+	if got := getTribeColor(tribe); got != assigned {
+		t.Errorf("failed sync changed the color to %v", got)
+	}
+}
@@ -0,0 +1,40 @@
+package territory
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-redis/redis"
+)
+
+// runStartupChecks connects to each redis and to the S3 bucket so bad hosts or credentials
+// fail at startup instead of on the first generation cycle
+func runStartupChecks(clients map[string]*redis.Client) error {
+	var names []string
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := clients[name].Ping().Err(); err != nil {
+			return fmt.Errorf("redis %s: %v", name, err)
+		}
+		log.Printf("Startup check: redis %s OK", name)
+	}
+
+	// S3 upload is disabled without an access id
+	if len(config.AtlasS3AccessID) == 0 {
+		return nil
+	}
+	svc, err := newS3Client()
+	if err != nil {
+		return fmt.Errorf("S3: %v", err)
+	}
+	if _, err := svc.HeadBucket(&s3.HeadBucketInput{Bucket: &config.AtlasS3BucketName}); err != nil {
+		return fmt.Errorf("S3 bucket %s: %v", config.AtlasS3BucketName, err)
+	}
+	log.Printf("Startup check: S3 bucket %s OK", config.AtlasS3BucketName)
+	return nil
+}
@@ -0,0 +1,38 @@
+package territory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestStartupChecks(t *testing.T) {
+	useTestConfig(t, nil)
+	_, defaultDB := newTestRedis(t)
+	territoryServer, territoryDB := newTestRedis(t)
+	clients := map[string]*redis.Client{"Default": defaultDB, "TerritoryDB": territoryDB}
+
+	// without S3 only redis is checked
+	if err := runStartupChecks(clients); err != nil {
+		t.Fatalf("checks failed with both redis up: %v", err)
+	}
+
+	fake := useFakeS3(t)
+	if err := runStartupChecks(clients); err != nil {
+		t.Fatalf("checks failed with the bucket there: %v", err)
+	}
+	if fake.heads != 1 {
+		t.Errorf("%d HEAD requests, want the bucket checked once", fake.heads)
+	}
+
+	fake.noBucket = true
+	if err := runStartupChecks(clients); err == nil || !strings.Contains(err.Error(), "S3 bucket bucket") {
+		t.Errorf("missing bucket gave %v, want an error naming it", err)
+	}
+
+	territoryServer.Close()
+	if err := runStartupChecks(clients); err == nil || !strings.HasPrefix(err.Error(), "redis TerritoryDB") {
+		t.Errorf("unreachable redis gave %v, want an error naming TerritoryDB", err)
+	}
+}
@@ -0,0 +1,227 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateStoreVersion is the StateFile format, files without a version are the legacy GenerationState
+const stateStoreVersion = 1
+
+// StateStore keeps small pieces of state across restarts as JSON values under namespaced keys.
+// A missing key isn't an error, Get reports it with ok false and consumers use their defaults
+type StateStore interface {
+	Get(namespace, key string, value interface{}) (ok bool, err error)
+	Set(namespace, key string, value interface{}) error
+	Delete(namespace, key string) error
+	// Iterate calls fn for every key of the namespace in key order, stopping at its first error
+	Iterate(namespace string, fn func(key string, value json.RawMessage) error) error
+}
+
+// stateStore is the process' state, in memory only until openStateStore replaces it at startup
+var stateStore StateStore = newFileStateStore("", nil)
+
+// stateFileContents is the StateFile on disk
+type stateFileContents struct {
+	Version int                                   `json:"version"`
+	Entries map[string]map[string]json.RawMessage `json:"entries"` // namespace -> key -> value
+}
+
+// fileStateStore keeps every entry in memory and rewrites its file atomically on every change,
+// the state is a few KB. An empty filename keeps the state in memory only
+type fileStateStore struct {
+	sync.Mutex
+	filename string
+	entries  map[string]map[string]json.RawMessage
+}
+
+func newFileStateStore(filename string, entries map[string]map[string]json.RawMessage) *fileStateStore {
+	if entries == nil {
+		entries = make(map[string]map[string]json.RawMessage)
+	}
+	return &fileStateStore{filename: filename, entries: entries}
+}
+
+// openStateStore opens the StateFile for the server. A legacy file is migrated and rewritten in
+// the current format, keeping the original as .legacy. A file that can't be read is moved aside
+// as .corrupt-<time> and the server starts with empty state rather than not starting at all
+func openStateStore(filename string) StateStore {
+	if len(filename) == 0 {
+		return newFileStateStore("", nil)
+	}
+	entries, legacy, err := readStateFile(filename)
+	if err != nil {
+		quarantined := fmt.Sprintf("%s.corrupt-%s", filename, time.Now().UTC().Format("20060102T150405Z"))
+		if renameErr := os.Rename(filename, quarantined); renameErr != nil {
+			log.Printf("Error! state file %s is unreadable (%v) and couldn't be moved aside: %v, starting with empty state", filename, err, renameErr)
+		} else {
+			log.Printf("Error! state file %s is unreadable (%v), moved it to %s and starting with empty state", filename, err, quarantined)
+		}
+		return newFileStateStore(filename, nil)
+	}
+
+	store := newFileStateStore(filename, entries)
+	if legacy {
+		if err := copyFile(filename, filename+".legacy"); err != nil {
+			log.Printf("Warning! couldn't keep a copy of the legacy state file %s: %v", filename, err)
+		}
+		store.Lock()
+		err := store.save()
+		store.Unlock()
+		if err != nil {
+			log.Printf("Warning! couldn't rewrite the legacy state file %s: %v", filename, err)
+		} else {
+			log.Printf("Migrated legacy state file %s, the original is kept as %s.legacy", filename, filename)
+		}
+	}
+	return store
+}
+
+// loadStateStore reads the StateFile without changing it, for tools inspecting a running
+// server's state. The returned store is in memory only
+func loadStateStore(filename string) (StateStore, error) {
+	entries, _, err := readStateFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStateStore("", entries), nil
+}
+
+// readStateFile reads a state file, migrating the legacy format in memory. A missing file is
+// empty state
+func readStateFile(filename string) (entries map[string]map[string]json.RawMessage, legacy bool, err error) {
+	js, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var contents stateFileContents
+	if err := json.Unmarshal(js, &contents); err != nil {
+		return nil, false, err
+	}
+	switch contents.Version {
+	case stateStoreVersion:
+		return contents.Entries, false, nil
+	case 0:
+		entries, err := migrateLegacyState(js)
+		return entries, true, err
+	default:
+		return nil, false, fmt.Errorf("unknown state file version %d", contents.Version)
+	}
+}
+
+// migrateLegacyState converts the GenerationState the StateFile used to hold
+func migrateLegacyState(js []byte) (map[string]map[string]json.RawMessage, error) {
+	var legacy GenerationState
+	if err := json.Unmarshal(js, &legacy); err != nil {
+		return nil, err
+	}
+	store := newFileStateStore("", nil)
+	if err := store.Set("generation", "zooms", generationZooms{SettingsHash: legacy.SettingsHash, ZoomCrcs: legacy.ZoomCrcs}); err != nil {
+		return nil, err
+	}
+	if len(legacy.Artifacts) > 0 {
+		if err := store.Set("generation", "artifacts", legacy.Artifacts); err != nil {
+			return nil, err
+		}
+	}
+	return store.entries, nil
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, data, 0600)
+}
+
+func (s *fileStateStore) Get(namespace, key string, value interface{}) (bool, error) {
+	s.Lock()
+	raw, ok := s.entries[namespace][key]
+	s.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return false, fmt.Errorf("state %s/%s: %v", namespace, key, err)
+	}
+	return true, nil
+}
+
+func (s *fileStateStore) Set(namespace, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("state %s/%s: %v", namespace, key, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if existing, ok := s.entries[namespace][key]; ok && string(existing) == string(raw) {
+		return nil
+	}
+	if s.entries[namespace] == nil {
+		s.entries[namespace] = make(map[string]json.RawMessage)
+	}
+	s.entries[namespace][key] = raw
+	return s.save()
+}
+
+func (s *fileStateStore) Delete(namespace, key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[namespace][key]; !ok {
+		return nil
+	}
+	delete(s.entries[namespace], key)
+	if len(s.entries[namespace]) == 0 {
+		delete(s.entries, namespace)
+	}
+	return s.save()
+}
+
+func (s *fileStateStore) Iterate(namespace string, fn func(key string, value json.RawMessage) error) error {
+	// fn runs on a copy so it can use the store
+	s.Lock()
+	values := make(map[string]json.RawMessage, len(s.entries[namespace]))
+	keys := make([]string, 0, len(s.entries[namespace]))
+	for key, raw := range s.entries[namespace] {
+		values[key] = raw
+		keys = append(keys, key)
+	}
+	s.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save atomically rewrites the file, the caller holds the lock
+func (s *fileStateStore) save() error {
+	if len(s.filename) == 0 {
+		return nil
+	}
+	js, err := json.MarshalIndent(stateFileContents{Version: stateStoreVersion, Entries: s.entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFilename := path.Join(path.Dir(s.filename), tempFileName("tmp_", ".json"))
+	if err = ioutil.WriteFile(tmpFilename, js, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFilename, s.filename); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateStoreKeepsValuesAcrossReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	store := openStateStore(filename)
+	var missing string
+	if ok, err := store.Get("owners", "1", &missing); ok || err != nil {
+		t.Errorf("Get of a missing key returned %v, %v", ok, err)
+	}
+	for key, value := range map[string]string{"b": "second", "a": "first", "c": "third"} {
+		if err := store.Set("owners", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Set("other", "a", 1)
+	if err := store.Delete("owners", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("owners", "missing"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	reopened := openStateStore(filename)
+	var keys []string
+	reopened.Iterate("owners", func(key string, value json.RawMessage) error {
+		var s string
+		json.Unmarshal(value, &s)
+		keys = append(keys, key+"="+s)
+		return nil
+	})
+	if want := []string{"a=first", "b=second"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("reopened store iterates %v, want %v", keys, want)
+	}
+	var wrongType int
+	if ok, err := reopened.Get("owners", "a", &wrongType); ok || err == nil {
+		t.Errorf("Get into the wrong type returned %v, %v, want an error", ok, err)
+	}
+}
+
+func TestStateStoreMigratesLegacyFile(t *testing.T) {
+	buf := useLogBuffer(t)
+	filename := filepath.Join(t.TempDir(), "state.json")
+	generatedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	legacy := GenerationState{
+		SettingsHash: 42,
+		ZoomCrcs:     map[uint]uint32{0: 7, 1: 7},
+		Artifacts:    map[string]ArtifactMeta{"gameTiles/world.map": {GeneratedAt: generatedAt, CheckedAt: generatedAt, CRC: 7}},
+	}
+	js, _ := json.Marshal(legacy)
+	if err := ioutil.WriteFile(filename, js, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// tools reading a running server's state don't migrate it
+	if _, err := loadStateStore(filename); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := ioutil.ReadFile(filename); string(unchanged) != string(js) {
+		t.Errorf("loadStateStore rewrote the legacy file")
+	}
+
+	store := openStateStore(filename)
+	state, ok := readGenerationState(store)
+	if !ok || state.SettingsHash != 42 || !reflect.DeepEqual(state.ZoomCrcs, legacy.ZoomCrcs) || !reflect.DeepEqual(state.Artifacts, legacy.Artifacts) {
+		t.Errorf("migrated state %+v, want %+v", state, legacy)
+	}
+	if kept, _ := ioutil.ReadFile(filename + ".legacy"); string(kept) != string(js) {
+		t.Errorf("the legacy file wasn't kept as .legacy")
+	}
+	var contents stateFileContents
+	rewritten, _ := ioutil.ReadFile(filename)
+	if err := json.Unmarshal(rewritten, &contents); err != nil || contents.Version != stateStoreVersion {
+		t.Errorf("the state file wasn't rewritten in version %d: %s", stateStoreVersion, rewritten)
+	}
+	if !strings.Contains(buf.String(), "Migrated legacy state file") {
+		t.Errorf("the migration wasn't logged:\n%s", buf.String())
+	}
+
+	// the second start reads the migrated file as is
+	buf.Reset()
+	state, _ = readGenerationState(openStateStore(filename))
+	if state.SettingsHash != 42 || strings.Contains(buf.String(), "Migrated") {
+		t.Errorf("reopening the migrated file got %+v and logged %s", state, buf.String())
+	}
+}
+
+func TestStateStoreQuarantinesCorruptFile(t *testing.T) {
+	for name, contents := range map[string]string{
+		"truncated":       `{"version": 1, "entries": {"generation": {`,
+		"unknown version": `{"version": 99, "entries": {}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := useLogBuffer(t)
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "state.json")
+			if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			store := openStateStore(filename)
+			if state, ok := readGenerationState(store); ok {
+				t.Errorf("a corrupt file gave state %+v, want a fresh start", state)
+			}
+			quarantined, _ := filepath.Glob(filepath.Join(dir, "state.json.corrupt-*"))
+			if len(quarantined) != 1 {
+				t.Fatalf("quarantined files %v, want 1", quarantined)
+			}
+			if kept, _ := ioutil.ReadFile(quarantined[0]); string(kept) != contents {
+				t.Errorf("the quarantined file holds %q, want the corrupt contents", kept)
+			}
+			if !strings.Contains(buf.String(), "Error! state file") || !strings.Contains(buf.String(), "starting with empty state") {
+				t.Errorf("the quarantine wasn't logged loudly:\n%s", buf.String())
+			}
+
+			// the fresh store still saves
+			if err := store.Set("generation", "zooms", generationZooms{SettingsHash: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if state, ok := readGenerationState(openStateStore(filename)); !ok || state.SettingsHash != 1 {
+				t.Errorf("state after the fresh start %+v", state)
+			}
+		})
+	}
+
+	if _, err := loadStateStore(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("a missing state file is an error: %v", err)
+	}
+}
+
+// TestStateStoreConcurrentAccess saves from workers while handlers read the state, run with -race
+func TestStateStoreConcurrentAccess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	useTestConfig(t, func(cfg *Configuration) { cfg.StateFile = filename })
+	useArtifactMeta(t)
+	previous := stateStore
+	t.Cleanup(func() { stateStore = previous })
+	stateStore = openStateStore(filename)
+	handler := newHTTPHandler(nil)
+
+	const writers, writes = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				stateStore.Set(fmt.Sprintf("worker%d", w), fmt.Sprintf("%03d", i), i)
+				if i%10 == 0 {
+					stateStore.Delete(fmt.Sprintf("worker%d", w), fmt.Sprintf("%03d", i))
+				}
+				setArtifactMeta(fmt.Sprintf("gameTiles/%d.map", w), uint32(i))
+				saveGenerationState(nil)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			stateStore.Iterate("worker0", func(string, json.RawMessage) error { return nil })
+			readGenerationState(stateStore)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+		}
+	}()
+	wg.Wait()
+
+	reopened := openStateStore(filename)
+	for w := 0; w < writers; w++ {
+		n := 0
+		reopened.Iterate(fmt.Sprintf("worker%d", w), func(string, json.RawMessage) error {
+			n++
+			return nil
+		})
+		if want := writes - writes/10; n != want {
+			t.Errorf("worker%d has %d keys in the file, want %d", w, n, want)
+		}
+	}
+	state, _ := readGenerationState(reopened)
+	if len(state.Artifacts) != writers {
+		t.Errorf("the file has %d artifacts, want %d", len(state.Artifacts), writers)
+	}
+	if leftovers := tmpFilesUnder(t, filepath.Dir(filename)); len(leftovers) != 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
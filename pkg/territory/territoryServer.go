@@ -0,0 +1,2207 @@
+package territory
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GrapeshotGames/goquadtree/quadtree"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/go-redis/redis"
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+const (
+	MarkerLand  uint8 = 0
+	MarkerWater uint8 = 1
+)
+
+// Marker represents a territory flag roughly as stored in redis
+type Marker struct {
+	serverX        int // from redis key which is serverId
+	serverY        int // from redis key which is serverId
+	tribeOrOwnerID uint64
+	relX           float64 // uint16 in redis
+	relY           float64 // uint16 in redis
+	markerType     uint8
+	UnusedExtra1   uint8
+	UnusedExtra2   uint8
+	UnusedExtra    uint8
+}
+
+// EntityInfo represents Marker / Entity relationship
+type EntityInfo struct {
+	entityID uint64
+	parentID uint64
+	marker   Marker
+}
+
+// ClaimFlagOutputEntry for saving compressed file out
+type ClaimFlagOutputEntry struct {
+	X, Y uint16
+}
+
+// FlagOwnerOutputHeader for saving compressed file out
+type FlagOwnerOutputHeader struct {
+	TribeOrPlayerID uint64
+	LandClaims      []ClaimFlagOutputEntry
+	WaterClaims     []ClaimFlagOutputEntry
+	Color           color.NRGBA // written in the v3 color table
+	//ServerIdx uint16 (10 bits)
+	//ExtraFlags? (4 bits)
+}
+
+// ByTribeOrPlayerID implements sort.Interface for []FlagOwnerOutputHeader based on the TribeOrPlayerID field.
+type ByTribeOrPlayerID []FlagOwnerOutputHeader
+
+func (a ByTribeOrPlayerID) Len() int           { return len(a) }
+func (a ByTribeOrPlayerID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByTribeOrPlayerID) Less(i, j int) bool { return a[i].TribeOrPlayerID < a[j].TribeOrPlayerID }
+
+// VirtualBounds represents marker in virtual coordinates for quad tree
+type VirtualBounds struct {
+	x      float64
+	y      float64
+	radius float64
+	marker Marker
+}
+
+// BoundingBox for quadtree.BoundingBoxer interface
+func (v VirtualBounds) BoundingBox() quadtree.BoundingBox {
+	return quadtree.BoundingBox{
+		MinX: v.x - v.radius,
+		MaxX: v.x + v.radius,
+		MinY: v.y - v.radius,
+		MaxY: v.y + v.radius,
+	}
+}
+
+// RedisConfiguration holds Atlas database configuration
+type RedisConfiguration struct {
+	Name         string
+	URL          string
+	Port         int
+	Password     string
+	PasswordFile string // Optional file re-read on every connect for rotating credentials
+	Username     string // Optional ACL user, AUTH sends only the password when empty
+}
+
+// Configuration holds applicaiton configuration
+type Configuration struct {
+	EnableTileGeneration       bool                 // Turn on/off generation for web page
+	EnableGameGeneration       bool                 // Turn on/off generation for game
+	EnableTopTribes            bool                 // Turn on/off generation of top 10 tribe generation
+	Host                       string               // Host adapter for http listen
+	Port                       uint16               // Port for http listen
+	AlternativeURL             string               // Alternative URL (e.g. S3) for game and web viewer, shorthand for a single AlternativeURLs entry
+	WWWDir                     string               // Directory holding generated images
+	FetchRateInSeconds         int                  // Polling rate
+	DatabaseConnections        []RedisConfiguration // Databases config
+	ServersX                   int                  // Number of servers in X dim
+	ServersY                   int                  // Number of servers in Y dim
+	GameSize                   int                  // Number of pixels for in-game images
+	TileSize                   int                  // Number of pixels per tile
+	MaxZoom                    uint                 // Maxium zoom level
+	GridSize                   float64              // UE Coordinate range per server
+	LandRadiusUE               float64              // UE radius of land marker
+	WaterRadiusUE              float64              // UE radius of water marker
+	CircleAlpha                uint8                // Alpha value for circles 0-100%
+	AtlasS3URL                 string               // Alternative S3 URL for something like Minio
+	AtlasS3Region              string               // AWS lib needs a region, no default?
+	AtlasS3AccessID            string               // AWS access id, if empty disables S3 upload
+	AtlasS3SecretKey           string               // AWS Secret key
+	AtlasS3BucketName          string               // AWS S3 bucket name
+	AtlasS3KeyPrefix           string               // AWS SE key prefix
+	AtlasS3StorageClass        string               // AWS S3 storage class, empty for the bucket default (STANDARD)
+	AtlasS3StorageClasses      map[string]string    // Output kind (territoryTiles, gameTiles) -> storage class override
+	EnableClaimTrend           bool                 // Tint tribe claims by growth/shrink since the previous generation
+	ClaimGrowthColor           string               // Color name growing tribes are tinted toward
+	ClaimShrinkColor           string               // Color name shrinking tribes are tinted toward
+	ClaimTrendMaxBlend         float64              // Maximum blend toward the trend color 0.0-1.0
+	OutboundCAFile             string               // Optional PEM bundle appended to the system cert pool for outbound HTTPS
+	OutboundTimeoutSeconds     int                  // Timeout for outbound HTTP requests
+	InsecureSkipVerify         bool                 // Disable outbound TLS verification (debug only)
+	DropZeroPositionMarkers    bool                 // Drop markers at exactly grid origin when the owner has others in the grid
+	ZeroPositionQuarantineFile string               // Optional file the dropped raw payloads are appended to
+	ZoomSchedule               map[uint]int         // Zoom level -> generate every N cycles (default 1)
+	EnableHeatmap              bool                 // Turn on/off generation of the claims per server heatmap
+	HeatmapCellPixels          int                  // Number of pixels per server cell in the heatmap
+	MapFileVersion             uint16               // Force .map file version, 0 negotiates with territory_capabilities
+	EnableAccessLog            bool                 // Log every HTTP request with its request ID
+	ClaimOutlineOnly           bool                 // Render claims as rings (stroke only) instead of filled circles
+	ClaimOutlineWidth          float64              // Ring line width in pixels
+	AdminToken                 string               // Legacy single admin API token, named "admin"
+	AdminTokens                map[string]string    // Named admin API tokens, name is recorded in the audit log
+	AuditLogPath               string               // Admin action audit log (JSON lines), empty keeps memory only
+	AuditLogMaxBytes           int64                // Rotate the audit log once it reaches this size
+	AuditLogMaxFiles           int                  // Rotated audit logs kept, the oldest is removed beyond this
+	MaxDiffEntries             int                  // Cap on each list returned by /api/diff, 0 for no cap
+	MapIncludePlayerClaims     bool                 // Include player (non-tribe) and unowned claims in the .map export
+	StateFile                  string               // File persisting state across restarts, empty keeps it in memory
+	WarmBeforeServing          bool                 // Run the first generation cycle before serving HTTP, the port is bound first
+	OutOfRangeTransparentTiles bool                 // Serve a transparent tile instead of 404 for tiles outside the world
+	OpaqueClaims               bool                 // Draw solid claims, skipping the CircleAlpha mask
+	VerifyIntervalSeconds      int                  // Periodically check world.map against redis, 0 disables
+	MapMaxClaimsPerOwner       int                  // Cap on claims exported per owner in the .map, 0 for no cap
+	GameSizes                  []int                // Sizes to generate .map files for, GameSize is world.map and others are world_<size>.map
+	MapRotation                int                  // Clockwise rotation of tiles in degrees, multiple of 90
+	MapFlipHorizontal          bool                 // Mirror tiles left to right, applied before MapRotation
+	MapFlipVertical            bool                 // Mirror tiles top to bottom, applied before MapRotation
+	S3VerifyUploads            bool                 // HEAD each uploaded object and compare it with the local file
+	S3VerifySampleRate         float64              // Fraction of tile uploads verified, game outputs are always verified
+	S3VerifyRetries            int                  // Re-uploads of a mismatched object before giving up
+	EnableGeoJSON              bool                 // Export claims as gameTiles/claims.geojson for GIS tools
+	RenderOrder                string               // Claim draw order: "ownerID", "sizeDescending" (small owners on top) or "sizeAscending"
+	TribeCountPerServer        bool                 // Keep a per server breakdown of each tribe's claim count
+	StatsFields                []string             // Aggregates exposed by /api/stats
+	StatsExposeTopTribeID      bool                 // Allow largestTribeID in /api/stats when it's also in StatsFields
+	S3FailurePolicy            string               // "continue" logs failed uploads, "failCycle" retries the tile or game output next cycle
+	ActiveGrids                []string             // Packed server IDs (x<<16|y) to fetch, empty for the whole ServersX by ServersY world
+	GridDiscovery              bool                 // SCAN for territorymapdata keys and warn about ones not in ActiveGrids
+	GridDiscoveryAutoInclude   bool                 // Also fetch discovered in-world grids missing from ActiveGrids
+	BasePath                   string               // Path prefix for all routes and published URLs when behind a proxy, e.g. "/atlasmap"
+	StaleAfterSeconds          int                  // Age after which generated files are reported stale, 0 disables
+	PerCircleAlpha             bool                 // Blend each claim with CircleAlpha so overlaps show density, instead of one mask
+	ClaimAlphaCap              uint8                // Max accumulated alpha per pixel with PerCircleAlpha, 255 for no cap
+	MaxConcurrentRenders       int                  // On-demand renders run at once, 0 for half the CPUs
+	RenderQueueSize            int                  // On-demand renders waiting for a slot before new ones are rejected
+	RenderQueueTimeoutSeconds  int                  // Longest an on-demand render waits for a slot
+	FetchBatchSize             int                  // Grids fetched per redis pipeline, 0 for all in one
+	EnableContested            bool                 // Overlay areas claimed by several owners
+	ContestedColor             string               // Color of contested areas
+	ContestedAlpha             uint8                // Opacity of the contested overlay
+	ContestedPattern           string               // "solid" or "hatch"
+	ContestedMinOwners         int                  // Distinct owners covering a pixel before it's contested
+	MapColorTable              bool                 // Include each owner's web color in v3 .map files
+	QuarantineDedupeCapacity   int                  // Quarantined payloads remembered to avoid writing them again
+	SmallClaimPolicy           string               // Claims with a radius under SmallClaimMinPixels: "dot" draws them at that size, "skip" leaves them out
+	SmallClaimMinPixels        float64              // Smallest claim radius in image pixels
+	Regions                    []RegionConfig       // Named grid rectangles rendered as their own tile trees under territoryTiles/regions/
+	StartupChecks              bool                 // PING redis and HEAD the S3 bucket before starting, exiting on failure
+	GameArtifactAccess         GameAccessConfig     // IP allowlist and/or shared key required for /gameTiles/
+	MapCoverage                bool                 // Include a GameSize/4 ownership raster in v3 .map files
+	EnableFog                  bool                 // Darken tiles everywhere further than FogRadiusUE from a claim
+	FogColor                   string               // Color of the fog
+	FogAlpha                   uint8                // Opacity of the fog
+	FogRadiusUE                float64              // Distance from a claim that stays clear, in UE units
+	CoincidentPolicy           string               // Owners with claims at the exact same position: "none", "offset" or "split"
+	CoincidentOffsetPixels     float64              // Distance each owner is moved with the offset policy
+	ZoomAdvisoryFraction       float64              // Share of FetchRateInSeconds tile generation should fit in before advising a smaller MaxZoom / ZoomSchedule, 0 disables
+	ZoomAdvisoryCycles         int                  // Consecutive cycles over that share before advising
+	AutoTuneZoom               bool                 // Apply the advice by deferring the deepest zooms to every Nth cycle
+	EnableTribeMasks           bool                 // Write a white on transparent PNG of each top tribe's claims under tribeMasks/
+	TribeMaskCount             int                  // Number of top tribes to write masks for
+	TribeMaskSize              int                  // Width and height of the masks in pixels
+	UploadCoalesceMillis       int                  // Minimum time between uploads of one file, uploads requested meanwhile collapse into one, 0 disables
+	TileCacheMB                int                  // Memory for serving hot tiles without touching disk, 0 disables
+	TileCachePrewarmZooms      []uint               // Zooms loaded into the tile cache after each generation
+	URLScheme                  string               // Scheme of published URLs, "http" or "https", ignored when AlternativeURL has one
+	LeaderLockKey              string               // Redis key instances sharing redis elect a single generator with, empty disables
+	LeaderLockTTLSeconds       int                  // How long the lock outlives its holder, followers take over within this
+	TileBoundsOnly             bool                 // Only generate the tiles around the claims' bounding box, tiles outside it are cleared once
+	TileBoundsMarginTiles      int                  // Tiles added around the bounding box on each side
+	ExportIntervalSeconds      int                  // Write the claims export to exports/claims.jsonl.gz this often, 0 disables
+	ExportAnonymize            bool                 // Leave owner names out of exports
+	TribeColorMode             string               // How tribe colors are picked: "palette" (by ID modulo the palette) or "hash" (hue from a hash of the ID)
+	TribeColorSaturation       float64              // Saturation of hash colors, 0-1
+	TribeColorValue            float64              // Value (brightness) of hash colors, 0-1
+	TransientRetries           int                  // Retries within a cycle of redis and S3 errors that may pass, 0 disables
+	TransientBackoffMillis     int                  // Wait before the first retry, doubled for each one after
+	ClaimColorBy               string               // Color claims by "owner" or by "markerType", the latter uses LandClaimColor / WaterClaimColor
+	LandClaimColor             string               // Color of land claims when coloring by marker type
+	WaterClaimColor            string               // Color of water claims when coloring by marker type
+	PosterMaxPixels            int                  // Largest poster width POST /admin/poster accepts
+	PosterStripPixels          int                  // Height of the strips posters are rendered in, bounds their memory
+	PosterQueueSize            int                  // Poster jobs waiting behind the running one before new ones are rejected
+	PosterBackground           string               // Optional image of the whole world drawn under poster claims
+	ClaimWeights               ClaimWeights         // Score of a claim of each marker type in tribe rankings, raw counts are kept alongside
+	RetainVersions             int                  // Newest versions kept of outputs written under a new name each time (posters), older ones are deleted locally and from S3, 0 keeps all
+	ClaimFalloff               string               // Claim fill: "none" for solid circles, "linear" or "smooth" to fade from the center to transparent at the radius
+	URLPublisherName           string               // Identifies our territory_urls writes, hostname:pid when empty. Set a stable name with "respect"
+	URLOwnershipPolicy         string               // When another publisher wrote territory_urls after us: "takeover" writes anyway, "respect" leaves it
+	LogBufferRecords           int                  // Recent log records kept in memory for GET /admin/logs, 0 disables
+	SharedTribeColorsKey       string               // Redis hash of tribe colors shared by every instance, the first to see a tribe assigns it. Empty keeps colors local
+	NotifyMinChangedMarkers    int                  // Changed markers needed before game servers are told the URLs changed, smaller changes are batched. 0 always notifies
+	NotifyMaxDelaySeconds      int                  // Notify anyway once the oldest batched change is this old, 0 waits for NotifyMinChangedMarkers
+	AlternativeURLs            []URLMirror          // Mirrors of the outputs, game servers are handed one by weight per generation or the whole list when they support it
+	PrimaryURL                 int                  // Index of the AlternativeURLs entry the web viewer and published artifact links use
+	StrictStartup              bool                 // Exit when the redis diagnostics at startup find a problem instead of logging them and starting anyway
+	URLRefreshIntervalSeconds  int                  // Re-publish territory_urls this often even when nothing changed, keeping publishedAt current. 0 disables
+	GridWarningEveryCycles     int                  // Repeat a failing grid's fetch warning as a summary every this many cycles, 0 only warns on the first failure
+	GridErrorAfterCycles       int                  // Escalate a grid failing this many consecutive cycles to an error and report /health degraded, 0 never escalates
+	ConcentrationBuckets       []int                // Scores /api/stats counts the owners above, each as ownersAbove<score>
+	MapCompression             string               // .map v4 body compression: "zlib" writes CompressionType 1, "none" CompressionType 0 for debugging, older versions are never compressed
+	FetchSchedule              string               // Cron expression ("minute hour day month weekday") the tile and game cycles run on instead of every FetchRateInSeconds, empty disables
+	ScheduleTimeZone           string               // IANA time zone FetchSchedule is evaluated in, e.g. "America/New_York", empty for UTC
+}
+
+// requiredDatabases are the DatabaseConnections names the server connects to: Default has the
+// game's server list and URLs, TerritoryDB the claims
+var requiredDatabases = []string{"Default", "TerritoryDB"}
+
+func (c *Configuration) getDatabaseByName(name string) (RedisConfiguration, error) {
+	for _, v := range c.DatabaseConnections {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return RedisConfiguration{}, fmt.Errorf("no DatabaseConnections entry named %q", name)
+}
+
+var config Configuration
+var colors = [...]string{
+	"red",
+	"green",
+	"yellow",
+	"blue",
+	"orange",
+	"purple",
+	"cyan",
+	"magenta",
+	"lime",
+	"pink",
+	"teal",
+	"lavender",
+	"brown",
+	"beige",
+	"maroon",
+	"olive",
+	"coral",
+	"navy",
+}
+var colorValues = map[string]color.NRGBA{
+	"black":    color.NRGBA{0x00, 0x00, 0x00, 0xff},
+	"grey":     color.NRGBA{0xa9, 0xa9, 0xa9, 0xff},
+	"red":      color.NRGBA{0xff, 0x00, 0x00, 0xff},
+	"green":    color.NRGBA{0x00, 0x80, 0x00, 0xff},
+	"yellow":   color.NRGBA{0xff, 0xff, 0x00, 0xff},
+	"blue":     color.NRGBA{0x00, 0x00, 0xff, 0xff},
+	"orange":   color.NRGBA{0xff, 0xa5, 0x00, 0xff},
+	"purple":   color.NRGBA{0x80, 0x00, 0x80, 0xff},
+	"cyan":     color.NRGBA{0x00, 0xff, 0xff, 0xff},
+	"magenta":  color.NRGBA{0xff, 0x00, 0xff, 0xff},
+	"lime":     color.NRGBA{0x00, 0xff, 0x00, 0xff},
+	"pink":     color.NRGBA{0xff, 0xc0, 0xcb, 0xff},
+	"teal":     color.NRGBA{0x00, 0x80, 0x80, 0xff},
+	"lavender": color.NRGBA{0xe6, 0xe6, 0xfa, 0xff},
+	"brown":    color.NRGBA{0xa5, 0x2a, 0x2a, 0xff},
+	"beige":    color.NRGBA{0xf5, 0xf5, 0xdc, 0xff},
+	"maroon":   color.NRGBA{0x80, 0x00, 0x00, 0xff},
+	"olive":    color.NRGBA{0x80, 0x80, 0x00, 0xff},
+	"coral":    color.NRGBA{0xff, 0x7f, 0x50, 0xff},
+	"navy":     color.NRGBA{0x00, 0x00, 0x80, 0xff},
+}
+
+func loadConfig(path string) (cfg Configuration, err error) {
+	var file *os.File
+
+	file, err = os.Open(path)
+	defer file.Close()
+	if err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(file)
+
+	cfg = Configuration{
+		EnableTileGeneration: false,
+		EnableGameGeneration: true,
+		EnableTopTribes:      false,
+		Host:                 "",
+		Port:                 8881,
+		AlternativeURL:       "",
+		WWWDir:               "./www",
+		FetchRateInSeconds:   15,
+		DatabaseConnections: []RedisConfiguration{
+			{
+				Name:     "Default",
+				URL:      "localhost",
+				Port:     6379,
+				Password: "foobared",
+			},
+			{
+				Name:     "TerritoryDB",
+				URL:      "localhost",
+				Port:     6379,
+				Password: "foobared",
+			},
+		},
+		ServersX:                   3,
+		ServersY:                   3,
+		GameSize:                   2048,
+		TileSize:                   256,
+		MaxZoom:                    7,
+		GridSize:                   1400000,
+		LandRadiusUE:               10000,
+		WaterRadiusUE:              21000,
+		CircleAlpha:                128,
+		AtlasS3URL:                 "",
+		AtlasS3Region:              "us-east-1",
+		AtlasS3AccessID:            "",
+		AtlasS3SecretKey:           "",
+		AtlasS3BucketName:          "",
+		AtlasS3KeyPrefix:           "",
+		AtlasS3StorageClass:        "",
+		AtlasS3StorageClasses:      map[string]string{},
+		EnableClaimTrend:           false,
+		ClaimGrowthColor:           "lime",
+		ClaimShrinkColor:           "maroon",
+		ClaimTrendMaxBlend:         0.5,
+		OutboundCAFile:             "",
+		OutboundTimeoutSeconds:     120,
+		InsecureSkipVerify:         false,
+		DropZeroPositionMarkers:    false,
+		ZeroPositionQuarantineFile: "",
+		ZoomSchedule:               map[uint]int{},
+		EnableHeatmap:              false,
+		HeatmapCellPixels:          32,
+		MapFileVersion:             0,
+		EnableAccessLog:            false,
+		ClaimOutlineOnly:           false,
+		ClaimOutlineWidth:          2,
+		AdminToken:                 "",
+		AdminTokens:                map[string]string{},
+		AuditLogPath:               "./audit.log",
+		AuditLogMaxBytes:           10 * 1024 * 1024,
+		AuditLogMaxFiles:           5,
+		MaxDiffEntries:             1000,
+		MapIncludePlayerClaims:     true,
+		StateFile:                  "./state.json",
+		WarmBeforeServing:          false,
+		OutOfRangeTransparentTiles: false,
+		OpaqueClaims:               false,
+		VerifyIntervalSeconds:      0,
+		MapMaxClaimsPerOwner:       0,
+		GameSizes:                  nil,
+		MapRotation:                0,
+		MapFlipHorizontal:          false,
+		MapFlipVertical:            false,
+		S3VerifyUploads:            false,
+		S3VerifySampleRate:         1,
+		S3VerifyRetries:            1,
+		EnableGeoJSON:              false,
+		RenderOrder:                RenderOrderOwnerID,
+		TribeCountPerServer:        false,
+		StatsFields:                []string{"totalClaims", "landClaims", "waterClaims", "tribeOwners", "playerOwners", "largestTribeClaims", "activeGrids", "generatedAt", "gini", "top1Share", "top5Share", "top10Share", "ownersAbove"},
+		StatsExposeTopTribeID:      false,
+		S3FailurePolicy:            S3FailureContinue,
+		ActiveGrids:                nil,
+		GridDiscovery:              false,
+		GridDiscoveryAutoInclude:   false,
+		BasePath:                   "",
+		StaleAfterSeconds:          0,
+		PerCircleAlpha:             false,
+		ClaimAlphaCap:              255,
+		MaxConcurrentRenders:       0,
+		RenderQueueSize:            16,
+		RenderQueueTimeoutSeconds:  10,
+		FetchBatchSize:             0,
+		EnableContested:            false,
+		ContestedColor:             "red",
+		ContestedAlpha:             200,
+		ContestedPattern:           ContestedPatternHatch,
+		ContestedMinOwners:         2,
+		MapColorTable:              true,
+		QuarantineDedupeCapacity:   10000,
+		SmallClaimPolicy:           SmallClaimDot,
+		SmallClaimMinPixels:        1,
+		Regions:                    nil,
+		StartupChecks:              false,
+		GameArtifactAccess:         GameAccessConfig{},
+		MapCoverage:                false,
+		EnableFog:                  false,
+		FogColor:                   "black",
+		FogAlpha:                   160,
+		FogRadiusUE:                30000,
+		CoincidentPolicy:           CoincidentNone,
+		CoincidentOffsetPixels:     2,
+		ZoomAdvisoryFraction:       0.8,
+		ZoomAdvisoryCycles:         3,
+		AutoTuneZoom:               false,
+		EnableTribeMasks:           false,
+		TribeMaskCount:             10,
+		TribeMaskSize:              1024,
+		UploadCoalesceMillis:       0,
+		TileCacheMB:                0,
+		TileCachePrewarmZooms:      []uint{0, 1, 2},
+		URLScheme:                  "http",
+		LeaderLockKey:              "",
+		LeaderLockTTLSeconds:       30,
+		TileBoundsOnly:             false,
+		TileBoundsMarginTiles:      1,
+		ExportIntervalSeconds:      0,
+		ExportAnonymize:            false,
+		TribeColorMode:             TribeColorPalette,
+		TribeColorSaturation:       0.75,
+		TribeColorValue:            0.9,
+		TransientRetries:           2,
+		TransientBackoffMillis:     500,
+		ClaimColorBy:               ClaimColorByOwner,
+		LandClaimColor:             "olive",
+		WaterClaimColor:            "navy",
+		PosterMaxPixels:            16384,
+		PosterStripPixels:          1024,
+		PosterQueueSize:            4,
+		PosterBackground:           "",
+		ClaimWeights:               ClaimWeights{Land: 1.0, Water: 0.25},
+		RetainVersions:             0,
+		ClaimFalloff:               ClaimFalloffNone,
+		URLPublisherName:           "",
+		URLOwnershipPolicy:         URLOwnershipTakeover,
+		LogBufferRecords:           2000,
+		SharedTribeColorsKey:       "",
+		NotifyMinChangedMarkers:    0,
+		NotifyMaxDelaySeconds:      600,
+		AlternativeURLs:            nil,
+		PrimaryURL:                 0,
+		StrictStartup:              false,
+		URLRefreshIntervalSeconds:  0,
+		GridWarningEveryCycles:     10,
+		GridErrorAfterCycles:       30,
+		ConcentrationBuckets:       []int{100, 1000},
+		MapCompression:             MapCompressionZlib,
+		FetchSchedule:              "",
+		ScheduleTimeZone:           "",
+	}
+
+	if err = decoder.Decode(&cfg); err != nil {
+		return
+	}
+
+	if len(cfg.AtlasS3KeyPrefix) > 0 && !strings.HasSuffix(cfg.AtlasS3KeyPrefix, "/") {
+		cfg.AtlasS3KeyPrefix += "/"
+	}
+
+	if _, ok := colorValues[cfg.ClaimGrowthColor]; !ok {
+		log.Printf("Warning! Unknown ClaimGrowthColor %q, using lime", cfg.ClaimGrowthColor)
+		cfg.ClaimGrowthColor = "lime"
+	}
+	if _, ok := colorValues[cfg.ClaimShrinkColor]; !ok {
+		log.Printf("Warning! Unknown ClaimShrinkColor %q, using maroon", cfg.ClaimShrinkColor)
+		cfg.ClaimShrinkColor = "maroon"
+	}
+	if cfg.ClaimTrendMaxBlend < 0 || cfg.ClaimTrendMaxBlend > 1 {
+		blend := math.Max(0, math.Min(1, cfg.ClaimTrendMaxBlend))
+		log.Printf("Warning! ClaimTrendMaxBlend %v is outside 0-1, using %v", cfg.ClaimTrendMaxBlend, blend)
+		cfg.ClaimTrendMaxBlend = blend
+	}
+
+	// GameSize is always generated, other sizes must fit the .map's uint16 source width
+	gameSizes := []int{cfg.GameSize}
+	for _, size := range cfg.GameSizes {
+		if size == cfg.GameSize {
+			continue
+		}
+		if size <= 0 || mapSrcPixels(size) > math.MaxUint16 {
+			log.Printf("Warning! Ignoring invalid GameSizes entry %d", size)
+			continue
+		}
+		gameSizes = append(gameSizes, size)
+	}
+	cfg.GameSizes = gameSizes
+
+	// BasePath is either empty or "/path" without a trailing slash
+	cfg.BasePath = strings.TrimRight(cfg.BasePath, "/")
+	if len(cfg.BasePath) > 0 && !strings.HasPrefix(cfg.BasePath, "/") {
+		cfg.BasePath = "/" + cfg.BasePath
+	}
+
+	// AlternativeURL is shorthand for a single mirror
+	if len(cfg.AlternativeURL) > 0 && len(cfg.AlternativeURLs) > 0 {
+		log.Printf("Warning! Both AlternativeURL and AlternativeURLs are set, ignoring AlternativeURL")
+	}
+	cfg.expandAlternativeURL()
+
+	if cfg.MaxConcurrentRenders <= 0 {
+		cfg.MaxConcurrentRenders = Max(1, runtime.NumCPU()/2)
+	}
+
+	if _, ok := colorValues[cfg.ContestedColor]; !ok {
+		log.Printf("Warning! Unknown ContestedColor %q, using red", cfg.ContestedColor)
+		cfg.ContestedColor = "red"
+	}
+	if cfg.ContestedPattern != ContestedPatternSolid && cfg.ContestedPattern != ContestedPatternHatch {
+		log.Printf("Warning! Unknown ContestedPattern %q, using %s", cfg.ContestedPattern, ContestedPatternHatch)
+		cfg.ContestedPattern = ContestedPatternHatch
+	}
+	cfg.ContestedMinOwners = Max(2, cfg.ContestedMinOwners)
+
+	if _, ok := colorValues[cfg.FogColor]; !ok {
+		log.Printf("Warning! Unknown FogColor %q, using black", cfg.FogColor)
+		cfg.FogColor = "black"
+	}
+	if !isFinite(cfg.FogRadiusUE) || cfg.FogRadiusUE < 0 {
+		log.Printf("Warning! Invalid FogRadiusUE %v, using 0", cfg.FogRadiusUE)
+		cfg.FogRadiusUE = 0
+	}
+
+	if cfg.CoincidentPolicy != CoincidentNone && cfg.CoincidentPolicy != CoincidentOffset && cfg.CoincidentPolicy != CoincidentSplit {
+		log.Printf("Warning! Unknown CoincidentPolicy %q, using %s", cfg.CoincidentPolicy, CoincidentNone)
+		cfg.CoincidentPolicy = CoincidentNone
+	}
+
+	if cfg.TribeColorMode != TribeColorPalette && cfg.TribeColorMode != TribeColorHash {
+		log.Printf("Warning! Unknown TribeColorMode %q, using %s", cfg.TribeColorMode, TribeColorPalette)
+		cfg.TribeColorMode = TribeColorPalette
+	}
+	if !isFinite(cfg.TribeColorSaturation) || cfg.TribeColorSaturation < 0 || cfg.TribeColorSaturation > 1 {
+		log.Printf("Warning! Invalid TribeColorSaturation %v, using 0.75", cfg.TribeColorSaturation)
+		cfg.TribeColorSaturation = 0.75
+	}
+	if !isFinite(cfg.TribeColorValue) || cfg.TribeColorValue < 0 || cfg.TribeColorValue > 1 {
+		log.Printf("Warning! Invalid TribeColorValue %v, using 0.9", cfg.TribeColorValue)
+		cfg.TribeColorValue = 0.9
+	}
+
+	if cfg.ClaimColorBy != ClaimColorByOwner && cfg.ClaimColorBy != ClaimColorByMarkerType {
+		log.Printf("Warning! Unknown ClaimColorBy %q, using %s", cfg.ClaimColorBy, ClaimColorByOwner)
+		cfg.ClaimColorBy = ClaimColorByOwner
+	}
+	if _, ok := colorValues[cfg.LandClaimColor]; !ok {
+		log.Printf("Warning! Unknown LandClaimColor %q, using olive", cfg.LandClaimColor)
+		cfg.LandClaimColor = "olive"
+	}
+	if _, ok := colorValues[cfg.WaterClaimColor]; !ok {
+		log.Printf("Warning! Unknown WaterClaimColor %q, using navy", cfg.WaterClaimColor)
+		cfg.WaterClaimColor = "navy"
+	}
+	if cfg.ClaimFalloff != ClaimFalloffNone && cfg.ClaimFalloff != ClaimFalloffLinear && cfg.ClaimFalloff != ClaimFalloffSmooth {
+		log.Printf("Warning! Unknown ClaimFalloff %q, using %s", cfg.ClaimFalloff, ClaimFalloffNone)
+		cfg.ClaimFalloff = ClaimFalloffNone
+	}
+	if cfg.MapCompression != MapCompressionZlib && cfg.MapCompression != MapCompressionNone {
+		log.Printf("Warning! Unknown MapCompression %q, using %s", cfg.MapCompression, MapCompressionZlib)
+		cfg.MapCompression = MapCompressionZlib
+	}
+	if cfg.URLOwnershipPolicy != URLOwnershipTakeover && cfg.URLOwnershipPolicy != URLOwnershipRespect {
+		log.Printf("Warning! Unknown URLOwnershipPolicy %q, using %s", cfg.URLOwnershipPolicy, URLOwnershipTakeover)
+		cfg.URLOwnershipPolicy = URLOwnershipTakeover
+	}
+
+	if cfg.SmallClaimPolicy != SmallClaimDot && cfg.SmallClaimPolicy != SmallClaimSkip {
+		log.Printf("Warning! Unknown SmallClaimPolicy %q, using %s", cfg.SmallClaimPolicy, SmallClaimDot)
+		cfg.SmallClaimPolicy = SmallClaimDot
+	}
+
+	cfg.ZoomAdvisoryCycles = Max(1, cfg.ZoomAdvisoryCycles)
+	if cfg.TribeMaskSize <= 0 || cfg.TribeMaskSize > maxVirtualPixels {
+		log.Printf("Warning! Invalid TribeMaskSize %d, using 1024", cfg.TribeMaskSize)
+		cfg.TribeMaskSize = 1024
+	}
+
+	cfg.RenderOrder = validRenderOrder(cfg.RenderOrder)
+	cfg.Regions = validRegions(cfg.Regions, cfg.ServersX, cfg.ServersY)
+
+	cfg.MapRotation = ((cfg.MapRotation % 360) + 360) % 360
+	if cfg.MapRotation%90 != 0 {
+		log.Printf("Warning! MapRotation %d is not a multiple of 90, ignoring", cfg.MapRotation)
+		cfg.MapRotation = 0
+	}
+
+	return
+}
+
+// parseServerID unpacks the packed server ID. Each Server has an X and Y ID which
+// corresponds to its 2D location in the game world. The ID is packed into
+// 32-bits as follows:
+//   +--------------+--------------+
+//   | X (uint16_t) | Y (uint16_t) |
+//   +--------------+--------------+
+func parseServerID(packed string) (split [2]uint16, err error) {
+	var id uint64
+	id, err = strconv.ParseUint(packed, 10, 32)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(id))
+	split[0] = binary.LittleEndian.Uint16(buf[2:]) // X
+	split[1] = binary.LittleEndian.Uint16(buf[:2]) // Y
+	if int(split[0]) >= config.ServersX || int(split[1]) >= config.ServersY {
+		err = fmt.Errorf("server ID %s is (%d, %d) which is outside the %dx%d world", packed, split[0], split[1], config.ServersX, config.ServersY)
+	}
+	return
+}
+
+func isTribeID(tribeID uint64) bool {
+	return tribeID > 1000000000+50000
+}
+
+// getTribeColor returns a consistent color for a given tribe id, the shared assignment when
+// SharedTribeColorsKey is set
+func getTribeColor(tribeID uint64) color.NRGBA {
+	if tribeID == 0 {
+		return colorValues["black"]
+	}
+	if !isTribeID(tribeID) {
+		return colorValues["gray"]
+	}
+	if len(config.SharedTribeColorsKey) > 0 {
+		if c, ok := sharedTribeColor(tribeID); ok {
+			return c
+		}
+	}
+	return localTribeColor(tribeID)
+}
+
+// localTribeColor is the color this instance picks for a tribe by TribeColorMode
+func localTribeColor(tribeID uint64) color.NRGBA {
+	if config.TribeColorMode == TribeColorHash {
+		return hashTribeColor(tribeID)
+	}
+	idx := int(tribeID % uint64(len(colors)))
+	color := colors[idx]
+	return colorValues[color]
+}
+
+// blendColor linearly interpolates from a to b by t (0.0-1.0)
+func blendColor(a, b color.NRGBA, t float64) color.NRGBA {
+	lerp := func(x, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + (float64(y)-float64(x))*t))
+	}
+	return color.NRGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), lerp(a.A, b.A)}
+}
+
+// getClaimColor returns the tribe color, tinted by the tribe's trend when enabled
+func getClaimColor(tribeID uint64, trends map[uint64]float64) color.NRGBA {
+	base := getTribeColor(tribeID)
+	trend, ok := trends[tribeID]
+	if !ok || trend == 0 {
+		return base
+	}
+	target := colorValues[config.ClaimGrowthColor]
+	if trend < 0 {
+		target = colorValues[config.ClaimShrinkColor]
+	}
+	return blendColor(base, target, math.Abs(trend)*config.ClaimTrendMaxBlend)
+}
+
+// MapOptions holds map construction information
+type MapOptions struct {
+	filename      string
+	actualPixels  int
+	virtualPixels int
+	virtualClip   image.Rectangle
+	tribeTrends   map[uint64]float64 // optional per tribe growth/shrink -1.0 to 1.0
+	mapVersion    uint16             // .map file version to write
+	ownerSizes    map[uint64]int     // claims per owner for size based RenderOrder
+	serversX      int                // world size in servers when rendering a region, 0 for the whole world
+	serversY      int
+	mask          bool // draw claims opaque white without overlays, for per tribe masks
+}
+
+// worldServers is the size in servers of the world being rendered
+func (opts *MapOptions) worldServers() (int, int) {
+	if opts.serversX > 0 && opts.serversY > 0 {
+		return opts.serversX, opts.serversY
+	}
+	return config.ServersX, config.ServersY
+}
+
+func createQuadTree(opts *MapOptions, markers []Marker) *quadtree.QuadTree {
+	serversX, serversY := opts.worldServers()
+	var virtualPixelsPerServer float64
+	if serversX >= serversY {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversX)
+	} else {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversY)
+	}
+	virtualWaterRadius := virtualPixelsPerServer * config.WaterRadiusUE / config.GridSize
+	worldWidth := float64(serversX) * virtualPixelsPerServer
+	worldHeight := float64(serversY) * virtualPixelsPerServer
+
+	bb := quadtree.BoundingBox{MinX: 0, MinY: 0, MaxX: float64(opts.virtualPixels), MaxY: float64(opts.virtualPixels)}
+	qt := quadtree.NewQuadTree(bb)
+
+	for _, marker := range markers {
+		vServerOffsetX := float64(marker.serverX) * virtualPixelsPerServer
+		vServerOffsetY := float64(marker.serverY) * virtualPixelsPerServer
+		vX := (float64(marker.relX) * virtualPixelsPerServer) + vServerOffsetX
+		vY := (float64(marker.relY) * virtualPixelsPerServer) + vServerOffsetY
+		vX, vY = transformVirtual(vX, vY, worldWidth, worldHeight)
+		v := VirtualBounds{
+			x:      vX,
+			y:      vY,
+			radius: virtualWaterRadius,
+			marker: marker,
+		}
+		qt.Add(v)
+	}
+	return &qt
+}
+
+func tempFileName(prefix, suffix string) string {
+	return fmt.Sprintf("%s%x%s", prefix, rand.Int31(), suffix)
+}
+
+// s3StorageClass picks the storage class by output kind (first directory under WWWDir, e.g. territoryTiles)
+func s3StorageClass(relPath string) string {
+	kind := strings.SplitN(relPath, "/", 2)[0]
+	if storageClass, ok := config.AtlasS3StorageClasses[kind]; ok {
+		return storageClass
+	}
+	return config.AtlasS3StorageClass
+}
+
+const (
+	S3FailureContinue  = "continue"
+	S3FailureFailCycle = "failCycle"
+)
+
+// uploadFailure applies S3FailurePolicy to an upload error, nil means carry on
+func uploadFailure(err error) error {
+	if config.S3FailurePolicy == S3FailureFailCycle {
+		return err
+	}
+	recordError(err)
+	log.Printf("Warning! %v", err)
+	return nil
+}
+
+// newS3Client creates an S3 client from the AtlasS3 settings
+func newS3Client() (*s3.S3, error) {
+	session, err := session.NewSession(&aws.Config{
+		Region:      &config.AtlasS3Region,
+		Credentials: credentials.NewStaticCredentials(config.AtlasS3AccessID, config.AtlasS3SecretKey, ""),
+		HTTPClient:  outboundClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(session), nil
+}
+
+// s3ConfigErrorCodes are the S3 error codes that won't pass by retrying, the bucket or the
+// credentials are wrong
+var s3ConfigErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"NoSuchBucket":          true,
+	"SignatureDoesNotMatch": true,
+}
+
+// classifyS3Error classifies a failed S3 request by its AWS error code, including the codes of the
+// errors it wraps, anything else may pass and is transient
+func classifyS3Error(op string, err error) error {
+	for cause := err; cause != nil; {
+		awsErr, ok := cause.(awserr.Error)
+		if !ok {
+			break
+		}
+		if s3ConfigErrorCodes[awsErr.Code()] {
+			return classify(ErrConfig, op, err)
+		}
+		cause = awsErr.OrigErr()
+	}
+	return classify(ErrTransient, op, err)
+}
+
+// uploadFileToS3 uploads the file's current contents, see uploadToS3 for the coalescing wrapper
+func uploadFileToS3(file string) error {
+
+	// Open input file
+	in, err := os.Open(file)
+	if err != nil {
+		return classify(ErrStorage, "upload", err)
+	}
+	defer in.Close()
+
+	// Prep S3 connection
+	svc, err := newS3Client()
+	if err != nil {
+		return classify(ErrConfig, "upload", err)
+	}
+	uploader := s3manager.NewUploaderWithClient(svc)
+
+	// Upload the file
+	relPath := strings.TrimPrefix(file, path.Clean(config.WWWDir)+"/")
+	key := config.AtlasS3KeyPrefix + relPath
+	upParams := &s3manager.UploadInput{
+		Bucket: &config.AtlasS3BucketName,
+		Key:    &key,
+		Body:   in,
+	}
+	if storageClass := s3StorageClass(relPath); len(storageClass) > 0 {
+		upParams.StorageClass = &storageClass
+	}
+	if _, err = uploader.Upload(upParams); err != nil {
+		return classifyS3Error("upload", err)
+	}
+	if !shouldVerifyUpload(relPath) {
+		return nil
+	}
+
+	// optionally check the object really landed intact, re-uploading on mismatch
+	for attempt := 0; ; attempt++ {
+		err = verifyS3Object(svc, key, file)
+		if err == nil || attempt >= config.S3VerifyRetries {
+			return err
+		}
+		log.Printf("Warning! %v, re-uploading", err)
+		if _, err = in.Seek(0, io.SeekStart); err != nil {
+			return classify(ErrStorage, "upload", err)
+		}
+		if _, err = uploader.Upload(upParams); err != nil {
+			return classifyS3Error("upload", err)
+		}
+	}
+}
+
+// encodePNG writes generated images, tests replace it to make encoding fail
+var encodePNG = png.Encode
+
+// generateImage renders and saves a single image, returning the number of markers drawn. Write
+// failures are returned as ErrStorage, upload errors only when S3FailurePolicy fails the cycle
+func generateImage(ctx context.Context, opts *MapOptions, quadTree *quadtree.QuadTree) (int, error) {
+	finalImg, drawn := renderImage(opts, quadTree)
+	if finalImg == nil {
+		// tiles without claims all share one prebuilt transparent encoding
+		if opts.actualPixels == config.TileSize {
+			return drawn, writeEmptyTile(ctx, opts.filename)
+		}
+		finalImg = image.NewRGBA(image.Rect(0, 0, opts.actualPixels, opts.actualPixels))
+	}
+
+	// save the a tmp file
+	dir := path.Dir(opts.filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return drawn, classify(ErrStorage, "write", fmt.Errorf("failed to create directory %s: %v", dir, err))
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".png"))
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return drawn, classify(ErrStorage, "write", fmt.Errorf("failed to create %s: %v", tmpFilename, err))
+	}
+	if err := encodePNG(f, finalImg); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return drawn, classify(ErrStorage, "write", fmt.Errorf("failed to encode %s: %v", tmpFilename, err))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return drawn, classify(ErrStorage, "write", fmt.Errorf("failed to write %s: %v", tmpFilename, err))
+	}
+
+	// delete old file and rename tmp
+	os.Remove(opts.filename)
+	if err := os.Rename(tmpFilename, opts.filename); err != nil {
+		os.Remove(tmpFilename)
+		return drawn, classify(ErrStorage, "write", err)
+	}
+
+	if err := uploadToS3(ctx, opts.filename); err != nil {
+		return drawn, uploadFailure(err)
+	}
+	return drawn, nil
+}
+
+// renderImage draws the markers within opts.virtualClip with every overlay, returning the image
+// and the number of markers drawn. The image is nil when it would be fully transparent
+func renderImage(opts *MapOptions, quadTree *quadtree.QuadTree) (*image.RGBA, int) {
+	serversX, serversY := opts.worldServers()
+	var virtualPixelsPerServer float64
+	if serversX >= serversY {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversX)
+	} else {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversY)
+	}
+	virtualLandRadius := virtualPixelsPerServer * config.LandRadiusUE / config.GridSize
+	virtualWaterRadius := virtualPixelsPerServer * config.WaterRadiusUE / config.GridSize
+	// virtualClip is half-open, Min is inside the image and Max is the next image's Min
+	clipWidth := float64(opts.virtualClip.Dx())
+	clipHeight := float64(opts.virtualClip.Dy())
+	projection := newProjection(opts.virtualClip, opts.actualPixels)
+	virtualToActual := projection.scale
+
+	maskSrcImg := image.NewRGBA(image.Rect(0, 0, opts.actualPixels, opts.actualPixels))
+	gc := draw2dimg.NewGraphicContext(maskSrcImg)
+
+	qtBB := quadtree.BoundingBox{
+		MinX: float64(opts.virtualClip.Min.X),
+		MaxX: float64(opts.virtualClip.Max.X),
+		MinY: float64(opts.virtualClip.Min.Y),
+		MaxY: float64(opts.virtualClip.Max.Y),
+	}
+	perCircleAlpha := config.PerCircleAlpha && !config.OpaqueClaims && !opts.mask
+	// claims fading out towards their radius, outlines and masks keep hard edges
+	falloff := config.ClaimFalloff != ClaimFalloffNone && !config.ClaimOutlineOnly && !opts.mask
+	var circles []contestedCircle
+	drawn := 0
+	invalid := 0
+	results := quadTree.Query(qtBB)
+	vbs := make([]VirtualBounds, len(results))
+	for i, iVB := range results {
+		vbs[i] = iVB.(VirtualBounds)
+	}
+	sortForRendering(vbs, opts.ownerSizes)
+	coincident := coincidentGroups(vbs)
+	for _, vb := range vbs {
+
+		// snapped marker adjusted for clip zone
+		tX := snapVirtual(vb.x) - float64(opts.virtualClip.Min.X)
+		tY := snapVirtual(vb.y) - float64(opts.virtualClip.Min.Y)
+
+		// radius in virtual coordinates, claims smaller than SmallClaimMinPixels in the image are
+		// either enlarged to it or skipped
+		vRadius := 0.0
+		switch vb.marker.markerType {
+		case MarkerLand:
+			vRadius = virtualLandRadius
+		case MarkerWater:
+			vRadius = virtualWaterRadius
+		}
+		if vRadius*virtualToActual < config.SmallClaimMinPixels {
+			if config.SmallClaimPolicy == SmallClaimSkip {
+				continue
+			}
+			vRadius = config.SmallClaimMinPixels / virtualToActual
+		}
+
+		// filter circles not overlapping the half-open clip
+		if tX+vRadius <= 0 || tY+vRadius <= 0 || tX-vRadius >= clipWidth || tY-vRadius >= clipHeight {
+			continue
+		}
+
+		// marker and radius in image coordinates
+		iX, iY := projection.center(vb.x, vb.y)
+		iRadius := projection.length(vRadius)
+		if !isFinite(iX) || !isFinite(iY) || !isFinite(iRadius) {
+			invalid++
+			continue
+		}
+
+		if config.EnableContested && !opts.mask {
+			circles = append(circles, contestedCircle{owner: vb.marker.tribeOrOwnerID, x: iX, y: iY, r: iRadius})
+		}
+
+		// render marker, owners sharing an exact position are either nudged apart or each get a slice
+		color := getClaimColor(vb.marker.tribeOrOwnerID, opts.tribeTrends)
+		if config.ClaimColorBy == ClaimColorByMarkerType {
+			color = markerTypeColor(vb.marker.markerType)
+		}
+		if perCircleAlpha {
+			color.A = config.CircleAlpha
+		}
+		if opts.mask {
+			color = maskColor
+		}
+		slot, owners := coincidentSlot(coincident, vb)
+		if falloff {
+			switch {
+			case owners > 1 && config.CoincidentPolicy == CoincidentOffset:
+				dx, dy := coincidentOffset(slot, owners)
+				drawFalloffClaim(maskSrcImg, iX+dx, iY+dy, iRadius, 0.0, 2*math.Pi, color)
+			case owners > 1 && config.CoincidentPolicy == CoincidentSplit:
+				sweep := 2 * math.Pi / float64(owners)
+				drawFalloffClaim(maskSrcImg, iX, iY, iRadius, float64(slot)*sweep, sweep, color)
+			default:
+				drawFalloffClaim(maskSrcImg, iX, iY, iRadius, 0.0, 2*math.Pi, color)
+			}
+			drawn++
+			continue
+		}
+		gc.SetStrokeColor(color)
+		gc.SetFillColor(color)
+		switch {
+		case owners > 1 && config.CoincidentPolicy == CoincidentOffset:
+			dx, dy := coincidentOffset(slot, owners)
+			gc.ArcTo(iX+dx, iY+dy, iRadius, iRadius, 0.0, 2*math.Pi)
+		case owners > 1 && config.CoincidentPolicy == CoincidentSplit:
+			sweep := 2 * math.Pi / float64(owners)
+			gc.MoveTo(iX, iY)
+			gc.ArcTo(iX, iY, iRadius, iRadius, float64(slot)*sweep, sweep)
+		default:
+			gc.ArcTo(iX, iY, iRadius, iRadius, 0.0, 2*math.Pi)
+		}
+		if config.ClaimOutlineOnly && !opts.mask {
+			gc.SetLineWidth(config.ClaimOutlineWidth)
+			gc.Close()
+			gc.Stroke()
+		} else {
+			gc.Fill()
+		}
+		drawn++
+	}
+
+	if invalid > 0 {
+		log.Printf("Warning! Skipped %d markers with invalid coordinates in %s", invalid, opts.filename)
+	}
+
+	// nothing to compose without claims, unless they're fogged
+	if drawn == 0 && !config.EnableFog {
+		return nil, drawn
+	}
+
+	// Generate transparent final image using the opaque maskSrcImg, or use it directly in opaque mode
+	// and when each circle was already blended with its own alpha
+	finalImg := maskSrcImg
+	if perCircleAlpha {
+		capAlpha(finalImg, config.ClaimAlphaCap)
+	} else if config.OpaqueClaims {
+		// the anti-aliased edges are made solid too, falloff fades claims on purpose
+		if !falloff && !opts.mask {
+			solidifyAlpha(finalImg)
+		}
+	} else if !opts.mask {
+		finalImg = image.NewRGBA(image.Rect(0, 0, opts.actualPixels, opts.actualPixels))
+		draw.DrawMask(finalImg, finalImg.Bounds(), maskSrcImg, image.ZP, image.NewUniform(color.Alpha{config.CircleAlpha}), image.ZP, draw.Over)
+	}
+
+	// overlay areas claimed by several owners
+	if config.EnableContested && !opts.mask {
+		drawContested(finalImg, circles)
+	}
+
+	// darken everything away from the claims
+	if config.EnableFog && !opts.mask {
+		drawFog(finalImg, fogClearCircles(opts, quadTree, virtualPixelsPerServer, projection))
+	}
+
+	return finalImg, drawn
+}
+
+type claimCircle struct {
+	location image.Point
+	id       int64
+}
+
+const (
+	SmallClaimDot  = "dot"
+	SmallClaimSkip = "skip"
+)
+
+// gameClaimRadiusPixels is a claim's radius in the game's GameSize image
+func gameClaimRadiusPixels(markerType uint8) float64 {
+	radius := config.LandRadiusUE
+	if markerType == MarkerWater {
+		radius = config.WaterRadiusUE
+	}
+	pixelsPerServer := float64(config.GameSize) / float64(Max(config.ServersX, config.ServersY))
+	return pixelsPerServer * radius / config.GridSize
+}
+
+// mapSrcPixels is the .map source image width for a game size
+func mapSrcPixels(gameSize int) int {
+	const BitsPerPixel uint16 = 32
+	ChannelBlocksPerDimension := uint16(math.Floor(math.Sqrt(float64(BitsPerPixel))))
+	return gameSize * int(ChannelBlocksPerDimension)
+}
+
+// buildMapOwners aggregates the markers exported to the .map into per-owner claims sorted by owner,
+// all in memory. invalid is the number of exported markers dropped for unusable coordinates and
+// capped the number of owners cut down to MapMaxClaimsPerOwner. Generation uses spillMapOwners
+// instead so memory doesn't grow with the number of claims
+func buildMapOwners(markers []Marker) (IDList []FlagOwnerOutputHeader, invalid, capped int) {
+	export := newMapExport()
+
+	// First pass only counts claims per owner so all claims can be laid out in one exactly
+	// sized buffer rather than growing a slice per owner
+	IDList, IDCounts, invalid := countMapOwners(markers, export)
+	totalClaims := 0
+	for _, counts := range IDCounts {
+		totalClaims += counts.land + counts.water
+	}
+
+	// Each owner's claims are zero length windows into the shared buffer, in file order
+	claims := make([]ClaimFlagOutputEntry, totalClaims)
+	IDIndex := make(map[uint64]int, len(IDList))
+	offset := 0
+	for i := range IDList {
+		counts := IDCounts[i]
+		IDList[i].LandClaims = claims[offset:offset:(offset + counts.land)]
+		offset += counts.land
+		IDList[i].WaterClaims = claims[offset:offset:(offset + counts.water)]
+		offset += counts.water
+		IDIndex[IDList[i].TribeOrPlayerID] = i
+	}
+
+	// Second pass fills the windows, appends never exceed their exact capacity
+	for _, marker := range markers {
+		if !export.exported(marker) {
+			continue
+		}
+		ClaimEntry, ok := export.position(marker)
+		if !ok {
+			continue
+		}
+		Entry := &IDList[IDIndex[marker.tribeOrOwnerID]]
+		if marker.markerType == MarkerLand {
+			Entry.LandClaims = append(Entry.LandClaims, ClaimEntry)
+		} else {
+			Entry.WaterClaims = append(Entry.WaterClaims, ClaimEntry)
+		}
+	}
+
+	for i := range IDList {
+		if _, ok := cappedMapCounts(IDCounts[i]); ok {
+			capped++
+		}
+		IDList[i].LandClaims, IDList[i].WaterClaims = finishMapClaims(IDList[i].LandClaims, IDList[i].WaterClaims)
+	}
+	return IDList, invalid, capped
+}
+
+// scaleMapClaims converts claims aggregated for GameSize to another game size into dst, coordinates
+// are scaled from the full resolution ones and rounded down so every variant agrees with world.map
+func scaleMapClaims(dst, claims []ClaimFlagOutputEntry, gameSize int) []ClaimFlagOutputEntry {
+	from, to := uint32(mapSrcPixels(config.GameSize)), uint32(mapSrcPixels(gameSize))
+	dst = dst[:len(claims)]
+	for i, c := range claims {
+		dst[i] = ClaimFlagOutputEntry{X: uint16(uint32(c.X) * to / from), Y: uint16(uint32(c.Y) * to / from)}
+	}
+	return dst
+}
+
+// scaleMapOwners converts owners aggregated for GameSize to another game size, see scaleMapClaims
+func scaleMapOwners(owners []FlagOwnerOutputHeader, gameSize int) []FlagOwnerOutputHeader {
+	scaled := make([]FlagOwnerOutputHeader, len(owners))
+	for i, owner := range owners {
+		scaled[i] = FlagOwnerOutputHeader{
+			TribeOrPlayerID: owner.TribeOrPlayerID,
+			LandClaims:      scaleMapClaims(make([]ClaimFlagOutputEntry, len(owner.LandClaims)), owner.LandClaims, gameSize),
+			WaterClaims:     scaleMapClaims(make([]ClaimFlagOutputEntry, len(owner.WaterClaims)), owner.WaterClaims, gameSize),
+			Color:           owner.Color,
+		}
+	}
+	return scaled
+}
+
+// generateCompressedFile writes a .map of the owners, loading one owner's claims at a time
+func generateCompressedFile(ctx context.Context, opts *MapOptions, IDList mapOwners, gameSize int) error {
+	//TODO: Cleanup and remote the whole per server option on this one
+	SrcPixels := uint16(mapSrcPixels(gameSize))
+
+	// save the a tmp file
+	dir := path.Dir(opts.filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return classify(ErrStorage, "write", fmt.Errorf("failed to create directory %s: %v", dir, err))
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".map"))
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return classify(ErrStorage, "write", fmt.Errorf("failed to create %s: %v", tmpFilename, err))
+	}
+	w := bufio.NewWriter(f)
+
+	FileVerison := opts.mapVersion
+	CompressionType := mapCompressionType(FileVerison)
+
+	//Simple Header
+	FileVerisonBuff := make([]byte, 2)
+	binary.LittleEndian.PutUint16(FileVerisonBuff, FileVerison)
+	w.Write(FileVerisonBuff)
+
+	CompressionTypeBuff := make([]byte, 2)
+	binary.LittleEndian.PutUint16(CompressionTypeBuff, CompressionType)
+	w.Write(CompressionTypeBuff)
+
+	SrcImageWidthBuff := make([]byte, 2)
+	binary.LittleEndian.PutUint16(SrcImageWidthBuff, SrcPixels)
+	w.Write(SrcImageWidthBuff)
+
+	DestImageWidthBuff := make([]byte, 2)
+	binary.LittleEndian.PutUint16(DestImageWidthBuff, uint16(gameSize))
+	w.Write(DestImageWidthBuff)
+
+	OwnerIDCountBuff := make([]byte, 4)
+	binary.LittleEndian.PutUint32(OwnerIDCountBuff, uint32(IDList.Len()))
+	w.Write(OwnerIDCountBuff)
+
+	// v3 adds header flags for the optional sections
+	var Flags uint32
+	var Coverage MapCoverage
+	if FileVerison >= 3 {
+		if config.MapColorTable {
+			Flags |= MapFlagColorTable
+		}
+		if config.MapCoverage {
+			var ok bool
+			if Coverage, ok, err = rasterizeCoverage(IDList, gameSize); err != nil {
+				f.Close()
+				os.Remove(tmpFilename)
+				return classify(ErrStorage, "write", err)
+			} else if ok {
+				Flags |= MapFlagCoverage
+			} else {
+				log.Printf("Warning! %d owners is too many for the .map coverage raster, leaving it out", IDList.Len())
+			}
+		}
+		FlagsBuff := make([]byte, 4)
+		binary.LittleEndian.PutUint32(FlagsBuff, Flags)
+		w.Write(FlagsBuff)
+	}
+
+	// everything after the fixed header is the body CompressionType applies to, it is streamed
+	// one owner at a time
+	err = writeMapBody(f, w, mapBodyCompression(FileVerison, CompressionType), func(b io.Writer) error {
+		colors := make([]color.NRGBA, IDList.Len())
+		EntryBuff := make([]byte, 4)
+		for i := range colors {
+			k, err := IDList.Owner(i)
+			if err != nil {
+				return err
+			}
+			colors[i] = k.Color
+
+			//Write Entry Header
+			TribeOrPlayerIDBuff := make([]byte, 8)
+			binary.LittleEndian.PutUint64(TribeOrPlayerIDBuff, k.TribeOrPlayerID)
+			b.Write(TribeOrPlayerIDBuff)
+
+			//TODO: Use (20 bits: 0xFFFFF //F FF FF) for some of these eventually
+			LandClaimsCountBuff := make([]byte, 4)
+			binary.LittleEndian.PutUint32(LandClaimsCountBuff, uint32(len(k.LandClaims)))
+			b.Write(LandClaimsCountBuff)
+			WaterClaimCountBuff := make([]byte, 4)
+			binary.LittleEndian.PutUint32(WaterClaimCountBuff, uint32(len(k.WaterClaims)))
+			b.Write(WaterClaimCountBuff)
+
+			//WriteEntries, X then Y of each
+			for _, LandEntry := range k.LandClaims {
+				binary.LittleEndian.PutUint16(EntryBuff[0:], LandEntry.X)
+				binary.LittleEndian.PutUint16(EntryBuff[2:], LandEntry.Y)
+				b.Write(EntryBuff)
+			}
+			for _, WaterEntry := range k.WaterClaims {
+				binary.LittleEndian.PutUint16(EntryBuff[0:], WaterEntry.X)
+				binary.LittleEndian.PutUint16(EntryBuff[2:], WaterEntry.Y)
+				b.Write(EntryBuff)
+			}
+		}
+
+		// trailing color table, the RGBA the web tiles use for each owner in entry order
+		if Flags&MapFlagColorTable != 0 {
+			for _, c := range colors {
+				b.Write([]byte{c.R, c.G, c.B, c.A})
+			}
+		}
+
+		// trailing ownership raster, indices refer to the entries above
+		if Flags&MapFlagCoverage != 0 {
+			writeCoverage(b, Coverage)
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", fmt.Errorf("failed to write %s: %v", tmpFilename, err))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", fmt.Errorf("failed to write %s: %v", tmpFilename, err))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", fmt.Errorf("failed to write %s: %v", tmpFilename, err))
+	}
+
+	// delete old file and rename tmp
+	os.Remove(opts.filename)
+	if err := os.Rename(tmpFilename, opts.filename); err != nil {
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", err)
+	}
+
+	// a verified mismatch always blocks publishing the URL
+	if err := uploadToS3(ctx, opts.filename); err != nil {
+		var verifyErr *s3VerifyError
+		if errors.As(err, &verifyErr) {
+			return err
+		}
+		return uploadFailure(err)
+	}
+	return nil
+}
+
+// generateTiles creates all the tile images at the specified zoom level, stopping early once ctx
+// is cancelled
+func generateTiles(ctx context.Context, tilePath string, zoomLevel uint, snapshot *tileSnapshot, trends map[uint64]float64) {
+	tiles := 1 << zoomLevel
+	tileRange := image.Rect(0, 0, tiles, tiles)
+	if config.TileBoundsOnly {
+		tileRange = markerTileBounds(zoomLevel, snapshot.markers)
+		setZoomBounds(ctx, tilePath, zoomLevel, tileRange)
+	}
+	count := generateTileRange(ctx, tilePath, zoomLevel, snapshot, MapOptions{tribeTrends: trends}, tileRange)
+	if config.TileBoundsOnly {
+		count.Bounds = &TileBounds{MinX: tileRange.Min.X, MinY: tileRange.Min.Y, MaxX: tileRange.Max.X, MaxY: tileRange.Max.Y}
+	}
+	setZoomTileCount(count)
+}
+
+// generateTileRange renders the tiles of a zoom level within tileRange (half-open, in tile indices),
+// base carries the trends. Once ctx is cancelled the remaining tiles are left as they are
+func generateTileRange(ctx context.Context, tilePath string, zoomLevel uint, snapshot *tileSnapshot, base MapOptions, tileRange image.Rectangle) ZoomTileCount {
+	opts := base
+	opts.serversX, opts.serversY = snapshot.serversX, snapshot.serversY
+	opts.ownerSizes = snapshot.ownerSizes
+	opts.actualPixels = config.TileSize
+	opts.virtualPixels = tileVirtualPixels()
+	qt := snapshot.quadTree
+
+	tiles := 1 << zoomLevel
+	virtualPixelsPerTile := opts.virtualPixels / tiles
+	count := ZoomTileCount{Zoom: zoomLevel, Total: tileRange.Dx() * tileRange.Dy(), nonEmptyTiles: make(map[TileCoord]bool)}
+
+	for tileX := tileRange.Min.X; tileX < tileRange.Max.X; tileX++ {
+		for tileY := tileRange.Min.Y; tileY < tileRange.Max.Y; tileY++ {
+			if ctx.Err() != nil {
+				return count
+			}
+			minX := tileX * virtualPixelsPerTile
+			minY := tileY * virtualPixelsPerTile
+			opts.virtualClip = image.Rect(minX, minY, minX+virtualPixelsPerTile, minY+virtualPixelsPerTile)
+			opts.filename = path.Join(tilePath, strconv.Itoa(int(zoomLevel)), strconv.Itoa(tileX), strconv.Itoa(tileY)+".png")
+			drawn, err := generateTile(ctx, &opts, qt)
+			if err != nil {
+				recordError(err)
+				log.Printf("Warning! Tile %d/%d/%d failed (%s): %v", zoomLevel, tileX, tileY, errorClass(err), err)
+				count.FailedTiles = append(count.FailedTiles, TileCoord{X: tileX, Y: tileY})
+			} else if drawn > 0 {
+				count.NonEmpty++
+				count.nonEmptyTiles[TileCoord{X: tileX, Y: tileY}] = true
+			}
+		}
+	}
+	return count
+}
+
+// generateTile renders a single tile, containing any panic so sibling tiles still render
+func generateTile(ctx context.Context, opts *MapOptions, quadTree *quadtree.QuadTree) (drawn int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = classify(ErrDataCorrupt, "render", fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return generateImage(ctx, opts, quadTree)
+}
+
+// isFinite checks a coordinate is usable for rendering
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// gameMapFile is one .map variant and its territory_urls key
+type gameMapFile struct {
+	size int
+	name string
+	key  string
+}
+
+// gameMapFiles lists the .map variants, GameSize is always first as world.map
+func gameMapFiles() []gameMapFile {
+	files := []gameMapFile{{size: config.GameSize, name: "world.map", key: "world"}}
+	for _, size := range config.GameSizes {
+		if size != config.GameSize {
+			files = append(files, gameMapFile{size: size, name: fmt.Sprintf("world_%d.map", size), key: fmt.Sprintf("world_%d", size)})
+		}
+	}
+	return files
+}
+
+// generateGame creates the game outputs, only an error on a .map is returned as it gates URL publication
+func generateGame(ctx context.Context, gamePath string, markers []Marker, mapVersion uint16) error {
+	// owners are aggregated once and shared by every size, their claims spilled to disk
+	owners, invalid, capped, err := spillMapOwners(markers, gamePath)
+	if err != nil {
+		return classify(ErrStorage, "write", err)
+	}
+	defer owners.Close()
+	if invalid > 0 {
+		log.Printf("Warning! Skipped %d markers with invalid coordinates", invalid)
+	}
+	if capped > 0 {
+		log.Printf("Capped %d owners to %d claims", capped, config.MapMaxClaimsPerOwner)
+	}
+
+	// generate world maps
+	for _, file := range gameMapFiles() {
+		opts := MapOptions{}
+		opts.filename = path.Join(gamePath, file.name)
+		opts.mapVersion = mapVersion
+
+		var sized mapOwners = owners
+		if file.size != config.GameSize {
+			sized = &scaledMapOwners{mapOwners: owners, gameSize: file.size}
+		}
+		if err := generateCompressedFile(ctx, &opts, sized, file.size); err != nil {
+			return err
+		}
+	}
+
+	// generate claims per server heatmap
+	if config.EnableHeatmap {
+		generateHeatmap(ctx, path.Join(gamePath, "heatmap.png"), serverClaimCounts(markers))
+	}
+	return nil
+}
+
+// setGameArtifactMeta records the outputs of generateGame as generated from crc
+func setGameArtifactMeta(crc uint32) {
+	for _, file := range gameMapFiles() {
+		setArtifactMeta("gameTiles/"+file.name, crc)
+	}
+	if config.EnableHeatmap {
+		setArtifactMeta("gameTiles/heatmap.png", crc)
+	}
+}
+
+// fetchGridMembers pipelines the SMembers of every grid in batches of FetchBatchSize (0 for a
+// single batch), the results line up with grids
+func fetchGridMembers(client *redis.Client, grids []GridID) []*redis.StringSliceCmd {
+	cmds := make([]*redis.StringSliceCmd, len(grids))
+	batchSize := config.FetchBatchSize
+	if batchSize <= 0 {
+		batchSize = len(grids)
+	}
+	for start := 0; start < len(grids); start += batchSize {
+		end := Min(start+batchSize, len(grids))
+		// a failed batch is retried whole, errors left after that are per command and reported
+		// by the caller
+		retryTransient(client.Context(), func() error {
+			pipe := client.Pipeline()
+			defer pipe.Close()
+			for i := start; i < end; i++ {
+				cmds[i] = pipe.SMembers(fmt.Sprintf("territorymapdata:%d", grids[i].X<<16|grids[i].Y))
+			}
+			_, err := pipe.Exec()
+			return classify(ErrTransient, "fetch", err)
+		})
+	}
+	return cmds
+}
+
+// fetchClaimMarkers reads every grid's markers, failed grids are skipped and reported through
+// failures (nil logs each one)
+func fetchClaimMarkers(client *redis.Client, includeCounts bool, failures *gridFailures) ([]Marker, uint32, map[uint64]*TribeCount) {
+	var crcs []uint32
+	var markers []Marker
+	countsPerTribe := make(map[uint64]*TribeCount)
+	droppedZeroPosition := 0
+	corrupt := 0
+
+	grids := fetchGrids(client)
+	cmds := fetchGridMembers(client, grids)
+	for i, grid := range grids {
+		x, y := grid.X, grid.Y
+		results, err := cmds[i].Result()
+		if err != nil {
+			err = classify(ErrTransient, "fetch", err)
+			recordError(err)
+			failures.observe(grid, err)
+			continue
+		}
+		failures.observe(grid, nil)
+		if config.DropZeroPositionMarkers {
+			var dropped []string
+			results, dropped = dropZeroPositionMarkers(x, y, results)
+			droppedZeroPosition += len(dropped)
+		}
+		for _, rawString := range results {
+			bytes := []byte(rawString)
+			if len(bytes) < 13 {
+				corrupt++
+				continue
+			}
+
+			newCRC := crc32.ChecksumIEEE(bytes)
+			crcs = append(crcs, newCRC)
+
+			tid := binary.LittleEndian.Uint64(bytes[0:8])
+			tx := binary.LittleEndian.Uint16(bytes[8:10])
+			ty := binary.LittleEndian.Uint16(bytes[10:12])
+			markerType := bytes[12]
+
+			m := Marker{}
+			m.serverX = x
+			m.serverY = y
+			m.tribeOrOwnerID = tid
+			m.relX = float64(tx) / float64(math.MaxUint16)
+			m.relY = float64(ty) / float64(math.MaxUint16)
+			m.markerType = markerType
+
+			markers = append(markers, m)
+
+			if includeCounts {
+				countTribeClaim(countsPerTribe, m)
+			}
+		}
+	}
+
+	failures.endCycle()
+
+	// only the workers' fetches are counted, one-off fetches would count the same markers again
+	if config.DropZeroPositionMarkers && failures != nil {
+		recordZeroPositionDrops(failures.worker, droppedZeroPosition)
+	}
+	if droppedZeroPosition > 0 {
+		log.Printf("Dropped %d zero position markers", droppedZeroPosition)
+	}
+	if corrupt > 0 {
+		err := classify(ErrDataCorrupt, "parse", fmt.Errorf("skipped %d claims shorter than 13 bytes", corrupt))
+		recordError(err)
+		log.Printf("Warning! %v", err)
+	}
+
+	// generate CRC32 for markers for rough "have they changed" check
+	sort.Slice(crcs, func(i, j int) bool { return crcs[i] < crcs[j] })
+	hash := crc32.NewIEEE()
+	for _, crc := range crcs {
+		binary.Write(hash, binary.LittleEndian, crc)
+	}
+
+	return markers, hash.Sum32(), countsPerTribe
+}
+
+// listenAddress is the address the HTTP server binds, every interface when Host is empty
+func listenAddress() string {
+	return net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+}
+
+// publicEndpoint is the host:port clients reach this service on, the primary of AlternativeURLs
+// when there are any
+func publicEndpoint() string {
+	if mirror, ok := primaryMirror(); ok {
+		return mirror.URL
+	} else if len(config.Host) > 0 {
+		return fmt.Sprintf("%s:%d", config.Host, config.Port)
+	}
+	return fmt.Sprintf("localhost:%d", config.Port)
+}
+
+// publicBaseURL is the URL published artifacts are served under
+func publicBaseURL() string {
+	return baseURLFor(publicEndpoint())
+}
+
+// updateUrlsInRedis publishes the URLs of the latest game generation under a new tag, returning
+// whether they were written
+func updateUrlsInRedis(client *redis.Client) bool {
+	urlWrites.Lock()
+	defer urlWrites.Unlock()
+	gameMeta, _ := artifactMetaFor("gameTiles/world.map")
+	written, _ := writeUrlsToRedis(client, gameMeta, rand.Int31())
+	return written
+}
+
+// writeUrlsToRedis publishes the URLs of a game generation with our publisher identity, returning
+// whether they were written and whether they differ from our last write. Each URL is on a mirror
+// of AlternativeURLs picked by weight, game servers that advertise urlLists also get every mirror
+// in <file>_urls to pick from
+func writeUrlsToRedis(client *redis.Client, gameMeta ArtifactMeta, tag int32) (written, changed bool) {
+	name := urlPublisherName()
+	if !checkURLOwnership(client, name) {
+		return false, false
+	}
+	baseURL := publicBaseURL()
+	// seeded by the generation so publishing it again hands out the same mirror
+	if mirror, ok := selectMirror(gameMeta.CRC); ok {
+		baseURL = baseURLFor(mirror.URL)
+	}
+	caps, _ := fetchGameCapabilities(client)
+	fields := make(map[string]interface{})
+	for _, file := range gameMapFiles() {
+		query := fmt.Sprintf("t=%d", tag)
+		if config.GameArtifactAccess.KeyInURL && len(config.GameArtifactAccess.Key) > 0 {
+			query += "&key=" + url.QueryEscape(config.GameArtifactAccess.Key)
+		}
+		fields[file.key] = fmt.Sprintf("%s/gameTiles/%s?%s", baseURL, file.name, query)
+		if caps.URLLists {
+			fields[file.key+"_urls"] = publishedMirrors(file, query)
+		}
+	}
+	urls := fmt.Sprint(fields)
+	publishedAt := time.Now().UTC()
+	fields["publisher"] = name
+	fields["publishedAt"] = publishedAt.Format(time.RFC3339Nano)
+
+	err := retryTransient(client.Context(), func() error {
+		return classify(ErrTransient, "publish", client.HMSet("territory_urls", fields).Err())
+	})
+	if err != nil {
+		recordError(err)
+		log.Printf("Warning! %v", err)
+		return false, false
+	}
+	return true, recordURLWrite(publishedAt, gameMeta, tag, urls)
+}
+
+func notifyUrlsChanged(client *redis.Client) {
+	client.Publish("GeneralNotifications:GlobalCommands", "RefreshTerrityoryUrls")
+}
+
+// zoomDue checks the ZoomSchedule, and any AutoTuneZoom deferral, to see if a zoom level should be
+// generated this cycle
+func zoomDue(zoom uint, cycle int) bool {
+	every := zoomEvery(zoom)
+	if every <= 1 {
+		return true
+	}
+	return cycle%every == 0
+}
+
+// tileGeneration is the tiles worker's state the regenerate endpoint renders with. The lock is
+// held for a whole generation so the worker and the endpoint never write tiles at once
+var tileGeneration = struct {
+	sync.Mutex
+	progress *tileProgress
+	trends   map[uint64]float64
+}{progress: newTileProgress()}
+
+// fetchTileMarkers fetches the tiles' snapshot: every marker of owners that didn't opt out, with
+// their shared tribe colors loaded, and its CRC
+func fetchTileMarkers(client *redis.Client, includeCounts bool, failures *gridFailures) ([]Marker, uint32, map[uint64]*TribeCount) {
+	markers, crc, counts := fetchClaimMarkers(client, includeCounts, failures)
+	optOut, optOutCrc := fetchOptOutOwners(client)
+	markers = withoutOptedOut(markers, optOut)
+	counts = countsWithoutOptedOut(counts, optOut)
+	crc = combineCrcs(crc, optOutCrc)
+	crc = withSharedTribeColors(client, markers, crc)
+	return markers, crc, counts
+}
+
+// dueZooms lists the zooms that are out of date and scheduled for this cycle
+func dueZooms(progress *tileProgress, crc uint32, cycle int) []uint {
+	progress.Lock()
+	defer progress.Unlock()
+	var zooms []uint
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		if zoomCrc, ok := progress.zoomCrcs[zoom]; ok && zoomCrc == crc {
+			continue
+		}
+		if zoomDue(zoom, cycle) {
+			zooms = append(zooms, zoom)
+		}
+	}
+	return zooms
+}
+
+// generateZooms renders the zooms from the markers, recording each zoom in progress as it
+// completes so a restart resumes with the rest. Zooms this process rendered from an earlier
+// snapshot only re-render the tiles of changed grids. Once ctx is cancelled the unfinished zooms
+// stop and stay unrecorded. It returns the number of failed tiles
+func generateZooms(ctx context.Context, tilePath string, zooms []uint, markers []Marker, crc uint32, trends map[uint64]float64, progress *tileProgress) int {
+	grids := gridCrcs(markers, trends)
+	changed := make(map[uint][]GridID)
+	digests := make(map[uint]uint32)
+	progress.Lock()
+	for _, zoom := range zooms {
+		previous, ok := progress.zoomGridCrcs[zoom]
+		if digest, recorded := progress.zoomDigests[zoom]; ok && recorded {
+			changed[zoom] = changedGrids(previous, grids)
+			digests[zoom] = digest
+		}
+	}
+	progress.Unlock()
+	// the tiles are read back outside the lock
+	for zoom := range changed {
+		if !canRegenerateChanged(tilePath, zoom, digests[zoom]) {
+			delete(changed, zoom)
+		}
+	}
+
+	// one quadtree per snapshot, shared by every zoom
+	snapshot := newTileSnapshot(markers, 0, 0)
+	regionSnapshots := newRegionSnapshots(markers)
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	failed := 0
+	wg.Add(len(zooms))
+	for _, zoom := range zooms {
+		go func(zoom uint) {
+			defer wg.Done()
+			zoomStart := time.Now()
+			if gridsChanged, partial := changed[zoom]; partial {
+				generateChangedTiles(ctx, tilePath, zoom, snapshot, trends, gridsChanged)
+			} else {
+				generateTiles(ctx, tilePath, zoom, snapshot, trends)
+			}
+			generateRegionTiles(ctx, tilePath, zoom, regionSnapshots, trends)
+			if ctx.Err() != nil {
+				return // unfinished, resumed after the restart
+			}
+			recordZoomDuration(zoom, time.Since(zoomStart))
+
+			if n := zoomFailedTiles(zoom); n > 0 {
+				failedMutex.Lock()
+				failed += n
+				failedMutex.Unlock()
+				return // retried next cycle
+			}
+			// record progress as each zoom completes so a restart can resume
+			if progress.complete(tilePath, zoom, crc, grids) {
+				setArtifactMeta(fmt.Sprintf("territoryTiles/%d", zoom), crc)
+				saveGenerationState(progress)
+			}
+		}(zoom)
+	}
+	wg.Wait()
+	return failed
+}
+
+// tileBackgroundWorker generates tiles until ctx is cancelled, firstCycle (optional) is marked done
+// after the first cycle
+func tileBackgroundWorker(ctx context.Context, client *redis.Client, firstCycle *sync.WaitGroup) {
+	// redis retries back off on ctx too
+	client = client.WithContext(ctx)
+	schedule := newFetchSchedule()
+	defer schedule.stop()
+	tilePath := path.Join(config.WWWDir, "territoryTiles")
+	previousCrc := uint32(1)
+	var previousCounts map[uint64]*TribeCount
+	var trends map[uint64]float64
+	var previousAggregationHash uint32
+	fetchFailures := newGridFailures("tiles")
+	// New loaded the zooms the previous run completed
+	tileGeneration.Lock()
+	progress := tileGeneration.progress
+	tileGeneration.Unlock()
+
+	for cycle := 0; ; cycle++ {
+		if leader, _ := isLeader(); !leader {
+			if cycle == 0 && firstCycle != nil {
+				firstCycle.Done()
+			}
+			if !schedule.wait(ctx) {
+				return
+			}
+			continue
+		}
+
+		// uploads stop retrying for the rest of the cycle once S3 looks down
+		cycleCtx := withUploadBreaker(ctx)
+
+		log.Println("Getting markers for tiles")
+		markers, crc, counts := fetchTileMarkers(client, config.EnableClaimTrend, fetchFailures)
+		if crc != previousCrc {
+			previousCrc = crc
+
+			if config.EnableClaimTrend {
+				if previousCounts != nil {
+					trends = TribeTrends(previousCounts, counts)
+				}
+				previousCounts = counts
+			}
+		}
+
+		tileGeneration.Lock()
+		tileGeneration.trends = trends
+		zooms := dueZooms(progress, crc, cycle)
+		if len(zooms) > 0 {
+			beginGeneration()
+			log.Printf("Starting tile generation for zooms %v", zooms)
+			start := time.Now()
+			failed := generateZooms(cycleCtx, tilePath, zooms, markers, crc, trends, progress)
+			endGeneration()
+			recordTileCycle(time.Since(start))
+			if ctx.Err() != nil {
+				log.Println("Tile generation interrupted, unfinished zooms resume after the restart")
+			} else if failed > 0 {
+				log.Printf("Finished tile generation with errors, %d tiles failed", failed)
+			} else {
+				log.Println("Finished tile generation")
+			}
+		} else {
+			log.Println("tile CRCs matched so skipping generation")
+		}
+		tileGeneration.Unlock()
+		if aggregationHash := aggregationSettingsHash(); len(zooms) > 0 || aggregationHash != previousAggregationHash {
+			generateRegionTopTribes(cycleCtx, client, tilePath, markers)
+			previousAggregationHash = aggregationHash
+		}
+		if len(zooms) > 0 || cycle == 0 {
+			refreshTileCache()
+		}
+		progress.Lock()
+		updateZoomStaleness(progress.zoomCrcs, crc)
+		progress.Unlock()
+		touchArtifacts("territoryTiles/", crc)
+		// the state file stays current for healthcheck --local
+		saveGenerationState(progress)
+
+		writeArtifactInventory(cycleCtx)
+
+		if cycle == 0 && firstCycle != nil {
+			firstCycle.Done()
+		}
+		if !schedule.wait(ctx) {
+			return
+		}
+	}
+}
+
+func stringSliceEq(a, b []string) bool {
+	if (a == nil) != (b == nil) {
+		return false
+	}
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// gameBackgroundWorker generates game outputs until ctx is cancelled, firstCycle (optional) is
+// marked done after the first cycle
+func gameBackgroundWorker(ctx context.Context, client *redis.Client, notifyClient *redis.Client, firstCycle *sync.WaitGroup) {
+	// redis retries back off on ctx too
+	client = client.WithContext(ctx)
+	schedule := newFetchSchedule()
+	defer schedule.stop()
+	gamePath := path.Join(config.WWWDir, "gameTiles")
+	previousCrc := uint32(1)
+	var previousTopTribes []string
+	var previousMapVersion uint16
+	var previousMarkers []Marker
+	var previousMarkersCrc uint32
+	var previousAggregationHash uint32
+	var batch notifyBatch
+	fetchFailures := newGridFailures("game")
+
+	// publishUrls writes the URLs and notifies the game servers once the batch of changes is due
+	publishUrls := func() {
+		if !batch.due(clock.Now()) {
+			log.Printf("%d changed markers since the last URL notification, waiting for %d", batch.pending, config.NotifyMinChangedMarkers)
+			return
+		}
+		if updateUrlsInRedis(client) {
+			notifyUrlsChanged(notifyClient)
+			batch.notified()
+		}
+	}
+
+	var term int
+	if leader, _ := isLeader(); leader {
+		if updateUrlsInRedis(client) {
+			notifyUrlsChanged(notifyClient)
+		}
+	}
+
+	for cycle := 0; ; cycle++ {
+		leader, leaderTerm := isLeader()
+		if !leader {
+			if cycle == 0 && firstCycle != nil {
+				firstCycle.Done()
+			}
+			if !schedule.wait(ctx) {
+				return
+			}
+			continue
+		}
+		if leaderTerm != term {
+			// taking over from another instance, publish our URLs even if nothing changed
+			term = leaderTerm
+			previousCrc = 1
+			batch.add(-1, clock.Now())
+		}
+
+		// uploads stop retrying for the rest of the cycle once S3 looks down
+		cycleCtx := withUploadBreaker(ctx)
+
+		log.Println("Getting markers for game image")
+		result := nextGeneration()
+		fetchedAt := time.Now().UTC()
+		markers, crc, counts := fetchClaimMarkers(client, config.EnableTopTribes, fetchFailures)
+		optOut, optOutCrc := fetchOptOutOwners(client)
+		if len(optOut) > 0 {
+			log.Printf("%d owners opted out of public outputs", len(optOut))
+		}
+		crc = combineCrcs(crc, optOutCrc)
+		crc = withSharedTribeColors(client, markers, crc)
+		mapVersion := negotiateMapVersion(fetchGameCapabilities(client))
+		if mapVersion != previousMapVersion {
+			log.Printf("Negotiated map file version %d", mapVersion)
+		}
+		// the leaderboard is also re-derived when only the ClaimWeights changed
+		aggregationHash := aggregationSettingsHash()
+		changed := crc != previousCrc || mapVersion != previousMapVersion
+		if config.EnableTopTribes && (changed || aggregationHash != previousAggregationHash) {
+			result.Leaderboard, previousTopTribes = publishTopTribes(client, markers, counts, optOut, previousTopTribes)
+			previousAggregationHash = aggregationHash
+		}
+
+		if changed {
+			if mapVersion != previousMapVersion {
+				batch.add(-1, clock.Now())
+			}
+			if previousMarkers == nil || crc != previousMarkersCrc {
+				if previousMarkers != nil {
+					diff := diffMarkers(withoutOptedOut(previousMarkers, optOut), withoutOptedOut(markers, optOut))
+					result.Diff = diff
+					batch.add(diff.Changes(), clock.Now())
+				} else {
+					batch.add(-1, clock.Now())
+				}
+				previousMarkers = markers
+				previousMarkersCrc = crc
+				result.Stats = computePublicStats(markers, optOut)
+				result.Servers, _ = json.Marshal(summarizeServers(markers, optOut))
+				result.Markers = sortedPublicMarkers(markers, optOut)
+				result.FetchedAt = fetchedAt
+			}
+			previousCrc = crc
+			previousMapVersion = mapVersion
+
+			log.Println("Generating game images")
+			beginGeneration()
+			err := generateGame(cycleCtx, gamePath, markers, mapVersion)
+			endGeneration()
+			if err != nil {
+				// transient errors were already retried at their boundary, anything left aborts the cycle
+				recordError(err)
+				log.Printf("Warning! Game generation failed (%s), not publishing URLs: %v", errorClass(err), err)
+				previousCrc = 1
+			} else {
+				setGameArtifactMeta(crc)
+				saveGenerationState(nil)
+				if confirmLeadership(client) {
+					publishUrls()
+				} else {
+					log.Println("Warning! No longer the generator leader, not publishing URLs")
+				}
+			}
+
+			// GeoJSON is a public output so opted out owners are left out
+			if config.EnableGeoJSON {
+				generateGeoJSON(cycleCtx, path.Join(gamePath, "claims.geojson"), withoutOptedOut(markers, optOut))
+				setArtifactMeta("gameTiles/claims.geojson", crc)
+			}
+
+			// masks are public too
+			if config.EnableTribeMasks {
+				generateTribeMasks(cycleCtx, path.Join(config.WWWDir, "tribeMasks"), withoutOptedOut(markers, optOut))
+			}
+		} else {
+			log.Println("game CRCs matched so skipping generation")
+			touchArtifacts("gameTiles/", crc)
+			saveGenerationState(nil)
+			// small changes held back still go out once NotifyMaxDelaySeconds pass
+			if batch.pending > 0 && batch.due(clock.Now()) && confirmLeadership(client) {
+				publishUrls()
+			}
+		}
+
+		writeArtifactInventory(cycleCtx)
+		// the API only sees the cycle's outputs once they are all done
+		result.CRC = crc
+		publishGeneration(result)
+
+		if cycle == 0 && firstCycle != nil {
+			firstCycle.Done()
+		}
+		if !schedule.wait(ctx) {
+			return
+		}
+	}
+}
+
+type fileHandlerWithCacheControl struct {
+	fileServer http.Handler
+}
+
+func (f *fileHandlerWithCacheControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	setFreshnessHeaders(w, strings.TrimPrefix(path.Clean(r.URL.Path), "/"))
+	f.fileServer.ServeHTTP(w, r)
+}
+
+// Min helper faster than float math.Min in Go
+func Min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// Max helper faster than float math.Max in Go
+func Max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// RunCLI runs the AtlasTerritoryMap command with args, the command line without the program
+// name, from the config.json in the working directory. It serves until SIGINT or SIGTERM unless
+// args name a one-off command, and returns the process' exit code
+func RunCLI(args []string) int {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if command == "compare" {
+		return runCompare(args[1:])
+	}
+
+	cfg, err := loadConfig("./config.json")
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		log.Println("Failed to read configuration file: config.json")
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config = cfg
+	if command == "healthcheck" {
+		return runHealthcheck(args[1:])
+	}
+	if command == "replay" {
+		return runReplay(args[1:])
+	}
+	startLogCapture()
+	log.SetOutput(io.MultiWriter(os.Stderr, logCaptureWriter{}))
+
+	generator, err := New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to setup the generator: %v", err)
+	}
+	defer generator.Close()
+	dbClient, defaultClient := generator.territoryDB, generator.defaultDB
+
+	clients := map[string]*redis.Client{"Default": defaultClient, "TerritoryDB": dbClient}
+	if problems := diagnoseRedisConnections(clients); problems > 0 && config.StrictStartup {
+		log.Fatalf("Found %d redis problems at startup, exiting (StrictStartup)", problems)
+	}
+	if config.StartupChecks {
+		if err := runStartupChecks(clients); err != nil {
+			log.Fatalf("Startup checks failed: %v", err)
+		}
+	}
+
+	switch command {
+	case "verify":
+		report := verifyWorldMap(dbClient)
+		js, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(js))
+		if !report.Pass {
+			return 1
+		}
+		return 0
+	case "export":
+		return runExport(dbClient, args[1:])
+	case "import":
+		return runImport(dbClient, args[1:])
+	}
+
+	// SIGINT / SIGTERM stop the workers once their cycle is done and the server, the process exits
+	// after both
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down")
+		cancel()
+	}()
+
+	// bind before any generation so a port in use or a bad Host fails startup right away, even
+	// when WarmBeforeServing holds off serving for a whole cycle
+	listener, err := net.Listen("tcp", listenAddress())
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", listenAddress(), err)
+	}
+	log.Printf("Listening on %s", listener.Addr())
+
+	var workers sync.WaitGroup
+	startWorker := func(worker func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker()
+		}()
+	}
+
+	if leaderElectionEnabled() {
+		campaign(dbClient)
+		startWorker(func() { leaderElectionWorker(ctx, dbClient) })
+	}
+
+	// optionally hold off serving until each worker has generated fresh output once
+	var firstCycle *sync.WaitGroup
+	if config.WarmBeforeServing {
+		firstCycle = &sync.WaitGroup{}
+	}
+	if config.EnableTileGeneration {
+		if firstCycle != nil {
+			firstCycle.Add(1)
+		}
+		startWorker(func() { tileBackgroundWorker(ctx, dbClient, firstCycle) })
+	}
+	if config.EnableGameGeneration {
+		if firstCycle != nil {
+			firstCycle.Add(1)
+		}
+		startWorker(func() { gameBackgroundWorker(ctx, dbClient, defaultClient, firstCycle) })
+	}
+	if config.EnableGameGeneration && config.URLRefreshIntervalSeconds > 0 {
+		startWorker(func() { urlRefreshWorker(ctx, dbClient, defaultClient) })
+	}
+	if config.EnableGameGeneration && config.VerifyIntervalSeconds > 0 {
+		startWorker(func() { verifyWorker(ctx, dbClient) })
+	}
+	if config.ExportIntervalSeconds > 0 {
+		startWorker(func() { exportWorker(ctx, dbClient) })
+	}
+	if firstCycle != nil {
+		log.Println("Waiting for first generation before serving")
+		firstCycle.Wait()
+	}
+
+	server := &http.Server{Handler: generator.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelShutdown()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	workers.Wait()
+	// a follower takes over immediately rather than after the TTL
+	if leaderElectionEnabled() {
+		releaseLeadership(dbClient)
+	}
+	return 0
+}
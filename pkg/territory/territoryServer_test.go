@@ -0,0 +1,920 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// testMarkers is a small claim set across the first grids of the world
+func testMarkers() []Marker {
+	return []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 1, serverY: 0, tribeOrOwnerID: 2, relX: 0.25, relY: 0.75, markerType: MarkerLand},
+		{serverX: 1, serverY: 1, tribeOrOwnerID: 3, relX: 0.1, relY: 0.1, markerType: MarkerWater},
+	}
+}
+
+// tmpFilesUnder lists leftover temporary files below dir
+func tmpFilesUnder(t *testing.T, dir string) []string {
+	t.Helper()
+	var leftovers []string
+	filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasPrefix(info.Name(), "tmp_") {
+			leftovers = append(leftovers, filename)
+		}
+		return nil
+	})
+	return leftovers
+}
+
+func TestRenderSkipsNaNMarkers(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	markers := append(testMarkers(), Marker{serverX: 0, serverY: 0, tribeOrOwnerID: 4, relX: math.NaN(), relY: math.Inf(1), markerType: MarkerLand})
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+	count := generateTileRange(context.Background(), tilePath, 1, newTileSnapshot(markers, 0, 0), MapOptions{}, image.Rect(0, 0, 2, 2))
+	if len(count.FailedTiles) != 0 {
+		t.Fatalf("failed tiles %v, want the NaN marker skipped", count.FailedTiles)
+	}
+	if count.NonEmpty == 0 {
+		t.Fatalf("no tile drawn, want the valid markers drawn")
+	}
+}
+
+func TestRenderContainsNaNRadius(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	// a zero GridSize turns every radius into NaN or Inf, Validate rejects it but rendering must not panic
+	config.GridSize = 0
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+	count := generateTileRange(context.Background(), tilePath, 1, newTileSnapshot(testMarkers(), 0, 0), MapOptions{}, image.Rect(0, 0, 2, 2))
+	if len(count.FailedTiles) != 0 {
+		t.Fatalf("failed tiles %v, want the markers skipped", count.FailedTiles)
+	}
+}
+
+func TestRenderRecordsEncodeFailures(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	previous := encodePNG
+	encodePNG = func(w io.Writer, m image.Image) error { return errors.New("encoder broke") }
+	defer func() { encodePNG = previous }()
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+	generateTiles(context.Background(), tilePath, 1, newTileSnapshot(testMarkers(), 0, 0), nil)
+	count, _ := zoomTileCount(1)
+	if len(count.FailedTiles) == 0 || zoomFailedTiles(1) != len(count.FailedTiles) {
+		t.Fatalf("failed tiles %v, want the tiles with claims recorded as failed", count.FailedTiles)
+	}
+	for _, tile := range count.FailedTiles {
+		filename := filepath.Join(tilePath, "1", strconv.Itoa(tile.X), strconv.Itoa(tile.Y)+".png")
+		if _, err := os.Stat(filename); err == nil {
+			t.Errorf("%s was written", filename)
+		}
+	}
+	if leftovers := tmpFilesUnder(t, tilePath); len(leftovers) > 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestGenerateImageReturnsEncodeFailure(t *testing.T) {
+	useTestConfig(t, nil)
+	previous := encodePNG
+	encodePNG = func(w io.Writer, m image.Image) error { return errors.New("encoder broke") }
+	defer func() { encodePNG = previous }()
+
+	opts := MapOptions{actualPixels: 64, virtualPixels: 64, virtualClip: image.Rect(0, 0, 64, 64)}
+	opts.filename = filepath.Join(config.WWWDir, "image.png")
+	_, err := generateImage(context.Background(), &opts, createQuadTree(&opts, testMarkers()))
+	if !errors.Is(err, ErrStorage) {
+		t.Fatalf("got %v, want a storage error", err)
+	}
+	if files, _ := ioutil.ReadDir(config.WWWDir); len(files) != 0 {
+		t.Fatalf("files left behind: %v", files)
+	}
+}
+
+// blockedDir is a directory path that can't be created because a file is in the way, which fails
+// even for root unlike permissions
+func blockedDir(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(file, "territoryTiles")
+}
+
+func TestTilesFailWhenDirectoryCantBeCreated(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 3 })
+	tilePath := blockedDir(t)
+
+	generateTiles(context.Background(), tilePath, 1, newTileSnapshot(testMarkers(), 0, 0), nil)
+	if failed := zoomFailedTiles(1); failed != 4 {
+		t.Fatalf("%d failed tiles, want all 4 including the empty ones", failed)
+	}
+}
+
+func TestMapFileFailsWhenDirectoryCantBeCreated(t *testing.T) {
+	useTestConfig(t, nil)
+	opts := MapOptions{filename: filepath.Join(blockedDir(t), "world.map"), mapVersion: 3}
+
+	err := generateCompressedFile(context.Background(), &opts, mapOwnerList(nil), config.GameSize)
+	if !errors.Is(err, ErrStorage) {
+		t.Fatalf("got %v, want a storage error", err)
+	}
+}
+
+func TestMapFileRemovesTempFileWhenRenameFails(t *testing.T) {
+	useTestConfig(t, nil)
+	// a non-empty directory where world.map goes can't be removed or renamed over
+	dir := t.TempDir()
+	opts := MapOptions{filename: filepath.Join(dir, "world.map"), mapVersion: 3}
+	if err := os.MkdirAll(filepath.Join(opts.filename, "keep"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	err := generateCompressedFile(context.Background(), &opts, mapOwnerList(nil), config.GameSize)
+	if !errors.Is(err, ErrStorage) {
+		t.Fatalf("got %v, want a storage error", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "tmp_*")); len(leftovers) != 0 {
+		t.Errorf("left %v behind", leftovers)
+	}
+}
+
+func TestMarkerOnTileBoundaryLandsInTilesItsRadiusReaches(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		landRadiusUE float64
+		want         []TileCoord
+	}{
+		// the center snaps into the right tile's first pixel, the circle spills back over the seam
+		{"crossing the seam", 10000, []TileCoord{{X: 0, Y: 0}, {X: 1, Y: 0}}},
+		// under half a pixel wide it stays within the pixel it snapped into
+		{"within a pixel", 1000, []TileCoord{{X: 1, Y: 0}}},
+	} {
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.ServersX, cfg.ServersY = 2, 2
+			cfg.MaxZoom = 2
+			cfg.SmallClaimMinPixels = 0
+			cfg.LandRadiusUE = test.landRadiusUE
+		})
+		// exactly on the seam between the zoom 1 tiles 0/0 and 1/0
+		marker := Marker{serverX: 1, serverY: 0, tribeOrOwnerID: 1, relX: 0, relY: 0.5, markerType: MarkerLand}
+		tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+
+		count := generateTileRange(context.Background(), tilePath, 1, newTileSnapshot([]Marker{marker}, 0, 0), MapOptions{}, image.Rect(0, 0, 2, 2))
+		if count.NonEmpty != len(test.want) {
+			t.Errorf("%s: drawn in %v, want exactly %v", test.name, count.nonEmptyTiles, test.want)
+			continue
+		}
+		for _, tile := range test.want {
+			if !count.nonEmptyTiles[tile] {
+				t.Errorf("%s: drawn in %v, want exactly %v", test.name, count.nonEmptyTiles, test.want)
+			}
+		}
+	}
+}
+
+// rewrittenZooms ages every tile below tilePath and returns a func listing the zooms with a tile
+// written since
+func rewrittenZooms(t *testing.T, tilePath string) func() []uint {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	for _, tile := range tilesUnder(t, tilePath) {
+		if err := os.Chtimes(filepath.Join(tilePath, tile), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() []uint {
+		rewritten := make(map[uint]bool)
+		for _, tile := range tilesUnder(t, tilePath) {
+			info, err := os.Stat(filepath.Join(tilePath, tile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ModTime().After(old) {
+				zoom, _ := strconv.Atoi(strings.Split(tile, "/")[0])
+				rewritten[uint(zoom)] = true
+			}
+		}
+		var zooms []uint
+		for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+			if rewritten[zoom] {
+				zooms = append(zooms, zoom)
+			}
+		}
+		return zooms
+	}
+}
+
+func TestZoomScheduleRewritesZoomsOnTheirCycles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MaxZoom = 3
+		cfg.ZoomSchedule = map[uint]int{2: 3}
+	})
+	useTestStateStore(t)
+	resetTileCounts()
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	progress := newTileProgress()
+	want := [][]uint{{0, 1, 2}, {0, 1}, {0, 1}, {0, 1, 2}, {0, 1}}
+
+	for cycle, wantZooms := range want {
+		// the claim moves every cycle so every zoom is out of date
+		crc := uint32(cycle + 10)
+		markers := []Marker{{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.2 + 0.1*float64(cycle), relY: 0.5, markerType: MarkerLand}}
+		rewritten := rewrittenZooms(t, tilePath)
+		generateZooms(context.Background(), tilePath, dueZooms(progress, crc, cycle), markers, crc, nil, progress)
+		updateZoomStaleness(progress.zoomCrcs, crc)
+
+		if zooms := rewritten(); !reflect.DeepEqual(zooms, wantZooms) {
+			t.Fatalf("cycle %d rewrote zooms %v, want %v", cycle, zooms, wantZooms)
+		}
+		for _, count := range getZoomTileCounts() {
+			if wantStale := count.Zoom == 2 && len(wantZooms) == 2; count.Stale != wantStale || count.Every != zoomEvery(count.Zoom) {
+				t.Errorf("cycle %d zoom %d stale %v every %d, want stale %v every %d", cycle, count.Zoom, count.Stale, count.Every, wantStale, zoomEvery(count.Zoom))
+			}
+		}
+	}
+}
+
+func TestClaimOutlineOnlyRendersRing(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.LandRadiusUE = 280000
+		cfg.ClaimOutlineOnly = true
+		cfg.ClaimOutlineWidth = 4
+	})
+	const size = 256
+	marker := Marker{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	img := renderWorld([]Marker{marker}, MapOptions{}, size)
+	checkGolden(t, "outline", img)
+
+	// the radius is a fifth of the world
+	center, radius := size/2, size/5
+	for _, test := range []struct {
+		name  string
+		x     int
+		inked bool
+	}{
+		{"center", center, false},
+		{"inside the ring", center + radius/2, false},
+		{"on the ring", center + radius, true},
+		{"outside the ring", center + radius + 4, false},
+	} {
+		if inked := img.RGBAAt(test.x, center).A > 0; inked != test.inked {
+			t.Errorf("%s: inked %v, want %v", test.name, inked, test.inked)
+		}
+	}
+}
+
+func TestUploadUsesConfiguredStorageClass(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.AtlasS3StorageClass = "STANDARD_IA"
+		cfg.AtlasS3StorageClasses = map[string]string{"gameTiles": "GLACIER_IR"}
+	})
+	fake := useFakeS3(t)
+
+	for _, relPath := range []string{"territoryTiles/0/0/0.png", "gameTiles/world.map"} {
+		if err := uploadToS3(context.Background(), writeOutput(t, relPath, []byte(relPath))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, want := range map[string]string{"territoryTiles/0/0/0.png": "STANDARD_IA", "gameTiles/world.map": "GLACIER_IR"} {
+		if got := fake.storageClasses[key]; got != want {
+			t.Errorf("%s uploaded with storage class %q, want %q", key, got, want)
+		}
+	}
+}
+
+// exportedOwners writes world.map from the markers and returns the owners read back from it
+func exportedOwners(t *testing.T, markers []Marker) []uint64 {
+	t.Helper()
+	gamePath := filepath.Join(config.WWWDir, "gameTiles")
+	if err := generateGame(context.Background(), gamePath, markers, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, owners, _, err := readMapFile(filepath.Join(gamePath, "world.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, owner := range owners {
+		ids = append(ids, owner.TribeOrPlayerID)
+	}
+	return ids
+}
+
+func TestMapIncludePlayerClaims(t *testing.T) {
+	const tribe, player = 1000050001, 42
+	markers := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: tribe, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 1, serverY: 0, tribeOrOwnerID: player, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 1, serverY: 1, tribeOrOwnerID: player, relX: 0.2, relY: 0.5, markerType: MarkerWater},
+	}
+	for _, test := range []struct {
+		include bool
+		want    []uint64
+	}{
+		{false, []uint64{tribe}},
+		{true, []uint64{player, tribe}},
+	} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.MapIncludePlayerClaims = test.include })
+		if owners := exportedOwners(t, markers); !reflect.DeepEqual(owners, test.want) {
+			t.Errorf("MapIncludePlayerClaims %v exported owners %v, want %v", test.include, owners, test.want)
+		}
+	}
+}
+
+// worldClaims is count claims of 50 tribes spread over a 3x3 world in no particular order
+func worldClaims(count int) []Marker {
+	random := rand.New(rand.NewSource(1))
+	markers := make([]Marker, count)
+	for i := range markers {
+		markerType := MarkerLand
+		if random.Intn(4) == 0 {
+			markerType = MarkerWater
+		}
+		markers[i] = Marker{
+			serverX:        random.Intn(3),
+			serverY:        random.Intn(3),
+			tribeOrOwnerID: 1000050001 + uint64(random.Intn(50)),
+			relX:           random.Float64(),
+			relY:           random.Float64(),
+			markerType:     markerType,
+		}
+	}
+	return markers
+}
+
+// perOwnerSliceMapOwners is the in-memory aggregation buildMapOwners replaced, a slice per owner
+// grown claim by claim, kept as the reference its output must match
+func perOwnerSliceMapOwners(markers []Marker) []FlagOwnerOutputHeader {
+	pixels := mapSrcPixels(config.GameSize)
+	perServerX, perServerY := float64(pixels/config.ServersX), float64(pixels/config.ServersY)
+	byOwner := make(map[uint64]*FlagOwnerOutputHeader)
+	for _, marker := range markers {
+		entry := ClaimFlagOutputEntry{
+			X: uint16(marker.relX*perServerX + float64(marker.serverX)*perServerX),
+			Y: uint16(marker.relY*perServerY + float64(marker.serverY)*perServerY),
+		}
+		owner, ok := byOwner[marker.tribeOrOwnerID]
+		if !ok {
+			owner = &FlagOwnerOutputHeader{TribeOrPlayerID: marker.tribeOrOwnerID, Color: getTribeColor(marker.tribeOrOwnerID)}
+			byOwner[marker.tribeOrOwnerID] = owner
+		}
+		if marker.markerType == MarkerLand {
+			owner.LandClaims = append(owner.LandClaims, entry)
+		} else {
+			owner.WaterClaims = append(owner.WaterClaims, entry)
+		}
+	}
+	var owners []FlagOwnerOutputHeader
+	for _, owner := range byOwner {
+		sortClaims(owner.LandClaims)
+		sortClaims(owner.WaterClaims)
+		owners = append(owners, *owner)
+	}
+	sort.Sort(ByTribeOrPlayerID(owners))
+	return owners
+}
+
+func TestMapOwnersMatchInMemoryAggregation(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.MapColorTable = true
+		cfg.MapCoverage = true
+	})
+	markers := worldClaims(5000)
+
+	write := func(name string, owners mapOwners) []byte {
+		opts := MapOptions{filename: filepath.Join(config.WWWDir, name), mapVersion: 3}
+		if err := generateCompressedFile(context.Background(), &opts, owners, config.GameSize); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(opts.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	owners, invalid, capped := buildMapOwners(markers)
+	if invalid != 0 || capped != 0 {
+		t.Fatalf("%d invalid and %d capped, want none", invalid, capped)
+	}
+	spill, invalid, capped, err := spillMapOwners(markers, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.Close()
+	if invalid != 0 || capped != 0 {
+		t.Fatalf("spill has %d invalid and %d capped, want none", invalid, capped)
+	}
+
+	want := write("perOwnerSlices.map", mapOwnerList(perOwnerSliceMapOwners(markers)))
+	for name, got := range map[string][]byte{
+		"twoPass": write("twoPass.map", mapOwnerList(owners)),
+		"spilled": write("spilled.map", spill),
+	} {
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s .map (%d bytes) differs from the in-memory one (%d bytes)", name, len(got), len(want))
+		}
+	}
+}
+
+func TestSpilledMapOwnersMatchWhenCappedAndScaled(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.MapMaxClaimsPerOwner = 50
+	})
+	markers := worldClaims(5000)
+
+	owners, _, wantCapped := buildMapOwners(markers)
+	spill, _, capped, err := spillMapOwners(markers, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.Close()
+	if capped != wantCapped || capped == 0 {
+		t.Fatalf("spill capped %d owners, want %d", capped, wantCapped)
+	}
+
+	scaled := scaleMapOwners(owners, config.GameSize/2)
+	sources := map[string]struct {
+		got  mapOwners
+		want []FlagOwnerOutputHeader
+	}{
+		"full":   {spill, owners},
+		"scaled": {&scaledMapOwners{mapOwners: spill, gameSize: config.GameSize / 2}, scaled},
+	}
+	for name, source := range sources {
+		if source.got.Len() != len(source.want) {
+			t.Fatalf("%s: %d owners, want %d", name, source.got.Len(), len(source.want))
+		}
+		for i, want := range source.want {
+			got, err := source.got.Owner(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.got.ClaimCount(i) != len(want.LandClaims)+len(want.WaterClaims) || !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: owner %d is %d land and %d water claims, want %d and %d", name, want.TribeOrPlayerID,
+					len(got.LandClaims), len(got.WaterClaims), len(want.LandClaims), len(want.WaterClaims))
+			}
+		}
+	}
+}
+
+// BenchmarkMapOwners compares the memory of the spilled aggregation with the in-memory ones for
+// growing claim counts, see B/op and the live heap the result holds (heldB/op). Only the spill
+// stays flat
+func BenchmarkMapOwners(b *testing.B) {
+	previous := config
+	defer func() { config = previous }()
+	config.ServersX, config.ServersY = 3, 3
+	dir := b.TempDir()
+
+	for _, claims := range []int{50000, 200000, 800000} {
+		markers := worldClaims(claims)
+		for _, bench := range []struct {
+			name  string
+			build func([]Marker) mapOwners
+		}{
+			{"spilled", func(markers []Marker) mapOwners {
+				spill, _, _, err := spillMapOwners(markers, dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return spill
+			}},
+			{"twoPass", func(markers []Marker) mapOwners {
+				owners, _, _ := buildMapOwners(markers)
+				return mapOwnerList(owners)
+			}},
+			{"perOwnerSlices", func(markers []Marker) mapOwners {
+				return mapOwnerList(perOwnerSliceMapOwners(markers))
+			}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bench.name, claims), func(b *testing.B) {
+				b.ReportAllocs()
+				var before, after runtime.MemStats
+				var held int64
+				for i := 0; i < b.N; i++ {
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					owners := bench.build(markers)
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+					held += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+					if spill, ok := owners.(io.Closer); ok {
+						spill.Close()
+					}
+					runtime.KeepAlive(owners)
+				}
+				b.ReportMetric(float64(held)/float64(b.N), "heldB/op")
+			})
+		}
+	}
+}
+
+func TestOpaqueClaimsAreFullyOpaque(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.LandRadiusUE = 200000
+	})
+	const size = 512
+	// overlapping claims of two tribes so blending would show
+	markers := []Marker{
+		{tribeOrOwnerID: 1000050001, relX: 0.45, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: 1000050002, relX: 0.55, relY: 0.5, markerType: MarkerLand},
+	}
+	count := func(img *image.RGBA) (claimed, opaque int) {
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				claimed++
+			}
+			if img.Pix[i] == 255 {
+				opaque++
+			}
+		}
+		return claimed, opaque
+	}
+
+	if claimed, opaque := count(renderWorld(markers, MapOptions{}, size)); claimed == 0 || opaque == claimed {
+		t.Fatalf("default render has %d opaque of %d claimed pixels, want translucent claims", opaque, claimed)
+	}
+	config.OpaqueClaims = true
+	img := renderWorld(markers, MapOptions{}, size)
+	claimed, opaque := count(img)
+	if claimed == 0 {
+		t.Fatalf("nothing rendered")
+	}
+	if opaque != claimed {
+		t.Errorf("%d of %d claimed pixels are opaque, want all", opaque, claimed)
+	}
+	for _, marker := range markers {
+		if got := worldPixel(img, marker, size); got.A != 255 {
+			t.Errorf("claim center %v, want opaque", got)
+		}
+	}
+}
+
+func TestReducedMapVariantIsHalfTheFullOne(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.GameSize = 2048
+		cfg.GameSizes = []int{2048, 1024}
+	})
+	markers := worldClaims(500)
+	gamePath := filepath.Join(config.WWWDir, "gameTiles")
+	if err := generateGame(context.Background(), gamePath, markers, 2); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) (MapFileHeader, []FlagOwnerOutputHeader) {
+		header, owners, _, err := readMapFile(filepath.Join(gamePath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header, owners
+	}
+	fullHeader, full := read("world.map")
+	halfHeader, half := read("world_1024.map")
+	if fullHeader.DestPixels != 2048 || halfHeader.DestPixels != 1024 {
+		t.Fatalf("destination sizes %d and %d, want 2048 and 1024", fullHeader.DestPixels, halfHeader.DestPixels)
+	}
+	if len(half) != len(full) {
+		t.Fatalf("%d owners at 1024, want the %d at 2048", len(half), len(full))
+	}
+
+	odd := 0
+	for i := range full {
+		if half[i].TribeOrPlayerID != full[i].TribeOrPlayerID {
+			t.Fatalf("owner %d is %d at 1024 and %d at 2048", i, half[i].TribeOrPlayerID, full[i].TribeOrPlayerID)
+		}
+		for _, claims := range [][2][]ClaimFlagOutputEntry{{full[i].LandClaims, half[i].LandClaims}, {full[i].WaterClaims, half[i].WaterClaims}} {
+			if len(claims[0]) != len(claims[1]) {
+				t.Fatalf("owner %d has %d claims at 1024, want %d", full[i].TribeOrPlayerID, len(claims[1]), len(claims[0]))
+			}
+			for j, claim := range claims[0] {
+				// odd coordinates round down
+				want := ClaimFlagOutputEntry{X: claim.X / 2, Y: claim.Y / 2}
+				if claims[1][j] != want {
+					t.Errorf("claim %v at 2048 is %v at 1024, want %v", claim, claims[1][j], want)
+				}
+				if claim.X%2 == 1 || claim.Y%2 == 1 {
+					odd++
+				}
+			}
+		}
+	}
+	if odd == 0 {
+		t.Fatalf("no odd coordinates, rounding wasn't tested")
+	}
+}
+
+func TestClaimAlphaCapLimitsOverlappedClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.LandRadiusUE = 200000
+		cfg.PerCircleAlpha = true
+		cfg.CircleAlpha = 100
+	})
+	const size = 512
+	// 40 claims of one tribe piled on nearly the same spot
+	var markers []Marker
+	for i := 0; i < 40; i++ {
+		markers = append(markers, Marker{tribeOrOwnerID: 1000050001, relX: 0.5 + float64(i%5)*0.002, relY: 0.5 + float64(i/5)*0.002, markerType: MarkerLand})
+	}
+	maxAlpha := func(img *image.RGBA) uint8 {
+		var max uint8
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] > max {
+				max = img.Pix[i]
+			}
+		}
+		return max
+	}
+
+	uncapped := renderWorld(markers, MapOptions{}, size)
+	if got := maxAlpha(uncapped); got < 250 {
+		t.Fatalf("uncapped overlap reaches alpha %d, want it saturated", got)
+	}
+
+	config.ClaimAlphaCap = 160
+	capped := renderWorld(markers, MapOptions{}, size)
+	if got := maxAlpha(capped); got != 160 {
+		t.Errorf("capped overlap reaches alpha %d, want the cap 160", got)
+	}
+	// the cap keeps the claim's color
+	center := color.NRGBAModel.Convert(worldPixel(capped, markers[0], size)).(color.NRGBA)
+	full := worldPixel(uncapped, markers[0], size)
+	if distance := colorDistance(full, center); distance > 48 {
+		t.Errorf("capped center %v drifted %d from the uncapped color %v", center, distance, full)
+	}
+	// a lone claim under the cap isn't touched
+	lone := []Marker{{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}}
+	if got := worldPixel(renderWorld(lone, MapOptions{}, size), lone[0], size); got.A != 100 {
+		t.Errorf("single claim alpha %d, want CircleAlpha 100", got.A)
+	}
+}
+
+func TestFetchPipelinesEveryGridKey(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 3, 3
+		cfg.FetchBatchSize = 4
+	})
+	_, client := newTestRedis(t)
+	// every grid but the last has a claim of an owner naming it
+	for _, grid := range configuredGrids[:len(configuredGrids)-1] {
+		addClaim(t, client, grid, uint64(1000+grid.X*10+grid.Y), 0.5, 0.5, MarkerLand)
+	}
+
+	var batches [][]string
+	client.WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			var keys []string
+			for _, cmd := range cmds {
+				if cmd.Name() == "smembers" {
+					keys = append(keys, cmd.Args()[1].(string))
+				}
+			}
+			batches = append(batches, keys)
+			return old(cmds)
+		}
+	})
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+
+	requested := make(map[string]int)
+	var sizes []int
+	for _, keys := range batches {
+		sizes = append(sizes, len(keys))
+		for _, key := range keys {
+			requested[key]++
+		}
+	}
+	if !reflect.DeepEqual(sizes, []int{4, 4, 1}) {
+		t.Errorf("pipelined batches of %v, want 4, 4 and 1 with FetchBatchSize 4", sizes)
+	}
+	for _, grid := range configuredGrids {
+		key := "territorymapdata:" + strconv.Itoa(grid.X<<16|grid.Y)
+		if requested[key] != 1 {
+			t.Errorf("%s requested %d times, want once", key, requested[key])
+		}
+	}
+
+	if len(markers) != len(configuredGrids)-1 {
+		t.Fatalf("fetched %d markers, want %d", len(markers), len(configuredGrids)-1)
+	}
+	for _, marker := range markers {
+		if owner := uint64(1000 + marker.serverX*10 + marker.serverY); marker.tribeOrOwnerID != owner {
+			t.Errorf("owner %d's claim was put on server (%d, %d)", marker.tribeOrOwnerID, marker.serverX, marker.serverY)
+		}
+	}
+}
+
+func TestSmallClaimPolicySkipsClaimsBelowThreshold(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		// a claim radius of 1/32 of the world, 2px at 64px and 16px at 512px
+		cfg.LandRadiusUE = cfg.GridSize / 32
+		cfg.SmallClaimMinPixels = 4
+		cfg.SmallClaimPolicy = SmallClaimSkip
+	})
+	markers := []Marker{{tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}}
+	drawnPixels := func(img *image.RGBA) int {
+		drawn := 0
+		if img == nil {
+			return drawn
+		}
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				drawn++
+			}
+		}
+		return drawn
+	}
+
+	if drawn := drawnPixels(renderWorld(markers, MapOptions{}, 64)); drawn != 0 {
+		t.Errorf("2px claim drew %d pixels, want it skipped below 4px", drawn)
+	}
+	if drawn := drawnPixels(renderWorld(markers, MapOptions{}, 512)); drawn < 700 {
+		t.Errorf("16px claim drew %d pixels, want it drawn full size", drawn)
+	}
+	config.SmallClaimPolicy = SmallClaimDot
+	if drawn := drawnPixels(renderWorld(markers, MapOptions{}, 64)); drawn < 40 || drawn > 80 {
+		t.Errorf("2px claim drew %d pixels with dot, want a 4px dot", drawn)
+	}
+
+	// the .map applies the same rule at GameSize
+	config.SmallClaimMinPixels = gameClaimRadiusPixels(MarkerLand) + 1
+	if owners, _, _ := buildMapOwners(markers); len(owners) != 1 {
+		t.Errorf("dot exported %d owners, want the claim kept", len(owners))
+	}
+	config.SmallClaimPolicy = SmallClaimSkip
+	if owners, _, _ := buildMapOwners(markers); len(owners) != 0 {
+		t.Errorf("skip exported %d owners, want the claim left out", len(owners))
+	}
+}
+
+func TestPublishedURLsUseURLScheme(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		scheme  string
+		mirrors []URLMirror
+		want    string
+	}{
+		{"default", "", nil, "http://maps.example.com:8880/gameTiles/world.map?t=7"},
+		{"https", "https", nil, "https://maps.example.com:8880/gameTiles/world.map?t=7"},
+		{"mirror without a scheme", "https", []URLMirror{{URL: "cdn.example.com", Weight: 1}}, "https://cdn.example.com/gameTiles/world.map?t=7"},
+		{"mirror with its own scheme", "http", []URLMirror{{URL: "https://cdn.example.com/", Weight: 1}}, "https://cdn.example.com/gameTiles/world.map?t=7"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.Host, cfg.Port = "maps.example.com", 8880
+				if test.scheme != "" {
+					cfg.URLScheme = test.scheme
+				}
+				cfg.AlternativeURLs = test.mirrors
+			})
+			_, client := newTestRedis(t)
+			if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 7); !written {
+				t.Fatalf("URLs weren't written")
+			}
+			if got, _ := client.HGet("territory_urls", "world").Result(); got != test.want {
+				t.Errorf("published %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	useTestConfig(t, nil)
+	cfg := config
+	cfg.URLScheme = "ftp"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Validate accepted URLScheme ftp")
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, test := range []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"", 8881, ":8881"},
+		{"127.0.0.1", 8881, "127.0.0.1:8881"},
+		{"0.0.0.0", 80, "0.0.0.0:80"},
+		{"::1", 8881, "[::1]:8881"},
+		{"maps.example.com", 443, "maps.example.com:443"},
+	} {
+		useTestConfig(t, func(cfg *Configuration) { cfg.Host, cfg.Port = test.host, test.port })
+		if got := listenAddress(); got != test.want {
+			t.Errorf("Host %q Port %d listens on %q, want %q", test.host, test.port, got, test.want)
+		}
+	}
+
+	useTestConfig(t, nil)
+	cfg := config
+	cfg.Port = 0
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "Port") {
+		t.Errorf("Validate of Port 0 returned %v, want an error naming Port", err)
+	}
+}
+
+func TestListenBindsTheConfiguredHost(t *testing.T) {
+	// find a free port, then bind it the way the server does
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	useTestConfig(t, func(cfg *Configuration) { cfg.Host, cfg.Port = "127.0.0.1", uint16(port) })
+	listener, err := net.Listen("tcp", listenAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if got := listener.Addr().String(); got != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Errorf("bound %s, want 127.0.0.1:%d", got, port)
+	}
+	if _, err := net.Listen("tcp", listenAddress()); err == nil {
+		t.Errorf("binding a port in use succeeded")
+	}
+
+	// the healthcheck finds the server on its listen address, loopback when Host is empty
+	useArtifactMeta(t)
+	config.Host = ""
+	server := &http.Server{Handler: newHTTPHandler(nil)}
+	go server.Serve(listener)
+	defer server.Close()
+	if code := runHealthcheck([]string{"--http"}); code != 0 {
+		t.Errorf("healthcheck against the listen address exited %d", code)
+	}
+}
+
+func TestDatabaseLookup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(filename, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default set has every name the server connects to
+	for _, name := range requiredDatabases {
+		if dbCfg, err := defaults.getDatabaseByName(name); err != nil || dbCfg.Name != name {
+			t.Errorf("default %s lookup returned %+v, %v", name, dbCfg, err)
+		}
+	}
+	if err := defaults.Validate(); err != nil {
+		t.Errorf("the default config doesn't validate: %v", err)
+	}
+
+	// the old TribeDB name isn't quietly replaced by localhost
+	if dbCfg, err := defaults.getDatabaseByName("TribeDB"); err == nil || dbCfg != (RedisConfiguration{}) {
+		t.Errorf("TribeDB lookup returned %+v, %v, want an error", dbCfg, err)
+	}
+
+	// a config listing only Default fails at startup naming the missing connection
+	onlyDefault := `{"DatabaseConnections": [{"Name": "Default", "URL": "redis.example.com", "Port": 6380}]}`
+	if err := ioutil.WriteFile(filename, []byte(onlyDefault), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbCfg, err := cfg.getDatabaseByName("Default"); err != nil || dbCfg.URL != "redis.example.com" || dbCfg.Port != 6380 {
+		t.Errorf("Default lookup returned %+v, %v", dbCfg, err)
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `"TerritoryDB"`) {
+		t.Errorf("Validate without TerritoryDB returned %v, want an error naming it", err)
+	}
+	if generator, err := New(cfg); err == nil || errorClass(err) != "config" {
+		if generator != nil {
+			generator.Close()
+		}
+		t.Errorf("New without TerritoryDB returned %v, want a config error", err)
+	}
+}
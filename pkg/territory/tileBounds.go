@@ -0,0 +1,114 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// TileBounds is the half-open range of tile indices a zoom was generated for with TileBoundsOnly
+type TileBounds struct {
+	MinX int `json:"minX"`
+	MinY int `json:"minY"`
+	MaxX int `json:"maxX"`
+	MaxY int `json:"maxY"`
+}
+
+// zoomBounds holds the tile range each zoom was last generated for, zooms without one were
+// generated in full
+var zoomBounds = struct {
+	sync.Mutex
+	byZoom map[uint]image.Rectangle
+}{byZoom: make(map[uint]image.Rectangle)}
+
+// markerTileBounds returns the tiles of a zoom level the markers can touch, as far as
+// claimReach, as a half-open rectangle of tile indices grown by TileBoundsMarginTiles, empty when
+// there are no markers
+func markerTileBounds(zoom uint, markers []Marker) image.Rectangle {
+	if len(markers) == 0 {
+		return image.Rectangle{}
+	}
+	virtualPixels := config.TileSize * (1 << (config.MaxZoom - 1))
+	var virtualPixelsPerServer float64
+	if config.ServersX >= config.ServersY {
+		virtualPixelsPerServer = float64(virtualPixels / config.ServersX)
+	} else {
+		virtualPixelsPerServer = float64(virtualPixels / config.ServersY)
+	}
+	reach := claimReach(zoom, virtualPixelsPerServer)
+	worldWidth := float64(config.ServersX) * virtualPixelsPerServer
+	worldHeight := float64(config.ServersY) * virtualPixelsPerServer
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, marker := range markers {
+		vX := (float64(marker.serverX) + marker.relX) * virtualPixelsPerServer
+		vY := (float64(marker.serverY) + marker.relY) * virtualPixelsPerServer
+		vX, vY = transformVirtual(vX, vY, worldWidth, worldHeight)
+		if !isFinite(vX) || !isFinite(vY) {
+			continue
+		}
+		minX, maxX = math.Min(minX, vX), math.Max(maxX, vX)
+		minY, maxY = math.Min(minY, vY), math.Max(maxY, vY)
+	}
+	if math.IsInf(minX, 1) {
+		return image.Rectangle{}
+	}
+
+	tiles := 1 << zoom
+	virtualPixelsPerTile := float64(virtualPixels / tiles)
+	margin := config.TileBoundsMarginTiles
+	bounds := image.Rect(
+		int(math.Floor((minX-reach)/virtualPixelsPerTile))-margin,
+		int(math.Floor((minY-reach)/virtualPixelsPerTile))-margin,
+		int(math.Floor((maxX+reach)/virtualPixelsPerTile))+1+margin,
+		int(math.Floor((maxY+reach)/virtualPixelsPerTile))+1+margin,
+	)
+	return bounds.Intersect(image.Rect(0, 0, tiles, tiles))
+}
+
+// setZoomBounds records the range a zoom was generated for and clears tiles left over outside
+// it, the zoom's directory is only walked when the range changed (or on the first generation
+// since a restart) so unchanged bounds cost nothing
+func setZoomBounds(ctx context.Context, tilePath string, zoom uint, bounds image.Rectangle) {
+	zoomBounds.Lock()
+	previous, ok := zoomBounds.byZoom[zoom]
+	zoomBounds.byZoom[zoom] = bounds
+	zoomBounds.Unlock()
+	if ok && previous == bounds {
+		return
+	}
+
+	zoomPath := path.Join(tilePath, strconv.Itoa(int(zoom)))
+	filepath.Walk(zoomPath, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(tilePath, filename)
+		if err != nil {
+			return nil
+		}
+		z, x, y, ok := parseTilePath(filepath.ToSlash(relPath))
+		if ok && uint(z) == zoom && !image.Pt(x, y).In(bounds) {
+			if err := writeEmptyTile(ctx, filename); err != nil {
+				recordError(err)
+				log.Printf("Warning! Failed to clear tile %s outside the bounds: %v", relPath, err)
+			}
+		}
+		return nil
+	})
+}
+
+// tileInBounds checks the tile is within the range its zoom was last generated for
+func tileInBounds(z, x, y int) bool {
+	zoomBounds.Lock()
+	defer zoomBounds.Unlock()
+	bounds, ok := zoomBounds.byZoom[uint(z)]
+	return !ok || image.Pt(x, y).In(bounds)
+}
@@ -0,0 +1,113 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// resetZoomBounds forgets the bounds of every zoom for the test
+func resetZoomBounds(t *testing.T) {
+	zoomBounds.Lock()
+	zoomBounds.byZoom = make(map[uint]image.Rectangle)
+	zoomBounds.Unlock()
+	t.Cleanup(func() {
+		zoomBounds.Lock()
+		zoomBounds.byZoom = make(map[uint]image.Rectangle)
+		zoomBounds.Unlock()
+	})
+}
+
+func tileFilename(tilePath string, zoom uint, tileX, tileY int) string {
+	return filepath.Join(tilePath, strconv.Itoa(int(zoom)), strconv.Itoa(tileX), strconv.Itoa(tileY)+".png")
+}
+
+func TestTileBoundsOnlySkipsTilesOutsideBounds(t *testing.T) {
+	for name, edit := range map[string]func(cfg *Configuration){
+		"default":        nil,
+		"fog":            func(cfg *Configuration) { cfg.EnableFog = true },
+		"small claims":   func(cfg *Configuration) { cfg.SmallClaimMinPixels = 24 },
+		"claim outlines": func(cfg *Configuration) { cfg.ClaimOutlineOnly = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.ServersX, cfg.ServersY = 4, 4
+				cfg.MaxZoom = 4
+				cfg.TileBoundsMarginTiles = 0
+				if edit != nil {
+					edit(cfg)
+				}
+			})
+			resetZoomBounds(t)
+			// a claim a few pixels from a tile edge, only its reach past its radius touches the next tile
+			markers := []Marker{
+				{serverX: 1, serverY: 1, tribeOrOwnerID: 1, relX: 0.018, relY: 0.5, markerType: MarkerLand},
+				{serverX: 1, serverY: 2, tribeOrOwnerID: 2, relX: 0.9, relY: 0.1, markerType: MarkerWater},
+			}
+			snapshot := newTileSnapshot(markers, 0, 0)
+			const zoom = 3
+			fullPath := filepath.Join(config.WWWDir, "full")
+			generateTiles(context.Background(), fullPath, zoom, snapshot, nil)
+
+			config.TileBoundsOnly = true
+			boundedPath := filepath.Join(config.WWWDir, "bounded")
+			generateTiles(context.Background(), boundedPath, zoom, snapshot, nil)
+			bounds := markerTileBounds(zoom, markers)
+			if bounds.Empty() || bounds == image.Rect(0, 0, 1<<zoom, 1<<zoom) {
+				t.Fatalf("bounds %v, want part of the zoom", bounds)
+			}
+			if count, _ := zoomTileCount(zoom); count.Total != bounds.Dx()*bounds.Dy() {
+				t.Fatalf("rendered %d tiles, want the %d within %v", count.Total, bounds.Dx()*bounds.Dy(), bounds)
+			}
+
+			for tileX := 0; tileX < 1<<zoom; tileX++ {
+				for tileY := 0; tileY < 1<<zoom; tileY++ {
+					full, err := ioutil.ReadFile(tileFilename(fullPath, zoom, tileX, tileY))
+					if err != nil {
+						t.Fatal(err)
+					}
+					bounded, err := ioutil.ReadFile(tileFilename(boundedPath, zoom, tileX, tileY))
+					if !image.Pt(tileX, tileY).In(bounds) {
+						if err == nil {
+							t.Errorf("tile %d/%d outside the bounds was rendered", tileX, tileY)
+						}
+						// the claims' reach must be within the bounds
+						if !bytes.Equal(full, emptyTilePNG()) {
+							t.Errorf("tile %d/%d outside the bounds isn't empty in a full render", tileX, tileY)
+						}
+					} else if !bytes.Equal(full, bounded) {
+						t.Errorf("tile %d/%d differs from the full render", tileX, tileY)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetZoomBoundsFogsLeftoverTiles(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.EnableFog = true })
+	resetZoomBounds(t)
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	inside, outside := tileFilename(tilePath, 1, 0, 0), tileFilename(tilePath, 1, 1, 1)
+	for _, filename := range []string{inside, outside} {
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("claims"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setZoomBounds(context.Background(), tilePath, 1, image.Rect(0, 0, 1, 1))
+	if data, _ := ioutil.ReadFile(outside); !bytes.Equal(data, emptyTilePNG()) || bytes.Equal(data, transparentTilePNG()) {
+		t.Fatalf("leftover tile outside the bounds isn't fogged")
+	}
+	if data, _ := ioutil.ReadFile(inside); string(data) != "claims" {
+		t.Fatalf("tile inside the bounds was cleared")
+	}
+}
@@ -0,0 +1,130 @@
+package territory
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tileCache holds encoded tiles in memory so hot tiles are served without touching disk, nil when
+// TileCacheMB is 0
+var tileCache *lruCache
+
+// cachedTile is one encoded tile with the ETag its bytes are served under
+type cachedTile struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// newTileCache creates the tile cache bounded by TileCacheMB of tile bytes
+func newTileCache() *lruCache {
+	if config.TileCacheMB <= 0 {
+		return nil
+	}
+	c := newLRUCache("tiles", math.MaxInt32, 0)
+	c.maxBytes = int64(config.TileCacheMB) << 20
+	return c
+}
+
+// tileCacheKey keys a tile by its path and the CRC of the generation it was rendered from
+func tileCacheKey(relPath string) string {
+	meta, _ := artifactMetaFor(relPath)
+	return fmt.Sprintf("%s@%08x", relPath, meta.CRC)
+}
+
+// loadCachedTile reads a tile from disk into the cache
+func loadCachedTile(relPath string) (*cachedTile, error) {
+	filename := filepath.Join(config.WWWDir, filepath.FromSlash(relPath))
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tile := &cachedTile{
+		data:    data,
+		etag:    fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE(data)),
+		modTime: info.ModTime(),
+	}
+	tileCache.AddSized(tileCacheKey(relPath), tile, int64(len(data)))
+	return tile, nil
+}
+
+// refreshTileCache drops every cached tile after tiles were rewritten and pre-warms the zooms in
+// TileCachePrewarmZooms
+func refreshTileCache() {
+	if tileCache == nil {
+		return
+	}
+	tileCache.Purge()
+
+	loaded := 0
+	for _, zoom := range config.TileCachePrewarmZooms {
+		dir := path.Join("territoryTiles", fmt.Sprint(zoom))
+		err := filepath.Walk(filepath.Join(config.WWWDir, filepath.FromSlash(dir)), func(filename string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || (!strings.HasSuffix(filename, ".png") && !strings.HasSuffix(filename, ".webp")) {
+				return nil
+			}
+			relPath, err := filepath.Rel(config.WWWDir, filename)
+			if err != nil {
+				return nil
+			}
+			if _, err := loadCachedTile(filepath.ToSlash(relPath)); err == nil {
+				loaded++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Warning! Failed to pre-warm tile cache for zoom %d: %v", zoom, err)
+		}
+	}
+	if loaded > 0 {
+		stats := tileCache.Stats()
+		log.Printf("Pre-warmed tile cache with %d tiles, %d bytes cached", loaded, stats.Bytes)
+	}
+}
+
+// tileCacheHandler serves tiles from tileCache, loading them from disk on a miss. Anything it
+// can't load is passed through so the file server reports it
+type tileCacheHandler struct {
+	next http.Handler
+}
+
+func (t *tileCacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if tileCache == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+	relPath := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+
+	var tile *cachedTile
+	if value, ok := tileCache.Get(tileCacheKey(relPath)); ok {
+		tile = value.(*cachedTile)
+	} else {
+		var err error
+		if tile, err = loadCachedTile(relPath); err != nil {
+			t.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "max-age=60")
+	setFreshnessHeaders(w, relPath)
+	w.Header().Set("ETag", tile.etag)
+	http.ServeContent(w, r, path.Base(relPath), tile.modTime, bytes.NewReader(tile.data))
+}
@@ -0,0 +1,139 @@
+package territory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTileCache installs a tile cache from the current config for the test
+func useTileCache(t testing.TB) {
+	previous := tileCache
+	tileCache = newTileCache()
+	t.Cleanup(func() { tileCache = previous })
+}
+
+func TestTileCacheServesFromMemoryUntilTheGenerationChanges(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.TileCacheMB = 1
+		cfg.TileCachePrewarmZooms = []uint{2}
+	})
+	useArtifactMeta(t)
+	useTileCache(t)
+	handler := newHTTPHandler(nil)
+	const tile = "territoryTiles/2/1/3.png"
+	filename := writeOutput(t, tile, []byte("first"))
+	setArtifactMeta("territoryTiles/2", 1)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/"+tile, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	w := get("")
+	if w.Code != http.StatusOK || w.Body.String() != "first" {
+		t.Fatalf("GET is %d %q", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+
+	// the same generation is served from memory, even once the file is gone
+	os.Remove(filename)
+	if w := get(""); w.Code != http.StatusOK || w.Body.String() != "first" {
+		t.Errorf("cached GET is %d %q, want the cached tile", w.Code, w.Body.String())
+	}
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag is %d, want 304", w.Code)
+	}
+	if stats := tileCache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Bytes != int64(len("first")) {
+		t.Errorf("stats %+v, want 2 hits, 1 miss and the tile's bytes", stats)
+	}
+
+	// a new generation of the zoom misses the old entry
+	writeOutput(t, tile, []byte("second"))
+	setArtifactMeta("territoryTiles/2", 2)
+	w = get(etag)
+	if w.Code != http.StatusOK || w.Body.String() != "second" || w.Header().Get("ETag") == etag {
+		t.Errorf("GET after a new generation is %d %q with ETag %s", w.Code, w.Body.String(), w.Header().Get("ETag"))
+	}
+
+	// refreshing after a generation drops everything and pre-warms the configured zooms
+	writeOutput(t, "territoryTiles/2/0/0.png", []byte("warm"))
+	writeOutput(t, "territoryTiles/3/0/0.png", []byte("cold"))
+	refreshTileCache()
+	if stats := tileCache.Stats(); stats.Size != 2 || stats.Bytes != int64(len("second")+len("warm")) {
+		t.Errorf("pre-warmed cache %+v, want zoom 2's 2 tiles", stats)
+	}
+	os.Remove(filename)
+	if w := get(""); w.Body.String() != "second" {
+		t.Errorf("pre-warmed tile is %q", w.Body.String())
+	}
+}
+
+// BenchmarkTileServing serves a popular-first spread of tiles from disk and from the cache
+func BenchmarkTileServing(b *testing.B) {
+	for _, cacheMB := range []int{0, 64} {
+		name := "disk"
+		if cacheMB > 0 {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			previous, previousMeta := config, artifactMetaSnapshot()
+			b.Cleanup(func() {
+				config = previous
+				artifacts.Lock()
+				artifacts.byKey = previousMeta
+				artifacts.Unlock()
+			})
+			config.WWWDir = dir
+			config.MaxZoom = 5
+			config.TileCacheMB = cacheMB
+			config.TileCachePrewarmZooms = nil
+			useTileCache(b)
+			setArtifactMeta("territoryTiles/4", 1)
+
+			// a zoom of 16x16 tiles of a realistic size
+			data := make([]byte, 12<<10)
+			rand.New(rand.NewSource(1)).Read(data)
+			for x := 0; x < 16; x++ {
+				for y := 0; y < 16; y++ {
+					filename := tileFilename(filepath.Join(dir, "territoryTiles"), 4, x, y)
+					os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+					if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			handler := newHTTPHandler(nil)
+
+			// viewers mostly look at the same few tiles
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, 255)
+			paths := make([]string, 4096)
+			for i := range paths {
+				n := zipf.Uint64()
+				paths[i] = fmt.Sprintf("/territoryTiles/4/%d/%d.png", n%16, n/16)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, paths[i%len(paths)], nil))
+				if w.Code != http.StatusOK {
+					b.Fatalf("GET %s is %d", paths[i%len(paths)], w.Code)
+				}
+			}
+			if tileCache != nil {
+				stats := tileCache.Stats()
+				b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hitRate")
+			}
+		})
+	}
+}
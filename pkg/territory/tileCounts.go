@@ -0,0 +1,125 @@
+package territory
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// TileCoord is a tile's x/y within its zoom level
+type TileCoord struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// ZoomTileCount is the JSON structure for per zoom tile counts
+type ZoomTileCount struct {
+	Zoom          uint        `json:"zoom"`
+	NonEmpty      int         `json:"nonEmpty"`
+	Total         int         `json:"total"`
+	GenerationCRC uint32      `json:"generationCRC"`         // marker CRC the zoom's tiles were generated from
+	Stale         bool        `json:"stale"`                 // true when the zoom was skipped by the ZoomSchedule
+	Every         int         `json:"every"`                 // zoom renders every N cycles, from ZoomSchedule and AutoTuneZoom
+	FailedTiles   []TileCoord `json:"failedTiles,omitempty"` // tiles that failed to render, retried next cycle
+	Bounds        *TileBounds `json:"bounds,omitempty"`      // tiles generated with TileBoundsOnly, the rest are empty
+
+	nonEmptyTiles map[TileCoord]bool // kept so a partial regeneration can update NonEmpty
+}
+
+// tileCounts holds the tile counts from the last generation of each zoom level
+var tileCounts = struct {
+	sync.Mutex
+	zooms map[uint]ZoomTileCount
+}{zooms: make(map[uint]ZoomTileCount)}
+
+func setZoomTileCount(count ZoomTileCount) {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	tileCounts.zooms[count.Zoom] = count
+}
+
+// mergeZoomTileCount folds a partial regeneration of the rendered tiles into the zoom's counts
+func mergeZoomTileCount(partial ZoomTileCount, rendered map[TileCoord]bool) {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	count := tileCounts.zooms[partial.Zoom]
+	nonEmptyTiles := make(map[TileCoord]bool, len(count.nonEmptyTiles))
+	for tile := range count.nonEmptyTiles {
+		if !rendered[tile] {
+			nonEmptyTiles[tile] = true
+		}
+	}
+	for tile := range partial.nonEmptyTiles {
+		nonEmptyTiles[tile] = true
+	}
+	// failures outside the rendered tiles are still failed
+	var failedTiles []TileCoord
+	for _, tile := range count.FailedTiles {
+		if !rendered[tile] {
+			failedTiles = append(failedTiles, tile)
+		}
+	}
+	failedTiles = append(failedTiles, partial.FailedTiles...)
+	sort.Slice(failedTiles, func(i, j int) bool {
+		a, b := failedTiles[i], failedTiles[j]
+		return a.X < b.X || (a.X == b.X && a.Y < b.Y)
+	})
+	count.Zoom = partial.Zoom
+	count.nonEmptyTiles = nonEmptyTiles
+	count.NonEmpty = len(nonEmptyTiles)
+	count.FailedTiles = failedTiles
+	tileCounts.zooms[partial.Zoom] = count
+}
+
+func zoomTileCount(zoom uint) (ZoomTileCount, bool) {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	count, ok := tileCounts.zooms[zoom]
+	return count, ok
+}
+
+// zoomFailedTiles returns the number of tiles that failed in the zoom's last generation
+func zoomFailedTiles(zoom uint) int {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	return len(tileCounts.zooms[zoom].FailedTiles)
+}
+
+// updateZoomStaleness records which marker CRC each zoom was generated from
+func updateZoomStaleness(zoomCrcs map[uint]uint32, currentCrc uint32) {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	for zoom, count := range tileCounts.zooms {
+		count.GenerationCRC = zoomCrcs[zoom]
+		count.Stale = zoomCrcs[zoom] != currentCrc
+		count.Every = zoomEvery(zoom)
+		tileCounts.zooms[zoom] = count
+	}
+}
+
+func getZoomTileCounts() []ZoomTileCount {
+	tileCounts.Lock()
+	defer tileCounts.Unlock()
+	counts := make([]ZoomTileCount, 0, len(tileCounts.zooms))
+	for _, v := range tileCounts.zooms {
+		counts = append(counts, v)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Zoom < counts[j].Zoom })
+	return counts
+}
+
+// tileCountsHandler serves GET /api/tiles/counts
+func tileCountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	js, err := json.Marshal(getZoomTileCounts())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,70 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeZoomTileCountKeepsFailuresOutsideRenderedTiles(t *testing.T) {
+	resetTileCounts()
+	setZoomTileCount(ZoomTileCount{Zoom: 2, Total: 16, FailedTiles: []TileCoord{{X: 0, Y: 0}, {X: 3, Y: 3}}})
+
+	rendered := map[TileCoord]bool{{X: 3, Y: 3}: true, {X: 3, Y: 2}: true}
+	mergeZoomTileCount(ZoomTileCount{Zoom: 2, FailedTiles: []TileCoord{{X: 3, Y: 2}}}, rendered)
+
+	count, _ := zoomTileCount(2)
+	if want := []TileCoord{{X: 0, Y: 0}, {X: 3, Y: 2}}; !reflect.DeepEqual(count.FailedTiles, want) {
+		t.Fatalf("failed tiles %v, want %v", count.FailedTiles, want)
+	}
+	if count.Total != 16 {
+		t.Fatalf("total %d, want the zoom's 16", count.Total)
+	}
+}
+
+func TestTileCountsEndpointReflectsSparseClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 3
+	})
+	resetTileCounts()
+	markers := []Marker{
+		{serverX: 0, serverY: 0, tribeOrOwnerID: 1, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{serverX: 3, serverY: 3, tribeOrOwnerID: 2, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+	}
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	snapshot := newTileSnapshot(markers, 0, 0)
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		generateTiles(context.Background(), tilePath, zoom, snapshot, nil)
+	}
+
+	w := httptest.NewRecorder()
+	tileCountsHandler(w, httptest.NewRequest(http.MethodGet, "/api/tiles/counts", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var counts []ZoomTileCount
+	if err := json.Unmarshal(w.Body.Bytes(), &counts); err != nil {
+		t.Fatal(err)
+	}
+	// each claim sits in the middle of one tile from zoom 2 on, zoom 1's quarters hold one each
+	want := []struct{ nonEmpty, total int }{{1, 1}, {2, 4}, {2, 16}}
+	if len(counts) != len(want) {
+		t.Fatalf("got %d zooms, want %d", len(counts), len(want))
+	}
+	for zoom, count := range counts {
+		if count.Zoom != uint(zoom) || count.NonEmpty != want[zoom].nonEmpty || count.Total != want[zoom].total {
+			t.Errorf("zoom %d: got %+v, want %d of %d tiles non-empty", zoom, count, want[zoom].nonEmpty, want[zoom].total)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	tileCountsHandler(w, httptest.NewRequest(http.MethodPost, "/api/tiles/counts", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,81 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// TileForPoint is the tile containing a world coordinate
+type TileForPoint struct {
+	Z   int
+	X   int
+	Y   int
+	URL string
+}
+
+// tileForPoint converts a world coordinate in UE units to the tile containing it at a zoom level,
+// using the same virtual space and transform as tile generation
+func tileForPoint(worldX, worldY float64, zoom int) (int, int) {
+	opts := MapOptions{virtualPixels: config.TileSize * (1 << (config.MaxZoom - 1))}
+	serversX, serversY := opts.worldServers()
+	var virtualPixelsPerServer float64
+	if serversX >= serversY {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversX)
+	} else {
+		virtualPixelsPerServer = float64(opts.virtualPixels / serversY)
+	}
+	worldWidth := float64(serversX) * virtualPixelsPerServer
+	worldHeight := float64(serversY) * virtualPixelsPerServer
+
+	vX := worldX / config.GridSize * virtualPixelsPerServer
+	vY := worldY / config.GridSize * virtualPixelsPerServer
+	vX, vY = transformVirtual(vX, vY, worldWidth, worldHeight)
+
+	tiles := 1 << uint(zoom)
+	virtualPixelsPerTile := float64(opts.virtualPixels / tiles)
+	tileX := Min(int(vX/virtualPixelsPerTile), tiles-1)
+	tileY := Min(int(vY/virtualPixelsPerTile), tiles-1)
+	return tileX, tileY
+}
+
+// tileForPointHandler serves GET /api/tileForPoint?x=&y=&z= with x and y in world UE units
+func tileForPointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	x, err := strconv.ParseFloat(query.Get("x"), 64)
+	if err != nil || !isFinite(x) {
+		writeError(w, r, http.StatusBadRequest, "invalid x")
+		return
+	}
+	y, err := strconv.ParseFloat(query.Get("y"), 64)
+	if err != nil || !isFinite(y) {
+		writeError(w, r, http.StatusBadRequest, "invalid y")
+		return
+	}
+	z, err := strconv.Atoi(query.Get("z"))
+	if err != nil || z < 0 || z >= int(config.MaxZoom) {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("z must be between 0 and %d", config.MaxZoom-1))
+		return
+	}
+	if x < 0 || y < 0 || x >= float64(config.ServersX)*config.GridSize || y >= float64(config.ServersY)*config.GridSize {
+		writeError(w, r, http.StatusBadRequest, "point is outside the world")
+		return
+	}
+
+	tileX, tileY := tileForPoint(x, y, z)
+	result := TileForPoint{
+		Z:   z,
+		X:   tileX,
+		Y:   tileY,
+		URL: fmt.Sprintf("%s/territoryTiles/%d/%d/%d.png", publicBaseURL(), z, tileX, tileY),
+	}
+	js, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,56 @@
+package territory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTileForPointMapsKnownCoordinate(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 4, 4
+		cfg.MaxZoom = 4
+		cfg.Host = "maps.example.com"
+		cfg.Port = 8880
+	})
+	// the middle of grid (2, 0), one grid per tile at zoom 2
+	x, y := 2.5*config.GridSize, 0.5*config.GridSize
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		tileForPointHandler(w, httptest.NewRequest(http.MethodGet, "/api/tileForPoint?"+query, nil))
+		return w
+	}
+
+	for zoom, want := range map[int][2]int{0: {0, 0}, 1: {1, 0}, 2: {2, 0}, 3: {5, 1}} {
+		w := get(fmt.Sprintf("x=%f&y=%f&z=%d", x, y, zoom))
+		if w.Code != http.StatusOK {
+			t.Fatalf("zoom %d: got %d: %s", zoom, w.Code, w.Body.String())
+		}
+		var tile TileForPoint
+		if err := json.Unmarshal(w.Body.Bytes(), &tile); err != nil {
+			t.Fatal(err)
+		}
+		if tile.Z != zoom || tile.X != want[0] || tile.Y != want[1] {
+			t.Errorf("zoom %d: tile %d/%d/%d, want %d/%d/%d", zoom, tile.Z, tile.X, tile.Y, zoom, want[0], want[1])
+		}
+		if wantURL := fmt.Sprintf("http://maps.example.com:8880/territoryTiles/%d/%d/%d.png", zoom, want[0], want[1]); tile.URL != wantURL {
+			t.Errorf("zoom %d: URL %q, want %q", zoom, tile.URL, wantURL)
+		}
+	}
+
+	for _, query := range []string{
+		"x=1&y=1",
+		"x=1&y=1&z=4",
+		"x=1&y=1&z=-1",
+		"x=-1&y=1&z=0",
+		fmt.Sprintf("x=%f&y=1&z=0", 4*config.GridSize),
+		"x=NaN&y=1&z=0",
+		"x=1&y=abc&z=0",
+	} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package territory
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// acceptsWebP checks the Accept header for image/webp with a non-zero quality
+func acceptsWebP(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != "image/webp" {
+			continue
+		}
+		return params["q"] != "0" && params["q"] != "0.0"
+	}
+	return false
+}
+
+// tileFormatHandler serves the .webp variant of a .png tile when the client accepts it and the
+// variant exists on disk, otherwise the request is passed through unchanged. Variants are made
+// out of band, one older than its .png is stale and the .png is served instead
+type tileFormatHandler struct {
+	next http.Handler
+}
+
+func (t *tileFormatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, ".png") {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+
+	// caches must key on Accept since the same URL can return either format
+	w.Header().Add("Vary", "Accept")
+	if acceptsWebP(r.Header.Get("Accept")) {
+		pngPath := path.Clean(r.URL.Path)
+		webpPath := strings.TrimSuffix(pngPath, ".png") + ".webp"
+		if webpIsCurrent(pngPath, webpPath) {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path = webpPath
+			r2.URL = &u
+			w.Header().Set("Content-Type", "image/webp")
+			t.next.ServeHTTP(w, r2)
+			return
+		}
+	}
+	t.next.ServeHTTP(w, r)
+}
+
+// webpIsCurrent checks the .webp variant exists and isn't older than the .png it was made from
+func webpIsCurrent(pngPath, webpPath string) bool {
+	webpInfo, err := os.Stat(filepath.Join(config.WWWDir, filepath.FromSlash(webpPath)))
+	if err != nil || webpInfo.IsDir() {
+		return false
+	}
+	pngInfo, err := os.Stat(filepath.Join(config.WWWDir, filepath.FromSlash(pngPath)))
+	return err != nil || !webpInfo.ModTime().Before(pngInfo.ModTime())
+}
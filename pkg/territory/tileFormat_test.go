@@ -0,0 +1,67 @@
+package territory
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTileFormatNegotiation(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 2 })
+	writeOutput(t, "territoryTiles/1/0/0.png", []byte("png tile"))
+	writeOutput(t, "territoryTiles/1/0/0.webp", []byte("webp tile"))
+	writeOutput(t, "territoryTiles/1/1/0.png", []byte("png only tile"))
+	handler := newHTTPHandler(nil)
+
+	for _, test := range []struct {
+		name, path, accept string
+		body, contentType  string
+	}{
+		{"webp client", "/territoryTiles/1/0/0.png", "image/webp,image/png,*/*", "webp tile", "image/webp"},
+		{"png only client", "/territoryTiles/1/0/0.png", "image/png,image/*;q=0.8", "png tile", "image/png"},
+		{"no Accept", "/territoryTiles/1/0/0.png", "", "png tile", "image/png"},
+		{"webp refused", "/territoryTiles/1/0/0.png", "image/webp;q=0, image/png", "png tile", "image/png"},
+		{"webp client without a webp variant", "/territoryTiles/1/1/0.png", "image/webp", "png only tile", "image/png"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != test.body {
+				t.Fatalf("got %d %q, want %q", w.Code, w.Body.String(), test.body)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type %q, want %q", got, test.contentType)
+			}
+			if !strings.Contains(w.Header().Get("Vary"), "Accept") {
+				t.Errorf("Vary %q, want Accept", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestStaleWebPVariantIsNotServed(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.MaxZoom = 2 })
+	webp := writeOutput(t, "territoryTiles/1/0/0.webp", []byte("old webp tile"))
+	writeOutput(t, "territoryTiles/1/0/0.png", []byte("new png tile"))
+	// the .png was re-rendered after the variant was made
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(webp, old, old); err != nil {
+		t.Fatal(err)
+	}
+	handler := newHTTPHandler(nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/territoryTiles/1/0/0.png", nil)
+	r.Header.Set("Accept", "image/webp")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Body.String() != "new png tile" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("got %s %q, want the current png", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
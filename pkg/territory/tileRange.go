@@ -0,0 +1,152 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// prebuiltTile is the settings a tile without claims is drawn with
+type prebuiltTile struct {
+	size     int
+	fogged   bool
+	fogColor string
+	fogAlpha uint8
+}
+
+// prebuiltTiles holds the encoded tiles without claims by their settings, a Generator reopened or
+// a compare run under another config mustn't get one drawn for the previous TileSize or fog
+var prebuiltTiles = struct {
+	sync.Mutex
+	data map[prebuiltTile][]byte
+}{data: make(map[prebuiltTile][]byte)}
+
+// encodePrebuiltTile returns the encoding of the tile without claims for key, encoded once
+func encodePrebuiltTile(key prebuiltTile) []byte {
+	prebuiltTiles.Lock()
+	defer prebuiltTiles.Unlock()
+	if data, ok := prebuiltTiles.data[key]; ok {
+		return data
+	}
+	img := image.NewRGBA(image.Rect(0, 0, key.size, key.size))
+	if key.fogged {
+		drawFog(img, nil)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	prebuiltTiles.data[key] = buf.Bytes()
+	return prebuiltTiles.data[key]
+}
+
+// transparentTilePNG returns a fully transparent tile, encoded once
+func transparentTilePNG() []byte {
+	return encodePrebuiltTile(prebuiltTile{size: config.TileSize})
+}
+
+// emptyTilePNG returns the tile without claims, fully fogged with EnableFog as no claim clears it
+// and otherwise transparent, encoded once
+func emptyTilePNG() []byte {
+	if !config.EnableFog {
+		return transparentTilePNG()
+	}
+	return encodePrebuiltTile(prebuiltTile{size: config.TileSize, fogged: true, fogColor: config.FogColor, fogAlpha: config.FogAlpha})
+}
+
+// writeEmptyTile saves the shared tile without claims, leaving the file (and S3) untouched when it
+// was already empty so claim-free tiles aren't rewritten every cycle
+func writeEmptyTile(ctx context.Context, filename string) error {
+	data := emptyTilePNG()
+	if existing, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+
+	// save the a tmp file
+	dir := path.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return classify(ErrStorage, "write", fmt.Errorf("failed to create directory %s: %v", dir, err))
+	}
+	tmpFilename := path.Join(dir, tempFileName("tmp_", ".png"))
+	if err := ioutil.WriteFile(tmpFilename, data, 0600); err != nil {
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", fmt.Errorf("failed to write %s: %v", tmpFilename, err))
+	}
+
+	// delete old file and rename tmp
+	os.Remove(filename)
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return classify(ErrStorage, "write", err)
+	}
+
+	if err := uploadToS3(ctx, filename); err != nil {
+		return uploadFailure(err)
+	}
+	return nil
+}
+
+// parseTilePath splits "<z>/<x>/<y>.png", ok is false when the path isn't shaped like a tile
+func parseTilePath(tilePath string) (z, x, y int, ok bool) {
+	parts := strings.Split(strings.Trim(tilePath, "/"), "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".png") {
+		return
+	}
+	var err error
+	if z, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	if x, err = strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	if y, err = strconv.Atoi(strings.TrimSuffix(parts[2], ".png")); err != nil {
+		return
+	}
+	return z, x, y, true
+}
+
+// tileInRange checks the tile exists for the configured world
+func tileInRange(z, x, y int) bool {
+	if z < 0 || z >= int(config.MaxZoom) {
+		return false
+	}
+	tiles := 1 << uint(z)
+	return x >= 0 && x < tiles && y >= 0 && y < tiles
+}
+
+// tileRangeHandler answers requests for tiles outside the world without touching the disk
+type tileRangeHandler struct {
+	prefix string
+	next   http.Handler
+}
+
+func (t *tileRangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseTilePath(strings.TrimPrefix(r.URL.Path, t.prefix))
+	if ok && tileInRange(z, x, y) && !tileInBounds(z, x, y) && config.OutOfRangeTransparentTiles {
+		// outside the claims' bounds the tile may never have been written, it's empty either way
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(emptyTilePNG())
+		return
+	}
+	if !ok || tileInRange(z, x, y) {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+
+	// out of range never changes for a given config so let clients cache it for a long time
+	w.Header().Set("Cache-Control", "max-age=86400")
+	if config.OutOfRangeTransparentTiles {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(transparentTilePNG())
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,124 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTileRangeBoundaries(t *testing.T) {
+	for _, transparent := range []bool{false, true} {
+		t.Run("transparent="+strconv.FormatBool(transparent), func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) {
+				cfg.MaxZoom = 4
+				cfg.OutOfRangeTransparentTiles = transparent
+			})
+			passed := 0
+			handler := &tileRangeHandler{prefix: "/territoryTiles/", next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passed++
+				w.WriteHeader(http.StatusTeapot)
+			})}
+			get := func(z, x, y int) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				path := "/territoryTiles/" + strconv.Itoa(z) + "/" + strconv.Itoa(x) + "/" + strconv.Itoa(y) + ".png"
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				return rec
+			}
+
+			for z := 0; z < int(config.MaxZoom); z++ {
+				last := 1<<uint(z) - 1
+				for _, tile := range [][2]int{{0, 0}, {last, 0}, {0, last}, {last, last}} {
+					passed = 0
+					if rec := get(z, tile[0], tile[1]); rec.Code != http.StatusTeapot || passed != 1 {
+						t.Errorf("in range tile %d/%d/%d answered %d, want it passed on", z, tile[0], tile[1], rec.Code)
+					}
+				}
+				outside := [][2]int{{-1, 0}, {0, -1}, {last + 1, 0}, {0, last + 1}, {last + 1, last + 1}}
+				for _, tile := range outside {
+					passed = 0
+					rec := get(z, tile[0], tile[1])
+					if passed != 0 {
+						t.Errorf("out of range tile %d/%d/%d was passed on", z, tile[0], tile[1])
+						continue
+					}
+					checkOutOfRangeTile(t, rec, transparent)
+				}
+			}
+			// a zoom past MaxZoom is outside the world too
+			passed = 0
+			if rec := get(int(config.MaxZoom), 0, 0); passed == 0 {
+				checkOutOfRangeTile(t, rec, transparent)
+			} else {
+				t.Errorf("tile at zoom MaxZoom was passed on")
+			}
+		})
+	}
+}
+
+// checkOutOfRangeTile checks the cached answer to a tile outside the world
+func checkOutOfRangeTile(t *testing.T, rec *httptest.ResponseRecorder, transparent bool) {
+	t.Helper()
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=86400" {
+		t.Errorf("Cache-Control %q, want max-age=86400", got)
+	}
+	if !transparent {
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("status %d, want 404", rec.Code)
+		}
+		return
+	}
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rec.Body.Bytes(), transparentTilePNG()) {
+		t.Errorf("status %d %q, want the transparent tile", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestEmptyTilePromotedByAClaimAndBack(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.MaxZoom = 2
+	})
+	tilePath := filepath.Join(config.WWWDir, "territoryTiles")
+	claimed := tileFilename(tilePath, 1, 0, 0)
+	promoted := tileFilename(tilePath, 1, 1, 1)
+	base := []Marker{{serverX: 0, serverY: 0, tribeOrOwnerID: 1000050001, relX: 0.5, relY: 0.5, markerType: MarkerLand}}
+	cycle := func(markers []Marker) []byte {
+		t.Helper()
+		generateTiles(context.Background(), tilePath, 1, newTileSnapshot(markers, 0, 0), nil)
+		data, err := ioutil.ReadFile(promoted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	if data := cycle(base); !bytes.Equal(data, emptyTilePNG()) {
+		t.Fatalf("tile without claims isn't the prebuilt empty tile")
+	}
+	if data, _ := ioutil.ReadFile(claimed); bytes.Equal(data, emptyTilePNG()) {
+		t.Fatalf("tile with a claim is the empty tile")
+	}
+	// an empty tile that's still empty isn't rewritten
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(promoted, old, old)
+	cycle(base)
+	if info, err := os.Stat(promoted); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("unchanged empty tile was rewritten")
+	}
+
+	// a claim appearing in it promotes it to a rendered tile
+	withClaim := append(base, Marker{serverX: 1, serverY: 1, tribeOrOwnerID: 1000050002, relX: 0.5, relY: 0.5, markerType: MarkerLand})
+	if data := cycle(withClaim); bytes.Equal(data, emptyTilePNG()) {
+		t.Fatalf("tile still empty after a claim appeared in it")
+	}
+	// and removing it makes it the empty tile again
+	if data := cycle(base); !bytes.Equal(data, emptyTilePNG()) {
+		t.Errorf("tile isn't the empty tile again after its claim went")
+	}
+}
@@ -0,0 +1,44 @@
+package territory
+
+import (
+	"github.com/GrapeshotGames/goquadtree/quadtree"
+)
+
+// tileSnapshot is a marker snapshot ready to render tiles from. Every zoom level shares the same
+// virtual scale, so the quadtree and owner sizes are built once per snapshot and then only read,
+// concurrently by the zoom goroutines
+type tileSnapshot struct {
+	markers    []Marker
+	serversX   int // world size in servers, 0 for config.ServersX / config.ServersY
+	serversY   int
+	quadTree   *quadtree.QuadTree
+	ownerSizes map[uint64]int
+}
+
+// tileVirtualPixels is the virtual size of the world at the tile scale, the size of MaxZoom's tiles
+func tileVirtualPixels() int {
+	return config.TileSize * (1 << (config.MaxZoom - 1))
+}
+
+// newTileSnapshot builds the quadtree of markers for a world of serversX by serversY servers, 0
+// for the whole world
+func newTileSnapshot(markers []Marker, serversX, serversY int) *tileSnapshot {
+	opts := MapOptions{virtualPixels: tileVirtualPixels(), serversX: serversX, serversY: serversY}
+	return &tileSnapshot{
+		markers:    markers,
+		serversX:   serversX,
+		serversY:   serversY,
+		quadTree:   createQuadTree(&opts, markers),
+		ownerSizes: ownerClaimSizes(markers),
+	}
+}
+
+// newRegionSnapshots builds the snapshot of every region by name, positions are relative to the
+// region's top left grid
+func newRegionSnapshots(markers []Marker) map[string]*tileSnapshot {
+	snapshots := make(map[string]*tileSnapshot, len(config.Regions))
+	for _, region := range config.Regions {
+		snapshots[region.Name] = newTileSnapshot(regionMarkers(region, markers), region.width(), region.height())
+	}
+	return snapshots
+}
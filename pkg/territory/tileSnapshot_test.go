@@ -0,0 +1,78 @@
+package territory
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSharedSnapshotRendersLikePerZoomTrees(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 3, 3
+		cfg.MaxZoom = 4
+	})
+	markers := worldClaims(3000)
+	shared := filepath.Join(config.WWWDir, "shared")
+	perZoom := filepath.Join(config.WWWDir, "perZoom")
+
+	// every zoom reads the one snapshot concurrently, as generateZooms does
+	snapshot := newTileSnapshot(markers, 0, 0)
+	var wg sync.WaitGroup
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		wg.Add(1)
+		go func(zoom uint) {
+			defer wg.Done()
+			generateTiles(context.Background(), shared, zoom, snapshot, nil)
+		}(zoom)
+	}
+	wg.Wait()
+	for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+		generateTiles(context.Background(), perZoom, zoom, newTileSnapshot(markers, 0, 0), nil)
+	}
+
+	want := readTiles(t, perZoom)
+	got := readTiles(t, shared)
+	if len(got) != len(want) || len(want) == 0 {
+		t.Fatalf("%d tiles from the shared snapshot, %d from per zoom trees", len(got), len(want))
+	}
+	for name, tile := range want {
+		if !bytes.Equal(got[name], tile) {
+			t.Errorf("tile %s differs when rendered from the shared snapshot", name)
+		}
+	}
+}
+
+// BenchmarkTileSnapshot compares the quadtree builds of a cycle over a 500k marker snapshot, once
+// for every zoom or once per zoom as before snapshots, see builds/op and B/op
+func BenchmarkTileSnapshot(b *testing.B) {
+	previous := config
+	defer func() { config = previous }()
+	config.ServersX, config.ServersY = 3, 3
+	config.TileSize, config.MaxZoom = 256, 6
+	markers := worldClaims(500000)
+
+	for _, bench := range []struct {
+		name   string
+		shared bool
+	}{
+		{"shared", true},
+		{"perZoom", false},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			builds := 0
+			for i := 0; i < b.N; i++ {
+				var snapshot *tileSnapshot
+				for zoom := uint(0); zoom < config.MaxZoom; zoom++ {
+					if snapshot == nil || !bench.shared {
+						snapshot = newTileSnapshot(markers, 0, 0)
+						builds++
+					}
+				}
+			}
+			b.ReportMetric(float64(builds)/float64(b.N), "builds/op")
+		})
+	}
+}
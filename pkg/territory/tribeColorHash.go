@@ -0,0 +1,52 @@
+package territory
+
+import (
+	"image/color"
+	"math"
+)
+
+const (
+	TribeColorPalette = "palette"
+	TribeColorHash    = "hash"
+)
+
+// mixTribeID scrambles the ID with the splitmix64 finalizer, tribe IDs are sequential so they
+// need mixing before neighbouring tribes get distant hues
+func mixTribeID(id uint64) uint64 {
+	id ^= id >> 30
+	id *= 0xbf58476d1ce4e5b9
+	id ^= id >> 27
+	id *= 0x94d049bb133111eb
+	id ^= id >> 31
+	return id
+}
+
+// hashTribeColor picks the tribe's hue from a hash of its ID, with TribeColorSaturation and
+// TribeColorValue fixed so every tribe is about as visible
+func hashTribeColor(tribeID uint64) color.NRGBA {
+	hue := float64(mixTribeID(tribeID)>>11) / (1 << 53) * 360
+	return hsvToNRGBA(hue, config.TribeColorSaturation, config.TribeColorValue)
+}
+
+// hsvToNRGBA converts a hue in degrees and saturation / value in 0-1 to an opaque color
+func hsvToNRGBA(h, s, v float64) color.NRGBA {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.NRGBA{uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255)), 0xff}
+}
@@ -0,0 +1,106 @@
+package territory
+
+import (
+	"image/color"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hueOf recovers the hue in degrees of an opaque color
+func hueOf(c color.NRGBA) float64 {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	if max == min {
+		return 0
+	}
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/(max-min), 6)
+	case g:
+		h = (b-r)/(max-min) + 2
+	default:
+		h = (r-g)/(max-min) + 4
+	}
+	if h < 0 {
+		h += 6
+	}
+	return h * 60
+}
+
+func TestHashTribeColorIsStable(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TribeColorMode = TribeColorHash })
+	const tribe = 1000050123
+	first := getTribeColor(tribe)
+	for i := 0; i < 3; i++ {
+		if got := getTribeColor(tribe); got != first {
+			t.Fatalf("tribe color changed from %v to %v", first, got)
+		}
+	}
+	// a tribe keeps its color across restarts, the hash doesn't depend on process state
+	useTestConfig(t, func(cfg *Configuration) { cfg.TribeColorMode = TribeColorHash })
+	if got := getTribeColor(tribe); got != first {
+		t.Errorf("tribe color after reloading the config %v, want %v", got, first)
+	}
+	if got := getTribeColor(42); got != colorValues["gray"] {
+		t.Errorf("player color %v, want gray", got)
+	}
+}
+
+func TestHashTribeColorSpreadsHues(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.TribeColorMode = TribeColorHash
+		cfg.TribeColorSaturation, cfg.TribeColorValue = 0.75, 0.9
+	})
+	const tribes, buckets = 12000, 12
+	var counts [buckets]int
+	var previous, spread float64
+	for id := uint64(1000050001); id < 1000050001+tribes; id++ {
+		c := getTribeColor(id)
+		if max := math.Max(float64(c.R), math.Max(float64(c.G), float64(c.B))); math.Abs(max-0.9*255) > 1 {
+			t.Fatalf("tribe %d color %v isn't at value 0.9", id, c)
+		}
+		if min := math.Min(float64(c.R), math.Min(float64(c.G), float64(c.B))); math.Abs(min-0.9*0.25*255) > 1 {
+			t.Fatalf("tribe %d color %v isn't at saturation 0.75", id, c)
+		}
+		hue := hueOf(c)
+		if id > 1000050001 {
+			d := math.Abs(hue - previous)
+			spread += math.Min(d, 360-d)
+		}
+		previous = hue
+		counts[int(hue/360*buckets)%buckets]++
+	}
+	// neighbouring IDs aren't neighbouring hues, random hues are 90 degrees apart on average
+	if mean := spread / (tribes - 1); mean < 80 {
+		t.Errorf("sequential tribes are on average %.1f degrees apart, want about 90", mean)
+	}
+	// sequential IDs land evenly around the wheel, each bucket within 15% of its share
+	for i, n := range counts {
+		if want := tribes / buckets; math.Abs(float64(n-want)) > 0.15*float64(want) {
+			t.Errorf("hues %d-%d hold %d tribes, want about %d", i*360/buckets, (i+1)*360/buckets, n, want)
+		}
+	}
+}
+
+func TestInvalidTribeColorSettingsFallBack(t *testing.T) {
+	logs := useLogBuffer(t)
+	filename := filepath.Join(t.TempDir(), "config.json")
+	js := `{"TribeColorMode": "rainbow", "TribeColorSaturation": 1.5, "TribeColorValue": -0.1}`
+	if err := ioutil.WriteFile(filename, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TribeColorMode != TribeColorPalette || cfg.TribeColorSaturation != 0.75 || cfg.TribeColorValue != 0.9 {
+		t.Errorf("loaded %q %v %v, want the defaults", cfg.TribeColorMode, cfg.TribeColorSaturation, cfg.TribeColorValue)
+	}
+	if warnings := strings.Count(logs.String(), "Warning! "); warnings != 3 {
+		t.Errorf("%d warnings, want one per setting:\n%s", warnings, logs)
+	}
+}
@@ -0,0 +1,159 @@
+package territory
+
+import (
+	"container/heap"
+	"math"
+)
+
+// GameTribeOutput is the JSON structure for the toptribes list
+type GameTribeOutput struct {
+	TribeID   uint64  `json:"tribeID"`
+	TribeName string  `json:"tribeName"`
+	Index     int     `json:"index"`
+	HomeGrid  string  `json:"homeGrid,omitempty"` // packed server ID of the tribe's home grid
+	Score     float64 `json:"score"`              // claims weighted by ClaimWeights, what the ranking is by
+	Land      uint32  `json:"land"`
+	Water     uint32  `json:"water"`
+}
+
+// ClaimWeights is how much a claim of each marker type adds to its tribe's score
+type ClaimWeights struct {
+	Land  float64
+	Water float64
+	Types map[uint8]float64 `json:",omitempty"` // other marker types by type byte, 0 when missing
+}
+
+// claimWeight is the score of one claim of markerType
+func claimWeight(markerType uint8) float64 {
+	switch markerType {
+	case MarkerLand:
+		return config.ClaimWeights.Land
+	case MarkerWater:
+		return config.ClaimWeights.Water
+	}
+	return config.ClaimWeights.Types[markerType]
+}
+
+// TribeCount holds the per tribe number of markers
+type TribeCount struct {
+	tribeID   uint64
+	count     uint32            // raw claims of every type
+	land      uint32            // raw land claims
+	water     uint32            // raw water claims
+	score     float64           // claims weighted by ClaimWeights
+	perServer map[uint32]uint32 // optional packed server ID (x<<16|y) -> count
+}
+
+// countTribeClaim adds a marker to its tribe's count, markers of players are ignored
+func countTribeClaim(counts map[uint64]*TribeCount, marker Marker) {
+	if !isTribeID(marker.tribeOrOwnerID) {
+		return
+	}
+	count, ok := counts[marker.tribeOrOwnerID]
+	if !ok {
+		count = &TribeCount{tribeID: marker.tribeOrOwnerID}
+		counts[marker.tribeOrOwnerID] = count
+	}
+	count.addClaim(marker.serverX, marker.serverY, marker.markerType)
+}
+
+// addClaim counts one claim on a server, keeping the per server breakdown if enabled
+func (t *TribeCount) addClaim(serverX, serverY int, markerType uint8) {
+	t.count++
+	switch markerType {
+	case MarkerLand:
+		t.land++
+	case MarkerWater:
+		t.water++
+	}
+	t.score += claimWeight(markerType)
+	if !config.TribeCountPerServer {
+		return
+	}
+	if t.perServer == nil {
+		t.perServer = make(map[uint32]uint32)
+	}
+	t.perServer[uint32(serverX<<16|serverY)]++
+}
+
+// TribeCountHeap heap wrapper
+type TribeCountHeap []*TribeCount
+
+func (h TribeCountHeap) Len() int { return len(h) }
+func (h TribeCountHeap) Less(i, j int) bool {
+	// ranked by weighted score, then raw count, then ID
+	if h[i].score != h[j].score {
+		return h[i].score < h[j].score
+	} else if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	} else {
+		return h[i].tribeID < h[j].tribeID
+	}
+}
+func (h TribeCountHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *TribeCountHeap) Push(x interface{}) { *h = append(*h, x.(*TribeCount)) }
+func (h *TribeCountHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func TopNTribes(n int, counts map[uint64]*TribeCount) []uint64 {
+	pq := make(TribeCountHeap, 0)
+	i := 0
+	for _, v := range counts {
+		// prime heap with n-items
+		if i < n {
+			pq = append(pq, v)
+			i++
+			continue
+		} else if i == n {
+			heap.Init(&pq)
+		}
+
+		// add n+1 items and fix up heap
+		heap.Push(&pq, v)
+		if pq.Len() > n {
+			heap.Pop(&pq)
+		}
+		i++
+	}
+	if i <= n {
+		heap.Init(&pq)
+	}
+	// popping the min-heap gives smallest first, the heap's array itself isn't sorted
+	results := make([]uint64, pq.Len())
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&pq).(*TribeCount).tribeID
+	}
+	return results
+}
+
+// TribeTrends returns each tribe's relative change in land claims between two counts, clamped to
+// -1.0 to 1.0. Trends color tiles so they ignore ClaimWeights, changing the weights never forces a
+// tile regeneration
+func TribeTrends(previous, current map[uint64]*TribeCount) map[uint64]float64 {
+	trends := make(map[uint64]float64)
+	for id, cur := range current {
+		prev, ok := previous[id]
+		if !ok {
+			trends[id] = 1.0
+			continue
+		}
+		if prev.land == 0 {
+			if cur.land > 0 {
+				trends[id] = 1.0
+			}
+			continue
+		}
+		trends[id] = math.Max(-1.0, math.Min(1.0, (float64(cur.land)-float64(prev.land))/float64(prev.land)))
+	}
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			trends[id] = -1.0
+		}
+	}
+	return trends
+}
@@ -0,0 +1,227 @@
+package territory
+
+import (
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// colorDistance is the squared RGB distance between two colors
+func colorDistance(a color.RGBA, b color.NRGBA) int {
+	dr, dg, db := int(a.R)-int(b.R), int(a.G)-int(b.G), int(a.B)-int(b.B)
+	return dr*dr + dg*dg + db*db
+}
+
+func TestTribeTrends(t *testing.T) {
+	const growing, shrinking, appeared, vanished = 1000050001, 1000050002, 1000050003, 1000050004
+	previous := map[uint64]*TribeCount{
+		growing:   {tribeID: growing, land: 10},
+		shrinking: {tribeID: shrinking, land: 10},
+		vanished:  {tribeID: vanished, land: 4},
+	}
+	current := map[uint64]*TribeCount{
+		growing:   {tribeID: growing, land: 15},
+		shrinking: {tribeID: shrinking, land: 5},
+		appeared:  {tribeID: appeared, land: 3},
+	}
+	want := map[uint64]float64{growing: 0.5, shrinking: -0.5, appeared: 1, vanished: -1}
+	trends := TribeTrends(previous, current)
+	if len(trends) != len(want) {
+		t.Fatalf("got %v, want %v", trends, want)
+	}
+	for id, trend := range want {
+		if trends[id] != trend {
+			t.Errorf("tribe %d trend %v, want %v", id, trends[id], trend)
+		}
+	}
+}
+
+func TestClaimTrendTintsRenderedColor(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.OpaqueClaims = true
+		cfg.EnableClaimTrend = true
+	})
+	const size = 1024
+	const tribe = 1000050001
+	marker := Marker{tribeOrOwnerID: tribe, relX: 0.5, relY: 0.5, markerType: MarkerLand}
+	render := func(trend float64) color.RGBA {
+		img := renderWorld([]Marker{marker}, MapOptions{tribeTrends: map[uint64]float64{tribe: trend}}, size)
+		return worldPixel(img, marker, size)
+	}
+
+	base := render(0)
+	if colorDistance(base, getTribeColor(tribe)) != 0 {
+		t.Fatalf("untinted claim %v, want the tribe color %v", base, getTribeColor(tribe))
+	}
+	for _, test := range []struct {
+		trend float64
+		tint  string
+	}{
+		{-0.5, config.ClaimShrinkColor},
+		{0.5, config.ClaimGrowthColor},
+	} {
+		target := colorValues[test.tint]
+		tinted := render(test.trend)
+		if colorDistance(tinted, target) >= colorDistance(base, target) {
+			t.Errorf("trend %v rendered %v, want it shifted from %v toward %s", test.trend, tinted, base, test.tint)
+		}
+		if full := render(2 * test.trend); colorDistance(full, target) >= colorDistance(tinted, target) {
+			t.Errorf("trend %v rendered %v, want it further toward %s than %v", 2*test.trend, full, test.tint, tinted)
+		}
+	}
+}
+
+func TestTribeCountPerServerTallies(t *testing.T) {
+	for _, perServer := range []bool{false, true} {
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.ServersX, cfg.ServersY = 3, 3
+			cfg.TribeCountPerServer = perServer
+		})
+		_, client := newTestRedis(t)
+		const tribe, other, player = 1000050001, 1000050002, 42
+		addClaim(t, client, GridID{X: 0, Y: 0}, tribe, 0.1, 0.1, MarkerLand)
+		addClaim(t, client, GridID{X: 0, Y: 0}, tribe, 0.2, 0.1, MarkerWater)
+		addClaim(t, client, GridID{X: 2, Y: 1}, tribe, 0.3, 0.1, MarkerLand)
+		addClaim(t, client, GridID{X: 2, Y: 1}, tribe, 0.4, 0.1, MarkerLand)
+		addClaim(t, client, GridID{X: 2, Y: 1}, tribe, 0.5, 0.1, MarkerLand)
+		addClaim(t, client, GridID{X: 1, Y: 2}, other, 0.5, 0.5, MarkerLand)
+		addClaim(t, client, GridID{X: 1, Y: 2}, player, 0.5, 0.5, MarkerLand)
+
+		_, _, counts := fetchClaimMarkers(client, true, nil)
+		if _, ok := counts[player]; ok {
+			t.Errorf("a player was counted")
+		}
+		if counts[tribe].count != 5 || counts[other].count != 1 {
+			t.Fatalf("counted %d and %d claims, want 5 and 1", counts[tribe].count, counts[other].count)
+		}
+		if !perServer {
+			if counts[tribe].perServer != nil {
+				t.Errorf("per server tallies kept with TribeCountPerServer off: %v", counts[tribe].perServer)
+			}
+			continue
+		}
+		want := map[uint32]uint32{0<<16 | 0: 2, 2<<16 | 1: 3}
+		if !reflect.DeepEqual(counts[tribe].perServer, want) {
+			t.Errorf("tribe per server %v, want %v", counts[tribe].perServer, want)
+		}
+		if want := map[uint32]uint32{1<<16 | 2: 1}; !reflect.DeepEqual(counts[other].perServer, want) {
+			t.Errorf("other tribe per server %v, want %v", counts[other].perServer, want)
+		}
+	}
+}
+
+// countClaims aggregates claims given as owner -> marker types
+func countClaims(claims map[uint64][]uint8) map[uint64]*TribeCount {
+	counts := make(map[uint64]*TribeCount)
+	for owner, types := range claims {
+		for _, markerType := range types {
+			countTribeClaim(counts, Marker{tribeOrOwnerID: owner, markerType: markerType})
+		}
+	}
+	return counts
+}
+
+func repeatType(markerType uint8, n int) []uint8 {
+	types := make([]uint8, n)
+	for i := range types {
+		types[i] = markerType
+	}
+	return types
+}
+
+func TestClaimWeightsChangeTheRanking(t *testing.T) {
+	const lander, sailor, builder = 1000050001, 1000050002, 1000050003
+	const outpost = 7 // a marker type without a name
+	claims := map[uint64][]uint8{
+		lander:  repeatType(MarkerLand, 10),
+		sailor:  repeatType(MarkerWater, 30),
+		builder: append(repeatType(MarkerLand, 5), outpost),
+		42:      repeatType(MarkerLand, 100),
+	}
+	for _, test := range []struct {
+		name    string
+		weights ClaimWeights
+		want    []uint64
+	}{
+		// 10, 7.5 and 5, players aren't ranked
+		{"defaults", ClaimWeights{Land: 1, Water: 0.25}, []uint64{lander, sailor, builder}},
+		{"equal", ClaimWeights{Land: 1, Water: 1}, []uint64{sailor, lander, builder}},
+		{"outposts count", ClaimWeights{Land: 1, Water: 0.25, Types: map[uint8]float64{outpost: 10}}, []uint64{builder, lander, sailor}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, func(cfg *Configuration) { cfg.ClaimWeights = test.weights })
+			counts := countClaims(claims)
+			if got := TopNTribes(10, counts); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ranked %v, want %v", got, test.want)
+			}
+			// the heap keeps the same order when it has to drop tribes
+			if got := TopNTribes(2, counts); !reflect.DeepEqual(got, test.want[:2]) {
+				t.Errorf("top 2 %v, want %v", got, test.want[:2])
+			}
+			if count := counts[sailor]; count.count != 30 || count.water != 30 || count.land != 0 {
+				t.Errorf("raw counts %+v changed with the weights", count)
+			}
+		})
+	}
+}
+
+func TestTribeRankingTieBreaks(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.ClaimWeights = ClaimWeights{Land: 1, Water: 0.25} })
+	const fewer, more, lowID, highID = 1000050001, 1000050002, 1000050003, 1000050004
+	counts := countClaims(map[uint64][]uint8{
+		// both score 4, more has more raw claims
+		fewer: repeatType(MarkerLand, 4),
+		more:  append(repeatType(MarkerLand, 2), repeatType(MarkerWater, 8)...),
+		// both score 3 from 3 claims, the higher ID ranks first as before weights
+		lowID:  repeatType(MarkerLand, 3),
+		highID: repeatType(MarkerLand, 3),
+	})
+	want := []uint64{more, fewer, highID, lowID}
+	if got := TopNTribes(4, counts); !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+}
+
+func TestClaimWeightsOnlyChangeTheAggregationHash(t *testing.T) {
+	useTestConfig(t, nil)
+	render, aggregation := renderSettingsHash(), aggregationSettingsHash()
+	config.ClaimWeights.Water = 0.5
+	if renderSettingsHash() != render {
+		t.Errorf("weights changed the render settings hash, tiles would be regenerated")
+	}
+	if aggregationSettingsHash() == aggregation {
+		t.Errorf("weights kept the aggregation hash, the leaderboard wouldn't be re-derived")
+	}
+}
+
+func TestClaimTrendSettingsFallBack(t *testing.T) {
+	buf := useLogBuffer(t)
+	filename := filepath.Join(t.TempDir(), "config.json")
+	settings := `{"ClaimGrowthColor": "limme", "ClaimShrinkColor": "", "ClaimTrendMaxBlend": 3}`
+	if err := ioutil.WriteFile(filename, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClaimGrowthColor != "lime" || cfg.ClaimShrinkColor != "maroon" || cfg.ClaimTrendMaxBlend != 1 {
+		t.Errorf("loaded %q, %q and %v, want lime, maroon and 1", cfg.ClaimGrowthColor, cfg.ClaimShrinkColor, cfg.ClaimTrendMaxBlend)
+	}
+	for _, warning := range []string{"Unknown ClaimGrowthColor", "Unknown ClaimShrinkColor", "ClaimTrendMaxBlend 3"} {
+		if !strings.Contains(buf.String(), warning) {
+			t.Errorf("no %q warning in:\n%s", warning, buf.String())
+		}
+	}
+
+	if err := ioutil.WriteFile(filename, []byte(`{"ClaimTrendMaxBlend": -0.5}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _ := loadConfig(filename); cfg.ClaimTrendMaxBlend != 0 {
+		t.Errorf("ClaimTrendMaxBlend -0.5 loaded as %v, want 0", cfg.ClaimTrendMaxBlend)
+	}
+}
@@ -0,0 +1,54 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maskColor is the single color per tribe masks are drawn in
+var maskColor = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+
+// generateTribeMasks renders a white on transparent PNG of each of the top TribeMaskCount tribes'
+// claims as <dir>/<tribeID>.png, masks of tribes that dropped out of the top are removed
+func generateTribeMasks(ctx context.Context, dir string, markers []Marker) {
+	counts := make(map[uint64]*TribeCount)
+	byTribe := make(map[uint64][]Marker)
+	for _, marker := range markers {
+		if !isTribeID(marker.tribeOrOwnerID) {
+			continue
+		}
+		countTribeClaim(counts, marker)
+		byTribe[marker.tribeOrOwnerID] = append(byTribe[marker.tribeOrOwnerID], marker)
+	}
+
+	keep := make(map[string]bool)
+	for _, tribeID := range TopNTribes(config.TribeMaskCount, counts) {
+		opts := MapOptions{mask: true}
+		opts.filename = path.Join(dir, strconv.FormatUint(tribeID, 10)+".png")
+		opts.actualPixels = config.TribeMaskSize
+		opts.virtualPixels = config.TribeMaskSize
+		opts.virtualClip = image.Rect(0, 0, config.TribeMaskSize, config.TribeMaskSize)
+		qt := createQuadTree(&opts, byTribe[tribeID])
+		if _, err := generateImage(ctx, &opts, qt); err != nil {
+			log.Printf("Warning! Failed to write mask of tribe %d: %v", tribeID, err)
+		}
+		keep[path.Base(opts.filename)] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".png") && !keep[file.Name()] {
+			os.Remove(path.Join(dir, file.Name()))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package territory
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestTribeMaskHasOnlyItsTribesClaims(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.LandRadiusUE = 140000
+		cfg.TribeMaskCount = 2
+		cfg.TribeMaskSize = 256
+		// the overlays the tiles get stay out of the masks
+		cfg.EnableFog = true
+		cfg.EnableContested = true
+	})
+	const big, medium, small, player = 1000050001, 1000050002, 1000050003, 42
+	markers := []Marker{
+		{tribeOrOwnerID: big, serverX: 0, serverY: 0, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: big, serverX: 1, serverY: 1, relX: 0.5, relY: 0.5, markerType: MarkerWater},
+		{tribeOrOwnerID: big, serverX: 0, serverY: 1, relX: 0.2, relY: 0.2, markerType: MarkerLand},
+		{tribeOrOwnerID: medium, serverX: 1, serverY: 0, relX: 0.5, relY: 0.5, markerType: MarkerLand},
+		{tribeOrOwnerID: medium, serverX: 0, serverY: 1, relX: 0.8, relY: 0.8, markerType: MarkerLand},
+		{tribeOrOwnerID: small, serverX: 1, serverY: 1, relX: 0.1, relY: 0.1, markerType: MarkerLand},
+		// players aren't tribes even with the most claims
+		{tribeOrOwnerID: player, serverX: 0, serverY: 0, relX: 0.1, relY: 0.9, markerType: MarkerLand},
+		{tribeOrOwnerID: player, serverX: 0, serverY: 0, relX: 0.9, relY: 0.1, markerType: MarkerLand},
+		{tribeOrOwnerID: player, serverX: 1, serverY: 0, relX: 0.1, relY: 0.9, markerType: MarkerLand},
+		{tribeOrOwnerID: player, serverX: 1, serverY: 0, relX: 0.9, relY: 0.1, markerType: MarkerLand},
+	}
+	dir := filepath.Join(config.WWWDir, "tribeMasks")
+	// a tribe that has dropped out of the top since the last cycle
+	writeOutput(t, "tribeMasks/1000050009.png", []byte("old"))
+
+	fake := useFakeS3(t)
+	generateTribeMasks(context.Background(), dir, markers)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "1000050001.png" || names[1] != "1000050002.png" {
+		t.Fatalf("masks %v, want the top 2 tribes", names)
+	}
+
+	for _, tribeID := range []uint64{big, medium} {
+		key := "tribeMasks/" + names[tribeID-big]
+		if _, ok := fake.objects[key]; !ok {
+			t.Errorf("mask of %d wasn't uploaded as %s", tribeID, key)
+		}
+		f, err := os.Open(filepath.Join(dir, names[tribeID-big]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(config.TribeMaskSize, config.TribeMaskSize) {
+			t.Fatalf("mask of %d is %v", tribeID, size)
+		}
+		rgba := image.NewRGBA(img.Bounds())
+		for y := 0; y < rgba.Rect.Dy(); y++ {
+			for x := 0; x < rgba.Rect.Dx(); x++ {
+				rgba.Set(x, y, img.At(x, y))
+			}
+		}
+		for _, marker := range markers {
+			got := worldPixel(rgba, marker, config.TribeMaskSize)
+			if marker.tribeOrOwnerID == tribeID {
+				if colorDistance(got, maskColor) != 0 {
+					t.Errorf("mask of %d is %v at its own claim %+v, want white", tribeID, got, marker)
+				}
+			} else if got.A != 0 {
+				t.Errorf("mask of %d is %v at %d's claim, want it clear", tribeID, got, marker.tribeOrOwnerID)
+			}
+		}
+		// nothing but white and clear
+		for i := 0; i < len(rgba.Pix); i += 4 {
+			if a := rgba.Pix[i+3]; a != 0 && (rgba.Pix[i] != a || rgba.Pix[i+1] != a || rgba.Pix[i+2] != a) {
+				t.Fatalf("mask of %d has a colored pixel %v", tribeID, rgba.Pix[i:i+4])
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package territory
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pendingUpload is one upload of a file, every caller that joins it shares its result
+type pendingUpload struct {
+	done chan struct{}
+	err  error
+}
+
+// uploadSlot tracks the upload in flight for a file and the one queued behind it
+type uploadSlot struct {
+	current   *pendingUpload
+	next      *pendingUpload
+	lastStart time.Time
+}
+
+var uploadSlots = struct {
+	sync.Mutex
+	byFile map[string]*uploadSlot
+}{byFile: make(map[string]*uploadSlot)}
+
+// uploadToS3 uploads a file. With UploadCoalesceMillis, uploads of one file start at least that
+// far apart and everything requested while one is in flight or waiting collapses into a single
+// follow up upload. The file is read when an upload starts so the latest contents are what land
+// in S3, and the first upload of a file is never delayed. Retries stop with ctx, see uploadWithRetry
+func uploadToS3(ctx context.Context, file string) error {
+	// Punt if no S3 config info
+	if len(config.AtlasS3AccessID) == 0 {
+		return nil
+	}
+	if config.UploadCoalesceMillis <= 0 {
+		return uploadWithRetry(ctx, file)
+	}
+	window := time.Duration(config.UploadCoalesceMillis) * time.Millisecond
+
+	uploadSlots.Lock()
+	slot, ok := uploadSlots.byFile[file]
+	if !ok {
+		slot = &uploadSlot{}
+		uploadSlots.byFile[file] = slot
+	}
+	if next := slot.next; next != nil {
+		uploadSlots.Unlock()
+		<-next.done
+		return next.err
+	}
+	upload := &pendingUpload{done: make(chan struct{})}
+	if slot.current == nil && clock.Now().Sub(slot.lastStart) >= window {
+		slot.current = upload
+		slot.lastStart = clock.Now()
+		uploadSlots.Unlock()
+		return runUpload(ctx, file, slot, upload)
+	}
+
+	// queue behind the upload in flight, later callers join this one
+	slot.next = upload
+	inFlight := slot.current
+	uploadSlots.Unlock()
+	if inFlight != nil {
+		<-inFlight.done
+	}
+	uploadSlots.Lock()
+	wait := window - clock.Now().Sub(slot.lastStart)
+	uploadSlots.Unlock()
+	if wait > 0 {
+		timer := clock.NewTimer(wait)
+		<-timer.C()
+	}
+
+	uploadSlots.Lock()
+	slot.next = nil
+	slot.current = upload
+	slot.lastStart = clock.Now()
+	uploadSlots.Unlock()
+	return runUpload(ctx, file, slot, upload)
+}
+
+// uploadBreaker is shared by the uploads of one cycle, once one of them ran out of retries on a
+// transient error the rest only get a single attempt so an S3 outage doesn't back off every tile
+type uploadBreaker struct {
+	tripped int32
+}
+
+type uploadBreakerKey struct{}
+
+// withUploadBreaker gives the uploads made with the returned context a breaker of their own, the
+// workers start each cycle with one
+func withUploadBreaker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uploadBreakerKey{}, &uploadBreaker{})
+}
+
+// uploadWithRetry retries transient upload failures within the cycle, unless the cycle's breaker
+// has tripped
+func uploadWithRetry(ctx context.Context, file string) error {
+	breaker, _ := ctx.Value(uploadBreakerKey{}).(*uploadBreaker)
+	if breaker != nil && atomic.LoadInt32(&breaker.tripped) != 0 {
+		return uploadFileToS3(file)
+	}
+	err := retryTransient(ctx, func() error { return uploadFileToS3(file) })
+	if breaker != nil && errors.Is(err, ErrTransient) && atomic.CompareAndSwapInt32(&breaker.tripped, 0, 1) {
+		log.Printf("Warning! Not retrying uploads for the rest of the cycle: %v", err)
+	}
+	return err
+}
+
+func runUpload(ctx context.Context, file string, slot *uploadSlot, upload *pendingUpload) error {
+	upload.err = uploadWithRetry(ctx, file)
+	uploadSlots.Lock()
+	slot.current = nil
+	uploadSlots.Unlock()
+	close(upload.done)
+	return upload.err
+}
@@ -0,0 +1,103 @@
+package territory
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRapidUploadsOfOneFileCoalesce(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.UploadCoalesceMillis = 300 })
+	fake := useFakeS3(t)
+	const key = "gameTiles/world.map"
+	filename := writeOutput(t, key, []byte("v1"))
+
+	// the first upload isn't delayed
+	start := time.Now()
+	if err := uploadToS3(context.Background(), filename); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("first upload took %v, want it immediate", elapsed)
+	}
+
+	// a burst within the window queues one upload that the rest join
+	var uploads sync.WaitGroup
+	upload := func() {
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+			if err := uploadToS3(context.Background(), filename); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	ioutil.WriteFile(filename, []byte("v2"), 0600)
+	upload()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		uploadSlots.Lock()
+		queued := uploadSlots.byFile[filename].next != nil
+		uploadSlots.Unlock()
+		if queued {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the second upload wasn't queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, body := range []string{"v3", "v4"} {
+		ioutil.WriteFile(filename, []byte(body), 0600)
+		upload()
+	}
+	uploads.Wait()
+
+	if puts := fake.putCount(key); puts != 2 {
+		t.Errorf("%d uploads, want the first and one for the burst", puts)
+	}
+	fake.Lock()
+	body := string(fake.objects[key])
+	fake.Unlock()
+	if body != "v4" {
+		t.Errorf("S3 has %q, want the latest v4", body)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("burst uploaded after %v, want it held until the window passed", elapsed)
+	}
+}
+
+func TestUploadBreakerStopsRetriesForTheCycle(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) { cfg.TransientRetries, cfg.TransientBackoffMillis = 2, 1 })
+	useLogBuffer(t)
+	usePipelineErrors(t)
+	fake := useFakeS3(t)
+	fake.Lock()
+	fake.failPuts = true
+	fake.Unlock()
+	tiles := []string{
+		writeOutput(t, "territoryTiles/0/0/0.png", []byte("a")),
+		writeOutput(t, "territoryTiles/1/0/0.png", []byte("b")),
+		writeOutput(t, "territoryTiles/1/1/0.png", []byte("c")),
+	}
+
+	// the first tile retries, once it gives up the others get a single attempt
+	ctx := withUploadBreaker(context.Background())
+	for _, tile := range tiles {
+		if err := uploadToS3(ctx, tile); err == nil {
+			t.Fatalf("upload of %s succeeded with S3 failing", tile)
+		}
+	}
+	if retries := getErrors(t).Counts["transient"]; retries != 2 {
+		t.Errorf("%d retries, want the first tile's 2", retries)
+	}
+
+	// the next cycle starts with a closed breaker
+	usePipelineErrors(t)
+	uploadToS3(withUploadBreaker(context.Background()), tiles[0])
+	if retries := getErrors(t).Counts["transient"]; retries != 2 {
+		t.Errorf("%d retries in the next cycle, want 2", retries)
+	}
+}
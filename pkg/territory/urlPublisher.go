@@ -0,0 +1,129 @@
+package territory
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	URLOwnershipTakeover = "takeover" // publish anyway, logging the other publisher
+	URLOwnershipRespect  = "respect"  // leave territory_urls to a publisher that wrote after us
+)
+
+// URLConflict is another publisher that wrote territory_urls after our last write
+type URLConflict struct {
+	Publisher   string    `json:"publisher"`
+	PublishedAt time.Time `json:"publishedAt"`
+	Skipped     bool      `json:"skipped"` // our write was skipped under "respect"
+	DetectedAt  time.Time `json:"detectedAt"`
+}
+
+var urlPublisher = struct {
+	sync.Mutex
+	lastWrite  time.Time
+	conflict   *URLConflict // the latest conflict, nil once we publish unopposed
+	generation ArtifactMeta // of the world.map our last write points at
+	tag        int32        // content tag of our last write
+	urls       string       // URL fields of our last write, to tell whether a refresh changed them
+}{}
+
+// urlWrites serializes our writes to territory_urls so a refresh never republishes an older
+// generation over a newer one
+var urlWrites sync.Mutex
+
+// urlPublisherName identifies our writes to territory_urls, URLPublisherName or hostname:pid
+func urlPublisherName() string {
+	if len(config.URLPublisherName) > 0 {
+		return config.URLPublisherName
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// checkURLOwnership reads who last published territory_urls before we write it, returning false
+// when URLOwnershipPolicy says to leave it alone. A read error doesn't block publishing
+func checkURLOwnership(client *redis.Client, name string) bool {
+	values, err := client.HMGet("territory_urls", "publisher", "publishedAt").Result()
+	if err != nil {
+		log.Printf("Warning! Failed to read the territory_urls publisher: %v", err)
+		return true
+	}
+	publisher, _ := values[0].(string)
+	publishedAtValue, _ := values[1].(string)
+	publishedAt, _ := time.Parse(time.RFC3339Nano, publishedAtValue)
+
+	urlPublisher.Lock()
+	defer urlPublisher.Unlock()
+	if len(publisher) == 0 || publisher == name || !publishedAt.After(urlPublisher.lastWrite) {
+		urlPublisher.conflict = nil
+		return true
+	}
+
+	respect := config.URLOwnershipPolicy == URLOwnershipRespect
+	urlPublisher.conflict = &URLConflict{Publisher: publisher, PublishedAt: publishedAt, Skipped: respect, DetectedAt: time.Now().UTC()}
+	if respect {
+		log.Printf("Warning! territory_urls was published by %s at %s after our last write, not publishing over it (URLOwnershipPolicy respect)",
+			publisher, publishedAtValue)
+		return false
+	}
+	log.Printf("Warning! territory_urls was published by %s at %s after our last write, publishing over it (URLOwnershipPolicy takeover)",
+		publisher, publishedAtValue)
+	return true
+}
+
+// recordURLWrite remembers when and what we last published to territory_urls, returning whether
+// the URLs changed from our previous write
+func recordURLWrite(at time.Time, generation ArtifactMeta, tag int32, urls string) bool {
+	urlPublisher.Lock()
+	defer urlPublisher.Unlock()
+	changed := urls != urlPublisher.urls
+	urlPublisher.lastWrite = at
+	urlPublisher.generation = generation
+	urlPublisher.tag = tag
+	urlPublisher.urls = urls
+	return changed
+}
+
+// refreshUrlsInRedis re-publishes the generation and tag of our last write, returning whether the
+// URLs changed, e.g. after a mirror or access key change. Nothing is written before our first write
+func refreshUrlsInRedis(client *redis.Client) bool {
+	urlWrites.Lock()
+	defer urlWrites.Unlock()
+	urlPublisher.Lock()
+	generation, tag, published := urlPublisher.generation, urlPublisher.tag, !urlPublisher.lastWrite.IsZero()
+	urlPublisher.Unlock()
+	if !published {
+		return false
+	}
+	_, changed := writeUrlsToRedis(client, generation, tag)
+	return changed
+}
+
+// urlRefreshWorker re-publishes territory_urls every URLRefreshIntervalSeconds so publishedAt stays
+// current through idle periods, game servers are only notified when the URLs changed
+func urlRefreshWorker(ctx context.Context, client *redis.Client, notifyClient *redis.Client) {
+	schedule := newIntervalSchedule(time.Duration(config.URLRefreshIntervalSeconds) * time.Second)
+	defer schedule.stop()
+	for schedule.wait(ctx) {
+		if leader, _ := isLeader(); !leader || !confirmLeadership(client) {
+			continue
+		}
+		if refreshUrlsInRedis(client) {
+			log.Println("territory_urls changed on refresh, notifying game servers")
+			notifyUrlsChanged(notifyClient)
+		}
+	}
+}
+
+// urlConflict is the latest conflict for /health, nil when there is none
+func urlConflict() *URLConflict {
+	urlPublisher.Lock()
+	defer urlPublisher.Unlock()
+	return urlPublisher.conflict
+}
@@ -0,0 +1,203 @@
+package territory
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// useURLPublisher starts the test as a publisher that never wrote territory_urls
+func useURLPublisher(t *testing.T, name, policy string) {
+	t.Helper()
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.URLPublisherName = name
+		cfg.URLOwnershipPolicy = policy
+	})
+	reset := func() {
+		urlPublisher.Lock()
+		urlPublisher.lastWrite, urlPublisher.conflict = time.Time{}, nil
+		urlPublisher.generation, urlPublisher.tag, urlPublisher.urls = ArtifactMeta{}, 0, ""
+		urlPublisher.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// competingWrite is the legacy script publishing its own URL at the given time
+func competingWrite(t *testing.T, client *redis.Client, at time.Time) {
+	t.Helper()
+	err := client.HMSet("territory_urls", map[string]interface{}{
+		"world":       "http://legacy.example.com/world.map",
+		"publisher":   "legacy-script",
+		"publishedAt": at.UTC().Format(time.RFC3339Nano),
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompetingPublisherUnderEachPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy    string
+		published bool
+		log       string
+	}{
+		{URLOwnershipRespect, false, "not publishing over it (URLOwnershipPolicy respect)"},
+		{URLOwnershipTakeover, true, "publishing over it (URLOwnershipPolicy takeover)"},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			useURLPublisher(t, "territory-1", test.policy)
+			logs := useLogBuffer(t)
+			_, client := newTestRedis(t)
+
+			if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 1); !written {
+				t.Fatalf("first write was skipped")
+			}
+			publishedAt, err := time.Parse(time.RFC3339Nano, client.HGet("territory_urls", "publishedAt").Val())
+			if publisherOf(t, client) != "territory-1" || err != nil || time.Since(publishedAt) > time.Minute {
+				t.Errorf("our write is by %q at %v (%v)", publisherOf(t, client), publishedAt, err)
+			}
+			if urlConflict() != nil {
+				t.Errorf("conflict %+v without another publisher", urlConflict())
+			}
+
+			competingWrite(t, client, time.Now().Add(time.Second))
+			written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 2)
+			if written != test.published {
+				t.Errorf("wrote %v over a newer competing write, want %v", written, test.published)
+			}
+			world := client.HGet("territory_urls", "world").Val()
+			if legacy := world == "http://legacy.example.com/world.map"; legacy == test.published {
+				t.Errorf("territory_urls world is %q after our write", world)
+			}
+			conflict := urlConflict()
+			if conflict == nil || conflict.Publisher != "legacy-script" || conflict.Skipped == test.published {
+				t.Fatalf("conflict %+v, want legacy-script with skipped %v", conflict, !test.published)
+			}
+			if !strings.Contains(logs.String(), "territory_urls was published by legacy-script") || !strings.Contains(logs.String(), test.log) {
+				t.Errorf("the conflict wasn't logged:\n%s", logs)
+			}
+			if health := getHealth(t, newHTTPHandler(nil)); health.URLConflict == nil || health.URLConflict.Publisher != "legacy-script" {
+				t.Errorf("/health reports conflict %+v", health.URLConflict)
+			}
+		})
+	}
+}
+
+func TestOlderCompetingWritesDontBlockPublishing(t *testing.T) {
+	useURLPublisher(t, "territory-1", URLOwnershipRespect)
+	useLogBuffer(t)
+	_, client := newTestRedis(t)
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 1); !written {
+		t.Fatalf("first write was skipped")
+	}
+
+	// a write stamped before our last one, e.g. from a slow clock, isn't newer than ours
+	competingWrite(t, client, time.Now().Add(-time.Hour))
+	if written, _ := writeUrlsToRedis(client, ArtifactMeta{}, 2); !written || publisherOf(t, client) != "territory-1" {
+		t.Errorf("an older competing write blocked ours")
+	}
+	if urlConflict() != nil {
+		t.Errorf("conflict %+v from an older write", urlConflict())
+	}
+}
+
+// startURLRefresh runs the URL refresh worker with a fake clock until the test ends. The returned
+// func fires one refresh interval and returns publishedAt afterwards, waiting for it to move when
+// a write is expected
+func startURLRefresh(t *testing.T, client *redis.Client) func(expectWrite bool) string {
+	t.Helper()
+	fake := useFakeClock(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		urlRefreshWorker(ctx, client, client)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	for fake.tickerCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return func(expectWrite bool) string {
+		t.Helper()
+		before, _ := client.HGet("territory_urls", "publishedAt").Result()
+		fake.tick()
+		deadline := time.Now().Add(5 * time.Second)
+		if !expectWrite {
+			deadline = time.Now().Add(100 * time.Millisecond)
+		}
+		for time.Now().Before(deadline) {
+			if after, _ := client.HGet("territory_urls", "publishedAt").Result(); after != before {
+				// the refresh holds urlWrites until it's done with the config
+				urlWrites.Lock()
+				urlWrites.Unlock()
+				return after
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if expectWrite {
+			t.Fatalf("territory_urls wasn't refreshed")
+		}
+		return before
+	}
+}
+
+func TestURLRefreshKeepsIdleURLsCurrent(t *testing.T) {
+	useURLPublisher(t, "primary", "takeover")
+	config.URLRefreshIntervalSeconds = 60
+	config.AlternativeURLs = []URLMirror{{URL: "na.example.com", Weight: 1}}
+	_, client := newTestRedis(t)
+	notifications := subscribeNotifications(t, client)
+	refresh := startURLRefresh(t, client)
+
+	refresh(false)
+	if exists, _ := client.Exists("territory_urls").Result(); exists != 0 {
+		t.Fatalf("territory_urls was refreshed before the first generation was published")
+	}
+
+	urlWrites.Lock()
+	writeUrlsToRedis(client, ArtifactMeta{CRC: 5}, 9)
+	urlWrites.Unlock()
+	world, _ := client.HGet("territory_urls", "world").Result()
+	published, _ := client.HGet("territory_urls", "publishedAt").Result()
+
+	// idle intervals move publishedAt without changing the URLs or notifying
+	for i := 0; i < 3; i++ {
+		refreshed := refresh(true)
+		if refreshed <= published {
+			t.Errorf("interval %d: publishedAt went from %s to %s", i, published, refreshed)
+		}
+		published = refreshed
+		if got, _ := client.HGet("territory_urls", "world").Result(); got != world {
+			t.Errorf("interval %d: an idle refresh changed the URL from %s to %s", i, world, got)
+		}
+	}
+	if n := notifications(); n != 0 {
+		t.Errorf("idle refreshes notified the game servers %d times", n)
+	}
+
+	// a changed mirror goes out with the same tag on the next refresh, notified once
+	config.AlternativeURLs = []URLMirror{{URL: "eu.example.com", Weight: 1}}
+	refresh(true)
+	if got, _ := client.HGet("territory_urls", "world").Result(); got != "http://eu.example.com/gameTiles/world.map?t=9" {
+		t.Errorf("refreshed URL %s, want the new mirror with the same tag", got)
+	}
+	refresh(true)
+	if n := notifications(); n != 1 {
+		t.Errorf("the changed URL notified the game servers %d times, want 1", n)
+	}
+
+	// followers leave territory_urls to the leader
+	config.LeaderLockKey = "territory_leader"
+	before, _ := client.HGet("territory_urls", "publishedAt").Result()
+	if after := refresh(false); after != before {
+		t.Errorf("a follower refreshed territory_urls")
+	}
+}
@@ -0,0 +1,200 @@
+package territory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const verifyMaxCoordinateSamples = 20
+
+// VerifyCountMismatch is an owner whose claim counts differ between redis and world.map
+type VerifyCountMismatch struct {
+	Owner          uint64 `json:"owner"`
+	ExpectedLand   int    `json:"expectedLand"`
+	PublishedLand  int    `json:"publishedLand"`
+	ExpectedWater  int    `json:"expectedWater"`
+	PublishedWater int    `json:"publishedWater"`
+}
+
+// VerifyCoordinateMismatch is a claim whose position differs between redis and world.map
+type VerifyCoordinateMismatch struct {
+	Owner     uint64               `json:"owner"`
+	Water     bool                 `json:"water"`
+	Expected  ClaimFlagOutputEntry `json:"expected"`
+	Published ClaimFlagOutputEntry `json:"published"`
+}
+
+// VerifyReport is the result of comparing one published .map against redis
+type VerifyReport struct {
+	File                 string                     `json:"file"`
+	GameSize             int                        `json:"gameSize"`
+	Pass                 bool                       `json:"pass"`
+	Errors               []string                   `json:"errors,omitempty"`
+	ExpectedOwners       int                        `json:"expectedOwners"`
+	PublishedOwners      int                        `json:"publishedOwners"`
+	MissingOwners        []uint64                   `json:"missingOwners,omitempty"`
+	ExtraOwners          []uint64                   `json:"extraOwners,omitempty"`
+	CountMismatches      []VerifyCountMismatch      `json:"countMismatches,omitempty"`
+	CoordinateMismatches []VerifyCoordinateMismatch `json:"coordinateMismatches,omitempty"`
+	ColorMismatches      []uint64                   `json:"colorMismatches,omitempty"`
+	CoverageMismatches   int                        `json:"coverageMismatches,omitempty"`
+}
+
+// VerifyResult covers every .map variant, it passes only if all of them do
+type VerifyResult struct {
+	Pass      bool           `json:"pass"`
+	CheckedAt time.Time      `json:"checkedAt"`
+	Files     []VerifyReport `json:"files"`
+}
+
+// verifyWorldMap decodes the published .map files and compares them with a fresh aggregation of
+// the markers in redis, using the same filters and scaling as the generator
+func verifyWorldMap(client *redis.Client) VerifyResult {
+	result := VerifyResult{Pass: true, CheckedAt: time.Now().UTC()}
+
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	withSharedTribeColors(client, markers, 0) // the color table uses the shared colors
+	owners, _, _ := buildMapOwners(markers)
+	mapVersion := negotiateMapVersion(fetchGameCapabilities(client))
+	for _, file := range gameMapFiles() {
+		expected := owners
+		if file.size != config.GameSize {
+			expected = scaleMapOwners(owners, file.size)
+		}
+		report := verifyMapFile(path.Join(config.WWWDir, "gameTiles", file.name), file.size, mapVersion, expected)
+		report.File = file.name
+		result.Pass = result.Pass && report.Pass
+		result.Files = append(result.Files, report)
+	}
+	return result
+}
+
+// verifyMapFile compares one decoded .map against the expected owners
+func verifyMapFile(filename string, gameSize int, mapVersion uint16, expected []FlagOwnerOutputHeader) VerifyReport {
+	report := VerifyReport{GameSize: gameSize}
+	header, published, coverage, err := readMapFile(filename)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+
+	// header values the generator derives from config and the game's capabilities
+	if header.Version != mapVersion {
+		report.Errors = append(report.Errors, fmt.Sprintf("map version is %d, expected %d", header.Version, mapVersion))
+	}
+	if int(header.DestPixels) != gameSize {
+		report.Errors = append(report.Errors, fmt.Sprintf("destination size is %d, expected %d", header.DestPixels, gameSize))
+	}
+
+	report.ExpectedOwners = len(expected)
+	report.PublishedOwners = len(published)
+	publishedByOwner := make(map[uint64]FlagOwnerOutputHeader, len(published))
+	for _, owner := range published {
+		publishedByOwner[owner.TribeOrPlayerID] = owner
+	}
+
+	for _, want := range expected {
+		got, ok := publishedByOwner[want.TribeOrPlayerID]
+		if !ok {
+			report.MissingOwners = append(report.MissingOwners, want.TribeOrPlayerID)
+			continue
+		}
+		delete(publishedByOwner, want.TribeOrPlayerID)
+
+		if len(want.LandClaims) != len(got.LandClaims) || len(want.WaterClaims) != len(got.WaterClaims) {
+			report.CountMismatches = append(report.CountMismatches, VerifyCountMismatch{
+				Owner:          want.TribeOrPlayerID,
+				ExpectedLand:   len(want.LandClaims),
+				PublishedLand:  len(got.LandClaims),
+				ExpectedWater:  len(want.WaterClaims),
+				PublishedWater: len(got.WaterClaims),
+			})
+			continue
+		}
+
+		if header.Flags&MapFlagColorTable != 0 && want.Color != got.Color {
+			report.ColorMismatches = append(report.ColorMismatches, want.TribeOrPlayerID)
+		}
+
+		// claim order follows redis iteration order so compare them sorted
+		for _, water := range []bool{false, true} {
+			wantClaims, gotClaims := want.LandClaims, got.LandClaims
+			if water {
+				wantClaims, gotClaims = want.WaterClaims, got.WaterClaims
+			}
+			sortClaims(wantClaims)
+			sortClaims(gotClaims)
+			for i := range wantClaims {
+				if wantClaims[i] != gotClaims[i] && len(report.CoordinateMismatches) < verifyMaxCoordinateSamples {
+					report.CoordinateMismatches = append(report.CoordinateMismatches, VerifyCoordinateMismatch{
+						Owner:     want.TribeOrPlayerID,
+						Water:     water,
+						Expected:  wantClaims[i],
+						Published: gotClaims[i],
+					})
+				}
+			}
+		}
+	}
+	// the raster indexes owners in file order so it's only comparable when the owners match
+	if coverage != nil && len(report.MissingOwners) == 0 && len(publishedByOwner) == 0 {
+		want, _, _ := rasterizeCoverage(mapOwnerList(expected), gameSize)
+		if want.Width != coverage.Width || want.Height != coverage.Height {
+			report.Errors = append(report.Errors, fmt.Sprintf("coverage is %dx%d, expected %dx%d", coverage.Width, coverage.Height, want.Width, want.Height))
+		} else {
+			for i := range want.Cells {
+				if want.Cells[i] != coverage.Cells[i] {
+					report.CoverageMismatches++
+				}
+			}
+		}
+	}
+	for id := range publishedByOwner {
+		report.ExtraOwners = append(report.ExtraOwners, id)
+	}
+	sort.Slice(report.ExtraOwners, func(i, j int) bool { return report.ExtraOwners[i] < report.ExtraOwners[j] })
+
+	report.Pass = len(report.Errors) == 0 && len(report.MissingOwners) == 0 && len(report.ExtraOwners) == 0 &&
+		len(report.CountMismatches) == 0 && len(report.CoordinateMismatches) == 0 &&
+		len(report.ColorMismatches) == 0 && report.CoverageMismatches == 0
+	return report
+}
+
+// verifyHandler serves POST /admin/verify
+func verifyHandler(client *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		js, err := json.Marshal(verifyWorldMap(client))
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+	}
+}
+
+// verifyWorker periodically checks the published .map files and logs failures
+func verifyWorker(ctx context.Context, client *redis.Client) {
+	schedule := newIntervalSchedule(time.Duration(config.VerifyIntervalSeconds) * time.Second)
+	defer schedule.stop()
+	for schedule.wait(ctx) {
+		for _, report := range verifyWorldMap(client).Files {
+			if !report.Pass {
+				log.Printf("Warning! %s verification failed: %d errors, %d missing owners, %d extra owners, %d count mismatches, %d coordinate mismatches",
+					report.File, len(report.Errors), len(report.MissingOwners), len(report.ExtraOwners), len(report.CountMismatches), len(report.CoordinateMismatches))
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package territory
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyWorldMapAgainstRedis(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.GameSizes = []int{cfg.GameSize / 2}
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, 0.25, 0.75, MarkerWater)
+	nextCycle := startGameWorker(t, client)
+
+	result := verifyWorldMap(client)
+	if !result.Pass || len(result.Files) != 2 {
+		t.Fatalf("fresh .map files failed verify: %+v", result)
+	}
+
+	// redis moves on before the next cycle
+	addClaim(t, client, GridID{X: 1, Y: 0}, 1000050003, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 0, Y: 1}, 1000050001, 0.5, 0.5, MarkerLand)
+	result = verifyWorldMap(client)
+	if result.Pass {
+		t.Fatalf("stale .map files passed verify")
+	}
+	for _, report := range result.Files {
+		if !reflect.DeepEqual(report.MissingOwners, []uint64{1000050003}) {
+			t.Errorf("%s missing owners %v, want the new one", report.File, report.MissingOwners)
+		}
+		if len(report.CountMismatches) != 1 || report.CountMismatches[0].Owner != 1000050001 ||
+			report.CountMismatches[0].ExpectedLand != 2 || report.CountMismatches[0].PublishedLand != 1 {
+			t.Errorf("%s count mismatches %+v, want 1000050001's second land claim", report.File, report.CountMismatches)
+		}
+	}
+
+	nextCycle()
+	if result := verifyWorldMap(client); !result.Pass {
+		t.Errorf("regenerated .map files failed verify: %+v", result)
+	}
+}
+
+func TestVerifyChecksTheCoverageRaster(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 2
+		cfg.LandRadiusUE = 140000
+		cfg.MapFileVersion = 3
+		cfg.MapCoverage = true
+	})
+	useTestStateStore(t)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0, Y: 0}, 1000050001, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 1, Y: 1}, 1000050002, 0.25, 0.75, MarkerLand)
+	startGameWorker(t, client)
+
+	result := verifyWorldMap(client)
+	if !result.Pass {
+		t.Fatalf("fresh .map failed verify: %+v", result)
+	}
+	if _, _, coverage, _ := readMapFile(filepath.Join(config.WWWDir, "gameTiles", "world.map")); coverage == nil {
+		t.Fatalf("world.map was written without the coverage raster")
+	}
+
+	// the same claims rasterized with a larger radius don't match the published raster
+	config.LandRadiusUE = 280000
+	result = verifyWorldMap(client)
+	if result.Pass || len(result.Files) != 1 || result.Files[0].CoverageMismatches == 0 {
+		t.Errorf("changed coverage passed verify: %+v", result)
+	}
+}
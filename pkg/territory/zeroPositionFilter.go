@@ -0,0 +1,125 @@
+package territory
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ZeroPositionDrops is a worker's dropped zero position markers, reported by /health
+type ZeroPositionDrops struct {
+	Worker    string `json:"worker"`
+	LastCycle int    `json:"lastCycle"`
+	Total     int    `json:"total"`
+}
+
+// zeroPositionDrops is every worker's drop counts for /health
+var zeroPositionDrops = struct {
+	sync.Mutex
+	byWorker map[string]*ZeroPositionDrops
+}{byWorker: make(map[string]*ZeroPositionDrops)}
+
+// quarantined tracks payloads already written so each fetch doesn't repeat them, an evicted
+// payload is only written again
+var quarantined struct {
+	sync.Mutex
+	payloads *lruCache
+}
+
+// isZeroPositionPayload checks if a raw redis marker has both relX and relY of exactly 0. Payloads
+// shorter than a claim aren't, the caller counts them as corrupt
+func isZeroPositionPayload(bytes []byte) bool {
+	if len(bytes) < 13 {
+		return false
+	}
+	return binary.LittleEndian.Uint16(bytes[8:10]) == 0 && binary.LittleEndian.Uint16(bytes[10:12]) == 0
+}
+
+// dropZeroPositionMarkers removes markers written with zeroed position bytes (a save race in game)
+// when the same owner has other markers in the grid. A lone origin marker is kept as it may be real.
+func dropZeroPositionMarkers(serverX, serverY int, results []string) (kept []string, dropped []string) {
+	ownersWithPositions := make(map[uint64]bool)
+	for _, rawString := range results {
+		bytes := []byte(rawString)
+		if len(bytes) >= 13 && !isZeroPositionPayload(bytes) {
+			ownersWithPositions[binary.LittleEndian.Uint64(bytes[0:8])] = true
+		}
+	}
+
+	kept = make([]string, 0, len(results))
+	for _, rawString := range results {
+		bytes := []byte(rawString)
+		if isZeroPositionPayload(bytes) && ownersWithPositions[binary.LittleEndian.Uint64(bytes[0:8])] {
+			dropped = append(dropped, rawString)
+			continue
+		}
+		kept = append(kept, rawString)
+	}
+
+	if len(dropped) > 0 && len(config.ZeroPositionQuarantineFile) > 0 {
+		quarantineMarkers(serverX, serverY, dropped)
+	}
+	return
+}
+
+// recordZeroPositionDrops records the markers a worker's fetch dropped this cycle
+func recordZeroPositionDrops(worker string, dropped int) {
+	zeroPositionDrops.Lock()
+	defer zeroPositionDrops.Unlock()
+	drops, ok := zeroPositionDrops.byWorker[worker]
+	if !ok {
+		drops = &ZeroPositionDrops{Worker: worker}
+		zeroPositionDrops.byWorker[worker] = drops
+	}
+	drops.LastCycle = dropped
+	drops.Total += dropped
+}
+
+// currentZeroPositionDrops is every worker's drop counts, by worker
+func currentZeroPositionDrops() []ZeroPositionDrops {
+	zeroPositionDrops.Lock()
+	defer zeroPositionDrops.Unlock()
+	var drops []ZeroPositionDrops
+	for _, worker := range zeroPositionDrops.byWorker {
+		drops = append(drops, *worker)
+	}
+	sort.Slice(drops, func(i, j int) bool { return drops[i].Worker < drops[j].Worker })
+	return drops
+}
+
+// quarantineMarkers appends new raw payloads to the quarantine log for the game team
+func quarantineMarkers(serverX, serverY int, payloads []string) {
+	quarantined.Lock()
+	defer quarantined.Unlock()
+	if quarantined.payloads == nil {
+		quarantined.payloads = newLRUCache("quarantinedPayloads", config.QuarantineDedupeCapacity, 0)
+	}
+
+	var fresh []string
+	for _, payload := range payloads {
+		if _, ok := quarantined.payloads.Get(payload); !ok {
+			quarantined.payloads.Add(payload, true)
+			fresh = append(fresh, payload)
+		}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(config.ZeroPositionQuarantineFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Warning! %v", err)
+		return
+	}
+	defer f.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, payload := range fresh {
+		fmt.Fprintf(f, "%s territorymapdata:%d %s\n", now, serverX<<16|serverY, hex.EncodeToString([]byte(payload)))
+	}
+}
@@ -0,0 +1,112 @@
+package territory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDropZeroPositionMarkersKeepsLoneOriginMarker(t *testing.T) {
+	useTestConfig(t, nil)
+	lone := encodeClaim(1, 0, 0, MarkerLand, 16)
+	other := encodeClaim(2, 0.5, 0.5, MarkerLand, 16)
+
+	kept, dropped := dropZeroPositionMarkers(0, 0, []string{lone, other})
+	if len(dropped) != 0 || len(kept) != 2 {
+		t.Fatalf("kept %d dropped %d, want the lone origin marker kept", len(kept), len(dropped))
+	}
+}
+
+func TestDropZeroPositionMarkersDropsClump(t *testing.T) {
+	useTestConfig(t, nil)
+	results := []string{
+		encodeClaim(1, 0.25, 0.75, MarkerLand, 16),
+		encodeClaim(1, 0, 0, MarkerLand, 16),
+		encodeClaim(1, 0, 0, MarkerWater, 16),
+		encodeClaim(2, 0, 0, MarkerLand, 16), // a different owner's lone origin marker
+	}
+
+	kept, dropped := dropZeroPositionMarkers(0, 0, results)
+	if len(dropped) != 2 {
+		t.Fatalf("dropped %d, want the owner's 2 origin markers", len(dropped))
+	}
+	if len(kept) != 2 || kept[0] != results[0] || kept[1] != results[3] {
+		t.Fatalf("kept the wrong markers")
+	}
+}
+
+func TestDropZeroPositionMarkersLeavesShortPayloads(t *testing.T) {
+	useTestConfig(t, nil)
+	short := string(make([]byte, 5))
+	results := []string{short, encodeClaim(1, 0, 0, MarkerLand, 16)}
+
+	kept, dropped := dropZeroPositionMarkers(0, 0, results)
+	if len(dropped) != 0 || len(kept) != 2 {
+		t.Fatalf("kept %d dropped %d, want the short payload left for the caller", len(kept), len(dropped))
+	}
+}
+
+func TestFetchClaimMarkersSkipsShortPayloadsWithFilter(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 1, 1
+		cfg.DropZeroPositionMarkers = true
+	})
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{}, 1, 0.5, 0.5, MarkerLand)
+	if err := client.SAdd("territorymapdata:0", "short").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	markers, _, _ := fetchClaimMarkers(client, false, nil)
+	if len(markers) != 1 {
+		t.Fatalf("got %d markers, want 1", len(markers))
+	}
+}
+
+func TestZeroPositionDropsReportedInHealth(t *testing.T) {
+	useTestConfig(t, func(cfg *Configuration) {
+		cfg.ServersX, cfg.ServersY = 2, 1
+		cfg.DropZeroPositionMarkers = true
+	})
+	useArtifactMeta(t)
+	useFailingGrids(t)
+	reset := func() {
+		zeroPositionDrops.Lock()
+		zeroPositionDrops.byWorker = make(map[string]*ZeroPositionDrops)
+		zeroPositionDrops.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+	_, client := newTestRedis(t)
+	addClaim(t, client, GridID{X: 0}, 1, 0.5, 0.5, MarkerLand)
+	addClaim(t, client, GridID{X: 0}, 1, 0, 0, MarkerLand)
+	addClaim(t, client, GridID{X: 1}, 2, 0.25, 0.25, MarkerLand)
+	addClaim(t, client, GridID{X: 1}, 2, 0, 0, MarkerWater)
+	handler := newHTTPHandler(nil)
+
+	if drops := getHealth(t, handler).ZeroPositionDrops; len(drops) != 0 {
+		t.Errorf("/health reports %+v before a fetch", drops)
+	}
+	game, tiles := newGridFailures("game"), newGridFailures("tiles")
+	fetchClaimMarkers(client, false, game)
+	fetchClaimMarkers(client, false, tiles)
+	// one-off fetches like verify aren't counted
+	fetchClaimMarkers(client, false, nil)
+	want := []ZeroPositionDrops{{Worker: "game", LastCycle: 2, Total: 2}, {Worker: "tiles", LastCycle: 2, Total: 2}}
+	if drops := getHealth(t, handler).ZeroPositionDrops; !reflect.DeepEqual(drops, want) {
+		t.Errorf("/health reports %+v, want %+v", drops, want)
+	}
+
+	// the clump is cleaned up, the last cycle drops nothing and the total stays
+	client.SRem("territorymapdata:0", encodeClaim(1, 0, 0, MarkerLand, 16))
+	fetchClaimMarkers(client, false, game)
+	want[0] = ZeroPositionDrops{Worker: "game", LastCycle: 1, Total: 3}
+	if drops := getHealth(t, handler).ZeroPositionDrops; !reflect.DeepEqual(drops, want) {
+		t.Errorf("/health reports %+v, want %+v", drops, want)
+	}
+	client.SRem("territorymapdata:65536", encodeClaim(2, 0, 0, MarkerWater, 16))
+	fetchClaimMarkers(client, false, game)
+	want[0] = ZeroPositionDrops{Worker: "game", LastCycle: 0, Total: 3}
+	if drops := getHealth(t, handler).ZeroPositionDrops; !reflect.DeepEqual(drops, want) {
+		t.Errorf("/health reports %+v, want %+v", drops, want)
+	}
+}
@@ -0,0 +1,162 @@
+package territory
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// zoomAdviceMaxEvery is the longest deferral the advice suggests before dropping a zoom
+const zoomAdviceMaxEvery = 16
+
+// zoomAdviceDeferredZooms is how many of the deepest zooms the advice defers, shallower zooms are
+// cheap and give the overview so they keep rendering every cycle
+const zoomAdviceDeferredZooms = 3
+
+// ZoomAdvice is the largest MaxZoom / ZoomSchedule the host looks able to sustain within the budget
+type ZoomAdvice struct {
+	MaxZoom          uint         `json:"maxZoom"`
+	ZoomSchedule     map[uint]int `json:"zoomSchedule"`
+	EstimatedSeconds float64      `json:"estimatedSeconds"` // average tile time per cycle with the advice
+	BudgetSeconds    float64      `json:"budgetSeconds"`
+	Applied          bool         `json:"applied"` // AutoTuneZoom is deferring zooms per the advice
+}
+
+// zoomTuning tracks tile timings for the advisory and the schedule AutoTuneZoom applies
+var zoomTuning = struct {
+	sync.Mutex
+	durations map[uint]time.Duration // smoothed duration of each zoom when it renders
+	overruns  int                    // consecutive tile cycles over budget
+	advice    *ZoomAdvice
+	schedule  map[uint]int // applied deferrals, on top of ZoomSchedule
+}{durations: make(map[uint]time.Duration)}
+
+// recordZoomDuration smooths a zoom's render time so one slow cycle doesn't swing the advice
+func recordZoomDuration(zoom uint, d time.Duration) {
+	zoomTuning.Lock()
+	defer zoomTuning.Unlock()
+	if previous, ok := zoomTuning.durations[zoom]; ok {
+		d = (previous + d) / 2
+	}
+	zoomTuning.durations[zoom] = d
+}
+
+// zoomAdviceBudget is the share of the fetch interval tile generation should fit in
+func zoomAdviceBudget() time.Duration {
+	return time.Duration(config.ZoomAdvisoryFraction * float64(config.FetchRateInSeconds) * float64(time.Second))
+}
+
+// recordTileCycle checks a tile cycle against the budget, after ZoomAdvisoryCycles overruns in
+// a row the advice is logged and, with AutoTuneZoom, applied
+func recordTileCycle(d time.Duration) {
+	if config.ZoomAdvisoryFraction <= 0 {
+		return
+	}
+	budget := zoomAdviceBudget()
+
+	zoomTuning.Lock()
+	defer zoomTuning.Unlock()
+	if d <= budget {
+		zoomTuning.overruns = 0
+		return
+	}
+	zoomTuning.overruns++
+	if zoomTuning.overruns < config.ZoomAdvisoryCycles {
+		return
+	}
+	zoomTuning.overruns = 0
+
+	advice := recommendZoomSchedule(zoomTuning.durations, effectiveSchedule(zoomTuning.schedule), config.MaxZoom, budget)
+	advice.Applied = config.AutoTuneZoom
+	if config.AutoTuneZoom {
+		zoomTuning.schedule = advice.ZoomSchedule
+	}
+	zoomTuning.advice = &advice
+	log.Printf("Warning! Tile generation took %v, over %v of the %ds fetch interval for %d cycles. "+
+		"This host looks able to sustain MaxZoom %d with ZoomSchedule %v (about %.1fs per cycle)",
+		d.Round(time.Second), config.ZoomAdvisoryFraction, config.FetchRateInSeconds, config.ZoomAdvisoryCycles,
+		advice.MaxZoom, advice.ZoomSchedule, advice.EstimatedSeconds)
+}
+
+// effectiveSchedule merges ZoomSchedule with applied deferrals, keeping the longer of the two
+func effectiveSchedule(applied map[uint]int) map[uint]int {
+	schedule := make(map[uint]int)
+	for zoom, every := range config.ZoomSchedule {
+		schedule[zoom] = every
+	}
+	for zoom, every := range applied {
+		if every > schedule[zoom] {
+			schedule[zoom] = every
+		}
+	}
+	return schedule
+}
+
+// zoomEvery is how often a zoom renders, in cycles
+func zoomEvery(zoom uint) int {
+	zoomTuning.Lock()
+	every := effectiveSchedule(zoomTuning.schedule)[zoom]
+	zoomTuning.Unlock()
+	return Max(1, every)
+}
+
+// recommendZoomSchedule estimates the average tile time per cycle as the sum of each zoom's time
+// divided by how often it renders, zooms render concurrently but contend for the same CPUs. The
+// deepest zoomAdviceDeferredZooms zooms are deferred, deepest first and doubling up to
+// zoomAdviceMaxEvery, and when that doesn't fit the deepest zoom is dropped and it's tried again.
+// Zooms without timings are assumed free
+func recommendZoomSchedule(durations map[uint]time.Duration, schedule map[uint]int, maxZoom uint, budget time.Duration) ZoomAdvice {
+	advice := ZoomAdvice{MaxZoom: maxZoom, BudgetSeconds: budget.Seconds()}
+	var every map[uint]int
+	estimate := func() float64 {
+		total := 0.0
+		for zoom := uint(0); zoom < advice.MaxZoom; zoom++ {
+			total += durations[zoom].Seconds() / float64(every[zoom])
+		}
+		return total
+	}
+
+	for ; ; advice.MaxZoom-- {
+		every = make(map[uint]int)
+		for zoom := uint(0); zoom < advice.MaxZoom; zoom++ {
+			every[zoom] = Max(1, schedule[zoom])
+		}
+		for zoom := int(advice.MaxZoom) - 1; zoom >= 0 && zoom >= int(advice.MaxZoom)-zoomAdviceDeferredZooms; zoom-- {
+			for every[uint(zoom)] < zoomAdviceMaxEvery && estimate() > advice.BudgetSeconds {
+				every[uint(zoom)] = Min(2*every[uint(zoom)], zoomAdviceMaxEvery)
+			}
+		}
+		if advice.MaxZoom <= 1 || estimate() <= advice.BudgetSeconds {
+			break
+		}
+	}
+
+	advice.ZoomSchedule = make(map[uint]int)
+	for zoom, n := range every {
+		if n > 1 {
+			advice.ZoomSchedule[zoom] = n
+		}
+	}
+	advice.EstimatedSeconds = estimate()
+	return advice
+}
+
+// zoomAdviceHandler serves GET /admin/zoomAdvice, 204 when tile generation fits its budget
+func zoomAdviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	zoomTuning.Lock()
+	advice := zoomTuning.advice
+	zoomTuning.Unlock()
+	if advice == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	js, _ := json.Marshal(advice)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
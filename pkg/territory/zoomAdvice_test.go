@@ -0,0 +1,145 @@
+package territory
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useZoomTuning starts the test without timings, advice or deferrals
+func useZoomTuning(t *testing.T) {
+	zoomTuning.Lock()
+	previous := zoomTuning.durations
+	zoomTuning.durations = make(map[uint]time.Duration)
+	zoomTuning.overruns, zoomTuning.advice, zoomTuning.schedule = 0, nil, nil
+	zoomTuning.Unlock()
+	t.Cleanup(func() {
+		zoomTuning.Lock()
+		zoomTuning.durations = previous
+		zoomTuning.overruns, zoomTuning.advice, zoomTuning.schedule = 0, nil, nil
+		zoomTuning.Unlock()
+	})
+}
+
+// seconds builds a zoom timing history from seconds per zoom
+func seconds(s ...float64) map[uint]time.Duration {
+	durations := make(map[uint]time.Duration)
+	for zoom, v := range s {
+		durations[uint(zoom)] = time.Duration(v * float64(time.Second))
+	}
+	return durations
+}
+
+func TestRecommendZoomSchedule(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		durations map[uint]time.Duration
+		schedule  map[uint]int
+		maxZoom   uint
+		budget    time.Duration
+		want      ZoomAdvice
+	}{
+		{
+			name:      "fits",
+			durations: seconds(1, 1, 2, 4),
+			maxZoom:   4,
+			budget:    10 * time.Second,
+			want:      ZoomAdvice{MaxZoom: 4, ZoomSchedule: map[uint]int{}, EstimatedSeconds: 8, BudgetSeconds: 10},
+		},
+		{
+			name:      "deepest zoom deferred",
+			durations: seconds(1, 1, 2, 8),
+			maxZoom:   4,
+			budget:    6 * time.Second,
+			want:      ZoomAdvice{MaxZoom: 4, ZoomSchedule: map[uint]int{3: 4}, EstimatedSeconds: 6, BudgetSeconds: 6},
+		},
+		{
+			name:      "configured schedule is the starting point",
+			durations: seconds(1, 1, 2, 8),
+			schedule:  map[uint]int{3: 8},
+			maxZoom:   4,
+			budget:    6 * time.Second,
+			want:      ZoomAdvice{MaxZoom: 4, ZoomSchedule: map[uint]int{3: 8}, EstimatedSeconds: 5, BudgetSeconds: 6},
+		},
+		{
+			name:      "deepest zoom dropped",
+			durations: seconds(1, 2, 4, 8, 100),
+			maxZoom:   5,
+			budget:    3 * time.Second,
+			want:      ZoomAdvice{MaxZoom: 4, ZoomSchedule: map[uint]int{1: 2, 2: 16, 3: 16}, EstimatedSeconds: 2.75, BudgetSeconds: 3},
+		},
+		{
+			name:      "zooms without timings are free",
+			durations: seconds(1, 1),
+			maxZoom:   7,
+			budget:    2 * time.Second,
+			want:      ZoomAdvice{MaxZoom: 7, ZoomSchedule: map[uint]int{}, EstimatedSeconds: 2, BudgetSeconds: 2},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, nil)
+			if got := recommendZoomSchedule(test.durations, test.schedule, test.maxZoom, test.budget); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("advice %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestZoomAdviceFollowsSustainedOverruns(t *testing.T) {
+	for _, autoTune := range []bool{false, true} {
+		useTestConfig(t, func(cfg *Configuration) {
+			cfg.MaxZoom = 4
+			cfg.FetchRateInSeconds = 10
+			cfg.ZoomAdvisoryFraction = 0.6
+			cfg.ZoomAdvisoryCycles = 3
+			cfg.AutoTuneZoom = autoTune
+		})
+		useZoomTuning(t)
+		resetTileCounts()
+		logs := useLogBuffer(t)
+		// a cycle takes the sum of its zooms, 12s against a 6s budget
+		history := seconds(1, 1, 2, 8)
+		cycle := time.Duration(0)
+		for zoom, d := range history {
+			recordZoomDuration(zoom, d)
+			cycle += d
+		}
+
+		// an overrun that isn't sustained is forgotten
+		recordTileCycle(cycle)
+		recordTileCycle(cycle)
+		recordTileCycle(time.Second)
+		recordTileCycle(cycle)
+		recordTileCycle(cycle)
+		zoomTuning.Lock()
+		advice := zoomTuning.advice
+		zoomTuning.Unlock()
+		if advice != nil || logs.Len() > 0 {
+			t.Fatalf("advised after 2 overruns in a row: %+v %s", advice, logs)
+		}
+
+		recordTileCycle(cycle)
+		zoomTuning.Lock()
+		advice = zoomTuning.advice
+		zoomTuning.Unlock()
+		if advice == nil || advice.MaxZoom != 4 || !reflect.DeepEqual(advice.ZoomSchedule, map[uint]int{3: 4}) || advice.Applied != autoTune {
+			t.Fatalf("AutoTuneZoom %v advised %+v, want zoom 3 every 4 cycles", autoTune, advice)
+		}
+		if !strings.Contains(logs.String(), "MaxZoom 4 with ZoomSchedule map[3:4]") {
+			t.Errorf("advice wasn't logged: %s", logs)
+		}
+
+		// tiles.json reports how often each zoom renders
+		setZoomTileCount(ZoomTileCount{Zoom: 3})
+		updateZoomStaleness(map[uint]uint32{3: 1}, 2)
+		count, _ := zoomTileCount(3)
+		want := 1
+		if autoTune {
+			want = 4
+		}
+		if count.Every != want || zoomDue(3, 1) == autoTune {
+			t.Errorf("AutoTuneZoom %v renders zoom 3 every %d cycles, want %d", autoTune, count.Every, want)
+		}
+	}
+}